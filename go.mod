@@ -6,9 +6,13 @@ require (
 	github.com/bmatcuk/doublestar v1.3.4
 	github.com/bradenaw/juniper v0.15.1
 	github.com/dgraph-io/ristretto v0.1.1
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/hashicorp/mdns v1.0.5
 	github.com/klauspost/compress v1.17.4
 	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/winfsp/cgofuse v1.5.1-0.20230130140708-f87f5db493b5
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
 	golang.org/x/text v0.14.0
 	google.golang.org/protobuf v1.32.0
 )
@@ -17,6 +21,7 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/miekg/dns v1.1.42 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
 )
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// AuditLog is append-only log of modifications through the mount (auditlog=), one JSON object per line,
+// so modders can see what a game or installer touched during a session.
+// Writes (including truncation through opened file) are recorded once per opened file on close, with total bytes written and size change.
+// nil AuditLog records nothing.
+type AuditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"new_path,omitempty"`
+	// bytes written, only for "write"
+	Bytes     int64 `json:"bytes,omitempty"`
+	SizeDelta int64 `json:"size_delta"`
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &AuditLog{file: f}, nil
+}
+
+func (l *AuditLog) Record(entry AuditEntry) {
+	if l == nil {
+		return
+	}
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("failed to encode audit log", err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		fmt.Println("failed to write audit log", err)
+	}
+}
+
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// StartAuditLog opens audit log if auditlog= is specified.
+func (fs *MayakashiFS) StartAuditLog() error {
+	if fs.AuditLogFile == "" {
+		return nil
+	}
+	l, err := OpenAuditLog(fs.AuditLogFile)
+	if err != nil {
+		return err
+	}
+	fs.AuditLog = l
+	return nil
+}
+
+// auditFileSize returns size of path as seen from the mount, or 0 if it isn't a file.
+// It should only be called when audit log is enabled, since it looks up every layer.
+func (fs *MayakashiFS) auditFileSize(path string) int64 {
+	var stat fuse.Stat_t
+	if fs.Getattr(path, &stat, ^uint64(0)) != 0 || stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+		return 0
+	}
+	return stat.Size
+}
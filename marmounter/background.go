@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const DEFAULT_SERVICE_NAME = "marmounter"
+const DEFAULT_LOG_FILE = "marmounter.log"
+
+// backgroundArgs returns os.Args[1:] for background process, replacing options which matches with isTarget.
+func backgroundArgs(isTarget func(arg string) bool, replacement string) ([]string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	// service and daemon will not run on current directory, so we need to tell it
+	// NOTE: called after parsing arguments, so cwd is already changed by workdir= of user
+	args := []string{"workdir=" + cwd}
+	for i, arg := range os.Args[1:] {
+		if arg == "--" {
+			// rest are fuse options
+			args = append(args, os.Args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "workdir=") {
+			// relative one would be applied again on top of cwd
+			continue
+		}
+		if isTarget(arg) {
+			if replacement != "" {
+				args = append(args, replacement)
+			}
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (fs *MayakashiFS) openLogFile() (*os.File, error) {
+	logFile := fs.LogFile
+	if logFile == "" {
+		logFile = DEFAULT_LOG_FILE
+	}
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const DAEMONIZED_ENV = "MAYAKASHI_DAEMONIZED"
+
+// HandleBackgroundMode handles daemon option, returns true if process should exit.
+func (fs *MayakashiFS) HandleBackgroundMode() (bool, error) {
+	if fs.ServiceMode != "" {
+		return true, fmt.Errorf("service= is only supported on Windows, use daemon instead")
+	}
+
+	if !fs.Daemon || os.Getenv(DAEMONIZED_ENV) != "" {
+		return false, nil
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return true, err
+	}
+	args, err := backgroundArgs(func(arg string) bool {
+		return arg == "daemon"
+	}, "")
+	if err != nil {
+		return true, err
+	}
+	f, err := fs.openLogFile()
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(exePath, args...)
+	cmd.Env = append(os.Environ(), DAEMONIZED_ENV+"=1")
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return true, err
+	}
+	fmt.Println("started daemon, pid:", cmd.Process.Pid, "log:", f.Name())
+	return true, cmd.Process.Release()
+}
+
+// Mount mounts filesystem and blocks until unmounted.
+func (fs *MayakashiFS) Mount(host *fuse.FileSystemHost, fuseOpts []string) bool {
+	return host.Mount(fs.MountPoint, fuseOpts)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+type mayakashiService struct {
+	host       *fuse.FileSystemHost
+	fuseOpts   []string
+	mountPoint string
+}
+
+func (s *mayakashiService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	unmounted := make(chan bool)
+	go func() {
+		unmounted <- s.host.Mount(s.mountPoint, s.fuseOpts)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case ok := <-unmounted:
+			if !ok {
+				fmt.Println("failed to mount")
+				return false, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				s.host.Unmount()
+				<-unmounted
+				return false, 0
+			}
+		}
+	}
+}
+
+func (fs *MayakashiFS) serviceName() string {
+	if fs.ServiceName == "" {
+		return DEFAULT_SERVICE_NAME
+	}
+	return fs.ServiceName
+}
+
+func (fs *MayakashiFS) installService() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args, err := backgroundArgs(func(arg string) bool {
+		return strings.HasPrefix(arg, "service=")
+	}, "service=run")
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(fs.serviceName(), exePath, mgr.Config{
+		DisplayName: "Mayakashi (" + fs.serviceName() + ")",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	fmt.Println("installed service", fs.serviceName())
+	return nil
+}
+
+func (fs *MayakashiFS) uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(fs.serviceName())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	fmt.Println("uninstalled service", fs.serviceName())
+	return nil
+}
+
+// HandleBackgroundMode handles service= option, returns true if process should exit.
+func (fs *MayakashiFS) HandleBackgroundMode() (bool, error) {
+	if fs.Daemon {
+		return true, fmt.Errorf("daemon is not supported on Windows, use service=install instead")
+	}
+
+	switch fs.ServiceMode {
+	case "":
+		return false, nil
+	case "install":
+		return true, fs.installService()
+	case "uninstall":
+		return true, fs.uninstallService()
+	case "run":
+		// services doesn't have console, so redirect output to log file
+		f, err := fs.openLogFile()
+		if err != nil {
+			return true, err
+		}
+		windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, windows.Handle(f.Fd()))
+		windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(f.Fd()))
+		os.Stdout = f
+		os.Stderr = f
+		return false, nil
+	}
+
+	return true, fmt.Errorf("unknown service mode: %s", fs.ServiceMode)
+}
+
+// Mount mounts filesystem and blocks until unmounted.
+func (fs *MayakashiFS) Mount(host *fuse.FileSystemHost, fuseOpts []string) bool {
+	if fs.ServiceMode != "run" {
+		return host.Mount(fs.MountPoint, fuseOpts)
+	}
+
+	if err := svc.Run(fs.serviceName(), &mayakashiService{
+		host:       host,
+		fuseOpts:   fuseOpts,
+		mountPoint: fs.MountPoint,
+	}); err != nil {
+		fmt.Println("failed to run as service", err)
+		return false
+	}
+	return true
+}
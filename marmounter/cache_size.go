@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// interval of checking available memory with cachesize=auto
+const ADAPTIVE_CACHE_INTERVAL = 5 * time.Second
+
+// StartAdaptiveCache starts resizing chunk cache (which is shared with sub filesystems) following available memory.
+func (fs *MayakashiFS) StartAdaptiveCache() error {
+	a := &mayafs.AdaptiveCacheSize{
+		Cache:   fs.ChunkCache,
+		Min:     mayafs.DEFAULT_ADAPTIVE_CACHE_MIN,
+		Max:     mayafs.DEFAULT_ADAPTIVE_CACHE_MAX,
+		Reserve: mayafs.DEFAULT_ADAPTIVE_CACHE_RESERVE,
+	}
+	if fs.CacheMin != 0 {
+		a.Min = fs.CacheMin
+	}
+	if fs.CacheMax != 0 {
+		a.Max = fs.CacheMax
+	}
+	if a.Min > a.Max {
+		return fmt.Errorf("cachemin (%d) is larger than cachemax (%d)", a.Min, a.Max)
+	}
+	if err := a.Start(ADAPTIVE_CACHE_INTERVAL); err != nil {
+		return fmt.Errorf("failed to start adaptive cache: %w", err)
+	}
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		f.AdaptiveCache = a
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckArchives checks structure of archives (check option) and prints report, returns false if some of them are broken.
+func (fs *MayakashiFS) CheckArchives() bool {
+	ok := true
+	for _, r := range fs.CheckPendingArchives() {
+		switch {
+		case r.Skipped:
+			fmt.Println("SKIPPED\t" + r.File + "\t(missing, but optional)")
+		case len(r.Problems) == 0:
+			fmt.Println("OK\t" + r.File)
+		default:
+			ok = false
+			fmt.Println("NG\t" + r.File + "\t" + strings.Join(r.Problems, "; "))
+		}
+	}
+	return ok
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Virtual control directory, so tools inside the mount can introspect (and control) marmounter.
+
+const CONTROL_DIR = "/.mayakashi"
+
+type controlFile struct {
+	// Read returns content of this file, nil if write-only
+	Read func(fs *MayakashiFS) []byte
+	// Write is called with written data, nil if read-only
+	Write func(fs *MayakashiFS, data []byte) error
+}
+
+type ControlFileHandler struct {
+	File    *controlFile
+	Content []byte
+}
+
+var controlDirs = map[string][]string{
+	CONTROL_DIR:            {"archives.txt", "stats.json", "cache"},
+	CONTROL_DIR + "/cache": {"flush"},
+}
+
+var controlFiles = map[string]*controlFile{
+	CONTROL_DIR + "/archives.txt": {
+		Read: func(fs *MayakashiFS) []byte {
+			var sb strings.Builder
+			for _, a := range fs.Archives() {
+				fmt.Fprintf(&sb, "%s\tpriority=%d\tfiles=%d", a.File, a.Priority, a.FileCount)
+				if a.Metadata != nil {
+					fmt.Fprintf(&sb, "\t%s", mayafs.FormatArchiveMetadata(a.Metadata))
+				}
+				sb.WriteString("\n")
+			}
+			return []byte(sb.String())
+		},
+	},
+	CONTROL_DIR + "/stats.json": {
+		Read: func(fs *MayakashiFS) []byte {
+			openOverlayFiles := 0
+			fs.OverlayFileHandlers.Range(func(key uint64, value *SharedFileHandler) bool {
+				openOverlayFiles++
+				return true
+			})
+			tree := fs.Tree()
+			stats := map[string]any{
+				"mountpoint":         fs.MountPoint,
+				"uptime_seconds":     int64(time.Since(fs.StartedAt).Seconds()),
+				"archives":           len(fs.Archives()),
+				"files":              len(tree.Files),
+				"directories":        len(tree.Directories),
+				"open_overlay_files": openOverlayFiles,
+				// writes failed because overlay disk is full
+				"overlay_no_space_errors": fs.OverlayNoSpaceErrors.Load(),
+				// small reads which were served from blocks read by previous reads
+				"coalesced_reads": fs.CoalescedReads.Load(),
+			}
+			if m := fs.ChunkCache.Metrics; m != nil {
+				cache := map[string]any{
+					"hits":         m.Hits(),
+					"misses":       m.Misses(),
+					"ratio":        m.Ratio(),
+					"cost_added":   m.CostAdded(),
+					"cost_evicted": m.CostEvicted(),
+					"keys_added":   m.KeysAdded(),
+					"keys_evicted": m.KeysEvicted(),
+					"max_cost":     fs.ChunkCache.MaxCost(),
+					// not cached because they were read by sequential scans (scannocache=)
+					"scan_skipped": fs.ScanSkippedCaches(),
+				}
+				if fs.AdaptiveCache != nil {
+					// dropped because of memory pressure (cachesize=auto)
+					cache["pressure_drops"] = fs.AdaptiveCache.Drops()
+				}
+				stats["cache"] = cache
+			}
+			archiveIO := []map[string]any{}
+			for _, s := range fs.IOStats.Snapshot() {
+				archiveIO = append(archiveIO, map[string]any{
+					"file":               s.File,
+					"reads":              s.Reads,
+					"bytes":              s.Bytes,
+					"errors":             s.Errors,
+					"retries":            s.Retries,
+					"timeouts":           s.Timeouts,
+					"degraded":           s.Degraded(),
+					"average_latency_ms": float64(s.AverageLatency().Microseconds()) / 1000,
+				})
+			}
+			stats["archive_io"] = archiveIO
+			remote := []map[string]any{}
+			for _, r := range fs.RemoteSnapshot() {
+				remote = append(remote, map[string]any{
+					"url":           r.URL,
+					"size":          r.Size,
+					"fetches":       r.Fetches,
+					"fetched_bytes": r.FetchedBytes,
+					"cache_hits":    r.CacheHits,
+					"peer_hits":     r.PeerHits,
+				})
+			}
+			stats["remote"] = remote
+			mirrors := []map[string]any{}
+			for _, m := range fs.MirrorSnapshot() {
+				mirrors = append(mirrors, map[string]any{
+					"file":   m.File,
+					"mirror": m.Mirror,
+				})
+			}
+			stats["mirrors"] = mirrors
+			if fs.OverlayIndex != nil {
+				stats["overlay_index"] = map[string]any{
+					"mode":  fs.OverlayIndexMode,
+					"paths": fs.OverlayIndex.size(),
+				}
+			}
+			if fs.NegativeCache != nil {
+				stats["negative_cache"] = fs.NegativeCache.snapshot()
+			}
+			if u, ok := mayafs.IOUringSnapshot(); ok {
+				stats["io_uring"] = map[string]any{
+					"reads":   u.Reads,
+					"batches": u.Batches,
+				}
+			}
+			if len(fs.PinGlobs) != 0 {
+				p := fs.PinStats()
+				stats["pinned"] = map[string]any{
+					"budget":  fs.PinBudget,
+					"entries": p.Entries,
+					"bytes":   p.Bytes,
+				}
+			}
+			if fs.HotStore != nil {
+				h := fs.HotStore.Snapshot()
+				stats["hot_store"] = map[string]any{
+					"capacity":  h.Capacity,
+					"used":      h.Used,
+					"chunks":    h.Chunks,
+					"hits":      h.Hits,
+					"misses":    h.Misses,
+					"promoted":  h.Promoted,
+					"demoted":   h.Demoted,
+					"requeued":  h.Requeued,
+					"corrupted": h.Corrupted,
+				}
+			}
+			if fs.Peers != nil {
+				p := fs.Peers.Snapshot()
+				stats["peers"] = map[string]any{
+					"peers":  p.Peers,
+					"hits":   p.Hits,
+					"misses": p.Misses,
+					"served": p.Served,
+				}
+			}
+			archiveMetadata := []map[string]any{}
+			for _, a := range fs.Archives() {
+				if a.Metadata != nil {
+					m := mayafs.ArchiveMetadataMap(a.Metadata)
+					m["file"] = a.File
+					archiveMetadata = append(archiveMetadata, m)
+				}
+			}
+			stats["archive_metadata"] = archiveMetadata
+			if fs.OverlayQuota != nil {
+				stats["overlay_quota"] = fs.OverlayQuota.snapshot()
+			}
+			if fs.Verify != nil {
+				stats["verify"] = fs.Verify.snapshot()
+			}
+			data, err := json.MarshalIndent(stats, "", "  ")
+			if err != nil {
+				return []byte(err.Error())
+			}
+			return append(data, '\n')
+		},
+	},
+	CONTROL_DIR + "/cache/flush": {
+		Write: func(fs *MayakashiFS, data []byte) error {
+			// NOTE: chunk cache is shared with all filesystems in this process
+			fmt.Println("flushing chunk cache by control file")
+			fs.ChunkCache.Clear()
+			return nil
+		},
+	},
+}
+
+func isControlPath(path string) bool {
+	lowerPath := mayafs.NormalizeString(path)
+	return lowerPath == CONTROL_DIR || strings.HasPrefix(lowerPath, CONTROL_DIR+"/")
+}
+
+func getControlStat(f *controlFile, fs *MayakashiFS, stat *fuse.Stat_t) {
+	stat.Mode = fuse.S_IFREG
+	if f.Read != nil {
+		stat.Mode |= 0444
+		stat.Size = int64(len(f.Read(fs)))
+	}
+	if f.Write != nil {
+		stat.Mode |= 0222
+	}
+	now := fuse.Now()
+	stat.Ctim = now
+	stat.Mtim = now
+}
+
+func (fs *MayakashiFS) controlGetattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	lowerPath := mayafs.NormalizeString(path)
+	if _, ok := controlDirs[lowerPath]; ok {
+		stat.Mode = fuse.S_IFDIR | 0555
+		return 0
+	}
+	if f, ok := controlFiles[lowerPath]; ok {
+		getControlStat(f, fs, stat)
+		if cf, ok := fs.ControlFileHandlers.Load(fh); ok && cf.File == f {
+			// content might be changed after open
+			stat.Size = int64(len(cf.Content))
+		}
+		return 0
+	}
+	return -fuse.ENOENT
+}
+
+func (fs *MayakashiFS) controlReaddir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool) int {
+	lowerPath := mayafs.NormalizeString(path)
+	children, ok := controlDirs[lowerPath]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	for _, name := range children {
+		var stat fuse.Stat_t
+		fs.controlGetattr(lowerPath+"/"+name, &stat, ^uint64(0))
+		fill(name, &stat, 0)
+	}
+	return 0
+}
+
+func (fs *MayakashiFS) controlOpen(path string, flags int) (int, uint64) {
+	f, ok := controlFiles[mayafs.NormalizeString(path)]
+	if !ok {
+		if _, ok := controlDirs[mayafs.NormalizeString(path)]; ok {
+			return -fuse.EISDIR, 0
+		}
+		return -fuse.ENOENT, 0
+	}
+	wantsWrite := flags&fuse.O_WRONLY != 0 || flags&fuse.O_RDWR != 0
+	if wantsWrite && f.Write == nil {
+		return -fuse.EACCES, 0
+	}
+	if !wantsWrite && f.Read == nil {
+		return -fuse.EACCES, 0
+	}
+
+	handler := &ControlFileHandler{File: f}
+	if f.Read != nil {
+		// snapshot on open, so reads are consistent
+		handler.Content = f.Read(fs)
+	}
+	oc := fs.OverlayCount.Add(1)
+	fs.ControlFileHandlers.Store(oc, handler)
+	return 0, oc
+}
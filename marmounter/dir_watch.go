@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// With dirwatch, directories of dirscan= are watched, and archives copied into them are loaded into the live mount
+// after they stop changing (so half-copied archives are not loaded).
+// Removed or replaced archives are not unloaded.
+
+const (
+	// archive is loaded after its files are not changed for this duration
+	dirWatchSettleTime   = 5 * time.Second
+	dirWatchPollInterval = 1 * time.Second
+)
+
+// watchingArchive is new archive which is not loaded yet.
+type watchingArchive struct {
+	signature string
+	changedAt time.Time
+	// loading failed with this signature, retried after it changes
+	failed bool
+}
+
+// archiveSignature returns sizes and modified times of files of archive (e.g. .mar.idx and .mar.dat),
+// or error if some of them are missing.
+func archiveSignature(archive string) (string, error) {
+	files := []string{archive}
+	if strings.HasSuffix(archive, ".mar") {
+		entries, err := os.ReadDir(filepath.Dir(archive))
+		if err != nil {
+			return "", err
+		}
+		files = []string{}
+		prefix := filepath.Base(archive) + "."
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), prefix) && (strings.HasSuffix(e.Name(), ".idx") || strings.HasSuffix(e.Name(), ".dat")) {
+				files = append(files, filepath.Join(filepath.Dir(archive), e.Name()))
+			}
+		}
+		if len(files) < 2 {
+			return "", fmt.Errorf("both .idx and .dat are required")
+		}
+		sort.Strings(files)
+	}
+	var sb strings.Builder
+	for _, file := range files {
+		st, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", file, st.Size(), st.ModTime().UnixNano())
+	}
+	return sb.String(), nil
+}
+
+// StartDirWatch starts watching directories of dirscan= if dirwatch is specified.
+func (fs *MayakashiFS) StartDirWatch() error {
+	if !fs.DirWatch || len(fs.ScanDirs) == 0 {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, sd := range fs.ScanDirs {
+		if err := addWatchDirs(watcher, sd.Dir, strings.Contains(sd.Glob, "/")); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch %s: %w", sd.Dir, err)
+		}
+		fmt.Println("dirwatch: watching", sd.Dir, "for", sd.Glob)
+	}
+	known := map[string]bool{}
+	for _, a := range fs.Archives() {
+		known[a.File] = true
+	}
+	go fs.watchDirs(watcher, known)
+	return nil
+}
+
+// addWatchDirs watches dir, and its subdirectories if recursive (fsnotify doesn't watch them).
+func addWatchDirs(watcher *fsnotify.Watcher, dir string, recursive bool) error {
+	if !recursive {
+		return watcher.Add(dir)
+	}
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// isRecursiveWatchDir reports whether dir is in directory of dirscan= which has recursive glob.
+func (fs *MayakashiFS) isRecursiveWatchDir(dir string) bool {
+	for _, sd := range fs.ScanDirs {
+		if !strings.Contains(sd.Glob, "/") {
+			continue
+		}
+		if rel, err := filepath.Rel(sd.Dir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *MayakashiFS) watchDirs(watcher *fsnotify.Watcher, known map[string]bool) {
+	defer watcher.Close()
+	pending := map[string]*watchingArchive{}
+	// events only tell that something was changed, scanning directories finds what to load
+	dirty := true
+	ticker := time.NewTicker(dirWatchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			dirty = true
+			if event.Has(fsnotify.Create) && fs.isRecursiveWatchDir(event.Name) {
+				if st, err := os.Stat(event.Name); err == nil && st.IsDir() {
+					if err := addWatchDirs(watcher, event.Name, true); err != nil {
+						fmt.Println("dirwatch: failed to watch", event.Name, err)
+					}
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("dirwatch: error", err)
+		case <-ticker.C:
+			if !dirty && len(pending) == 0 {
+				continue
+			}
+			dirty = false
+			fs.checkWatchedDirs(known, pending)
+		}
+	}
+}
+
+// checkWatchedDirs loads new archives in directories of dirscan= which are not changed for dirWatchSettleTime.
+func (fs *MayakashiFS) checkWatchedDirs(known map[string]bool, pending map[string]*watchingArchive) {
+	seen := map[string]bool{}
+	for _, sd := range fs.ScanDirs {
+		archives, err := mayafs.ScanArchives(sd.Dir, sd.Glob)
+		if err != nil {
+			fmt.Println("dirwatch: failed to scan", sd.Dir, err)
+			continue
+		}
+		for _, archive := range archives {
+			if known[archive] {
+				continue
+			}
+			seen[archive] = true
+			w, ok := pending[archive]
+			if !ok {
+				fmt.Println("dirwatch: new archive appeared, waiting for it to be completed", archive)
+				w = &watchingArchive{changedAt: time.Now()}
+				pending[archive] = w
+			}
+			signature, err := archiveSignature(archive)
+			if err != nil || signature != w.signature {
+				// still being copied
+				w.signature = signature
+				w.changedAt = time.Now()
+				w.failed = false
+				continue
+			}
+			if w.failed || time.Since(w.changedAt) < dirWatchSettleTime {
+				continue
+			}
+			if err := fs.loadNewArchive(archive, sd.Options); err != nil {
+				fmt.Println("dirwatch: failed to load", archive, err, "(retrying after it is changed)")
+				w.failed = true
+				continue
+			}
+			known[archive] = true
+			delete(pending, archive)
+		}
+	}
+	for archive := range pending {
+		if !seen[archive] {
+			fmt.Println("dirwatch: new archive disappeared before loading", archive)
+			delete(pending, archive)
+		}
+	}
+}
+
+// loadNewArchive merges archive into the live mount.
+func (fs *MayakashiFS) loadNewArchive(archive string, options mayafs.ArchiveReadOptions) error {
+	if err := fs.AddArchive(archive, options); err != nil {
+		return err
+	}
+	if err := fs.LoadPendingArchives(); err != nil {
+		return err
+	}
+	fmt.Println("dirwatch: loaded new archive", archive)
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// MAYAKASHI_* environment variables are translated into options, so containers and launchers don't have to build arguments.
+// They are applied before arguments, so arguments win.
+
+var envOptions = []struct {
+	Env    string
+	Option string
+}{
+	{"MAYAKASHI_MOUNTPOINT", "mountpoint="},
+	{"MAYAKASHI_OVERLAY_DIR", "overlaydir="},
+	{"MAYAKASHI_CACHE_SIZE", "cachesize="},
+	{"MAYAKASHI_PPROF_ADDR", "pprof="},
+	{"MAYAKASHI_LOG_LEVEL", "loglevel="},
+}
+
+// envArgs returns options from environment variables which are set (and not empty).
+func envArgs() []string {
+	args := []string{}
+	for _, e := range envOptions {
+		if value := os.Getenv(e.Env); value != "" {
+			fmt.Println("option from environment variable", e.Env+":", e.Option+value)
+			args = append(args, e.Option+value)
+		}
+	}
+	return args
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// publishExpvars publishes runtime stats and internal counters to /debug/vars of pprof= listener.
+// expvar itself publishes "memstats" (full runtime.MemStats) and "cmdline".
+func (fs *MayakashiFS) publishExpvars() {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("runtime", expvar.Func(func() any {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return map[string]any{
+			"heap_alloc":        m.HeapAlloc,
+			"heap_inuse":        m.HeapInuse,
+			"heap_objects":      m.HeapObjects,
+			"sys":               m.Sys,
+			"num_gc":            m.NumGC,
+			"gc_pause_total_ns": m.PauseTotalNs,
+			// PauseNs is circular buffer of recent pauses
+			"gc_pause_last_ns": m.PauseNs[(m.NumGC+255)%256],
+		}
+	}))
+	expvar.Publish("mayakashi", expvar.Func(func() any {
+		filesystems := []map[string]any{}
+		for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+			openOverlayFiles := 0
+			f.OverlayFileHandlers.Range(func(key uint64, value *SharedFileHandler) bool {
+				openOverlayFiles++
+				return true
+			})
+			archives := []map[string]any{}
+			for _, a := range f.Archives() {
+				archive := map[string]any{
+					"file":     a.File,
+					"priority": a.Priority,
+					"files":    a.FileCount,
+				}
+				if a.Metadata != nil {
+					archive["metadata"] = mayafs.ArchiveMetadataMap(a.Metadata)
+				}
+				archives = append(archives, archive)
+			}
+			filesystems = append(filesystems, map[string]any{
+				"mountpoint":         f.MountPoint,
+				"count":              f.Count.Load(),
+				"overlay_count":      f.OverlayCount.Load(),
+				"open_overlay_files": openOverlayFiles,
+				"archives":           archives,
+			})
+		}
+		filePools := []map[string]any{}
+		for _, p := range mayafs.FilePoolSnapshot() {
+			filePools = append(filePools, map[string]any{
+				"path":    p.Path,
+				"idle":    p.Idle,
+				"in_use":  p.InUse,
+				"reopens": p.Reopens,
+				"reaped":  p.Reaped,
+			})
+		}
+		return map[string]any{
+			"filesystems": filesystems,
+			"file_pools":  filePools,
+		}
+	}))
+}
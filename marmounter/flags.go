@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// Flag style arguments (e.g. `--archive mod.mar --priority 10 --overlay ./overlay`) are translated into legacy options
+// (e.g. `priority=10:mod.mar overlaydir=./overlay`) before parsing, so both styles can be mixed.
+
+var errShowHelp = errors.New("help requested")
+
+type cliFlag struct {
+	Name string
+	// placeholder of value, empty for boolean flags
+	Value string
+	// legacy option, value is appended to it
+	Option string
+	// sub-option of preceding --archive, --dir or --dirscan
+	ArchiveOption bool
+	Usage         string
+}
+
+var cliFlags = []cliFlag{
+	{Name: "archive", Value: "<file>", Usage: "Mount archive (.mar, .zip or .zst), can be specified multiple times"},
+	{Name: "dir", Value: "<dir>", Usage: "Mount local directory as an archive"},
+	{Name: "dirscan", Value: "<dir>[/<glob>]", Usage: "Mount archives in the directory (default glob: " + mayafs.DEFAULT_SCAN_GLOB + ") in order of their paths"},
+	{Name: "addprefix", Value: "<prefix>", Option: "addprefix=", ArchiveOption: true, Usage: "Add prefix to all files in the archive"},
+	{Name: "stripprefix", Value: "<prefix>", Option: "stripprefix=", ArchiveOption: true, Usage: "Strip prefix from files in the archive"},
+	{Name: "rewrite", Value: "|<regexp>|<replacement>|", Option: "rewrite=", ArchiveOption: true, Usage: "Rewrite paths in the archive by regexp, can be specified multiple times"},
+	{Name: "onlyglob", Value: "<glob>", Option: "onlyglob=", ArchiveOption: true, Usage: "Only mount files which match the glob, can be specified multiple times"},
+	{Name: "priority", Value: "<n>", Option: "priority=", ArchiveOption: true, Usage: "Priority of the archive (default: 0), higher one wins on conflict"},
+	{Name: "maxread", Value: "<rate>", Option: "maxread=", ArchiveOption: true, Usage: "Limit read speed from the archive (e.g. 50MiB/s)"},
+	{Name: "ziplocale", Value: "<locale>", Option: "ziplocale=", ArchiveOption: true, Usage: "Character set of file names in zip (e.g. cp932)"},
+	{Name: "optional", Option: "optional=", ArchiveOption: true, Usage: "Skip the archive with warning if it is missing"},
+	{Name: "skip-missing", Option: "skipmissing", Usage: "Skip all missing archives with warning (put it before archives)"},
+	{Name: "overlay", Value: "<dir>", Option: "overlaydir=", Usage: "Overlay directory, where writes go (default: ./overlay)"},
+	{Name: "mountpoint", Value: "<dir>", Option: "mountpoint=", Usage: "Where to mount"},
+	{Name: "preload", Value: "<glob>", Option: "preload=", Usage: "Read matching files into cache in background, can be specified multiple times"},
+	{Name: "check", Option: "check", Usage: "Check archives (e.g. truncated .dat or zip) and exit without mounting"},
+	{Name: "trace", Option: "trace", Usage: "Log every FUSE operation (--trace=<glob> for matching paths only)"},
+	{Name: "help", Usage: "Show this help"},
+}
+
+func findCLIFlag(name string) *cliFlag {
+	for i := range cliFlags {
+		if cliFlags[i].Name == name {
+			return &cliFlags[i]
+		}
+	}
+	return nil
+}
+
+// translateFlags converts flag style arguments in args into legacy options, other arguments are kept as is.
+// It returns errShowHelp for -h or --help.
+func translateFlags(args []string) ([]string, error) {
+	result := []string{}
+	// archive which is being built by --archive (or --dir, --dirscan) and its sub-options
+	var archive *string
+	flush := func() {
+		if archive != nil {
+			result = append(result, *archive)
+			archive = nil
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-h" {
+			return nil, errShowHelp
+		}
+		if !strings.HasPrefix(arg, "--") {
+			flush()
+			result = append(result, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(arg[2:], "=")
+		flag := findCLIFlag(name)
+		if flag == nil {
+			return nil, fmt.Errorf("unknown flag: --%s", name)
+		}
+		if flag.Name == "help" {
+			return nil, errShowHelp
+		}
+		if flag.Value != "" && !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("--%s requires %s", name, flag.Value)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch {
+		case flag.Name == "archive" || flag.Name == "dir" || flag.Name == "dirscan":
+			flush()
+			if flag.Name != "archive" {
+				value = flag.Name + "=" + value
+			}
+			archive = &value
+		case flag.ArchiveOption:
+			if archive == nil {
+				return nil, fmt.Errorf("--%s must follow --archive, --dir or --dirscan", name)
+			}
+			// rewrite rule is terminated by its delimiter, so it can contain ":"
+			if strings.Contains(value, ":") && flag.Name != "rewrite" {
+				return nil, fmt.Errorf("--%s can't contain \":\": %s", name, value)
+			}
+			// prefixes are parsed in any order
+			spec := flag.Option + value + ":" + *archive
+			if flag.Value == "" {
+				// marker without value
+				spec = flag.Option + *archive
+			}
+			archive = &spec
+		case flag.Value == "":
+			flush()
+			if hasValue {
+				result = append(result, flag.Option+"="+value)
+			} else {
+				result = append(result, flag.Option)
+			}
+		default:
+			flush()
+			result = append(result, flag.Option+value)
+		}
+	}
+	flush()
+	return result, nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: marmounter [flags] [options] [-- fuse options]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	for _, f := range cliFlags {
+		usage := "--" + f.Name
+		if f.Value != "" {
+			usage += " " + f.Value
+		}
+		if f.ArchiveOption {
+			usage = "  " + usage
+		}
+		fmt.Fprintf(w, "  %-28s %s\n", usage, f.Usage)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Indented flags apply to preceding --archive, --dir or --dirscan, e.g.:")
+	fmt.Fprintln(w, "  marmounter --archive base.mar --archive mod.mar --priority 10 --overlay ./overlay --mountpoint ./game")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Legacy options (e.g. priority=10:mod.mar overlaydir=./overlay) are also accepted, see README for all options.")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// /healthz on pprof= listener, for launcher scripts and supervisors.
+// It returns 200 if the filesystem answers Getattr in time and all archive files can be opened, otherwise 503.
+
+const healthzGetattrTimeout = 5 * time.Second
+
+type healthzArchive struct {
+	File  string `json:"file"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthzFilesystem struct {
+	MountPoint       string           `json:"mountpoint"`
+	GetattrOK        bool             `json:"getattr_ok"`
+	GetattrLatencyMs float64          `json:"getattr_latency_ms"`
+	GetattrError     string           `json:"getattr_error,omitempty"`
+	Archives         []healthzArchive `json:"archives"`
+}
+
+// checkGetattr checks whether root directory can be stat-ed within timeout.
+// It doesn't go through the kernel, so it catches deadlocks in this process, but not stuck FUSE mounts.
+func (fs *MayakashiFS) checkGetattr(h *healthzFilesystem) {
+	start := time.Now()
+	result := make(chan int, 1)
+	go func() {
+		result <- fs.Getattr("/", &fuse.Stat_t{}, ^uint64(0))
+	}()
+	select {
+	case errc := <-result:
+		h.GetattrOK = errc == 0
+		if errc != 0 {
+			h.GetattrError = fmt.Sprintf("getattr returned %d", errc)
+		}
+	case <-time.After(healthzGetattrTimeout):
+		h.GetattrError = fmt.Sprintf("getattr didn't return in %s", healthzGetattrTimeout)
+	}
+	h.GetattrLatencyMs = float64(time.Since(start).Microseconds()) / 1000
+}
+
+// checkArchives checks whether every file of archives (e.g. .dat files) can be opened,
+// e.g. external drive is still connected.
+func (fs *MayakashiFS) checkArchives(h *healthzFilesystem) {
+	for _, a := range fs.Archives() {
+		ha := healthzArchive{File: a.File, OK: true}
+		files := a.DataFiles
+		if a.IsDirectory {
+			files = []string{a.File}
+		}
+		for _, file := range files {
+			if mayafs.IsRemoteFile(file) {
+				if _, err := fs.DataFileSize(file); err != nil {
+					ha.OK = false
+					ha.Error = err.Error()
+					break
+				}
+				continue
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				ha.OK = false
+				ha.Error = err.Error()
+				break
+			}
+			f.Close()
+		}
+		h.Archives = append(h.Archives, ha)
+	}
+}
+
+func (fs *MayakashiFS) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	filesystems := []healthzFilesystem{}
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		h := healthzFilesystem{MountPoint: f.MountPoint, Archives: []healthzArchive{}}
+		f.checkGetattr(&h)
+		f.checkArchives(&h)
+		healthy = healthy && h.GetattrOK
+		for _, a := range h.Archives {
+			healthy = healthy && a.OK
+		}
+		filesystems = append(filesystems, h)
+	}
+	status := "ok"
+	if !healthy {
+		status = "unhealthy"
+	}
+	data, err := json.MarshalIndent(map[string]any{
+		"status":      status,
+		"filesystems": filesystems,
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(append(data, '\n'))
+}
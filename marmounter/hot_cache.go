@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// number of chunks saved to hotcache= file
+const HOT_CACHE_SAVE_CHUNKS = 4096
+
+func (fs *MayakashiFS) saveHotCache() {
+	if fs.HotCacheFile == "" {
+		return
+	}
+	if err := fs.HotChunks.Save(fs.HotCacheFile, HOT_CACHE_SAVE_CHUNKS); err != nil {
+		fmt.Println("failed to save hot cache", err)
+	}
+}
+
+// StartHotCache re-warms chunks saved in previous session in background, and saves hot chunks periodically.
+func (fs *MayakashiFS) StartHotCache() {
+	if fs.HotCacheFile == "" {
+		return
+	}
+	chunks, err := mayafs.LoadHotChunks(fs.HotCacheFile)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("failed to load hot cache", err)
+	}
+	fs.HotChunks.Seed(chunks)
+
+	go func() {
+		start := time.Now()
+		warmed := 0
+		for _, c := range chunks {
+			file, ok := fs.GetFile(c.Path)
+			if !ok || file.MarEntry == nil || c.ChunkNo >= len(file.MarEntry.Info.Chunks) {
+				continue
+			}
+			// apps might already started to read
+			fs.waitForIdle("hot cache " + c.Path)
+			if _, err := fs.CacheMarChunk(&file, c.ChunkNo); err != nil {
+				fmt.Println("failed to warm hot cache", c.Path, c.ChunkNo, err)
+				continue
+			}
+			warmed++
+		}
+		fmt.Printf("warmed %d chunks from hot cache in %s\n", warmed, time.Since(start))
+	}()
+
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+			fs.saveHotCache()
+		}
+	}()
+}
+
+// StartPin reads files which match pin= globs into pinned store in background.
+func (fs *MayakashiFS) StartPin() {
+	if len(fs.PinGlobs) == 0 {
+		return
+	}
+	go func() {
+		start := time.Now()
+		files, err := fs.LoadPinnedFiles()
+		if err != nil {
+			fmt.Println("failed to pin files", err)
+		}
+		fmt.Printf("pinned %d files (%d bytes) in %s\n", files, fs.PinStats().Bytes, time.Since(start))
+	}()
+}
+
+// size of hotstore= file if hotstoresize= is not specified
+const DEFAULT_HOT_STORE_SIZE = 4 << 30
+
+// StartHotStore opens hotstore= file which is shared with sub filesystems, and saves its index periodically.
+func (fs *MayakashiFS) StartHotStore() error {
+	size := fs.HotStoreSize
+	if size == 0 {
+		size = DEFAULT_HOT_STORE_SIZE
+	}
+	store, err := mayafs.OpenHotStore(fs.HotStoreFile, size)
+	if err != nil {
+		return fmt.Errorf("failed to open hot store: %w", err)
+	}
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		f.HotStore = store
+	}
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+			if err := store.Save(); err != nil {
+				fmt.Println("failed to save hot store", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// Internal table of POSIX-style byte-range locks, shared by frontends of one filesystem (9P for now),
+// so clients which take locks on the same path (e.g. lock files of launchers) see each other.
+// Locks are kept in memory only, and keyed by path (not by inode), so renaming a locked file doesn't move its locks.
+// FUSE mount doesn't use this since cgofuse has no lock operations, kernel (or WinFsp) handles locks on it locally.
+
+// LOCK_EOF is end of range which extends to end of file (and beyond).
+const LOCK_EOF = math.MaxUint64
+
+var errLockConflict = errors.New("conflicting lock is held")
+
+// lockOwner identifies who holds a lock, e.g. process of a 9P client.
+// Session separates frontends and their connections, so same ID from different clients never merges.
+type lockOwner struct {
+	Session uint64
+	ID      uint64
+}
+
+type byteRangeLock struct {
+	Owner lockOwner
+	// [Start, End), End is LOCK_EOF if lock extends to end of file
+	Start     uint64
+	End       uint64
+	Exclusive bool
+}
+
+func (l *byteRangeLock) overlaps(start uint64, end uint64) bool {
+	return l.Start < end && start < l.End
+}
+
+type lockTable struct {
+	mutex sync.Mutex
+	// keyed by normalized path, only paths which have locks
+	files    map[string][]byteRangeLock
+	sessions atomic.Uint64
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{files: map[string][]byteRangeLock{}}
+}
+
+// newSession returns new session ID for lockOwner, which is never 0.
+func (t *lockTable) newSession() uint64 {
+	return t.sessions.Add(1)
+}
+
+// conflict returns lock of other owner which conflicts with requested one, or nil.
+// caller must hold mutex
+func (t *lockTable) conflict(path string, owner lockOwner, start uint64, end uint64, exclusive bool) *byteRangeLock {
+	for _, l := range t.files[path] {
+		if l.Owner != owner && l.overlaps(start, end) && (exclusive || l.Exclusive) {
+			return &l
+		}
+	}
+	return nil
+}
+
+// Test returns lock which would block requested lock, or nil if it can be taken.
+func (t *lockTable) Test(path string, owner lockOwner, start uint64, end uint64, exclusive bool) *byteRangeLock {
+	path = mayafs.NormalizeString(path)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.conflict(path, owner, start, end, exclusive)
+}
+
+// Lock takes (or converts) lock of owner on [start, end), or returns errLockConflict without waiting.
+// Like POSIX, owner's own locks in the range are replaced, so shared lock can be upgraded to exclusive and vice versa.
+func (t *lockTable) Lock(path string, owner lockOwner, start uint64, end uint64, exclusive bool) error {
+	path = mayafs.NormalizeString(path)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conflict(path, owner, start, end, exclusive) != nil {
+		return errLockConflict
+	}
+	t.unlock(path, owner, start, end)
+	t.files[path] = append(t.files[path], byteRangeLock{Owner: owner, Start: start, End: end, Exclusive: exclusive})
+	return nil
+}
+
+// Unlock releases locks of owner on [start, end), splitting locks which partially overlap.
+func (t *lockTable) Unlock(path string, owner lockOwner, start uint64, end uint64) {
+	path = mayafs.NormalizeString(path)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.unlock(path, owner, start, end)
+}
+
+// caller must hold mutex
+func (t *lockTable) unlock(path string, owner lockOwner, start uint64, end uint64) {
+	locks := t.files[path]
+	if len(locks) == 0 {
+		return
+	}
+	kept := make([]byteRangeLock, 0, len(locks)+1)
+	for _, l := range locks {
+		if l.Owner != owner || !l.overlaps(start, end) {
+			kept = append(kept, l)
+			continue
+		}
+		if l.Start < start {
+			head := l
+			head.End = start
+			kept = append(kept, head)
+		}
+		if end < l.End {
+			tail := l
+			tail.Start = end
+			kept = append(kept, tail)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.files, path)
+	} else {
+		t.files[path] = kept
+	}
+}
+
+// ReleaseSession releases every lock of session, e.g. when 9P client disconnects.
+func (t *lockTable) ReleaseSession(session uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for path, locks := range t.files {
+		kept := locks[:0]
+		for _, l := range locks {
+			if l.Owner.Session != session {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.files, path)
+		} else {
+			t.files[path] = kept
+		}
+	}
+}
+
+// lockRangeEnd returns end of range which starts at start and has length, 0 length means to end of file.
+func lockRangeEnd(start uint64, length uint64) uint64 {
+	if length == 0 || start+length < start {
+		return LOCK_EOF
+	}
+	return start + length
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Levels of loglevel=, messages are printed if their level is lower than or equal to fs.LogLevel.
+// Messages of every operation (e.g. listing, open, create) are debug, so they don't flood logs by default.
+const (
+	LOG_LEVEL_ERROR = iota
+	LOG_LEVEL_WARN
+	LOG_LEVEL_INFO
+	LOG_LEVEL_DEBUG
+)
+
+var logLevelNames = map[string]int{
+	"error": LOG_LEVEL_ERROR,
+	"warn":  LOG_LEVEL_WARN,
+	"info":  LOG_LEVEL_INFO,
+	"debug": LOG_LEVEL_DEBUG,
+}
+
+// logAt prints args to stderr (same as println) if level is enabled.
+func (fs *MayakashiFS) logAt(level int, args ...any) {
+	if fs.LogLevel >= level {
+		fmt.Fprintln(os.Stderr, args...)
+	}
+}
+
+func (fs *MayakashiFS) logDebug(args ...any) {
+	fs.logAt(LOG_LEVEL_DEBUG, args...)
+}
+
+func (fs *MayakashiFS) logInfo(args ...any) {
+	fs.logAt(LOG_LEVEL_INFO, args...)
+}
+
+func (fs *MayakashiFS) logWarn(args ...any) {
+	fs.logAt(LOG_LEVEL_WARN, args...)
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
-	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,47 +11,38 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/text/unicode/norm"
-
 	"github.com/bmatcuk/doublestar"
 	"github.com/bradenaw/juniper/xsync"
-	"github.com/dgraph-io/ristretto"
-	"github.com/klauspost/compress/zstd"
-	"github.com/pierrec/lz4/v4"
+	"github.com/rinsuki/mayakashi/mayafs"
 	pb "github.com/rinsuki/mayakashi/proto"
 	"github.com/winfsp/cgofuse/fuse"
-	"google.golang.org/protobuf/proto"
 )
 
-const INDEX_MAGIC = "MARI"
-const WHITEOUT_SUFFIX = ".__whiteout__"
-const WRITEBACK_SUFFIX = ".__writeback__"
-
-type FileInfo struct {
-	MarEntry    *pb.FileEntry
-	ZipEntry    *zip.File
-	ArchiveFile string
-}
-
-type DirInfo struct {
-	Files       map[string]string
-	Directories map[string]string
-}
-
-type ChunkCache struct {
-	ChunkNo int
-	Data    []byte
-}
-
 type SharedFileHandler struct {
 	File         *os.File
+	Path         string
 	Mutex        sync.Mutex
 	IsAppendMode bool
+	// written (or truncated) by this handler, so it might be compressed on release
+	Written bool
+	// for audit log
+	WrittenBytes int64
+	SizeAtOpen   int64
+}
+
+// ArchiveFileHandler caches stat of opened archive file, to answer Getattr without looking up maps and overlay.
+type ArchiveFileHandler struct {
+	Path      string
+	Stat      fuse.Stat_t
+	coalescer readCoalescer
 }
 
 type RenameRequest struct {
@@ -64,23 +54,104 @@ type RenameRequest struct {
 
 type MayakashiFS struct {
 	fuse.FileSystemBase
-	Directories          map[string]*DirInfo
-	Files                map[string]FileInfo
+	*mayafs.FS
 	ArchivePrefix        string
-	Count                uint64
-	ChunkCache           *ristretto.Cache
+	Count                atomic.Uint64
 	OverlayDir           string
-	OverlayCount         uint64
+	OverlayCount         atomic.Uint64
 	OverlayFileHandlers  xsync.Map[uint64, *SharedFileHandler]
 	RemoveRequestedPaths xsync.Map[string, string]
+	ControlFileHandlers  xsync.Map[uint64, *ControlFileHandler]
+	DirHandlers          xsync.Map[uint64, []DirEntry]
+	ArchiveFileHandlers  xsync.Map[uint64, *ArchiveFileHandler]
+	DisableControlDir    bool
+	StartedAt            time.Time
 	RenameRequestedPaths xsync.Map[string, RenameRequest]
 	ReadonlyPrefixes     []string
-	SlowReadLog          *os.File
-	LastDatRead          time.Time
-	ZipCache             map[string]*xsync.Pool[*zip.ReadCloser]
 	PreloadGlobs         []string
+	PreloadIdle          time.Duration
+	PreloadPollInterval  time.Duration
+	PreloadJobs          int
+	PreloadLimiter       *mayafs.RateLimiter
+	PreloadCacheBudget   int64
+	Verify               *VerifyStatus
+	HotCacheFile         string
+	Recorder             *AccessRecorder
+	HideGlobs            []string
+	StubGlobs            []string
 	PProfAddr            string
 	MountPoint           string
+	ServiceMode          string
+	ServiceName          string
+	Daemon               bool
+	LogFile              string
+	FuseOpts             []string
+	DirectIO             bool
+	KeepCache            bool
+	CacheTimeoutOpts     []string
+	NinePAddr            string
+	SFTPAddr             string
+	ServeAddr            string
+	ServeToken           string
+	SFTPUsers            []SFTPUser
+	SFTPAuthorizedKeys   string
+	SFTPHostKey          string
+	SubFilesystems       []*MayakashiFS
+	// number of writes to overlay directory which failed because its disk is full
+	OverlayNoSpaceErrors atomic.Int64
+	OverlayQuota         *OverlayQuota
+	OverlayCompressGlobs []string
+	// per-path lock, held while replacing compressed overlay files (or decompressing them), and opening files which might be compressed
+	OverlayCompressLocks   overlayPathLocks
+	CompressingOverlays    xsync.Map[string, struct{}]
+	CompressedOverlaySizes xsync.Map[string, compressedOverlaySize]
+	CompressedFileHandlers xsync.Map[uint64, *CompressedFileHandler]
+	TrashDir               string
+	TrashRetention         time.Duration
+	AuditLogFile           string
+	AuditLog               *AuditLog
+	// see log_level.go
+	LogLevel   int
+	Trace      bool
+	TraceGlobs []string
+	DirWatch   bool
+	CheckOnly  bool
+	// interval of keepalive reads from archives, 0 to disable
+	KeepaliveInterval time.Duration
+	PeerAddr          string
+	PeerToken         string
+	HotStoreFile      string
+	HotStoreSize      int64
+	// paths which were not found recently, nil if disabled
+	NegativeCache *negativeCache
+	// off, on or watch, see overlay_index.go
+	OverlayIndexMode string
+	// nil if overlayindex= is off
+	OverlayIndex *overlayIndex
+	// cacheinternalcost=off, chunk cache is replaced at startup since ristretto can't change it later
+	CacheIgnoreInternalCost bool
+	// cachesize=auto, bounds are defaults of mayafs if 0
+	CacheAuto bool
+	CacheMin  int64
+	CacheMax  int64
+	// resizes chunk cache, nil unless cachesize=auto
+	AdaptiveCache *mayafs.AdaptiveCacheSize
+	// read .dat files through io_uring (Linux only)
+	IOUring bool
+	// open .dat files without OS cache (Windows only)
+	Unbuffered bool
+	// maximum idle handles of one archive file, 0 for default of mayafs
+	FilePoolSize int
+	// close handles of archive files which are idle for this, 0 to keep them
+	FilePoolIdle time.Duration
+	// coalesce bursts of small reads of archive files, see read_coalesce.go
+	ReadCoalesce   bool
+	CoalescedReads atomic.Uint64
+	// byte-range locks taken by 9P clients, see lock_table.go
+	Locks *lockTable
+	// discard writes to Zone.Identifier, see zone_identifier.go
+	DropZoneIdentifier     bool
+	ZoneIdentifierHandlers xsync.Map[uint64, struct{}]
 }
 
 func recoverHandler() {
@@ -98,375 +169,801 @@ func recoverHandler() {
 	}
 }
 
-func NormalizeString(s string) string {
-	s = strings.ToLower(s)
-	s = norm.NFC.String(s)
-
-	return s
-}
-
 func NewMayakashiFS() *MayakashiFS {
 	// sf, err := os.Create("slowread.log")
 	// if err != nil {
 	// 	panic(err)
 	// }
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		MaxCost:     4 * 1024 * 1024 * 1024, // 4GiB
-		NumCounters: 1024 * 1024 * 10,       // 10MiB * 3
-		BufferItems: 64,
-	})
-
-	if err != nil {
-		panic(err)
-	}
 
-	return &MayakashiFS{
-		Files:                map[string]FileInfo{},
-		Directories:          map[string]*DirInfo{},
-		ChunkCache:           cache,
-		OverlayCount:         0x1000_0000,
+	fs := &MayakashiFS{
+		FS:                   mayafs.New(),
+		OverlayDir:           "overlay",
 		OverlayFileHandlers:  xsync.Map[uint64, *SharedFileHandler]{},
 		RemoveRequestedPaths: xsync.Map[string, string]{},
-		ZipCache:             map[string]*xsync.Pool[*zip.ReadCloser]{},
+		StartedAt:            time.Now(),
+		PreloadIdle:          3 * time.Second,
+		PreloadPollInterval:  1 * time.Second,
+		TrashRetention:       7 * 24 * time.Hour,
+		Locks:                newLockTable(),
+		LogLevel:             LOG_LEVEL_INFO,
 		// SlowReadLog:          sf,
 	}
+	// handles of overlay files (and others which are kept in maps keyed by handle) never collide with archive ones
+	fs.OverlayCount.Store(0x1000_0000)
+	return fs
 }
 
 func (fs *MayakashiFS) ParseFile(file string) error {
-	var options ArchiveReadOptions
-
 	if file == "" || strings.HasPrefix(file, "# ") {
 		// ignore empty or starts with "# "
 		return nil
 	}
 
-	for {
-		shouldBreak := true
-
-		if strings.HasPrefix(file, "addprefix=") {
-			af := strings.SplitN(file, ":", 2)
-			ap := af[0]
-			file = af[1]
-			ap = strings.SplitN(ap, "=", 2)[1]
-			if len(ap) > 0 && !strings.HasPrefix(ap, "/") {
-				ap = "/" + ap
-			}
-			for strings.HasSuffix(ap, "/") {
-				ap = ap[:len(ap)-1]
-			}
-			if options.AdditionalPrefix != "" {
-				return fmt.Errorf("additional prefix already set (%s)", options.AdditionalPrefix)
-			}
-			options.AdditionalPrefix = ap
-			shouldBreak = false
+	if strings.HasPrefix(file, "roprefix=") {
+		rop := strings.SplitN(file, "=", 2)
+		file = rop[1]
+		if !strings.HasPrefix(file, "/") {
+			file = "/" + file
 		}
+		fs.ReadonlyPrefixes = append(fs.ReadonlyPrefixes, file)
+		return nil
+	}
 
-		if strings.HasPrefix(file, "stripprefix=") {
-			sf := strings.SplitN(file, ":", 2)
-			file = sf[1]
-			sf = strings.SplitN(sf[0], "=", 2)
-			sp := sf[1]
-			if len(sp) > 0 && !strings.HasPrefix(sp, "/") {
-				sp = "/" + sp
-			}
-			if options.StripPrefix != "" {
-				return fmt.Errorf("strip prefix already set (%s)", options.StripPrefix)
-			}
-			options.StripPrefix = sp
-			shouldBreak = false
+	if strings.HasPrefix(file, "overlaydir=") {
+		od := strings.SplitN(file, "=", 2)
+		file = od[1]
+		fs.OverlayDir = file
+		return nil
+	}
+
+	if strings.HasPrefix(file, "overlayquota=") {
+		oq := strings.SplitN(file, "=", 2)
+		limit, err := mayafs.ParseByteSize(oq[1])
+		if err != nil {
+			return fmt.Errorf("invalid overlayquota: %w", err)
 		}
+		fs.OverlayQuota = &OverlayQuota{Limit: limit}
+		return nil
+	}
 
-		if strings.HasPrefix(file, "roprefix=") {
-			rop := strings.SplitN(file, "=", 2)
-			file = rop[1]
-			if !strings.HasPrefix(file, "/") {
-				file = "/" + file
-			}
-			fs.ReadonlyPrefixes = append(fs.ReadonlyPrefixes, file)
-			return nil
+	if strings.HasPrefix(file, "trashdir=") {
+		td := strings.SplitN(file, "=", 2)
+		fs.TrashDir = td[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "trashdays=") {
+		td := strings.SplitN(file, "=", 2)
+		days, err := strconv.Atoi(td[1])
+		if err != nil || days < 0 {
+			return fmt.Errorf("invalid trashdays: %s", td[1])
 		}
+		fs.TrashRetention = time.Duration(days) * 24 * time.Hour
+		return nil
+	}
 
-		if strings.HasPrefix(file, "overlaydir=") {
-			od := strings.SplitN(file, "=", 2)
-			file = od[1]
-			fs.OverlayDir = file
-			return nil
+	if file == "check" {
+		fs.CheckOnly = true
+		return nil
+	}
+
+	if file == "skipmissing" {
+		fs.SkipMissingArchives = true
+		return nil
+	}
+
+	if file == "dirwatch" {
+		fs.DirWatch = true
+		return nil
+	}
+
+	if file == "trace" {
+		fs.Trace = true
+		fs.LogConflictFiles = true
+		return nil
+	}
+
+	if strings.HasPrefix(file, "trace=") {
+		tr := strings.SplitN(file, "=", 2)
+		fs.Trace = true
+		fs.LogConflictFiles = true
+		fs.TraceGlobs = append(fs.TraceGlobs, tr[1])
+		return nil
+	}
+
+	if strings.HasPrefix(file, "auditlog=") {
+		al := strings.SplitN(file, "=", 2)
+		fs.AuditLogFile = al[1]
+		return nil
+	}
+
+	if file == "dropzoneid" {
+		fs.DropZoneIdentifier = true
+		return nil
+	}
+
+	if strings.HasPrefix(file, "preload=") {
+		od := strings.SplitN(file, "=", 2)
+		file = od[1]
+		fs.PreloadGlobs = append(fs.PreloadGlobs, file)
+		return nil
+	}
+
+	if strings.HasPrefix(file, "pin=") {
+		pg := strings.SplitN(file, "=", 2)
+		fs.PinGlobs = append(fs.PinGlobs, pg[1])
+		return nil
+	}
+
+	if strings.HasPrefix(file, "pinsize=") {
+		ps := strings.SplitN(file, "=", 2)
+		size, err := mayafs.ParseByteSize(ps[1])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid pinsize: %s", ps[1])
 		}
+		fs.PinBudget = size
+		return nil
+	}
 
-		if strings.HasPrefix(file, "preload=") {
-			od := strings.SplitN(file, "=", 2)
-			file = od[1]
-			fs.PreloadGlobs = append(fs.PreloadGlobs, file)
-			return nil
+	if strings.HasPrefix(file, "iouring=") {
+		iu := strings.SplitN(file, "=", 2)
+		switch iu[1] {
+		case "on":
+			fs.IOUring = true
+		case "off":
+			fs.IOUring = false
+		default:
+			return fmt.Errorf("invalid iouring: %s (on or off)", iu[1])
 		}
+		return nil
+	}
 
-		if strings.HasPrefix(file, "pprof=") {
-			od := strings.SplitN(file, "=", 2)
-			file = od[1]
-			fs.PProfAddr = file
-			return nil
+	if strings.HasPrefix(file, "unbuffered=") {
+		ub := strings.SplitN(file, "=", 2)
+		switch ub[1] {
+		case "on":
+			fs.Unbuffered = true
+		case "off":
+			fs.Unbuffered = false
+		default:
+			return fmt.Errorf("invalid unbuffered: %s (on or off)", ub[1])
 		}
+		return nil
+	}
 
-		if strings.HasPrefix(file, "mountpoint=") {
-			mp := strings.SplitN(file, "=", 2)
-			file = mp[1]
-			fs.MountPoint = file
-			return nil
+	if strings.HasPrefix(file, "coalesce=") {
+		co := strings.SplitN(file, "=", 2)
+		switch co[1] {
+		case "on":
+			fs.ReadCoalesce = true
+		case "off":
+			fs.ReadCoalesce = false
+		default:
+			return fmt.Errorf("invalid coalesce: %s (on or off)", co[1])
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(file, "hideglob=") {
+		hg := strings.SplitN(file, "=", 2)
+		if _, err := doublestar.Match(hg[1], ""); err != nil {
+			return fmt.Errorf("invalid hideglob %s: %w", hg[1], err)
 		}
+		fs.HideGlobs = append(fs.HideGlobs, hg[1])
+		return nil
+	}
 
-		for strings.HasPrefix(file, "onlyglob=") {
-			oa := strings.SplitN(file, ":", 2)
-			file = oa[1]
-			options.IncludedGlobs = append(options.IncludedGlobs, oa[0][len("onlyglob="):])
-			shouldBreak = false
+	if strings.HasPrefix(file, "overlaycompress=") {
+		oc := strings.SplitN(file, "=", 2)
+		if _, err := doublestar.Match(oc[1], ""); err != nil {
+			return fmt.Errorf("invalid overlaycompress %s: %w", oc[1], err)
 		}
+		fs.OverlayCompressGlobs = append(fs.OverlayCompressGlobs, oc[1])
+		return nil
+	}
 
-		if strings.HasPrefix(file, "ziplocale=") {
-			zf := strings.SplitN(file, ":", 2)
-			file = zf[1]
-			zf = strings.SplitN(zf[0], "=", 2)
-			locale := zf[1]
-			if err := options.SetZipLocale(locale); err != nil {
-				return err
-			}
-			shouldBreak = false
+	if strings.HasPrefix(file, "stubglob=") {
+		sg := strings.SplitN(file, "=", 2)
+		if _, err := doublestar.Match(sg[1], ""); err != nil {
+			return fmt.Errorf("invalid stubglob %s: %w", sg[1], err)
 		}
+		fs.StubGlobs = append(fs.StubGlobs, sg[1])
+		return nil
+	}
 
-		if strings.HasPrefix(file, "commandsfile=") {
-			// commands are splitted by line.
+	if strings.HasPrefix(file, "record=") {
+		rc := strings.SplitN(file, "=", 2)
+		fs.Recorder = NewAccessRecorder(rc[1])
+		return nil
+	}
 
-			cf := strings.SplitN(file, "=", 2)
-			file = cf[1]
+	if strings.HasPrefix(file, "preloadidle=") || strings.HasPrefix(file, "preloadpoll=") {
+		kv := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(kv[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", kv[0], kv[1])
+		}
+		if kv[0] == "preloadidle" {
+			fs.PreloadIdle = d
+		} else {
+			fs.PreloadPollInterval = d
+		}
+		return nil
+	}
 
-			f, err := os.Open(file)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				line := scanner.Text()
-				fmt.Println("Loading from file", file, "Command: "+line)
-				if err := fs.ParseFile(line); err != nil {
-					return err
-				}
-			}
-			return nil
+	if strings.HasPrefix(file, "readretry=") {
+		rr := strings.SplitN(file, "=", 2)
+		retries, err := strconv.Atoi(rr[1])
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid readretry: %s", rr[1])
 		}
+		fs.ReadRetries = retries
+		return nil
+	}
 
-		if file == "showhashes" {
-			for _, f := range fs.Files {
-				if f.MarEntry != nil {
-					fmt.Printf("%s\t%s\n", hex.EncodeToString(f.MarEntry.Info.OriginalSha256), f.MarEntry.Info.Path)
-				}
-			}
-			os.Exit(0)
+	if strings.HasPrefix(file, "readretrybackoff=") {
+		rb := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(rb[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid readretrybackoff: %s", rb[1])
 		}
+		fs.ReadRetryBackoff = d
+		return nil
+	}
 
-		if shouldBreak {
-			break
+	if strings.HasPrefix(file, "readtimeout=") {
+		rt := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(rt[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid readtimeout: %s", rt[1])
 		}
+		fs.ReadTimeout = d
+		return nil
 	}
 
-	if strings.HasSuffix(file, ".zip") {
-		return fs.parseZipFile(file, options)
+	if strings.HasPrefix(file, "remotecache=") {
+		rc := strings.SplitN(file, "=", 2)
+		fs.RemoteCacheDir = rc[1]
+		return nil
 	}
 
-	if strings.HasSuffix(file, ".mar") {
-		return fs.parseMARFile(file, options)
+	if strings.HasPrefix(file, "mirrordir=") {
+		md := strings.SplitN(file, "=", 2)
+		if st, err := os.Stat(md[1]); err != nil || !st.IsDir() {
+			return fmt.Errorf("invalid mirrordir (not a directory): %s", md[1])
+		}
+		fs.MirrorDirs = append(fs.MirrorDirs, md[1])
+		return nil
 	}
 
-	return fmt.Errorf("unknown file type (filename suffix): %s", file)
-}
+	if strings.HasPrefix(file, "remotetoken=") {
+		rt := strings.SplitN(file, "=", 2)
+		fs.RemoteToken = rt[1]
+		return nil
+	}
 
-func (fs *MayakashiFS) getZipReadCloser(file string) *zip.ReadCloser {
-	pool, ok := fs.ZipCache[file]
-	if !ok {
-		p := xsync.NewPool[*zip.ReadCloser](func() *zip.ReadCloser {
-			zf, err := zip.OpenReader(file)
-			if err != nil {
-				panic(err)
-			}
-			return zf
-		})
-		pool = &p
-		fs.ZipCache[file] = pool
+	if strings.HasPrefix(file, "peer=") {
+		pa := strings.SplitN(file, "=", 2)
+		fs.PeerAddr = pa[1]
+		return nil
 	}
-	return pool.Get()
-}
 
-func (fs *MayakashiFS) putZipReadCloser(file string, zf *zip.ReadCloser) {
-	pool, ok := fs.ZipCache[file]
-	if !ok {
-		panic("cache not found")
+	if strings.HasPrefix(file, "peertoken=") {
+		pt := strings.SplitN(file, "=", 2)
+		fs.PeerToken = pt[1]
+		return nil
 	}
-	pool.Put(zf)
-}
 
-func (fs *MayakashiFS) parseZipFile(file string, o ArchiveReadOptions) error {
-	zf := fs.getZipReadCloser(file)
-	defer fs.putZipReadCloser(file, zf)
+	if strings.HasPrefix(file, "keepalive=") {
+		ka := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(ka[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid keepalive: %s", ka[1])
+		}
+		fs.KeepaliveInterval = d
+		return nil
+	}
+
+	if strings.HasPrefix(file, "filepoolsize=") {
+		ps := strings.SplitN(file, "=", 2)
+		size, err := strconv.Atoi(ps[1])
+		if err != nil || size < 1 {
+			return fmt.Errorf("invalid filepoolsize: %s", ps[1])
+		}
+		fs.FilePoolSize = size
+		return nil
+	}
 
-	var fileCount int
+	if strings.HasPrefix(file, "filepoolidle=") {
+		pi := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(pi[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid filepoolidle: %s", pi[1])
+		}
+		fs.FilePoolIdle = d
+		return nil
+	}
 
-	for _, f := range zf.File {
-		if f.NonUTF8 {
-			f.Name = o.ConvertZipFileName(f.Name)
+	if strings.HasPrefix(file, "preloadjobs=") {
+		pj := strings.SplitN(file, "=", 2)
+		jobs, err := strconv.Atoi(pj[1])
+		if err != nil || jobs < 0 {
+			return fmt.Errorf("invalid preloadjobs: %s", pj[1])
 		}
-		origPath := o.GetFilePath(f.Name)
-		if origPath == "" {
-			continue
+		fs.PreloadJobs = jobs
+		return nil
+	}
+
+	if strings.HasPrefix(file, "preloadbwlimit=") {
+		pb := strings.SplitN(file, "=", 2)
+		limit, err := mayafs.ParseByteSize(pb[1])
+		if err != nil {
+			return fmt.Errorf("invalid preloadbwlimit: %w", err)
 		}
+		fs.PreloadLimiter = mayafs.NewRateLimiter(limit)
+		return nil
+	}
 
-		shouldTreatAsDir := f.FileInfo().IsDir()
+	// "maxread=<rate>:<archive>" is per-archive limit, which is parsed by ParseArchiveSpec
+	if strings.HasPrefix(file, "maxread=") && !strings.Contains(file, ":") {
+		mr := strings.SplitN(file, "=", 2)
+		limit, err := mayafs.ParseByteRate(mr[1])
+		if err != nil {
+			return fmt.Errorf("invalid maxread: %w", err)
+		}
+		fs.ReadLimiter = mayafs.NewRateLimiter(limit)
+		return nil
+	}
 
-		if strings.HasSuffix(origPath, "/") {
-			if !shouldTreatAsDir {
-				if f.FileInfo().Size() != 0 {
-					fmt.Println("invalid file size for invalid directory", origPath)
-					continue
-				}
-				origPath = origPath[:len(origPath)-1]
-				shouldTreatAsDir = true
-			}
+	if strings.HasPrefix(file, "preloadcache=") {
+		pc := strings.SplitN(file, "=", 2)
+		budget, err := mayafs.ParseByteSize(pc[1])
+		if err != nil {
+			return fmt.Errorf("invalid preloadcache: %w", err)
 		}
+		fs.PreloadCacheBudget = budget
+		return nil
+	}
+
+	if strings.HasPrefix(file, "verify=") {
+		vf := strings.SplitN(file, "=", 2)
+		switch vf[1] {
+		case "on":
+			fs.Verify = &VerifyStatus{}
+		case "off":
+			fs.Verify = nil
+		default:
+			return fmt.Errorf("invalid verify: %s", vf[1])
+		}
+		return nil
+	}
 
-		lowerPath := NormalizeString(origPath)
+	if strings.HasPrefix(file, "hotcache=") {
+		hc := strings.SplitN(file, "=", 2)
+		fs.HotCacheFile = hc[1]
+		fs.HotChunks = mayafs.NewHotChunkTracker()
+		return nil
+	}
 
-		if !shouldTreatAsDir {
-			fs.Files[lowerPath] = FileInfo{
-				MarEntry:    nil,
-				ZipEntry:    f,
-				ArchiveFile: file,
-			}
+	if strings.HasPrefix(file, "overlayindex=") {
+		oi := strings.SplitN(file, "=", 2)
+		switch oi[1] {
+		case "off", "on", "watch":
+			fs.OverlayIndexMode = oi[1]
+		default:
+			return fmt.Errorf("invalid overlayindex: %s", oi[1])
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(file, "negcache=") {
+		nc := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(nc[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid negcache: %s", nc[1])
+		}
+		fs.NegativeCache = newNegativeCache(d)
+		return nil
+	}
+
+	if strings.HasPrefix(file, "hotstore=") {
+		hs := strings.SplitN(file, "=", 2)
+		fs.HotStoreFile = hs[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "hotstoresize=") {
+		hs := strings.SplitN(file, "=", 2)
+		size, err := mayafs.ParseByteSize(hs[1])
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid hotstoresize: %s", hs[1])
 		}
+		fs.HotStoreSize = size
+		return nil
+	}
+
+	if strings.HasPrefix(file, "cachesize=") {
+		cs := strings.SplitN(file, "=", 2)
+		if cs[1] == "auto" {
+			fs.CacheAuto = true
+			return nil
+		}
+		fs.CacheAuto = false
+		size, err := mayafs.ParseByteSize(cs[1])
+		if err != nil {
+			return fmt.Errorf("invalid cachesize: %w", err)
+		}
+		// NOTE: chunk cache is shared with all filesystems in this process
+		fs.ChunkCache.UpdateMaxCost(size)
+		return nil
+	}
 
-		dir := origPath[:strings.LastIndex(origPath, "/")]
-		// fmt.Println("dir", dir, origPath, f.FileInfo().IsDir())
-		if shouldTreatAsDir {
-			// just create directory
-			fs.getDirInfo(dir)
+	if strings.HasPrefix(file, "cachemin=") || strings.HasPrefix(file, "cachemax=") {
+		cm := strings.SplitN(file, "=", 2)
+		size, err := mayafs.ParseByteSize(cm[1])
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid %s: %s", cm[0], cm[1])
+		}
+		if cm[0] == "cachemin" {
+			fs.CacheMin = size
 		} else {
-			fs.Directories[fs.getDirInfo(dir)].Files[NormalizeString(origPath)] = origPath
-			fileCount += 1
+			fs.CacheMax = size
 		}
+		return nil
 	}
-	fmt.Printf("Loaded %d files\n", fileCount)
 
-	return nil
-}
+	if strings.HasPrefix(file, "cachecost=") {
+		cc := strings.SplitN(file, "=", 2)
+		switch cc[1] {
+		case mayafs.CACHE_COST_SIZE, mayafs.CACHE_COST_COUNT:
+			fs.CachePolicy.Cost = cc[1]
+		default:
+			return fmt.Errorf("unknown cachecost: %s (size or count)", cc[1])
+		}
+		return nil
+	}
 
-func (fs *MayakashiFS) parseMARFile(file string, o ArchiveReadOptions) error {
+	if strings.HasPrefix(file, "cacheinternalcost=") {
+		ci := strings.SplitN(file, "=", 2)
+		switch ci[1] {
+		case "on":
+			fs.CacheIgnoreInternalCost = false
+		case "off":
+			fs.CacheIgnoreInternalCost = true
+		default:
+			return fmt.Errorf("invalid cacheinternalcost: %s (on or off)", ci[1])
+		}
+		return nil
+	}
 
-	f, err := os.Open(file + ".idx")
-	if err != nil {
-		return err
+	if strings.HasPrefix(file, "zipcachettl=") || strings.HasPrefix(file, "marcachettl=") {
+		ct := strings.SplitN(file, "=", 2)
+		d, err := time.ParseDuration(ct[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", ct[0], ct[1])
+		}
+		if ct[0] == "zipcachettl" {
+			fs.CachePolicy.ZipTTL = d
+		} else {
+			fs.CachePolicy.MarTTL = d
+		}
+		return nil
 	}
-	defer f.Close()
-	// read magic
-	magic := make([]byte, 4)
-	if _, err := io.ReadFull(f, magic); err != nil {
-		return err
+
+	if strings.HasPrefix(file, "scannocache=") {
+		sn := strings.SplitN(file, "=", 2)
+		size, err := mayafs.ParseByteSize(sn[1])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid scannocache: %s", sn[1])
+		}
+		fs.CachePolicy.ScanNoCacheSize = size
+		return nil
 	}
 
-	if string(magic) != INDEX_MAGIC {
-		panic("invalid magic")
+	if strings.HasPrefix(file, "maxcachedchunk=") {
+		mc := strings.SplitN(file, "=", 2)
+		size, err := mayafs.ParseByteSize(mc[1])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid maxcachedchunk: %s", mc[1])
+		}
+		fs.MaxCachedChunkSize = size
+		return nil
 	}
 
-	// read compressed length
-	var compressedLength uint32
-	if err = binary.Read(f, binary.BigEndian, &compressedLength); err != nil {
-		return err
+	if strings.HasPrefix(file, "loglevel=") {
+		ll := strings.SplitN(file, "=", 2)
+		level, ok := logLevelNames[ll[1]]
+		if !ok {
+			return fmt.Errorf("unknown loglevel: %s (error, warn, info or debug)", ll[1])
+		}
+		fs.LogLevel = level
+		if level >= LOG_LEVEL_DEBUG {
+			// debug logs FUSE operations (and every conflicting file) too
+			fs.Trace = true
+			fs.LogConflictFiles = true
+		}
+		return nil
 	}
 
-	// read decompressed length
-	var decompressedLength uint32
-	if err = binary.Read(f, binary.BigEndian, &decompressedLength); err != nil {
-		return err
+	if strings.HasPrefix(file, "pprof=") {
+		od := strings.SplitN(file, "=", 2)
+		file = od[1]
+		fs.PProfAddr = file
+		return nil
 	}
 
-	// read data
-	data := make([]byte, compressedLength)
-	if _, err := io.ReadFull(f, data); err != nil {
-		return err
+	if strings.HasPrefix(file, "zipindexcache=") {
+		zc := strings.SplitN(file, "=", 2)
+		switch zc[1] {
+		case "on":
+			fs.DisableZipIndexCache = false
+		case "off":
+			fs.DisableZipIndexCache = true
+		default:
+			return fmt.Errorf("invalid zipindexcache: %s", zc[1])
+		}
+		return nil
 	}
 
-	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
-	if err != nil {
-		return err
+	if strings.HasPrefix(file, "directio=") || strings.HasPrefix(file, "keepcache=") {
+		kv := strings.SplitN(file, "=", 2)
+		var value bool
+		switch kv[1] {
+		case "on":
+			value = true
+		case "off":
+			value = false
+		default:
+			return fmt.Errorf("invalid %s: %s", kv[0], kv[1])
+		}
+		if kv[0] == "directio" {
+			fs.DirectIO = value
+		} else {
+			fs.KeepCache = value
+		}
+		return nil
 	}
 
-	data, err = decoder.DecodeAll(data, make([]byte, 0, int(decompressedLength)))
-	if err != nil {
-		return err
+	if strings.HasPrefix(file, "attrtimeout=") || strings.HasPrefix(file, "entrytimeout=") {
+		kv := strings.SplitN(file, "=", 2)
+		if _, err := strconv.ParseFloat(kv[1], 64); err != nil {
+			return fmt.Errorf("invalid %s: %w", kv[0], err)
+		}
+		// attrtimeout -> attr_timeout
+		fs.CacheTimeoutOpts = append(fs.CacheTimeoutOpts, strings.TrimSuffix(kv[0], "timeout")+"_timeout="+kv[1])
+		return nil
 	}
 
-	var indexFile pb.FileIndexFile
-	if err := proto.Unmarshal(data, &indexFile); err != nil {
-		return err
+	if strings.HasPrefix(file, "conflict=") {
+		cp := strings.SplitN(file, "=", 2)
+		switch cp[1] {
+		case mayafs.CONFLICT_FIRST_WINS, mayafs.CONFLICT_LAST_WINS:
+			fs.ConflictPolicy = cp[1]
+		default:
+			return fmt.Errorf("invalid conflict: %s", cp[1])
+		}
+		return nil
 	}
 
-	fileCount := 0
+	if strings.HasPrefix(file, "bindmount=") {
+		bm, err := mayafs.ParseBindMount(strings.SplitN(file, "=", 2)[1])
+		if err != nil {
+			return err
+		}
+		fs.BindMounts = append(fs.BindMounts, bm)
+		return nil
+	}
 
-	ourFiles := map[string]struct{}{}
-	for _, entry := range indexFile.Entries {
-		origPath := o.GetFilePath(entry.Info.Path)
-		if origPath == "" {
-			continue
+	if strings.HasPrefix(file, "loosefile=") {
+		lf, err := mayafs.ParseLooseFile(strings.SplitN(file, "=", 2)[1])
+		if err != nil {
+			return err
 		}
+		return fs.AddLooseFile(lf)
+	}
 
-		lowerPath := NormalizeString(origPath)
-		dir := origPath[:strings.LastIndex(origPath, "/")]
+	if strings.HasPrefix(file, "alias=") {
+		a, err := mayafs.ParseAlias(strings.SplitN(file, "=", 2)[1])
+		if err != nil {
+			return err
+		}
+		fs.Aliases = append(fs.Aliases, a)
+		return nil
+	}
 
-		if strings.HasSuffix(lowerPath, WHITEOUT_SUFFIX) {
-			lowerPath = lowerPath[:len(lowerPath)-len(WHITEOUT_SUFFIX)]
-			if _, ok := ourFiles[lowerPath]; ok {
-				fmt.Println("whiteout but including ", origPath)
-				continue
-			}
-			origPath = origPath[:len(origPath)-len(WHITEOUT_SUFFIX)]
-			println("whiteout", origPath)
-			delete(fs.Files, lowerPath)
-			delete(fs.Directories[fs.getDirInfo(dir)].Files, NormalizeString(origPath))
-			continue
+	if strings.HasPrefix(file, "controldir=") {
+		cd := strings.SplitN(file, "=", 2)
+		switch cd[1] {
+		case "on":
+			fs.DisableControlDir = false
+		case "off":
+			fs.DisableControlDir = true
+		default:
+			return fmt.Errorf("invalid controldir: %s", cd[1])
 		}
-		ourFiles[lowerPath] = struct{}{}
+		return nil
+	}
 
-		fs.Files[lowerPath] = FileInfo{
-			MarEntry:    entry,
-			ArchiveFile: file,
+	if strings.HasPrefix(file, "loadjobs=") {
+		lj := strings.SplitN(file, "=", 2)
+		jobs, err := strconv.Atoi(lj[1])
+		if err != nil || jobs < 1 {
+			return fmt.Errorf("invalid loadjobs: %s", lj[1])
 		}
+		fs.LoadJobs = jobs
+		return nil
+	}
 
-		fs.Directories[fs.getDirInfo(dir)].Files[NormalizeString(origPath)] = origPath
-		fileCount += 1
+	if strings.HasPrefix(file, "workdir=") {
+		wd := strings.SplitN(file, "=", 2)
+		return os.Chdir(wd[1])
 	}
-	fmt.Printf("Loaded %d files\n", fileCount)
 
-	return nil
-}
+	if strings.HasPrefix(file, "service=") {
+		sm := strings.SplitN(file, "=", 2)
+		fs.ServiceMode = sm[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "servicename=") {
+		sn := strings.SplitN(file, "=", 2)
+		fs.ServiceName = sn[1]
+		return nil
+	}
 
-func (fs *MayakashiFS) getDirInfo(dirPath string) string {
-	if dirPath == "" {
-		dirPath = "/"
+	if file == "daemon" {
+		fs.Daemon = true
+		return nil
 	}
-	lowerDirPath := NormalizeString(dirPath)
-	dirInfo, ok := fs.Directories[lowerDirPath]
-	if !ok {
-		dirInfo = &DirInfo{
-			Files:       map[string]string{},
-			Directories: map[string]string{},
+
+	if strings.HasPrefix(file, "logfile=") {
+		lf := strings.SplitN(file, "=", 2)
+		fs.LogFile = lf[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "mountpoint=") {
+		mp := strings.SplitN(file, "=", 2)
+		file = mp[1]
+		fs.MountPoint = file
+		return nil
+	}
+
+	if strings.HasPrefix(file, "9p=") {
+		np := strings.SplitN(file, "=", 2)
+		fs.NinePAddr = np[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "sftp=") {
+		sa := strings.SplitN(file, "=", 2)
+		fs.SFTPAddr = sa[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "sftpuser=") {
+		su := strings.SplitN(file, "=", 2)
+		user, err := ParseSFTPUser(su[1])
+		if err != nil {
+			return err
+		}
+		fs.SFTPUsers = append(fs.SFTPUsers, user)
+		return nil
+	}
+
+	if strings.HasPrefix(file, "sftpauthorizedkeys=") {
+		sk := strings.SplitN(file, "=", 2)
+		fs.SFTPAuthorizedKeys = sk[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "sftphostkey=") {
+		sh := strings.SplitN(file, "=", 2)
+		fs.SFTPHostKey = sh[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "serve=") {
+		sa := strings.SplitN(file, "=", 2)
+		fs.ServeAddr = sa[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "servetoken=") {
+		st := strings.SplitN(file, "=", 2)
+		fs.ServeToken = st[1]
+		return nil
+	}
+
+	if strings.HasPrefix(file, "fuseopt=") {
+		fo := strings.SplitN(file, "=", 2)
+		fs.FuseOpts = append(fs.FuseOpts, fo[1])
+		return nil
+	}
+
+	if strings.HasPrefix(file, "subfs=") {
+		// mount another filesystem (described by commands file) in this process
+		sf := strings.SplitN(file, "=", 2)
+		sub := NewMayakashiFS()
+		if err := sub.ParseFile("commandsfile=" + sf[1]); err != nil {
+			return fmt.Errorf("failed to parse subfs %s: %w", sf[1], err)
+		}
+		if sub.MountPoint == "" && sub.NinePAddr == "" && sub.SFTPAddr == "" && sub.ServeAddr == "" {
+			return fmt.Errorf("subfs %s does not have mountpoint (or 9p, sftp, serve)", sf[1])
+		}
+		if len(sub.SubFilesystems) > 0 {
+			// keep it flat, all filesystems are owned by main one
+			fs.SubFilesystems = append(fs.SubFilesystems, sub.SubFilesystems...)
+			sub.SubFilesystems = nil
+		}
+		fs.SubFilesystems = append(fs.SubFilesystems, sub)
+		return nil
+	}
+
+	if strings.HasPrefix(file, "commandsfile=") {
+		// commands are splitted by line.
+
+		cf := strings.SplitN(file, "=", 2)
+		file = cf[1]
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			fmt.Println("Loading from file", file, "Command: "+line)
+			if err := fs.ParseFile(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if file == "showhashes" {
+		if err := fs.LoadPendingArchives(); err != nil {
+			return err
+		}
+		for _, f := range fs.Tree().Files {
+			if f.MarEntry != nil {
+				fmt.Printf("%s\t%s\n", hex.EncodeToString(f.MarEntry.Info.OriginalSha256), f.MarEntry.Info.Path)
+			}
+		}
+		os.Exit(0)
+	}
+
+	if file == "overlaygc" {
+		if err := fs.LoadPendingArchives(); err != nil {
+			return err
+		}
+		removed, freed, err := fs.GCOverlay()
+		if err != nil {
+			return err
 		}
-		fs.Directories[lowerDirPath] = dirInfo
-		upDir := dirPath[:strings.LastIndex(dirPath, "/")]
-		if upDir == "" {
-			upDir = "/"
+		fmt.Println("overlaygc: removed", removed, "files,", freed, "bytes")
+		os.Exit(0)
+	}
+
+	if file == "trashlist" {
+		if err := fs.ListTrash(); err != nil {
+			return err
 		}
-		if upDir != dirPath {
-			fs.Directories[fs.getDirInfo(upDir)].Directories[NormalizeString(dirPath)] = dirPath
+		os.Exit(0)
+	}
+
+	if strings.HasPrefix(file, "undelete=") {
+		ud := strings.SplitN(file, "=", 2)
+		if err := fs.Undelete(ud[1]); err != nil {
+			return err
 		}
+		os.Exit(0)
 	}
-	return lowerDirPath
+
+	// otherwise, it should be an archive (with optional prefixes)
+	return fs.ParseArchiveSpec(file)
 }
 
 func (fs *MayakashiFS) getOverlayPath(path string) *string {
@@ -474,7 +971,7 @@ func (fs *MayakashiFS) getOverlayPath(path string) *string {
 		return nil
 	}
 	for _, prefix := range fs.ReadonlyPrefixes {
-		if strings.HasPrefix(NormalizeString(path), NormalizeString(prefix)) {
+		if strings.HasPrefix(mayafs.NormalizeString(path), mayafs.NormalizeString(prefix)) {
 			return nil
 		}
 	}
@@ -483,44 +980,142 @@ func (fs *MayakashiFS) getOverlayPath(path string) *string {
 	return &overlayPath
 }
 
-func GetFuseStatFromMarEntry(e *pb.FileEntry, stat *fuse.Stat_t) {
-	var size int64
-	for _, chunk := range e.Info.Chunks {
-		size += int64(chunk.OriginalLength)
+// overlayWriteError logs error of writing to overlay directory, and converts it to FUSE error.
+// Full disk is reported as ENOSPC instead of EIO, so apps (and users) can tell why saves fail.
+func (fs *MayakashiFS) overlayWriteError(what string, path string, err error) int {
+	if isDiskFullError(err) {
+		n := fs.OverlayNoSpaceErrors.Add(1)
+		fmt.Println("overlay disk is full: failed to", what, path, err, "(total", n, "times)")
+		return -fuse.ENOSPC
 	}
-	stat.Mode = fuse.S_IFREG | 0777
-	stat.Size = size
-	time := fuse.NewTimespec(e.Info.ModifiedTime.AsTime())
-	stat.Ctim = time
-	stat.Mtim = time
-	stat.Blocks = 1
+	fmt.Println("failed to", what, path, err)
+	return -fuse.EIO
+}
+
+func matchAnyGlob(globs []string, path string) bool {
+	for _, glob := range globs {
+		matched, err := doublestar.Match(mayafs.NormalizeString(glob), mayafs.NormalizeString(path))
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
 }
-func GetFuseStatFromZipEntry(e *zip.File, stat *fuse.Stat_t) {
-	info := e.FileInfo()
+
+// isHiddenPath reports whether path matches one of hideglob= patterns.
+func (fs *MayakashiFS) isHiddenPath(path string) bool {
+	return matchAnyGlob(fs.HideGlobs, path)
+}
+
+// isStubPath reports whether path should be served as empty file by stubglob= patterns.
+// Directories are never stubbed.
+func (fs *MayakashiFS) isStubPath(path string) bool {
+	if !matchAnyGlob(fs.StubGlobs, path) {
+		return false
+	}
+	if _, ok := fs.Tree().Directories[mayafs.NormalizeString(path)]; ok {
+		return false
+	}
+	if overlayPath := fs.getOverlayPath(path); overlayPath != nil && fs.OverlayIndex.mayHave(path) {
+		if us, err := os.Stat(*overlayPath); err == nil && us.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+func GetFuseStatFromFileInfo(fi *mayafs.FileInfo, stat *fuse.Stat_t) {
 	stat.Mode = fuse.S_IFREG | 0777
-	stat.Size = info.Size()
-	time := fuse.NewTimespec(info.ModTime())
+	stat.Size = fi.Size()
+	time := fuse.NewTimespec(fi.ModTime())
 	stat.Ctim = time
 	stat.Mtim = time
 	stat.Blocks = 1
-}
-func GetFuseStatFromFileInfo(fi *FileInfo, stat *fuse.Stat_t) {
 	if fi.MarEntry != nil {
-		GetFuseStatFromMarEntry(fi.MarEntry, stat)
-	} else {
-		GetFuseStatFromZipEntry(fi.ZipEntry, stat)
+		applyArchiveMetadata(fi.MarEntry, stat)
 	}
 }
-func (fi *FileInfo) GetFilename() string {
-	var path string
-	if fi.MarEntry != nil {
-		path = fi.MarEntry.Info.Path
-	} else {
-		path = FixPathSplitter(fi.ZipEntry.Name)
+
+// Windows file attributes (FILE_ATTRIBUTE_*) which can be represented in stat.Flags
+var windowsAttributeFlags = []struct {
+	Attribute uint32
+	Flag      uint32
+}{
+	{0x1, fuse.UF_READONLY},
+	{0x2, fuse.UF_HIDDEN},
+	{0x4, fuse.UF_SYSTEM},
+	{0x20, fuse.UF_ARCHIVE},
+}
+
+// applyArchiveMetadata applies metadata of original file which is recorded in .mar (by `create --metadata`).
+func applyArchiveMetadata(entry *pb.FileEntry, stat *fuse.Stat_t) {
+	if entry.SymlinkTarget != "" {
+		stat.Mode = fuse.S_IFLNK | 0777
+		stat.Size = int64(len(entry.SymlinkTarget))
+	}
+	if entry.Mode != nil {
+		stat.Mode = stat.Mode&fuse.S_IFMT | *entry.Mode&07777
+	}
+	if entry.Uid != nil {
+		stat.Uid = *entry.Uid
 	}
-	return path[strings.LastIndex(path, "/")+1:]
+	if entry.Gid != nil {
+		stat.Gid = *entry.Gid
+	}
+	for _, f := range windowsAttributeFlags {
+		if entry.WindowsAttributes&f.Attribute != 0 {
+			stat.Flags |= f.Flag
+		}
+	}
+}
+
+// GetFuseStatFromDirInfo fills stat of directory in archives. Times are left zero if archives don't record them.
+func GetFuseStatFromDirInfo(dir *mayafs.DirInfo, stat *fuse.Stat_t) {
+	stat.Mode = fuse.S_IFDIR | 0777
+	if dir != nil && !dir.Modified.IsZero() {
+		time := fuse.NewTimespec(dir.Modified)
+		stat.Ctim = time
+		stat.Mtim = time
+	}
+}
+
+// volumeStat is capacity of the volume (which contains overlay directory).
+type volumeStat struct {
+	BlockSize uint64
+	Blocks    uint64
+	Bfree     uint64
+	Bavail    uint64
+	Files     uint64
+	Ffree     uint64
 }
+
+// Statfs reports capacity of the volume which contains overlay directory, since all writes go there.
 func (fs *MayakashiFS) Statfs(path string, stat *fuse.Statfs_t) int {
+	defer recoverHandler()
+	stat.Namemax = 255
+	// overlay directory might not be created yet, use nearest existing parent
+	dir := fs.OverlayDir
+	for {
+		vs, err := getVolumeStat(dir)
+		if err == nil {
+			stat.Bsize = vs.BlockSize
+			stat.Frsize = vs.BlockSize
+			stat.Blocks = vs.Blocks
+			stat.Bfree = vs.Bfree
+			stat.Bavail = vs.Bavail
+			stat.Files = vs.Files
+			stat.Ffree = vs.Ffree
+			stat.Favail = vs.Ffree
+			return 0
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			fmt.Println("failed to statfs overlay directory", fs.OverlayDir, err)
+			break
+		}
+		dir = parent
+	}
+
 	stat.Bfree = 0x_1000_0000
 	stat.Bavail = 0x_1000_0000
 	stat.Blocks = 0x_1000_0000
@@ -532,18 +1127,61 @@ func (fs *MayakashiFS) Statfs(path string, stat *fuse.Statfs_t) int {
 func (fs *MayakashiFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 	defer recoverHandler()
 	if path == "/" {
-		stat.Mode = fuse.S_IFDIR | 0777
+		GetFuseStatFromDirInfo(fs.Tree().Directories["/"], stat)
+		return 0
+	}
+
+	if !fs.DisableControlDir && isControlPath(path) {
+		return fs.controlGetattr(path, stat, fh)
+	}
+
+	// fast path: answer from opened handle
+	if fp, ok := fs.OverlayFileHandlers.Load(fh); ok {
+		if us, err := fp.File.Stat(); err == nil {
+			stat.Mode = fuse.S_IFREG | 0777
+			stat.Size = us.Size()
+			stat.Ctim = fuse.NewTimespec(us.ModTime())
+			stat.Mtim = fuse.NewTimespec(us.ModTime())
+			if meta := fs.loadOverlayMeta(path); meta != nil {
+				meta.applyOwnership(stat)
+			}
+			return 0
+		}
+	}
+	if af, ok := fs.ArchiveFileHandlers.Load(fh); ok {
+		*stat = af.Stat
+		return 0
+	}
+	if cf, ok := fs.CompressedFileHandlers.Load(fh); ok {
+		*stat = cf.Stat
+		return 0
+	}
+	if fs.isZoneIdentifierSink(fh) {
+		getZoneIdentifierSinkStat(stat)
+		return 0
+	}
+
+	if fs.isHiddenPath(path) {
+		return -fuse.ENOENT
+	}
+
+	if fs.isStubPath(path) {
+		stat.Mode = fuse.S_IFREG | 0444
 		return 0
 	}
 
-	if strings.Contains(path, "/UnityCrashHandler64.exe") {
+	tree := fs.Tree()
+	missing, negGeneration := fs.NegativeCache.lookup(tree, path)
+	if missing {
 		return -fuse.ENOENT
 	}
 
 	overlayPath := fs.getOverlayPath(path)
-	if overlayPath != nil {
-		if us, err := os.Stat(*overlayPath); err == nil {
-			if us.IsDir() {
+	if overlayPath != nil && fs.OverlayIndex.mayHave(path) {
+		if us, err := os.Lstat(*overlayPath); err == nil {
+			if us.Mode()&os.ModeSymlink != 0 {
+				getOverlaySymlinkStat(*overlayPath, us, stat)
+			} else if us.IsDir() {
 				stat.Mode = fuse.S_IFDIR | 0777
 			} else {
 				stat.Mode = fuse.S_IFREG | 0777
@@ -551,71 +1189,204 @@ func (fs *MayakashiFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 			}
 			stat.Ctim = fuse.NewTimespec(us.ModTime())
 			stat.Mtim = fuse.NewTimespec(us.ModTime())
+			if meta := fs.loadOverlayMeta(path); meta != nil {
+				meta.applyOwnership(stat)
+			}
+			return 0
+		} else if fs.statCompressedOverlay(path, *overlayPath, stat) {
+			if meta := fs.loadOverlayMeta(path); meta != nil {
+				meta.applyOwnership(stat)
+			}
 			return 0
 		} else {
 			// println("failed to stat", overlayPath, err)
 		}
 	}
 
-	// fmt.Println("getattr", path)
-
-	if file, ok := fs.Files[NormalizeString(path)]; ok {
-		whiteoutPath := fs.getOverlayWhiteoutPath(path)
-		_, err := os.Stat(*whiteoutPath)
-		if err == nil {
-			return -fuse.ENOENT
+	if file, ok := tree.Files[mayafs.NormalizeString(path)]; ok {
+		if fs.OverlayIndex.mayHave(path) {
+			whiteoutPath := fs.getOverlayWhiteoutPath(path)
+			_, err := os.Stat(*whiteoutPath)
+			if err == nil {
+				fs.NegativeCache.add(tree, negGeneration, path)
+				return -fuse.ENOENT
+			}
 		}
 		GetFuseStatFromFileInfo(&file, stat)
+		if meta := fs.loadOverlayMeta(path); meta != nil {
+			meta.applyTimes(stat)
+			meta.applyOwnership(stat)
+		}
 		return 0
 	}
 
-	dir := fs.Directories[NormalizeString(path)]
+	dir := tree.Directories[mayafs.NormalizeString(path)]
 
 	if dir != nil {
-		stat.Mode = fuse.S_IFDIR | 0777
+		GetFuseStatFromDirInfo(dir, stat)
+		if meta := fs.loadOverlayMeta(path); meta != nil {
+			meta.applyOwnership(stat)
+		}
 		return 0
 	}
 
-	if !strings.Contains(path, "/._") && overlayPath != nil {
-		// fmt.Println("getattr but failed", path)
-	}
+	fs.NegativeCache.add(tree, negGeneration, path)
 	return -fuse.ENOENT
 }
 
+// Readlink returns target of symbolic link which is in overlay directory or recorded in archive.
+func (fs *MayakashiFS) Readlink(path string) (int, string) {
+	defer recoverHandler()
+	// also checks whiteout and overlay files which hide links in archive
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(path, &stat, ^uint64(0)); errc != 0 {
+		return errc, ""
+	}
+	if stat.Mode&fuse.S_IFMT != fuse.S_IFLNK {
+		return -fuse.EINVAL, ""
+	}
+	if overlayPath := fs.getOverlayPath(path); overlayPath != nil {
+		if target, ok := readOverlaySymlink(*overlayPath); ok {
+			return 0, target
+		}
+	}
+	file, ok := fs.Tree().Files[mayafs.NormalizeString(path)]
+	if !ok {
+		return -fuse.ENOENT, ""
+	}
+	return 0, file.SymlinkTarget()
+}
+
+type DirEntry struct {
+	Name string
+	Stat *fuse.Stat_t
+}
+
+// Opendir snapshots merged listing of directory, so following Readdir calls with this handle
+// returns consistent result without listing overlay directory again.
+func (fs *MayakashiFS) Opendir(path string) (int, uint64) {
+	defer recoverHandler()
+	if path != "/" && fs.isHiddenPath(path) {
+		return -fuse.ENOENT, 0
+	}
+	entries := []DirEntry{}
+	errc := fs.readdirInternally(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		entry := DirEntry{Name: name}
+		if stat != nil {
+			s := *stat
+			entry.Stat = &s
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	if errc != 0 {
+		return errc, 0
+	}
+	oc := fs.OverlayCount.Add(1)
+	fs.DirHandlers.Store(oc, entries)
+	return 0, oc
+}
+
+func (fs *MayakashiFS) Releasedir(path string, fh uint64) int {
+	fs.DirHandlers.Delete(fh)
+	return 0
+}
+
 func (fs *MayakashiFS) Readdir(path string,
 	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
 	ofst int64,
 	fh uint64) int {
 	defer recoverHandler()
-	println("listing", path)
+	if entries, ok := fs.DirHandlers.Load(fh); ok {
+		for _, entry := range entries {
+			if !fill(entry.Name, entry.Stat, 0) {
+				break
+			}
+		}
+		return 0
+	}
+	return fs.readdirInternally(path, fill)
+}
+
+func (fs *MayakashiFS) readdirInternally(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool) int {
+	fs.logDebug("listing", path)
+	if !fs.DisableControlDir && isControlPath(path) {
+		return fs.controlReaddir(path, fill)
+	}
 	fill(".", nil, 0)
 	fill("..", nil, 0)
 
+	if len(fs.HideGlobs) != 0 || len(fs.StubGlobs) != 0 {
+		dirPath := strings.TrimSuffix(path, "/")
+		fillAll := fill
+		fill = func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			childPath := dirPath + "/" + name
+			if fs.isHiddenPath(childPath) {
+				return true
+			}
+			if stat != nil && stat.Mode&fuse.S_IFMT == fuse.S_IFREG && fs.isStubPath(childPath) {
+				stat = &fuse.Stat_t{Mode: fuse.S_IFREG | 0444}
+			}
+			return fillAll(name, stat, ofst)
+		}
+	}
+
 	filenames := map[string]struct{}{}
-	filenames["unitycrashhandler64.exe"] = struct{}{}
+	hasMeta := map[string]struct{}{}
+	if path == "/" && !fs.DisableControlDir {
+		var stat fuse.Stat_t
+		fs.controlGetattr(CONTROL_DIR, &stat, ^uint64(0))
+		fill(CONTROL_DIR[1:], &stat, 0)
+		filenames[CONTROL_DIR[1:]] = struct{}{}
+	}
 	haveSomeFilesInOverlay := false
 
-	if overlayPath := fs.getOverlayPath(path); overlayPath != nil {
+	if overlayPath := fs.getOverlayPath(path); overlayPath != nil && fs.OverlayIndex.mayHave(path) {
 		files, err := ioutil.ReadDir(*overlayPath)
 		if err == nil {
 			haveSomeFilesInOverlay = true
+			for _, file := range files {
+				filename := file.Name()
+				if strings.HasSuffix(filename, META_SUFFIX) {
+					hasMeta[mayafs.NormalizeString(filename[:len(filename)-len(META_SUFFIX)])] = struct{}{}
+				}
+			}
 			for _, file := range files {
 				// println("readdir", path, file.Name())
 				filename := file.Name()
-				if strings.HasSuffix(filename, WHITEOUT_SUFFIX) {
-					filenames[NormalizeString(filename[:len(filename)-len(WHITEOUT_SUFFIX)])] = struct{}{}
+				if strings.HasSuffix(filename, mayafs.WHITEOUT_SUFFIX) {
+					filenames[mayafs.NormalizeString(filename[:len(filename)-len(mayafs.WHITEOUT_SUFFIX)])] = struct{}{}
+					continue
+				}
+				if strings.HasSuffix(filename, META_SUFFIX) {
 					continue
 				}
-				filenames[NormalizeString(file.Name())] = struct{}{}
 				var stat fuse.Stat_t
-				if file.IsDir() {
+				if strings.HasSuffix(filename, COMPRESSED_SUFFIX) {
+					filename = filename[:len(filename)-len(COMPRESSED_SUFFIX)]
+					if _, ok := filenames[mayafs.NormalizeString(filename)]; ok {
+						continue
+					}
+					if !fs.statCompressedOverlay(path+"/"+filename, *overlayPath+"/"+filename, &stat) {
+						continue
+					}
+				} else if file.Mode()&os.ModeSymlink != 0 {
+					getOverlaySymlinkStat(*overlayPath+"/"+filename, file, &stat)
+				} else if file.IsDir() {
 					stat.Mode = fuse.S_IFDIR | 0777
 				} else {
 					stat.Mode = fuse.S_IFREG | 0777
 					stat.Size = file.Size()
 					stat.Mtim = fuse.NewTimespec(file.ModTime())
 				}
-				fill(file.Name(), &stat, 0)
+				filenames[mayafs.NormalizeString(filename)] = struct{}{}
+				if _, ok := hasMeta[mayafs.NormalizeString(filename)]; ok {
+					if meta := fs.loadOverlayMeta(path + "/" + filename); meta != nil {
+						meta.applyOwnership(&stat)
+					}
+				}
+				fill(filename, &stat, 0)
 				// println("fill", "overlay", file.Name())
 			}
 		} else if !os.IsNotExist(err) {
@@ -623,11 +1394,13 @@ func (fs *MayakashiFS) Readdir(path string,
 		}
 	}
 
-	dirInfo, ok := fs.Directories[NormalizeString(path)]
+	// use same snapshot for whole listing
+	tree := fs.Tree()
+	dirInfo, ok := tree.Directories[mayafs.NormalizeString(path)]
 
 	if !ok {
 		if !haveSomeFilesInOverlay {
-			println("readdir: dir not found", path)
+			fs.logDebug("readdir: dir not found", path)
 			return -fuse.ENOENT
 		}
 		return 0
@@ -635,20 +1408,32 @@ func (fs *MayakashiFS) Readdir(path string,
 
 	for _, dir := range dirInfo.Directories {
 		var stat fuse.Stat_t
-		stat.Mode = fuse.S_IFDIR | 0777
+		GetFuseStatFromDirInfo(tree.Directories[mayafs.NormalizeString(dir)], &stat)
 		dirname := dir[strings.LastIndex(dir, "/")+1:]
-		if _, ok := filenames[NormalizeString(dirname)]; !ok {
+		if _, ok := hasMeta[mayafs.NormalizeString(dirname)]; ok {
+			if meta := fs.loadOverlayMeta(path + "/" + dirname); meta != nil {
+				meta.applyOwnership(&stat)
+			}
+		}
+		if _, ok := filenames[mayafs.NormalizeString(dirname)]; !ok {
 			fill(dirname, &stat, 0)
 			// println("fill", "dir", dirname)
 		}
 	}
-	for _, file := range dirInfo.Files {
-		file := fs.Files[NormalizeString(file)]
+	for _, filePath := range dirInfo.Files {
+		file := tree.Files[mayafs.NormalizeString(filePath)]
 		// println(file.Entry.Info.Path)
 		var stat fuse.Stat_t
 		GetFuseStatFromFileInfo(&file, &stat)
-		filename := file.GetFilename()
-		if _, ok := filenames[NormalizeString(filename)]; !ok {
+		// not file.GetFilename(), since aliased file has different name from its entry
+		filename := filePath[strings.LastIndex(filePath, "/")+1:]
+		if _, ok := hasMeta[mayafs.NormalizeString(filename)]; ok {
+			if meta := fs.loadOverlayMeta(path + "/" + filename); meta != nil {
+				meta.applyTimes(&stat)
+				meta.applyOwnership(&stat)
+			}
+		}
+		if _, ok := filenames[mayafs.NormalizeString(filename)]; !ok {
 			fill(filename, &stat, 0)
 			// println("fill", "file", filename)
 		}
@@ -659,116 +1444,153 @@ func (fs *MayakashiFS) Readdir(path string,
 
 func (fs *MayakashiFS) Open(path string, flags int) (int, uint64) {
 	defer recoverHandler()
-	// println("open", path, flags)
 
-	if strings.Contains(path, "/UnityCrashHandler64.exe") {
+	if !fs.DisableControlDir && isControlPath(path) {
+		return fs.controlOpen(path, flags)
+	}
+
+	if fs.isHiddenPath(path) {
 		return -fuse.ENOENT, 0
 	}
 
+	if fs.shouldDropZoneIdentifier(path) && (flags&(fuse.O_WRONLY|fuse.O_RDWR|fuse.O_CREAT) != 0) {
+		return fs.openZoneIdentifierSink(path)
+	}
+
+	// some hosts pass O_CREAT to Open instead of calling Create
+	if flags&fuse.O_CREAT != 0 {
+		if fs.Getattr(path, &fuse.Stat_t{}, ^uint64(0)) != 0 {
+			return fs.Create(path, flags, 0644)
+		}
+		if flags&fuse.O_EXCL != 0 {
+			return -fuse.EEXIST, 0
+		}
+		flags &^= fuse.O_CREAT | fuse.O_EXCL
+	}
+
+	if fs.isStubPath(path) {
+		if (flags&fuse.O_WRONLY != 0) || (flags&fuse.O_RDWR != 0) {
+			return -fuse.EROFS, 0
+		}
+		return 0, fs.Count.Add(1)
+	}
+
 	overlayPath := fs.getOverlayPath(path)
 	mayWantsWrite := false
 	if (flags&fuse.O_WRONLY != 0) || (flags&fuse.O_RDWR != 0) {
 		mayWantsWrite = true
 	}
-	if overlayPath != nil {
-		nativeFlag := os.O_RDONLY
-		if mayWantsWrite {
-			nativeFlag |= os.O_RDWR
-		}
-		if flags&fuse.O_APPEND == fuse.O_APPEND {
-			nativeFlag |= os.O_APPEND
-		}
-		if mayWantsWrite {
-			os.MkdirAll((*overlayPath)[:strings.LastIndex(*overlayPath, "/")], 0777)
-		}
-		fp, err := os.OpenFile(*overlayPath, nativeFlag, 0644)
-		if err == nil {
-			fs.removeWhiteout(path)
-			// println("open overlay", overlayPath, nativeFlag)
-			fs.OverlayCount += 1
-			oc := fs.OverlayCount
-			println("open overlay", path, oc)
-			fs.OverlayFileHandlers.Store(oc, &SharedFileHandler{
-				File:         fp,
-				IsAppendMode: flags&fuse.O_APPEND != 0,
-			})
-			return 0, oc
-		}
-		if !os.IsNotExist(err) {
-			fmt.Println("failed to open overlay", path, err)
-			return -fuse.EIO, 0
+	sizeAtOpen := int64(0)
+	if mayWantsWrite && fs.AuditLog != nil {
+		sizeAtOpen = fs.auditFileSize(path)
+	}
+	if mayWantsWrite {
+		// file will be copied up
+		fs.OverlayIndex.touch(path)
+	}
+	if overlayPath != nil && fs.OverlayIndex.mayHave(path) {
+		if errc, fh, ok := fs.openOverlayFile(path, *overlayPath, flags); ok {
+			if file, ok := fs.OverlayFileHandlers.Load(fh); ok && errc == 0 {
+				file.SizeAtOpen = sizeAtOpen
+			}
+			return errc, fh
 		}
 	}
 
-	if _, ok := fs.Files[NormalizeString(path)]; ok {
-		if whiteoutPath := fs.getOverlayWhiteoutPath(path); whiteoutPath != nil {
+	if _, ok := fs.Tree().Files[mayafs.NormalizeString(path)]; ok {
+		if whiteoutPath := fs.getOverlayWhiteoutPath(path); whiteoutPath != nil && fs.OverlayIndex.mayHave(path) {
 			_, err := os.Stat(*whiteoutPath)
 			if err == nil {
 				return -fuse.ENOENT, 0
 			}
 		}
 		if mayWantsWrite {
-			println("not read-only, copy...", path, flags)
+			fs.logDebug("not read-only, copy...", path, flags)
 			// We need to copy the file to overlay
 			if overlayPath != nil {
-				os.MkdirAll((*overlayPath)[:strings.LastIndex(*overlayPath, "/")], 0777)
-				fp, err := os.Create(*overlayPath + WRITEBACK_SUFFIX)
-				if err != nil {
-					println("failed to create writeback overlay", err)
-					return -fuse.EIO, 0
-				}
-				needsCopy := (flags & fuse.O_TRUNC) == 0
-				failed := false
-				if needsCopy {
-					buf := make([]byte, 32768)
-					cp := int64(0)
-					for {
-						readed := fs.Read(path, buf, cp, 0x7FFF_FFFF)
-						if readed < 0 {
-							println("failed to read", readed)
-							failed = true
-							break
-						}
-						if readed == 0 {
-							break
-						}
-						fp.Write(buf[:readed])
-						cp += int64(readed)
-					}
-				}
-				if !failed {
-					err = fp.Close()
-					if err != nil {
-						println("failed to close writeback overlay", err)
-						failed = true
-					}
-				}
-				if !failed {
-					err = os.Rename(*overlayPath+WRITEBACK_SUFFIX, *overlayPath)
-					if err != nil {
-						println("failed to rename writeback overlay", err)
-						failed = true
-					}
+				if errc := fs.copyUpFile(path, *overlayPath, (flags&fuse.O_TRUNC) == 0); errc != 0 {
+					return errc, 0
 				}
-				if failed {
-					os.Remove(*overlayPath + WRITEBACK_SUFFIX)
-					return -fuse.EIO, 0
+				fs.logDebug("try to reopen", path, flags)
+				errc, fh := fs.Open(path, flags)
+				if file, ok := fs.OverlayFileHandlers.Load(fh); ok && errc == 0 {
+					// size before copy up, which might truncate the file
+					file.SizeAtOpen = sizeAtOpen
 				}
-				println("try to reopen", path, flags)
-				return fs.Open(path, flags)
+				return errc, fh
 			}
 			// return -fuse.EROFS, 0
 		}
 		// println("open", path)
-		fs.Count += 1
+		fh := fs.Count.Add(1)
 		fs.LastDatRead = time.Now()
-		return 0, uint64(fs.Count)
+		handler := &ArchiveFileHandler{Path: path}
+		if errc := fs.Getattr(path, &handler.Stat, ^uint64(0)); errc == 0 {
+			fs.ArchiveFileHandlers.Store(fh, handler)
+		}
+		return 0, fh
 	}
 
-	println("not found", path)
+	fs.logDebug("not found", path)
 	return -fuse.ENOENT, 0
 }
 
+// openOverlayFile opens file in overlay directory (or compressed one), and returns false if it doesn't exist.
+func (fs *MayakashiFS) openOverlayFile(path string, overlayPath string, flags int) (int, uint64, bool) {
+	mayWantsWrite := (flags&fuse.O_WRONLY != 0) || (flags&fuse.O_RDWR != 0)
+	compressible := fs.isCompressiblePath(path)
+	if compressible {
+		// file must not be compressed while opening
+		unlock := fs.OverlayCompressLocks.Lock(path)
+		defer unlock()
+		if mayWantsWrite {
+			if errc := fs.decompressOverlay(path, overlayPath); errc != 0 {
+				return errc, 0, true
+			}
+		}
+	}
+
+	nativeFlag := os.O_RDONLY
+	if mayWantsWrite {
+		nativeFlag |= os.O_RDWR
+	}
+	if flags&fuse.O_APPEND == fuse.O_APPEND {
+		nativeFlag |= os.O_APPEND
+	}
+	if mayWantsWrite && flags&fuse.O_TRUNC != 0 {
+		nativeFlag |= os.O_TRUNC
+	}
+	if mayWantsWrite {
+		os.MkdirAll(overlayPath[:strings.LastIndex(overlayPath, "/")], 0777)
+	}
+	truncatedSize := int64(0)
+	if nativeFlag&os.O_TRUNC != 0 && fs.OverlayQuota != nil {
+		truncatedSize = overlayFileSize(overlayPath)
+	}
+	fp, err := os.OpenFile(overlayPath, nativeFlag, 0644)
+	if err == nil {
+		fs.OverlayQuota.Shrink(truncatedSize)
+		fs.removeWhiteout(path)
+		// println("open overlay", overlayPath, nativeFlag)
+		oc := fs.OverlayCount.Add(1)
+		fs.logDebug("open overlay", path, oc)
+		fs.OverlayFileHandlers.Store(oc, &SharedFileHandler{
+			File:         fp,
+			Path:         path,
+			IsAppendMode: flags&fuse.O_APPEND != 0,
+			Written:      nativeFlag&os.O_TRUNC != 0,
+		})
+		return 0, oc, true
+	}
+	if !os.IsNotExist(err) {
+		return fs.overlayWriteError("open overlay", path, err), 0, true
+	}
+	if compressible && !mayWantsWrite {
+		return fs.openCompressedOverlay(path, overlayPath)
+	}
+	return 0, 0, false
+}
+
 func (fs *MayakashiFS) Read(path string, buff []byte, offset int64, fh uint64) int {
 	defer recoverHandler()
 	readed := fs.readInternally(path, buff, offset, fh)
@@ -786,278 +1608,182 @@ func (fs *MayakashiFS) Read(path string, buff []byte, offset int64, fh uint64) i
 }
 
 func (fs *MayakashiFS) readInternally(path string, buff []byte, offset int64, fh uint64) int {
-	if fp, ok := fs.OverlayFileHandlers.Load(fh); ok {
-		fp.Mutex.Lock()
-		defer fp.Mutex.Unlock()
-		fp.File.Seek(offset, 0)
-		readed, err := fp.File.Read(buff)
-		if err == io.EOF {
+	if cf, ok := fs.ControlFileHandlers.Load(fh); ok {
+		if offset >= int64(len(cf.Content)) {
 			return 0
 		}
-		if err != nil {
-			fmt.Println("failed to ReadAt", err)
-			return -fuse.EIO
-		}
-		// println("reading from overlay", path, offset, len(buff), readed)
-		return readed
-	}
-	// println("read", path, offset, len(buff), fh)
-
-	file, ok := fs.Files[NormalizeString(path)]
-	if !ok {
-		println("read not found", path)
-		return -fuse.ENOENT
-	}
-
-	if file.ZipEntry != nil {
-		return fs.readInternalFromZipEntry(path, buff, offset, fh, &file)
-	} else if file.MarEntry != nil {
-		return fs.readInternalFromMarEntry(path, buff, offset, fh, &file)
+		return copy(buff, cf.Content[offset:])
 	}
-
-	fmt.Println("there is no known file entry", file)
-	return -fuse.EIO
-}
-
-func (fs *MayakashiFS) readInternalFromZipEntry(path string, buff []byte, offset int64, fh uint64, file *FileInfo) int {
-	entry := file.ZipEntry
-	if offset >= entry.FileInfo().Size() {
+	if fs.isStubPath(path) || fs.isZoneIdentifierSink(fh) {
 		return 0
 	}
-	// If entry is not compressed, we can use OpenRaw() to read without decompressing, which reduces resource usage.
-	if entry.Method == 0 {
-		reader, err := entry.OpenRaw()
-		if err != nil {
-			fmt.Println("failed to open zip entry", err)
-			return -fuse.EIO
-		}
-		r := reader.(io.ReadSeeker)
-		_, err = r.Seek(offset, 0)
-		if err != nil {
-			fmt.Println("failed to seek zip entry", err)
-			return -fuse.EIO
-		}
-		readed, err := r.Read(buff)
-		if err == io.EOF {
-			return 0
-		}
+	if cf, ok := fs.CompressedFileHandlers.Load(fh); ok {
+		readed, err := fs.ReadZstAt(cf.Archive, buff, offset)
 		if err != nil {
-			fmt.Println("failed to read zip (direct)", err)
-			return -fuse.EIO
-		}
-		return readed
-	}
-
-	// check cache to avoid decompressing
-	zipoffset, err := entry.DataOffset()
-	if err != nil {
-		fmt.Println("failed to get data offset", err)
-		return -fuse.EIO
-	}
-	cache, ok := fs.ChunkCache.Get(fmt.Sprintf("%s#%d+%d", file.ArchiveFile, zipoffset, entry.CompressedSize64))
-	if ok {
-		decoded := cache.(*ChunkCache).Data
-		readed := copy(buff, decoded[offset:])
-		return readed
-	}
-
-	reader, err := entry.Open()
-	if err != nil {
-		fmt.Println("failed to open zip entry", err)
-		return -fuse.EIO
-	}
-	defer reader.Close()
-
-	dst := make([]byte, entry.UncompressedSize64)
-	_, err = io.ReadFull(reader, dst)
-	if err != nil {
-		fmt.Println("failed to read zip data", err)
-		return -fuse.EIO
-	}
-
-	fs.ChunkCache.Set(fmt.Sprintf("%s#%d+%d", file.ArchiveFile, zipoffset, entry.CompressedSize64), &ChunkCache{
-		Data: dst,
-	}, int64(len(dst)))
-
-	readed := copy(buff, dst[offset:])
-
-	return readed
-}
-
-func (fs *MayakashiFS) readInternalFromMarEntry(path string, buff []byte, offset int64, fh uint64, file *FileInfo) int {
-	entry := file.MarEntry
-	chunkStart := int64(0)
-	datStart := int64(entry.BodyOffset)
-	chunkNo := -1
-	var targetChunk *pb.ChunkInfo
-	for cn, chunk := range entry.Info.Chunks {
-		if offset < (chunkStart + int64(chunk.OriginalLength)) {
-			targetChunk = chunk
-			chunkNo = cn
-			// println("chunk number", cn, chunk.CompressedLength, chunk.OriginalLength, chunk.CompressedMethod, datStart)
-			break
-		}
-		chunkStart += int64(chunk.OriginalLength)
-		datStart += int64(chunk.CompressedLength)
-	}
-
-	if targetChunk == nil {
-		// fmt.Println("chunk not found", path, offset, chunkStart)
-		return 0
-	}
-
-	var marFileName string
-	if entry.FileIndex == 0 {
-		marFileName = file.ArchiveFile + ".dat"
-	} else {
-		marFileName = fmt.Sprintf("%s.%d.dat", file.ArchiveFile, entry.FileIndex)
-	}
-
-	pool := GetFilePoolFromPath(marFileName)
-
-	if targetChunk.CompressedMethod != pb.CompressedMethod_PASSTHROUGH {
-		// println("zstd")
-		cacheKey := fmt.Sprintf("%s#%d#%d", marFileName, datStart, chunkNo)
-		cachedData, ok := fs.ChunkCache.Get(cacheKey)
-		var decoded []byte
-		if ok {
-			// println("cache hit")
-			decoded = cachedData.(*ChunkCache).Data
-		} else {
-			compressedBytes := make([]byte, targetChunk.CompressedLength)
-			start := time.Now()
-			fs.LastDatRead = start
-			if _, err := pool.ReadAt(compressedBytes, datStart); err != nil {
-				println("failed to ReadAt compressed data", err)
-				return -fuse.EIO
-			}
-			used := time.Since(start)
-			if used.Milliseconds() > 40 && fs.SlowReadLog != nil {
-				fs.SlowReadLog.Write([]byte(path + "\n"))
-			}
-
-			res := fs.readChunk(targetChunk, &compressedBytes, &decoded)
-			if res != 0 {
-				return res
-			}
-
-			fs.ChunkCache.Set(cacheKey, &ChunkCache{
-				ChunkNo: chunkNo,
-				Data:    decoded,
-			}, int64(len(decoded)))
-		}
-
-		if offset < chunkStart {
-			println("offset < chunkStart", path, offset, chunkStart)
+			fmt.Println("failed to read compressed overlay", path, err)
 			return -fuse.EIO
 		}
-
-		decoded = decoded[offset-chunkStart:]
-
-		readed := copy(buff, decoded)
-
-		// println("ok")
-
 		return readed
 	}
-	// passthrough
-	// println("passthrough", path)
-	remainsLength := int(targetChunk.OriginalLength) - int(offset-chunkStart)
-	if len(buff) > remainsLength {
-		// fmt.Println("!!!OVERLOAD!!!", len(buff), remainsLength)
-		buff = buff[:remainsLength]
-	}
-	readed, err := pool.ReadAt(buff, datStart+(offset-chunkStart))
-	if err != nil {
-		fmt.Println("failed to read from passthrough", err)
-		return -fuse.EIO
-	}
-	return readed
-}
-
-func (fs *MayakashiFS) readChunk(targetChunk *pb.ChunkInfo, compressedBytes *[]byte, decoded *[]byte) int {
-	if targetChunk.CompressedMethod == pb.CompressedMethod_ZSTANDARD {
-		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if fp, ok := fs.OverlayFileHandlers.Load(fh); ok {
+		fp.Mutex.Lock()
+		defer fp.Mutex.Unlock()
+		fp.File.Seek(offset, 0)
+		readed, err := fp.File.Read(buff)
+		if err == io.EOF {
+			return 0
+		}
 		if err != nil {
-			println("failed to read", err)
+			fmt.Println("failed to ReadAt", err)
 			return -fuse.EIO
 		}
+		// println("reading from overlay", path, offset, len(buff), readed)
+		return readed
+	}
 
-		*decoded, err = decoder.DecodeAll(*compressedBytes, make([]byte, 0, int(targetChunk.OriginalLength)))
-		if err != nil {
-			println("failed to decode", err)
-			return -fuse.EIO
+	readed, coalesced := 0, false
+	if af, ok := fs.ArchiveFileHandlers.Load(fh); ok {
+		readed, coalesced = fs.readCoalesced(&af.coalescer, path, buff, offset)
+	}
+	if !coalesced {
+		var err error
+		readed, err = fs.ReadFileAt(path, buff, offset)
+		if errors.Is(err, os.ErrNotExist) {
+			fs.logDebug("read not found", path)
+			return -fuse.ENOENT
 		}
-	} else if targetChunk.CompressedMethod == pb.CompressedMethod_LZ4 {
-		*decoded = make([]byte, targetChunk.OriginalLength)
-		decoded_size, err := lz4.UncompressBlock(*compressedBytes, *decoded)
 		if err != nil {
-			println("failed to uncompress lz4 block", err)
-			return -fuse.EIO
-		}
-		if uint32(decoded_size) != targetChunk.OriginalLength {
-			println("invalid decoded size", decoded_size, targetChunk.OriginalLength)
+			fmt.Println("failed to read", path, err)
 			return -fuse.EIO
 		}
-		return 0
-	} else {
-		println("unknown compression method", targetChunk.CompressedMethod)
-		return -fuse.EIO
 	}
-
-	return 0
+	if fs.Recorder != nil {
+		fs.Recorder.Record(mayafs.NormalizeString(path), offset, readed)
+	}
+	return readed
 }
 
 func (fs *MayakashiFS) Mkdir(path string, mode uint32) int {
 	defer recoverHandler()
-	println("mkdir", path, mode)
+	fs.logDebug("mkdir", path, mode)
 	overlayPath := fs.getOverlayPath(path)
 	if overlayPath == nil {
 		fmt.Println("mkdir requested but this path is not overlay")
 		return -fuse.EROFS
 	}
+	fs.OverlayIndex.touch(path)
 	err := os.MkdirAll(*overlayPath, 0777)
 	if os.IsExist(err) {
 		fmt.Println("mkdir requested but already exists", path)
 		return -fuse.EEXIST
 	}
 	if err != nil {
-		fmt.Println("failed to mkdir", err)
-		return -fuse.EIO
+		return fs.overlayWriteError("mkdir", path, err)
+	}
+	fs.NegativeCache.clear()
+	return 0
+}
+
+// OpenEx is same as Open, but also sets cache behavior of opened file.
+func (fs *MayakashiFS) OpenEx(path string, fi *fuse.FileInfo_t) int {
+	errc, fh := fs.Open(path, fi.Flags)
+	if errc != 0 {
+		return errc
+	}
+	fi.Fh = fh
+	fs.setCacheBehavior(fi)
+	return 0
+}
+
+// CreateEx is same as Create, but also sets cache behavior of opened file.
+func (fs *MayakashiFS) CreateEx(path string, mode uint32, fi *fuse.FileInfo_t) int {
+	errc, fh := fs.Create(path, fi.Flags, mode)
+	if errc != 0 {
+		return errc
 	}
+	fi.Fh = fh
+	fs.setCacheBehavior(fi)
 	return 0
 }
 
+func (fs *MayakashiFS) setCacheBehavior(fi *fuse.FileInfo_t) {
+	if _, ok := fs.ControlFileHandlers.Load(fi.Fh); ok {
+		// content of control files are generated on open, and size in Getattr might be different
+		fi.DirectIo = true
+		return
+	}
+	fi.DirectIo = fs.DirectIO
+	if _, ok := fs.ArchiveFileHandlers.Load(fi.Fh); ok {
+		// archived files are immutable, so page cache can be kept between opens
+		fi.KeepCache = fs.KeepCache
+	}
+}
+
 func (fs *MayakashiFS) Create(path string, flags int, mode uint32) (int, uint64) {
 	defer recoverHandler()
+	if !fs.DisableControlDir && isControlPath(path) {
+		if fs.controlGetattr(path, &fuse.Stat_t{}, ^uint64(0)) == 0 && flags&fuse.O_EXCL == 0 {
+			return fs.controlOpen(path, flags)
+		}
+		return -fuse.EACCES, 0
+	}
+	if fs.shouldDropZoneIdentifier(path) {
+		return fs.openZoneIdentifierSink(path)
+	}
 	overlayPath := fs.getOverlayPath(path)
 	if overlayPath == nil {
 		fmt.Println("tried to write read-only path", path)
 		return -fuse.EROFS, 0
 	}
+	// path might be exists in any layer (e.g. archive), and Create might be called for it
+	if fs.Getattr(path, &fuse.Stat_t{}, ^uint64(0)) == 0 {
+		if flags&fuse.O_EXCL != 0 {
+			return -fuse.EEXIST, 0
+		}
+		return fs.Open(path, flags&^(fuse.O_CREAT|fuse.O_EXCL))
+	}
+	fs.OverlayIndex.touch(path)
 	err := os.MkdirAll((*overlayPath)[:strings.LastIndex(*overlayPath, "/")], 0777)
 	if err != nil {
-		println("failed to mkdir for create", err)
-		return -fuse.EIO, 0
+		return fs.overlayWriteError("mkdir for create", path, err), 0
 	}
-	println("create", path, flags, mode)
-	file, err := os.Create(*overlayPath)
+	fs.logDebug("create", path, flags, mode)
+	nativeFlag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if flags&fuse.O_APPEND != 0 {
+		nativeFlag |= os.O_APPEND
+	}
+	file, err := os.OpenFile(*overlayPath, nativeFlag, 0666)
 	if err != nil {
-		println("failed to create", err)
-		return -fuse.EIO, 0
+		return fs.overlayWriteError("create", path, err), 0
 	}
-	fs.OverlayCount += 1
-	oc := fs.OverlayCount
+	fs.removeWhiteout(path)
+	fs.AuditLog.Record(AuditEntry{Op: "create", Path: path})
+	oc := fs.OverlayCount.Add(1)
 	fs.OverlayFileHandlers.Store(oc, &SharedFileHandler{
-		File: file,
+		File:         file,
+		Path:         path,
+		IsAppendMode: flags&fuse.O_APPEND != 0,
+		Written:      true,
 	})
-	println("success", oc)
+	fs.logDebug("success", oc)
 	return 0, oc
 }
 
 func (fs *MayakashiFS) Write(path string, buff []byte, offset int64, fh uint64) int {
 	defer recoverHandler()
-	// println("write", path, offset, len(buff), fh)
+	if cf, ok := fs.ControlFileHandlers.Load(fh); ok {
+		if cf.File.Write == nil {
+			return -fuse.EBADF
+		}
+		if err := cf.File.Write(fs, buff); err != nil {
+			fmt.Println("failed to write control file", path, err)
+			return -fuse.EIO
+		}
+		return len(buff)
+	}
+	if fs.isZoneIdentifierSink(fh) {
+		return len(buff)
+	}
 	file, ok := fs.OverlayFileHandlers.Load(fh)
 	if !ok {
 		fmt.Println("not writable", path)
@@ -1065,15 +1791,31 @@ func (fs *MayakashiFS) Write(path string, buff []byte, offset int64, fh uint64)
 	}
 	file.Mutex.Lock()
 	defer file.Mutex.Unlock()
+	reserved := int64(0)
+	if fs.OverlayQuota != nil {
+		st, err := file.File.Stat()
+		if err != nil {
+			return fs.overlayWriteError("stat for quota", path, err)
+		}
+		// in append mode, offset is checked to be same as current size below
+		if end := offset + int64(len(buff)); end > st.Size() {
+			reserved = end - st.Size()
+			if !fs.OverlayQuota.Grow(reserved) {
+				return fs.overlayQuotaExceeded("write", path, reserved)
+			}
+		}
+	}
 	var err error
 	if file.IsAppendMode {
 		current, err2 := file.File.Seek(0, 2)
 		if err2 != nil {
 			fmt.Println("failed to seek for retriving current length on append mode", err2)
+			fs.OverlayQuota.Shrink(reserved)
 			return -fuse.EIO
 		}
 		if current != offset {
 			fmt.Println("using invalid offset on append mode", current, offset)
+			fs.OverlayQuota.Shrink(reserved)
 			return -fuse.EINVAL
 		}
 		_, err = file.File.Write(buff)
@@ -1081,35 +1823,71 @@ func (fs *MayakashiFS) Write(path string, buff []byte, offset int64, fh uint64)
 		_, err = file.File.WriteAt(buff, offset)
 	}
 	if err != nil {
-		fmt.Println("failed to write", err)
-		return -fuse.EIO
+		fs.OverlayQuota.Shrink(reserved)
+		return fs.overlayWriteError("write", path, err)
 	}
+	file.Written = true
+	file.WrittenBytes += int64(len(buff))
 	return len(buff)
 }
 
+func (fs *MayakashiFS) Destroy() {
+	if fs.Recorder != nil {
+		if err := fs.Recorder.Save(); err != nil {
+			fmt.Println("failed to save access record", err)
+		}
+	}
+	fs.saveHotCache()
+	if err := fs.HotStore.Save(); err != nil {
+		fmt.Println("failed to save hot store", err)
+	}
+	if err := fs.AuditLog.Close(); err != nil {
+		fmt.Println("failed to close audit log", err)
+	}
+}
+
 func (fs *MayakashiFS) Release(path string, fh uint64) int {
 	defer recoverHandler()
-	// println("release", path, fh)
+	fs.ControlFileHandlers.Delete(fh)
+	fs.ZoneIdentifierHandlers.Delete(fh)
+	if af, ok := fs.ArchiveFileHandlers.Load(fh); ok {
+		af.coalescer.release()
+		fs.ArchiveFileHandlers.Delete(fh)
+	}
+	if cf, ok := fs.CompressedFileHandlers.Load(fh); ok {
+		cf.File.Close()
+		fs.CompressedFileHandlers.Delete(fh)
+	}
 	if file, ok := fs.OverlayFileHandlers.Load(fh); ok {
 		file.Mutex.Lock()
 		defer file.Mutex.Unlock()
+		if file.Written && fs.AuditLog != nil {
+			entry := AuditEntry{Op: "write", Path: path, Bytes: file.WrittenBytes}
+			if st, err := file.File.Stat(); err == nil {
+				entry.SizeDelta = st.Size() - file.SizeAtOpen
+			}
+			fs.AuditLog.Record(entry)
+		}
 		file.File.Close()
 		fs.OverlayFileHandlers.Delete(fh)
-		if overlayPath, ok := fs.RemoveRequestedPaths.Load(NormalizeString(path)); ok {
-			err := os.Remove(overlayPath)
+		if file.Written && fs.isCompressiblePath(path) {
+			go fs.compressOverlay(path)
+		}
+		if overlayPath, ok := fs.RemoveRequestedPaths.Load(mayafs.NormalizeString(path)); ok {
+			err := fs.removeOverlayFile(overlayPath)
 			if err == nil {
 				fmt.Println("successfly remove scheduled files: ", path)
-				fs.RemoveRequestedPaths.Delete(NormalizeString(path))
+				fs.RemoveRequestedPaths.Delete(mayafs.NormalizeString(path))
 				fs.whiteoutIfNeeded(path)
 			} else {
 				fmt.Println("try to remove scheduled files: failed to remove", path, err)
 			}
 		}
-		if overlayPath, ok := fs.RenameRequestedPaths.Load(NormalizeString(path)); ok {
+		if overlayPath, ok := fs.RenameRequestedPaths.Load(mayafs.NormalizeString(path)); ok {
 			err := os.Rename(overlayPath.OldPath, overlayPath.NewPath)
 			if err == nil {
 				fmt.Println("successfly rename scheduled files: ", path)
-				fs.RenameRequestedPaths.Delete(NormalizeString(path))
+				fs.RenameRequestedPaths.Delete(mayafs.NormalizeString(path))
 				fs.whiteoutIfNeeded(overlayPath.OldPathInFuse)
 				fs.removeWhiteout(overlayPath.NewPathInFuse)
 			} else {
@@ -1122,7 +1900,6 @@ func (fs *MayakashiFS) Release(path string, fh uint64) int {
 
 func (fs *MayakashiFS) Access(path string, mask uint32) int {
 	defer recoverHandler()
-	// println("access", path, mask)
 	return 0
 }
 
@@ -1131,10 +1908,74 @@ func (fs *MayakashiFS) getOverlayWhiteoutPath(path string) *string {
 	if overlayPath == nil {
 		return nil
 	}
-	whiteoutPath := *overlayPath + WHITEOUT_SUFFIX
+	whiteoutPath := *overlayPath + mayafs.WHITEOUT_SUFFIX
 	return &whiteoutPath
 }
 
+// copyUpFile copies file in archive to overlayPath (or creates empty file if copyContent is false).
+// It writes to writeback file first, so overlayPath never contains partially copied file.
+func (fs *MayakashiFS) copyUpFile(path string, overlayPath string, copyContent bool) int {
+	reserved := int64(0)
+	if copyContent && fs.OverlayQuota != nil {
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(path, &stat, ^uint64(0)); errc != 0 {
+			return errc
+		}
+		if !fs.OverlayQuota.Grow(stat.Size) {
+			return fs.overlayQuotaExceeded("copy up", path, stat.Size)
+		}
+		reserved = stat.Size
+	}
+	os.MkdirAll(overlayPath[:strings.LastIndex(overlayPath, "/")], 0777)
+	fp, err := os.Create(overlayPath + mayafs.WRITEBACK_SUFFIX)
+	if err != nil {
+		fs.OverlayQuota.Shrink(reserved)
+		return fs.overlayWriteError("create writeback overlay", path, err)
+	}
+	failed := false
+	errc := -fuse.EIO
+	if copyContent {
+		buf := mayafs.GetBuffer(1 << 20)
+		defer mayafs.PutBuffer(buf)
+		cp := int64(0)
+		for {
+			readed := fs.Read(path, buf, cp, 0x7FFF_FFFF)
+			if readed < 0 {
+				println("failed to read", readed)
+				failed = true
+				break
+			}
+			if readed == 0 {
+				break
+			}
+			if _, err := fp.Write(buf[:readed]); err != nil {
+				errc = fs.overlayWriteError("write writeback overlay", path, err)
+				failed = true
+				break
+			}
+			cp += int64(readed)
+		}
+	}
+	// close even if failed, otherwise it can't be removed on Windows
+	if err := fp.Close(); err != nil && !failed {
+		errc = fs.overlayWriteError("close writeback overlay", path, err)
+		failed = true
+	}
+	if !failed {
+		err = os.Rename(overlayPath+mayafs.WRITEBACK_SUFFIX, overlayPath)
+		if err != nil {
+			println("failed to rename writeback overlay", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Remove(overlayPath + mayafs.WRITEBACK_SUFFIX)
+		fs.OverlayQuota.Shrink(reserved)
+		return errc
+	}
+	return 0
+}
+
 func (fs *MayakashiFS) whiteoutIfNeeded(path string) {
 	whiteoutPath := fs.getOverlayWhiteoutPath(path)
 	if whiteoutPath == nil {
@@ -1151,7 +1992,7 @@ func (fs *MayakashiFS) whiteoutIfNeeded(path string) {
 	}
 
 	// check actually we have a file in archive
-	if _, ok := fs.Files[NormalizeString(path)]; !ok {
+	if _, ok := fs.Tree().Files[mayafs.NormalizeString(path)]; !ok {
 		return
 	}
 
@@ -1178,21 +2019,42 @@ func (fs *MayakashiFS) removeWhiteout(path string) {
 	if err != nil && !os.IsNotExist(err) {
 		fmt.Println("failed to remove whiteout", err)
 	}
+	// called after path is created in overlay directory, which might be cached as missing
+	fs.NegativeCache.clear()
 }
 
 func (fs *MayakashiFS) Unlink(path string) int {
 	defer recoverHandler()
+	if fs.shouldDropZoneIdentifier(path) {
+		// it was never stored
+		return 0
+	}
 	if overlayPath := fs.getOverlayPath(path); overlayPath != nil {
-		err := os.Remove(*overlayPath)
+		// for whiteout
+		fs.OverlayIndex.touch(path)
+		if fs.AuditLog != nil {
+			fs.AuditLog.Record(AuditEntry{Op: "unlink", Path: path, SizeDelta: -fs.auditFileSize(path)})
+		}
+		fs.removeCompressedOverlay(path)
+		size := int64(0)
+		if fs.OverlayQuota != nil {
+			size = overlayFileSize(*overlayPath)
+		}
+		err := fs.removeOverlayFile(*overlayPath)
+		if err == nil {
+			fs.OverlayQuota.Shrink(size)
+		}
 		if os.IsNotExist(err) {
 			fs.whiteoutIfNeeded(path)
+			fs.removeOverlayMeta(path)
 			return 0
 		}
 		if err != nil {
 			fmt.Println("failed to remove, scheduled", err)
-			fs.RemoveRequestedPaths.Store(NormalizeString(path), *overlayPath)
+			fs.RemoveRequestedPaths.Store(mayafs.NormalizeString(path), *overlayPath)
 		}
 		fs.whiteoutIfNeeded(path)
+		fs.removeOverlayMeta(path)
 		return 0
 	}
 
@@ -1200,7 +2062,7 @@ func (fs *MayakashiFS) Unlink(path string) int {
 	return -fuse.EROFS
 }
 
-func (fs *MayakashiFS) Rename(oldpath_in_fuse string, newpath_in_fuse string) int {
+func (fs *MayakashiFS) Rename(oldpath_in_fuse string, newpath_in_fuse string) (errc int) {
 	defer recoverHandler()
 	oldPath := fs.getOverlayPath(oldpath_in_fuse)
 	if oldPath == nil {
@@ -1212,18 +2074,51 @@ func (fs *MayakashiFS) Rename(oldpath_in_fuse string, newpath_in_fuse string) in
 		fmt.Println("tried to rename but newpath is read-only", oldpath_in_fuse, newpath_in_fuse)
 		return -fuse.EROFS
 	}
+	if _, ok := fs.Tree().Directories[mayafs.NormalizeString(oldpath_in_fuse)]; ok {
+		// renaming only overlay part leaves contents in archive behind,
+		// copying whole directory is too heavy for single rename, mv(1) and most tools fall back to copy and delete
+		fmt.Println("tried to rename directory in archive", oldpath_in_fuse, newpath_in_fuse)
+		return -fuse.EXDEV
+	}
+	if errc := fs.ensurePlainOverlay(oldpath_in_fuse); errc != 0 {
+		return errc
+	}
+	// old path gets whiteout, and contents of renamed directory appear under new path
+	fs.OverlayIndex.touch(oldpath_in_fuse)
+	if err := fs.OverlayIndex.touchTree(newpath_in_fuse, *oldPath); err != nil {
+		fmt.Println("failed to index renamed overlay", oldpath_in_fuse, err)
+	}
+	if fs.AuditLog != nil {
+		// size of replaced file is lost
+		replacedSize := fs.auditFileSize(newpath_in_fuse)
+		defer func() {
+			if errc == 0 {
+				fs.AuditLog.Record(AuditEntry{Op: "rename", Path: oldpath_in_fuse, NewPath: newpath_in_fuse, SizeDelta: -replacedSize})
+			}
+		}()
+	}
 	err := os.Rename(*oldPath, *newPath)
+	if err == nil {
+		// replaced by renamed file
+		fs.removeCompressedOverlay(newpath_in_fuse)
+	}
 	if err != nil {
 		if os.IsPermission(err) {
 			fmt.Println("tried to rename but read-only", oldpath_in_fuse, newpath_in_fuse)
 			return -fuse.EPERM
 		}
 		if os.IsNotExist(err) {
-			fmt.Println("tried to rename but not found (maybe from archive?)", oldpath_in_fuse, newpath_in_fuse)
-			return -fuse.ENOENT
+			errc := fs.renameFromArchive(oldpath_in_fuse, newpath_in_fuse, *oldPath, *newPath)
+			if errc != 0 {
+				return errc
+			}
+			fs.whiteoutIfNeeded(oldpath_in_fuse)
+			fs.removeWhiteout(newpath_in_fuse)
+			fs.renameOverlayMeta(oldpath_in_fuse, newpath_in_fuse)
+			return 0
 		}
 		fmt.Println("failed to rename, queued", err)
-		fs.RenameRequestedPaths.Store(NormalizeString(oldpath_in_fuse), RenameRequest{
+		fs.RenameRequestedPaths.Store(mayafs.NormalizeString(oldpath_in_fuse), RenameRequest{
 			OldPath:       *oldPath,
 			NewPath:       *newPath,
 			OldPathInFuse: oldpath_in_fuse,
@@ -1233,74 +2128,185 @@ func (fs *MayakashiFS) Rename(oldpath_in_fuse string, newpath_in_fuse string) in
 	}
 	fs.whiteoutIfNeeded(oldpath_in_fuse)
 	fs.removeWhiteout(newpath_in_fuse)
+	fs.renameOverlayMeta(oldpath_in_fuse, newpath_in_fuse)
+
+	return 0
+}
+
+// renameFromArchive handles rename which failed with ENOENT, because the source isn't in overlay directory
+// (it is copied up from archive), or parent of the destination exists only in archive (it is created in overlay).
+// Caller should whiteout the source.
+func (fs *MayakashiFS) renameFromArchive(oldpath_in_fuse string, newpath_in_fuse string, oldPath string, newPath string) int {
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(oldpath_in_fuse, &stat, ^uint64(0)); errc != 0 {
+		fmt.Println("tried to rename but not found", oldpath_in_fuse, newpath_in_fuse)
+		return errc
+	}
+	if fs.isStubPath(oldpath_in_fuse) || (!fs.DisableControlDir && isControlPath(oldpath_in_fuse)) {
+		return -fuse.EROFS
+	}
+	if newParent := newpath_in_fuse[:strings.LastIndex(newpath_in_fuse, "/")]; newParent != "" {
+		var parentStat fuse.Stat_t
+		if errc := fs.Getattr(newParent, &parentStat, ^uint64(0)); errc != 0 {
+			return errc
+		}
+		if parentStat.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+			return -fuse.ENOTDIR
+		}
+	}
+	// parent of newPath might exist only in archive
+	os.MkdirAll(newPath[:strings.LastIndex(newPath, "/")], 0777)
+
+	if _, err := os.Lstat(oldPath); err == nil {
+		// already in overlay (e.g. edited copy of archived file), so its contents must not be replaced by archived one
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fs.overlayWriteError("rename", oldpath_in_fuse, err)
+		}
+		return 0
+	}
+	if _, ok := fs.Tree().Files[mayafs.NormalizeString(oldpath_in_fuse)]; !ok {
+		// exists in overlay but disappeared after os.Rename
+		return -fuse.ENOENT
+	}
 
+	fs.logInfo("rename from archive, copy...", oldpath_in_fuse, newpath_in_fuse)
+	if errc := fs.copyUpFile(oldpath_in_fuse, oldPath, true); errc != 0 {
+		return errc
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		fmt.Println("failed to rename copied file", oldpath_in_fuse, newpath_in_fuse, err)
+		os.Remove(oldPath)
+		return -fuse.EIO
+	}
 	return 0
 }
 
-func (fs *MayakashiFS) Truncate(path string, size int64, fh uint64) int {
+func (fs *MayakashiFS) Truncate(path string, size int64, fh uint64) (errc int) {
+	if !fs.DisableControlDir && isControlPath(path) {
+		// e.g. `echo 1 > cache/flush` truncates before writing
+		return fs.controlGetattr(path, &fuse.Stat_t{}, fh)
+	}
+	if fs.isStubPath(path) {
+		return -fuse.EROFS
+	}
+	if fs.isZoneIdentifierSink(fh) {
+		return 0
+	}
 	if fp, ok := fs.OverlayFileHandlers.Load(fh); ok {
 		fp.Mutex.Lock()
 		defer fp.Mutex.Unlock()
+		oldSize := int64(0)
+		if fs.OverlayQuota != nil {
+			if st, err := fp.File.Stat(); err == nil {
+				oldSize = st.Size()
+			}
+		}
+		if !fs.OverlayQuota.Grow(size - oldSize) {
+			return fs.overlayQuotaExceeded("truncate", path, size-oldSize)
+		}
 		err := fp.File.Truncate(size)
 		if err != nil {
-			fmt.Println("failed to truncate", err)
-			return -fuse.EIO
+			fs.OverlayQuota.Shrink(size - oldSize)
+			return fs.overlayWriteError("truncate", path, err)
 		}
+		fs.OverlayQuota.Shrink(oldSize - size)
+		fp.Written = true
 
 		return 0
 	}
 
 	// ファイルを開かずに truncate される場合がある
 	if overlayPath := fs.getOverlayPath(path); overlayPath != nil {
+		fs.OverlayIndex.touch(path)
+		if errc := fs.ensurePlainOverlay(path); errc != 0 {
+			return errc
+		}
+		if fs.AuditLog != nil {
+			oldSize := fs.auditFileSize(path)
+			defer func() {
+				if errc == 0 {
+					fs.AuditLog.Record(AuditEntry{Op: "truncate", Path: path, SizeDelta: size - oldSize})
+				}
+			}()
+		}
+		oldSize := int64(0)
+		if fs.OverlayQuota != nil {
+			oldSize = overlayFileSize(*overlayPath)
+		}
+		if !fs.OverlayQuota.Grow(size - oldSize) {
+			return fs.overlayQuotaExceeded("truncate", path, size-oldSize)
+		}
 		err := os.Truncate(*overlayPath, size)
 		if err == nil {
+			fs.OverlayQuota.Shrink(oldSize - size)
 			return 0
-		} else if os.IsNotExist(err) && size == 0 {
+		}
+		fs.OverlayQuota.Shrink(size - oldSize)
+		if os.IsNotExist(err) && size == 0 {
 			// archive にしかファイルがない場合は size == 0 だけ対応 (writeback が面倒)
-			if _, ok := fs.Files[NormalizeString(path)]; !ok {
+			if _, ok := fs.Tree().Files[mayafs.NormalizeString(path)]; !ok {
 				return -fuse.ENOENT
 			}
 			fs.removeWhiteout(path)
 			fp, err := os.Create(*overlayPath)
 			if err != nil {
-				fmt.Println("failed to create", err)
-				return -fuse.EIO
+				return fs.overlayWriteError("create", path, err)
 			}
 			fp.Close()
 			return 0
 		} else {
-			fmt.Println("failed to truncate", err)
-			return -fuse.EIO
+			return fs.overlayWriteError("truncate", path, err)
 		}
 	}
-	println("tried to truncate on archive file", path, size, fh)
+	fs.logWarn("tried to truncate on archive file", path, size, fh)
 	return -fuse.EROFS
 }
 
-func main() {
-	fmt.Println(runtime.GOARCH)
-
-	fs := NewMayakashiFS()
-	fs.OverlayDir = "overlay"
+// fuseOptions returns fuse options for mounting this filesystem.
+func (fs *MayakashiFS) fuseOptions(extra []string) []string {
 	fuseOpts := []string{}
-	for i, arg := range os.Args {
-		if arg == "--" {
-			fuseOpts = os.Args[i+1:]
-			break
-		}
-		if i == 0 {
-			continue
-		}
-		if err := fs.ParseFile(arg); err != nil {
-			panic(err)
+	if runtime.GOOS == "windows" {
+		fuseOpts = append(fuseOpts, "-o", "uid=-1", "-o", "gid=-1")
+	} else {
+		// WinFsp doesn't support these
+		for _, opt := range fs.CacheTimeoutOpts {
+			fuseOpts = append(fuseOpts, "-o", opt)
 		}
 	}
-	if runtime.GOOS == "windows" {
-		fuseOpts = append([]string{"-o", "uid=-1", "-o", "gid=-1"}, fuseOpts...)
+	for _, opt := range fs.FuseOpts {
+		fuseOpts = append(fuseOpts, "-o", opt)
 	}
-	// pp.Print(fs.Directories)
-	// return
+	return append(fuseOpts, extra...)
+}
+
+func (fs *MayakashiFS) NewHost() *fuse.FileSystemHost {
+	var iface fuse.FileSystemInterface = fs
+	if fs.Trace {
+		iface = &tracingFS{fs}
+	}
+	host := fuse.NewFileSystemHost(iface)
+	host.SetCapCaseInsensitive(true)
+	return host
+}
+
+// waitForIdle blocks until apps don't read .dat files for PreloadIdle.
+func (fs *MayakashiFS) waitForIdle(what string) {
+	waited := false
+	for fs.LastDatRead.Add(fs.PreloadIdle).After(time.Now()) {
+		fmt.Println("waiting for dat read", what, fs.LastDatRead)
+		waited = true
+		time.Sleep(fs.PreloadPollInterval)
+	}
+	if waited {
+		fmt.Println("continue...")
+	}
+}
 
+// StartPreload starts reading chunks which matches preload globs in background.
+func (fs *MayakashiFS) StartPreload() {
+	if len(fs.PreloadGlobs) == 0 {
+		return
+	}
 	go func() {
 		type RuleAndFile struct {
 			Rule     string
@@ -1308,24 +2314,18 @@ func main() {
 		}
 		preloadFilesPerMarFile := map[string][]RuleAndFile{}
 		for _, rule := range fs.PreloadGlobs {
-			for filename, file := range fs.Files {
-				matched, err := doublestar.Match(NormalizeString(rule), filename)
+			for filename, file := range fs.Tree().Files {
+				matched, err := doublestar.Match(mayafs.NormalizeString(rule), filename)
 				if err != nil {
 					panic(err)
 				}
 				if !matched {
 					continue
 				}
-				var marFileName string
-				entry := file.MarEntry
-				if entry == nil {
+				if file.MarEntry == nil {
 					continue
 				}
-				if entry.FileIndex == 0 {
-					marFileName = file.ArchiveFile + ".dat"
-				} else {
-					marFileName = fmt.Sprintf("%s.%d.dat", file.ArchiveFile, entry.FileIndex)
-				}
+				marFileName := file.DatPath()
 				if _, ok := preloadFilesPerMarFile[marFileName]; !ok {
 					preloadFilesPerMarFile[marFileName] = []RuleAndFile{}
 				}
@@ -1336,43 +2336,251 @@ func main() {
 			}
 		}
 
+		// decompressed bytes put into chunk cache by preload
+		var cachedBytes int64
+
+		// limits number of .dat files which are preloaded concurrently
+		var workers chan struct{}
+		if fs.PreloadJobs > 0 {
+			workers = make(chan struct{}, fs.PreloadJobs)
+		}
+
 		for marFileName, files := range preloadFilesPerMarFile {
 			go func(marFileName string, files []RuleAndFile) {
+				if workers != nil {
+					workers <- struct{}{}
+					defer func() { <-workers }()
+				}
 				for _, f := range files {
 					rule := f.Rule
 					filename := f.FileName
 					fmt.Println("matched", rule, marFileName, filename)
-					file := fs.Files[NormalizeString(filename)]
-					pool := GetFilePoolFromPath(marFileName)
+					file := fs.Tree().Files[mayafs.NormalizeString(filename)]
+					pool := fs.ArchiveReader(marFileName)
 					ptr := file.MarEntry.BodyOffset
-					for _, chunk := range file.MarEntry.Info.Chunks {
-						first_wait := true
-						for fs.LastDatRead.Add(3 * time.Second).After(time.Now()) {
-							fmt.Println("waiting for dat read", filename, fs.LastDatRead)
-							first_wait = false
-							time.Sleep(1 * time.Second)
-						}
-						if !first_wait {
-							fmt.Println("continue...")
+					fs.AdviseSequential(marFileName, int64(ptr))
+					for chunkNo, chunk := range file.MarEntry.Info.Chunks {
+						fs.waitForIdle(filename)
+						fs.PreloadLimiter.Wait(int(chunk.CompressedLength))
+						if atomic.LoadInt64(&cachedBytes) < fs.PreloadCacheBudget {
+							cached, err := fs.CacheMarChunk(&file, chunkNo)
+							if err != nil {
+								fmt.Println("failed to preload chunk into cache", filename, chunkNo, err)
+							}
+							atomic.AddInt64(&cachedBytes, int64(cached))
+						} else {
+							pool.ReadAt(make([]byte, chunk.CompressedLength), int64(ptr))
 						}
-						pool.ReadAt(make([]byte, chunk.CompressedLength), int64(ptr))
 						ptr += uint64(chunk.CompressedLength)
 					}
 				}
-				println("preload finish", marFileName)
+				fs.logInfo("preload finish", marFileName)
 			}(marFileName, files)
 		}
 	}()
+}
+
+func main() {
+	fmt.Println(runtime.GOARCH)
+
+	fs := NewMayakashiFS()
+	args := os.Args[1:]
+	fuseOpts := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			fuseOpts = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+	args, err := translateFlags(args)
+	if errors.Is(err, errShowHelp) {
+		printUsage(os.Stdout)
+		return
+	}
+	if err != nil {
+		fmt.Println(err, "(see --help)")
+		os.Exit(2)
+	}
+	for _, arg := range append(envArgs(), args...) {
+		if err := fs.ParseFile(arg); err != nil {
+			panic(err)
+		}
+	}
+	if fs.CheckOnly {
+		ok := true
+		for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+			ok = f.CheckArchives() && ok
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if shouldExit, err := fs.HandleBackgroundMode(); err != nil {
+		panic(err)
+	} else if shouldExit {
+		return
+	}
+	if fs.PeerAddr != "" {
+		// started before loading archives, so their indexes can be fetched from peers too
+		peers, err := mayafs.StartPeerCache(fs.PeerAddr, fs.PeerToken, fs.RemoteCacheDir)
+		if err != nil {
+			panic(err)
+		}
+		for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+			f.Peers = peers
+		}
+		go func() {
+			if err := peers.Serve(); err != nil {
+				fmt.Println("failed to serve peer cache", fs.PeerAddr, err)
+			}
+		}()
+	}
+	if fs.CacheIgnoreInternalCost {
+		// NOTE: chunk cache is shared with all filesystems in this process
+		cache := mayafs.ReplaceSharedChunkCache(true)
+		for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+			f.ChunkCache = cache
+		}
+	}
+	if fs.IOUring {
+		// NOTE: io_uring is shared with all filesystems in this process, like file pools
+		if err := mayafs.EnableIOUring(0); err != nil {
+			fmt.Println("io_uring is not available, reading without it:", err)
+		}
+	}
+	if fs.FilePoolSize > 0 {
+		// NOTE: file pools are shared with all filesystems in this process
+		mayafs.SetFilePoolLimit(fs.FilePoolSize)
+	}
+	if fs.Unbuffered {
+		if err := mayafs.EnableUnbufferedIO(); err != nil {
+			fmt.Println("unbuffered IO is not available, reading with OS cache:", err)
+		}
+	}
+	if fs.CacheAuto {
+		if err := fs.StartAdaptiveCache(); err != nil {
+			panic(err)
+		}
+	}
+	if fs.HotStoreFile != "" {
+		if err := fs.StartHotStore(); err != nil {
+			panic(err)
+		}
+	}
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		if err := f.LoadPendingArchives(); err != nil {
+			panic(err)
+		}
+		if err := f.PrepareMountPoint(); err != nil {
+			panic(err)
+		}
+		if f.Recorder != nil {
+			f.Recorder.StartAutoSave(10 * time.Second)
+		}
+		f.StartHotCache()
+		f.StartPin()
+		f.StartOverlayQuota()
+		f.StartTrash()
+		if err := f.StartOverlayIndex(); err != nil {
+			panic(err)
+		}
+		if err := f.StartAuditLog(); err != nil {
+			panic(err)
+		}
+		if err := f.StartDirWatch(); err != nil {
+			panic(err)
+		}
+	}
+	// pp.Print(fs.Directories)
+	// return
 
-	host := fuse.NewFileSystemHost(fs)
-	host.SetCapCaseInsensitive(true)
 	if fs.PProfAddr != "" {
+		fs.publishExpvars()
 		go func() {
 			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 				w.Write([]byte("Hello."))
 			})
+			http.HandleFunc("/healthz", fs.handleHealthz)
 			log.Fatal(http.ListenAndServe(fs.PProfAddr, nil))
 		}()
 	}
-	host.Mount(fs.MountPoint, fuseOpts)
+
+	if fs.KeepaliveInterval > 0 {
+		mayafs.StartFilePoolKeepalive(fs.KeepaliveInterval)
+	}
+	if fs.FilePoolIdle > 0 {
+		mayafs.StartFilePoolReaper(fs.FilePoolIdle)
+	}
+
+	// sub filesystems are sharing chunk cache, file pools and pprof with main one
+	wg := sync.WaitGroup{}
+	for _, sub := range fs.SubFilesystems {
+		if sub.MountPoint == "" {
+			// 9P, SFTP or serve only
+			continue
+		}
+		wg.Add(1)
+		go func(sub *MayakashiFS) {
+			defer wg.Done()
+			sub.StartPreload()
+			sub.StartVerify()
+			if !sub.NewHost().Mount(sub.MountPoint, sub.fuseOptions(nil)) {
+				fmt.Println("failed to mount", sub.MountPoint)
+			}
+		}(sub)
+	}
+
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		if f.NinePAddr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(f *MayakashiFS) {
+			defer wg.Done()
+			if err := f.ServeNineP(f.NinePAddr); err != nil {
+				fmt.Println("failed to serve 9P", f.NinePAddr, err)
+			}
+		}(f)
+	}
+
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		if f.SFTPAddr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(f *MayakashiFS) {
+			defer wg.Done()
+			if err := f.ServeSFTP(f.SFTPAddr); err != nil {
+				fmt.Println("failed to serve SFTP", f.SFTPAddr, err)
+			}
+		}(f)
+	}
+
+	for _, f := range append([]*MayakashiFS{fs}, fs.SubFilesystems...) {
+		if f.ServeAddr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(f *MayakashiFS) {
+			defer wg.Done()
+			if err := f.ServeArchives(f.ServeAddr); err != nil {
+				fmt.Println("failed to serve archives", f.ServeAddr, err)
+			}
+		}(f)
+	}
+
+	if fs.MountPoint == "" && len(fuseOpts) == 0 && (len(fs.SubFilesystems) > 0 || fs.NinePAddr != "" || fs.SFTPAddr != "" || fs.ServeAddr != "") {
+		// only sub filesystems (or servers) are specified
+		wg.Wait()
+		return
+	}
+
+	fs.StartPreload()
+	fs.StartVerify()
+	if !fs.Mount(fs.NewHost(), fs.fuseOptions(fuseOpts)) {
+		os.Exit(1)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const AUTO_MOUNTPOINT = "auto"
+
+// PrepareMountPoint resolves mountpoint=auto, and creates mountpoint (or its parent on Windows) if needed.
+func (fs *MayakashiFS) PrepareMountPoint() error {
+	if fs.MountPoint == AUTO_MOUNTPOINT {
+		mp, err := findFreeDriveLetter()
+		if err != nil {
+			return err
+		}
+		fs.MountPoint = mp
+		fmt.Println("Using", mp, "as mountpoint")
+		return nil
+	}
+
+	if fs.MountPoint == "" {
+		return nil
+	}
+
+	if runtime.GOOS == "windows" {
+		// WinFsp wants mountpoint directory to be not existed, so only create its parent
+		if len(fs.MountPoint) <= 2 {
+			// drive letter (e.g. "X:")
+			return nil
+		}
+		return os.MkdirAll(filepath.Dir(fs.MountPoint), 0777)
+	}
+
+	if _, err := os.Stat(fs.MountPoint); os.IsNotExist(err) {
+		fmt.Println("creating mountpoint", fs.MountPoint)
+		return os.MkdirAll(fs.MountPoint, 0777)
+	}
+
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+func findFreeDriveLetter() (string, error) {
+	return "", fmt.Errorf("mountpoint=%s is only supported on Windows", AUTO_MOUNTPOINT)
+}
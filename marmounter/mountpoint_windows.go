@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+func findFreeDriveLetter() (string, error) {
+	drives, err := windows.GetLogicalDrives()
+	if err != nil {
+		return "", err
+	}
+	// avoid A: and B: since they are reserved for floppy drives
+	for i := 2; i < 26; i++ {
+		if drives&(1<<i) == 0 {
+			return fmt.Sprintf("%c:", 'A'+i), nil
+		}
+	}
+	return "", fmt.Errorf("there is no free drive letter")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// negativeCache remembers paths which were not found, so apps probing many missing paths on every launch
+// (e.g. locale variants, optional DLC) are answered without normalizing paths nor stat-ing overlay directory.
+// It is cleared when the tree is replaced (archives are loaded or reloaded) and when names in overlay directory
+// are changed through the mount, and entries expire after ttl, for changes made to overlay directory directly.
+// nil negativeCache caches nothing.
+type negativeCache struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	// entries are valid only for this tree
+	tree    *mayafs.Tree
+	expires map[string]time.Time
+	// incremented by clear, so lookups which started before clear don't add stale entries
+	generation uint64
+	hits       atomic.Uint64
+}
+
+// caching more paths than this only wastes memory, cache is cleared when it is full
+const maxNegativeCacheEntries = 65536
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{
+		ttl:     ttl,
+		expires: map[string]time.Time{},
+	}
+}
+
+// lookup reports whether path (as requested, not normalized) is known to be missing in tree,
+// and returns generation which should be passed to add if it turns out to be missing.
+func (c *negativeCache) lookup(tree *mayafs.Tree, path string) (bool, uint64) {
+	if c == nil {
+		return false, 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tree != tree {
+		return false, c.generation
+	}
+	expires, ok := c.expires[path]
+	if !ok {
+		return false, c.generation
+	}
+	if time.Now().After(expires) {
+		delete(c.expires, path)
+		return false, c.generation
+	}
+	c.hits.Add(1)
+	return true, c.generation
+}
+
+// add records path was missing in tree, unless cache was cleared after lookup.
+func (c *negativeCache) add(tree *mayafs.Tree, generation uint64, path string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.tree != tree || len(c.expires) >= maxNegativeCacheEntries {
+		c.tree = tree
+		c.expires = map[string]time.Time{}
+	}
+	c.expires[path] = time.Now().Add(c.ttl)
+}
+
+// clear forgets all paths, called when something might be created in overlay directory.
+func (c *negativeCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	if len(c.expires) != 0 {
+		c.expires = map[string]time.Time{}
+	}
+}
+
+func (c *negativeCache) snapshot() map[string]any {
+	c.mutex.Lock()
+	entries := len(c.expires)
+	c.mutex.Unlock()
+	return map[string]any{
+		"ttl_ms":  c.ttl.Milliseconds(),
+		"entries": entries,
+		"hits":    c.hits.Load(),
+	}
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Minimal read-only 9P2000.L server, which is backed by MayakashiFS's FUSE handlers like SFTP server,
+// so it exports the same tree as the mount (overlay, whiteouts, hideglob= and stubglob= are applied).
+// It can be mounted by Linux v9fs, e.g. `mount -t 9p -o trans=tcp,port=5640,version=9p2000.L <host> /mnt`
+// There is no authentication, so it listens on loopback unless host is specified.
+
+const NINEP_VERSION = "9P2000.L"
+const NINEP_MAX_MSIZE = 1024 * 1024
+
+const (
+	ninepRlerror      = 7
+	ninepTstatfs      = 8
+	ninepRstatfs      = 9
+	ninepTlopen       = 12
+	ninepRlopen       = 13
+	ninepTgetattr     = 24
+	ninepRgetattr     = 25
+	ninepTreaddir     = 40
+	ninepRreaddir     = 41
+	ninepTfsync       = 50
+	ninepRfsync       = 51
+	ninepTlock        = 52
+	ninepRlock        = 53
+	ninepTgetlock     = 54
+	ninepRgetlock     = 55
+	ninepTversion     = 100
+	ninepRversion     = 101
+	ninepTattach      = 104
+	ninepRattach      = 105
+	ninepTflush       = 108
+	ninepRflush       = 109
+	ninepTwalk        = 110
+	ninepRwalk        = 111
+	ninepTread        = 116
+	ninepRread        = 117
+	ninepTclunk       = 120
+	ninepRclunk       = 121
+	ninepTxattrwalk   = 30
+	ninepTreadlink    = 22
+	ninepTlcreate     = 14
+	ninepTsymlink     = 16
+	ninepTmknod       = 18
+	ninepTrename      = 20
+	ninepTsetattr     = 26
+	ninepTxattrcreate = 32
+	ninepTlink        = 70
+	ninepTmkdir       = 72
+	ninepTrenameat    = 74
+	ninepTunlinkat    = 76
+	ninepTwrite       = 118
+	ninepTremove      = 122
+)
+
+// linux errno, since 9P2000.L uses them regardless of server OS
+const (
+	ninepENOENT     = 2
+	ninepEIO        = 5
+	ninepEBADF      = 9
+	ninepENOTDIR    = 20
+	ninepEISDIR     = 21
+	ninepEINVAL     = 22
+	ninepEROFS      = 30
+	ninepENODATA    = 61
+	ninepEOPNOTSUPP = 95
+)
+
+const (
+	ninepQTDIR  = 0x80
+	ninepQTFILE = 0x00
+)
+
+// type and status of Tlock/Tgetlock
+const (
+	ninepLockRead    = 0
+	ninepLockWrite   = 1
+	ninepLockUnlock  = 2
+	ninepLockSuccess = 0
+	// client retries by itself if it wants to wait
+	ninepLockBlocked = 1
+	ninepLockError   = 2
+)
+
+// ninepFid is copied out of ninepConn.fids under fidsMu, since messages are handled concurrently.
+type ninepFid struct {
+	Path   string
+	IsDir  bool
+	Opened bool
+	// FUSE handle of opened file
+	Fh      uint64
+	Entries []ninepDirEntry
+}
+
+type ninepDirEntry struct {
+	Name  string
+	IsDir bool
+}
+
+type ninepConn struct {
+	fs     *MayakashiFS
+	conn   net.Conn
+	msize  uint32
+	fids   map[uint32]*ninepFid
+	fidsMu sync.Mutex
+	wMu    sync.Mutex
+	// locks of this connection are owned by (lockSession, proc_id)
+	lockSession uint64
+}
+
+// ninepBuf is a little-endian encoder/decoder for 9P messages.
+type ninepBuf struct {
+	b   []byte
+	err error
+}
+
+func (b *ninepBuf) u8() uint8 {
+	if len(b.b) < 1 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := b.b[0]
+	b.b = b.b[1:]
+	return v
+}
+
+func (b *ninepBuf) u16() uint16 {
+	if len(b.b) < 2 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.LittleEndian.Uint16(b.b)
+	b.b = b.b[2:]
+	return v
+}
+
+func (b *ninepBuf) u32() uint32 {
+	if len(b.b) < 4 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(b.b)
+	b.b = b.b[4:]
+	return v
+}
+
+func (b *ninepBuf) u64() uint64 {
+	if len(b.b) < 8 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(b.b)
+	b.b = b.b[8:]
+	return v
+}
+
+func (b *ninepBuf) str() string {
+	l := int(b.u16())
+	if len(b.b) < l {
+		b.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(b.b[:l])
+	b.b = b.b[l:]
+	return v
+}
+
+func (b *ninepBuf) putU8(v uint8) { b.b = append(b.b, v) }
+func (b *ninepBuf) putU16(v uint16) {
+	b.b = binary.LittleEndian.AppendUint16(b.b, v)
+}
+func (b *ninepBuf) putU32(v uint32) {
+	b.b = binary.LittleEndian.AppendUint32(b.b, v)
+}
+func (b *ninepBuf) putU64(v uint64) {
+	b.b = binary.LittleEndian.AppendUint64(b.b, v)
+}
+func (b *ninepBuf) putStr(s string) {
+	b.putU16(uint16(len(s)))
+	b.b = append(b.b, s...)
+}
+func (b *ninepBuf) putQid(isDir bool, p string) {
+	h := fnv.New64a()
+	h.Write([]byte(mayafs.NormalizeString(p)))
+	if isDir {
+		b.putU8(ninepQTDIR)
+	} else {
+		b.putU8(ninepQTFILE)
+	}
+	b.putU32(0)
+	b.putU64(h.Sum64())
+}
+
+// ninepListenAddr returns addr, or loopback of it if host is not specified (e.g. ":5640").
+func ninepListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// ServeNineP listens on addr and serves fs by 9P2000.L until error.
+func (fs *MayakashiFS) ServeNineP(addr string) error {
+	l, err := net.Listen("tcp", ninepListenAddr(addr))
+	if err != nil {
+		return err
+	}
+	fmt.Println("9P server listening on", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &ninepConn{
+			fs:          fs,
+			conn:        conn,
+			msize:       NINEP_MAX_MSIZE,
+			fids:        map[uint32]*ninepFid{},
+			lockSession: fs.Locks.newSession(),
+		}
+		go c.serve()
+	}
+}
+
+func (c *ninepConn) serve() {
+	defer c.conn.Close()
+	defer c.clunkAll()
+	defer c.fs.Locks.ReleaseSession(c.lockSession)
+	r := bufio.NewReader(c.conn)
+	fmt.Println("9P client connected", c.conn.RemoteAddr())
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			if err != io.EOF {
+				fmt.Println("9P: failed to read message", err)
+			}
+			return
+		}
+		if size < 7 || size > c.msize {
+			fmt.Println("9P: invalid message size", size)
+			return
+		}
+		msg := make([]byte, size-4)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			fmt.Println("9P: failed to read message", err)
+			return
+		}
+		typ := msg[0]
+		tag := binary.LittleEndian.Uint16(msg[1:3])
+		body := &ninepBuf{b: msg[3:]}
+		if typ == ninepTversion {
+			// version should be handled before other messages
+			c.handle(typ, tag, body)
+			continue
+		}
+		go c.handle(typ, tag, body)
+	}
+}
+
+func (c *ninepConn) reply(typ uint8, tag uint16, body []byte) {
+	msg := make([]byte, 7, 7+len(body))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(body)))
+	msg[4] = typ
+	binary.LittleEndian.PutUint16(msg[5:], tag)
+	msg = append(msg, body...)
+
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	if _, err := c.conn.Write(msg); err != nil {
+		fmt.Println("9P: failed to write reply", err)
+	}
+}
+
+func (c *ninepConn) replyError(tag uint16, errno uint32) {
+	var b ninepBuf
+	b.putU32(errno)
+	c.reply(ninepRlerror, tag, b.b)
+}
+
+// getFid returns copy of fid, which can be read without lock.
+func (c *ninepConn) getFid(fid uint32) (ninepFid, bool) {
+	c.fidsMu.Lock()
+	defer c.fidsMu.Unlock()
+	f, ok := c.fids[fid]
+	if !ok {
+		return ninepFid{}, false
+	}
+	return *f, true
+}
+
+func (c *ninepConn) setFid(fid uint32, f *ninepFid) {
+	c.fidsMu.Lock()
+	defer c.fidsMu.Unlock()
+	c.fids[fid] = f
+}
+
+// removeFid removes fid, and releases its file if it was opened.
+func (c *ninepConn) removeFid(fid uint32) {
+	c.fidsMu.Lock()
+	f, ok := c.fids[fid]
+	delete(c.fids, fid)
+	c.fidsMu.Unlock()
+	if ok && f.Opened && !f.IsDir {
+		c.fs.Release(f.Path, f.Fh)
+	}
+}
+
+// markOpened records handle of opened fid, false if fid is already clunked or opened.
+func (c *ninepConn) markOpened(fid uint32, fh uint64, entries []ninepDirEntry) bool {
+	c.fidsMu.Lock()
+	defer c.fidsMu.Unlock()
+	f, ok := c.fids[fid]
+	if !ok || f.Opened {
+		return false
+	}
+	f.Opened = true
+	f.Fh = fh
+	f.Entries = entries
+	return true
+}
+
+// clunkAll releases files which are still opened when client disconnects (or resets session).
+func (c *ninepConn) clunkAll() {
+	c.fidsMu.Lock()
+	fids := c.fids
+	c.fids = map[uint32]*ninepFid{}
+	c.fidsMu.Unlock()
+	for _, f := range fids {
+		if f.Opened && !f.IsDir {
+			c.fs.Release(f.Path, f.Fh)
+		}
+	}
+}
+
+// lookup returns (exists, isDir) of path in merged tree.
+func (c *ninepConn) lookup(p string) (bool, bool) {
+	var stat fuse.Stat_t
+	if c.fs.Getattr(p, &stat, ^uint64(0)) != 0 {
+		return false, false
+	}
+	return true, stat.Mode&fuse.S_IFMT == fuse.S_IFDIR
+}
+
+// ninepErrno converts errno of FUSE handler, since 9P2000.L uses linux ones.
+func ninepErrno(errc int) uint32 {
+	switch errc {
+	case -fuse.ENOENT:
+		return ninepENOENT
+	case -fuse.ENOTDIR:
+		return ninepENOTDIR
+	case -fuse.EISDIR:
+		return ninepEISDIR
+	case -fuse.EINVAL:
+		return ninepEINVAL
+	default:
+		return ninepEIO
+	}
+}
+
+func (c *ninepConn) handle(typ uint8, tag uint16, req *ninepBuf) {
+	defer recoverHandler()
+	var res ninepBuf
+	switch typ {
+	case ninepTversion:
+		msize := req.u32()
+		version := req.str()
+		if req.err != nil {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		if msize < c.msize {
+			c.msize = msize
+		}
+		if !strings.HasPrefix(version, NINEP_VERSION) {
+			version = "unknown"
+		} else {
+			version = NINEP_VERSION
+		}
+		// version resets session
+		c.clunkAll()
+		res.putU32(c.msize)
+		res.putStr(version)
+		c.reply(ninepRversion, tag, res.b)
+
+	case ninepTattach:
+		fid := req.u32()
+		if req.err != nil {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		c.setFid(fid, &ninepFid{Path: "/", IsDir: true})
+		res.putQid(true, "/")
+		c.reply(ninepRattach, tag, res.b)
+
+	case ninepTflush:
+		c.reply(ninepRflush, tag, nil)
+
+	case ninepTwalk:
+		fid := req.u32()
+		newfid := req.u32()
+		nwname := int(req.u16())
+		names := make([]string, nwname)
+		for i := range names {
+			names[i] = req.str()
+		}
+		if req.err != nil {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		f, ok := c.getFid(fid)
+		if !ok {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		current := f.Path
+		isDir := f.IsDir
+		var qids ninepBuf
+		walked := 0
+		for _, name := range names {
+			next := path.Join(current, name)
+			if name == ".." {
+				next = path.Dir(current)
+			}
+			exists, nextIsDir := c.lookup(next)
+			if !exists || !isDir {
+				break
+			}
+			current = next
+			isDir = nextIsDir
+			qids.putQid(isDir, current)
+			walked++
+		}
+		if walked == 0 && nwname > 0 {
+			c.replyError(tag, ninepENOENT)
+			return
+		}
+		if walked == nwname {
+			c.setFid(newfid, &ninepFid{Path: current, IsDir: isDir})
+		}
+		res.putU16(uint16(walked))
+		res.b = append(res.b, qids.b...)
+		c.reply(ninepRwalk, tag, res.b)
+
+	case ninepTlopen:
+		fid := req.u32()
+		flags := req.u32()
+		f, ok := c.getFid(fid)
+		if !ok {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		if flags&3 != 0 || flags&0o1000 != 0 {
+			// O_WRONLY, O_RDWR or O_TRUNC
+			c.replyError(tag, ninepEROFS)
+			return
+		}
+		if f.Opened {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		var errc int
+		if f.IsDir {
+			f.Entries, errc = c.readDirEntries(f.Path)
+		} else {
+			errc, f.Fh = c.fs.Open(f.Path, fuse.O_RDONLY)
+		}
+		if errc != 0 {
+			c.replyError(tag, ninepErrno(errc))
+			return
+		}
+		if !c.markOpened(fid, f.Fh, f.Entries) {
+			// clunked or opened by other message meanwhile
+			if !f.IsDir {
+				c.fs.Release(f.Path, f.Fh)
+			}
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		res.putQid(f.IsDir, f.Path)
+		res.putU32(0)
+		c.reply(ninepRlopen, tag, res.b)
+
+	case ninepTgetattr:
+		fid := req.u32()
+		f, ok := c.getFid(fid)
+		if !ok {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		fh := ^uint64(0)
+		if f.Opened && !f.IsDir {
+			fh = f.Fh
+		}
+		var stat fuse.Stat_t
+		if errc := c.fs.Getattr(f.Path, &stat, fh); errc != 0 {
+			c.replyError(tag, ninepErrno(errc))
+			return
+		}
+		// exported as read-only
+		mode := uint32(0o100444)
+		if f.IsDir {
+			mode = 0o040555
+		}
+		size := stat.Size
+		sec := uint64(stat.Mtim.Sec)
+		nsec := uint64(stat.Mtim.Nsec)
+		res.putU64(0x7ff) // P9_GETATTR_BASIC
+		res.putQid(f.IsDir, f.Path)
+		res.putU32(mode)
+		res.putU32(0)                          // uid
+		res.putU32(0)                          // gid
+		res.putU64(1)                          // nlink
+		res.putU64(0)                          // rdev
+		res.putU64(uint64(size))               // size
+		res.putU64(4096)                       // blksize
+		res.putU64((uint64(size) + 511) / 512) // blocks
+		for i := 0; i < 3; i++ {
+			// atime, mtime, ctime
+			res.putU64(sec)
+			res.putU64(nsec)
+		}
+		for i := 0; i < 4; i++ {
+			// btime, gen, data_version
+			res.putU64(0)
+		}
+		c.reply(ninepRgetattr, tag, res.b)
+
+	case ninepTread:
+		fid := req.u32()
+		offset := req.u64()
+		count := req.u32()
+		f, ok := c.getFid(fid)
+		if !ok || !f.Opened {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		if f.IsDir {
+			c.replyError(tag, ninepEISDIR)
+			return
+		}
+		if max := c.msize - 11; count > max {
+			count = max
+		}
+		buf := make([]byte, count)
+		readed := 0
+		for readed < len(buf) {
+			n := c.fs.Read(f.Path, buf[readed:], int64(offset)+int64(readed), f.Fh)
+			if n < 0 {
+				c.replyError(tag, ninepErrno(n))
+				return
+			}
+			if n == 0 {
+				break
+			}
+			readed += n
+		}
+		res.putU32(uint32(readed))
+		res.b = append(res.b, buf[:readed]...)
+		c.reply(ninepRread, tag, res.b)
+
+	case ninepTreaddir:
+		fid := req.u32()
+		offset := req.u64()
+		count := req.u32()
+		f, ok := c.getFid(fid)
+		if !ok || !f.Opened {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		if !f.IsDir {
+			c.replyError(tag, ninepENOTDIR)
+			return
+		}
+		if max := c.msize - 11; count > max {
+			count = max
+		}
+		var entries ninepBuf
+		for i := int(offset); i < len(f.Entries); i++ {
+			e := f.Entries[i]
+			// qid[13] offset[8] type[1] name[s]
+			if len(entries.b)+13+8+1+2+len(e.Name) > int(count) {
+				break
+			}
+			entries.putQid(e.IsDir, path.Join(f.Path, e.Name))
+			entries.putU64(uint64(i + 1))
+			if e.IsDir {
+				entries.putU8(4) // DT_DIR
+			} else {
+				entries.putU8(8) // DT_REG
+			}
+			entries.putStr(e.Name)
+		}
+		res.putU32(uint32(len(entries.b)))
+		res.b = append(res.b, entries.b...)
+		c.reply(ninepRreaddir, tag, res.b)
+
+	case ninepTclunk:
+		fid := req.u32()
+		c.removeFid(fid)
+		c.reply(ninepRclunk, tag, nil)
+
+	case ninepTstatfs:
+		res.putU32(0x01021997) // V9FS_MAGIC
+		res.putU32(4096)       // bsize
+		res.putU64(0)          // blocks
+		res.putU64(0)          // bfree
+		res.putU64(0)          // bavail
+		res.putU64(uint64(len(c.fs.Tree().Files)))
+		res.putU64(0) // ffree
+		res.putU64(0) // fsid
+		res.putU32(255)
+		c.reply(ninepRstatfs, tag, res.b)
+
+	case ninepTfsync:
+		c.reply(ninepRfsync, tag, nil)
+
+	case ninepTlock:
+		fid := req.u32()
+		lockType := req.u8()
+		req.u32() // flags, blocking lock is retried by client
+		start := req.u64()
+		length := req.u64()
+		procID := req.u32()
+		req.str() // client_id
+		if req.err != nil {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		f, ok := c.getFid(fid)
+		if !ok || !f.Opened {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		owner := lockOwner{Session: c.lockSession, ID: uint64(procID)}
+		end := lockRangeEnd(start, length)
+		status := uint8(ninepLockSuccess)
+		switch lockType {
+		case ninepLockUnlock:
+			c.fs.Locks.Unlock(f.Path, owner, start, end)
+		case ninepLockRead, ninepLockWrite:
+			if err := c.fs.Locks.Lock(f.Path, owner, start, end, lockType == ninepLockWrite); err != nil {
+				status = ninepLockBlocked
+			}
+		default:
+			status = ninepLockError
+		}
+		res.putU8(status)
+		c.reply(ninepRlock, tag, res.b)
+
+	case ninepTgetlock:
+		fid := req.u32()
+		lockType := req.u8()
+		start := req.u64()
+		length := req.u64()
+		procID := req.u32()
+		clientID := req.str()
+		if req.err != nil {
+			c.replyError(tag, ninepEINVAL)
+			return
+		}
+		f, ok := c.getFid(fid)
+		if !ok || !f.Opened {
+			c.replyError(tag, ninepEBADF)
+			return
+		}
+		owner := lockOwner{Session: c.lockSession, ID: uint64(procID)}
+		if l := c.fs.Locks.Test(f.Path, owner, start, lockRangeEnd(start, length), lockType == ninepLockWrite); l != nil {
+			lockType = ninepLockRead
+			if l.Exclusive {
+				lockType = ninepLockWrite
+			}
+			start = l.Start
+			length = 0
+			if l.End != LOCK_EOF {
+				length = l.End - l.Start
+			}
+			// holder might be other client, proc_id is only meaningful in the same session
+			procID = 0
+			if l.Owner.Session == c.lockSession {
+				procID = uint32(l.Owner.ID)
+			}
+		} else {
+			lockType = ninepLockUnlock
+		}
+		res.putU8(lockType)
+		res.putU64(start)
+		res.putU64(length)
+		res.putU32(procID)
+		res.putStr(clientID)
+		c.reply(ninepRgetlock, tag, res.b)
+
+	case ninepTxattrwalk:
+		c.replyError(tag, ninepENODATA)
+
+	case ninepTreadlink:
+		c.replyError(tag, ninepEINVAL)
+
+	case ninepTlcreate, ninepTsymlink, ninepTmknod, ninepTrename, ninepTsetattr, ninepTxattrcreate,
+		ninepTlink, ninepTmkdir, ninepTrenameat, ninepTunlinkat, ninepTwrite, ninepTremove:
+		c.replyError(tag, ninepEROFS)
+
+	default:
+		fmt.Println("9P: unsupported message", typ)
+		c.replyError(tag, ninepEOPNOTSUPP)
+	}
+}
+
+func (c *ninepConn) readDirEntries(p string) ([]ninepDirEntry, int) {
+	entries := []ninepDirEntry{}
+	errc := c.fs.Readdir(p, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat != nil {
+			entries = append(entries, ninepDirEntry{Name: name, IsDir: stat.Mode&fuse.S_IFMT == fuse.S_IFDIR})
+		}
+		return true
+	}, 0, ^uint64(0))
+	if errc != 0 {
+		return nil, errc
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, 0
+}
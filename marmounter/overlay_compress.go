@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Overlay files which matches overlaycompress= globs are compressed in zstd seekable format after they are written and closed,
+// and stored as "<path>.__zst__" in overlay directory instead of the file itself.
+// Reads only decompress frames which contains requested range (same as seekable .zst sources),
+// and opening for write (or truncate, rename, etc.) decompresses it back to plain file.
+
+const COMPRESSED_SUFFIX = ".__zst__"
+
+const (
+	// smaller files are not worth compressing
+	overlayCompressMinSize   = 1024 * 1024
+	overlayCompressFrameSize = 1024 * 1024
+)
+
+// CompressedFileHandler is opened (read-only) compressed overlay file.
+type CompressedFileHandler struct {
+	File    *os.File
+	Archive *mayafs.ZstArchive
+	Stat    fuse.Stat_t
+}
+
+// compressedOverlaySize caches original size of compressed overlay file, so Getattr and readdir don't parse its seek table every time.
+// it is valid while the compressed file has same mtime and size.
+type compressedOverlaySize struct {
+	ModTime  time.Time
+	FileSize int64
+	Size     int64
+}
+
+// overlayPathLocks is per-path lock which is held while compressed overlay file is replaced (or opened),
+// so long compression of one file doesn't block opening others.
+type overlayPathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*overlayPathLock
+}
+
+type overlayPathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks path, and returns function to unlock it.
+func (l *overlayPathLocks) Lock(path string) func() {
+	path = mayafs.NormalizeString(path)
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*overlayPathLock{}
+	}
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = &overlayPathLock{}
+		l.locks[path] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, path)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+func (fs *MayakashiFS) isCompressiblePath(path string) bool {
+	return matchAnyGlob(fs.OverlayCompressGlobs, path)
+}
+
+// statCompressedOverlay fills stat of compressed overlay file, and returns false if it doesn't exist.
+func (fs *MayakashiFS) statCompressedOverlay(path string, overlayPath string, stat *fuse.Stat_t) bool {
+	if !fs.isCompressiblePath(path) {
+		return false
+	}
+	compressedPath := overlayPath + COMPRESSED_SUFFIX
+	cs, err := os.Stat(compressedPath)
+	if err != nil {
+		return false
+	}
+	size, ok := fs.CompressedOverlaySizes.Load(compressedPath)
+	if !ok || !size.ModTime.Equal(cs.ModTime()) || size.FileSize != cs.Size() {
+		archive, err := mayafs.OpenZstArchive(compressedPath)
+		if err != nil {
+			fmt.Println("failed to read compressed overlay", path, err)
+			return false
+		}
+		size = compressedOverlaySize{ModTime: cs.ModTime(), FileSize: cs.Size(), Size: archive.Size()}
+		fs.CompressedOverlaySizes.Store(compressedPath, size)
+	}
+	stat.Mode = fuse.S_IFREG | 0777
+	stat.Size = size.Size
+	stat.Ctim = fuse.NewTimespec(cs.ModTime())
+	stat.Mtim = fuse.NewTimespec(cs.ModTime())
+	return true
+}
+
+// openCompressedOverlayArchive opens compressed overlay file with its own *os.File as Reader, since it might be replaced later.
+func openCompressedOverlayArchive(compressedPath string) (*mayafs.ZstArchive, error) {
+	archive, err := mayafs.OpenZstArchive(compressedPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(compressedPath)
+	if err != nil {
+		return nil, err
+	}
+	archive.Reader = f
+	return archive, nil
+}
+
+// openCompressedOverlay opens compressed overlay file for reading, and returns false if it doesn't exist.
+func (fs *MayakashiFS) openCompressedOverlay(path string, overlayPath string) (int, uint64, bool) {
+	handler := &CompressedFileHandler{}
+	if !fs.statCompressedOverlay(path, overlayPath, &handler.Stat) {
+		return 0, 0, false
+	}
+	archive, err := openCompressedOverlayArchive(overlayPath + COMPRESSED_SUFFIX)
+	if err != nil {
+		fmt.Println("failed to open compressed overlay", path, err)
+		return -fuse.EIO, 0, true
+	}
+	handler.File = archive.Reader.(*os.File)
+	handler.Archive = archive
+	if meta := fs.loadOverlayMeta(path); meta != nil {
+		meta.applyOwnership(&handler.Stat)
+	}
+	oc := fs.OverlayCount.Add(1)
+	fs.CompressedFileHandlers.Store(oc, handler)
+	return 0, oc, true
+}
+
+// isOverlayOpened reports whether overlay file of path is opened by someone.
+func (fs *MayakashiFS) isOverlayOpened(path string) bool {
+	lowerPath := mayafs.NormalizeString(path)
+	opened := false
+	fs.OverlayFileHandlers.Range(func(fh uint64, h *SharedFileHandler) bool {
+		opened = mayafs.NormalizeString(h.Path) == lowerPath
+		return !opened
+	})
+	return opened
+}
+
+// compressOverlay compresses overlay file if nobody opens it.
+// compression runs without the lock of path, and the result is used only if the file isn't opened or changed meanwhile.
+func (fs *MayakashiFS) compressOverlay(path string) {
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil || !fs.isCompressiblePath(path) {
+		return
+	}
+	// only one compression per path, they would share tmpPath
+	if _, loaded := fs.CompressingOverlays.LoadOrStore(mayafs.NormalizeString(path), struct{}{}); loaded {
+		return
+	}
+	defer fs.CompressingOverlays.Delete(mayafs.NormalizeString(path))
+
+	if fs.isOverlayOpened(path) {
+		return
+	}
+	us, err := os.Stat(*overlayPath)
+	if err != nil || !us.Mode().IsRegular() || us.Size() < overlayCompressMinSize {
+		return
+	}
+
+	tmpPath := *overlayPath + COMPRESSED_SUFFIX + mayafs.WRITEBACK_SUFFIX
+	written, err := func() (int64, error) {
+		src, err := os.Open(*overlayPath)
+		if err != nil {
+			return 0, err
+		}
+		defer src.Close()
+		dst, err := os.Create(tmpPath)
+		if err != nil {
+			return 0, err
+		}
+		written, err := mayafs.WriteZstSeekable(dst, src, overlayCompressFrameSize)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		return written, err
+	}()
+	if err == nil && written >= us.Size() {
+		err = fmt.Errorf("not compressible")
+	}
+	if err == nil {
+		// mtime of compressed file is used as mtime of the file
+		err = os.Chtimes(tmpPath, us.ModTime(), us.ModTime())
+	}
+	if err != nil {
+		fmt.Println("failed to compress overlay", path, err)
+		os.Remove(tmpPath)
+		return
+	}
+
+	unlock := fs.OverlayCompressLocks.Lock(path)
+	defer unlock()
+	if fs.isOverlayOpened(path) {
+		os.Remove(tmpPath)
+		return
+	}
+	if ns, err := os.Stat(*overlayPath); err != nil || ns.Size() != us.Size() || !ns.ModTime().Equal(us.ModTime()) {
+		// modified (or removed) while compressing
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, *overlayPath+COMPRESSED_SUFFIX); err != nil {
+		fmt.Println("failed to compress overlay", path, err)
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Remove(*overlayPath); err != nil {
+		fmt.Println("failed to remove compressed overlay source", path, err)
+		os.Remove(*overlayPath + COMPRESSED_SUFFIX)
+		return
+	}
+	fs.OverlayQuota.Shrink(us.Size() - written)
+	fmt.Println("compressed overlay", path, us.Size(), "->", written)
+}
+
+// decompressOverlay replaces compressed overlay file with plain one, so it can be modified.
+// Caller must hold lock of path in OverlayCompressLocks.
+func (fs *MayakashiFS) decompressOverlay(path string, overlayPath string) int {
+	compressedPath := overlayPath + COMPRESSED_SUFFIX
+	cs, err := os.Stat(compressedPath)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		return fs.overlayWriteError("stat compressed overlay", path, err)
+	}
+	archive, err := openCompressedOverlayArchive(compressedPath)
+	if err != nil {
+		fmt.Println("failed to read compressed overlay", path, err)
+		return -fuse.EIO
+	}
+	compressedFile := archive.Reader.(*os.File)
+	defer compressedFile.Close()
+	if !fs.OverlayQuota.Grow(archive.Size() - cs.Size()) {
+		return fs.overlayQuotaExceeded("decompress", path, archive.Size()-cs.Size())
+	}
+
+	fs.logInfo("decompress overlay", path)
+	tmpPath := overlayPath + mayafs.WRITEBACK_SUFFIX
+	errc := func() int {
+		dst, err := os.Create(tmpPath)
+		if err != nil {
+			return fs.overlayWriteError("create writeback overlay", path, err)
+		}
+		defer dst.Close()
+		buf := make([]byte, overlayCompressFrameSize)
+		offset := int64(0)
+		for offset < archive.Size() {
+			readed, err := fs.ReadZstAt(archive, buf, offset)
+			if err != nil || readed == 0 {
+				fmt.Println("failed to decompress overlay", path, err)
+				return -fuse.EIO
+			}
+			if _, err := dst.Write(buf[:readed]); err != nil {
+				return fs.overlayWriteError("write writeback overlay", path, err)
+			}
+			offset += int64(readed)
+		}
+		if err := dst.Close(); err != nil {
+			return fs.overlayWriteError("close writeback overlay", path, err)
+		}
+		os.Chtimes(tmpPath, cs.ModTime(), cs.ModTime())
+		if err := os.Rename(tmpPath, overlayPath); err != nil {
+			fmt.Println("failed to rename writeback overlay", path, err)
+			return -fuse.EIO
+		}
+		return 0
+	}()
+	if errc != 0 {
+		os.Remove(tmpPath)
+		fs.OverlayQuota.Shrink(archive.Size() - cs.Size())
+		return errc
+	}
+	// must be closed before removing it on Windows
+	compressedFile.Close()
+	if err := os.Remove(compressedPath); err != nil {
+		fmt.Println("failed to remove compressed overlay", path, err)
+	}
+	fs.CompressedOverlaySizes.Delete(compressedPath)
+	return 0
+}
+
+// ensurePlainOverlay decompresses overlay file of path if it is compressed, before modifying it.
+func (fs *MayakashiFS) ensurePlainOverlay(path string) int {
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil || !fs.isCompressiblePath(path) {
+		return 0
+	}
+	unlock := fs.OverlayCompressLocks.Lock(path)
+	defer unlock()
+	return fs.decompressOverlay(path, *overlayPath)
+}
+
+// removeCompressedOverlay removes compressed overlay file of path, e.g. when the file is removed or replaced.
+func (fs *MayakashiFS) removeCompressedOverlay(path string) {
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil || !fs.isCompressiblePath(path) {
+		return
+	}
+	unlock := fs.OverlayCompressLocks.Lock(path)
+	defer unlock()
+	size := overlayFileSize(*overlayPath + COMPRESSED_SUFFIX)
+	if err := fs.removeOverlayFile(*overlayPath + COMPRESSED_SUFFIX); err == nil {
+		fs.CompressedOverlaySizes.Delete(*overlayPath + COMPRESSED_SUFFIX)
+		fs.OverlayQuota.Shrink(size)
+	} else if !os.IsNotExist(err) {
+		fmt.Println("failed to remove compressed overlay", path, err)
+	}
+}
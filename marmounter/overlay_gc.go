@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// GCOverlay removes files in overlay directory which are identical to files in archives
+// (e.g. copied up by opening with write mode, but never modified), so they are served from archives again.
+// Overlay metadata (times, permissions) is kept, since it also applies to files in archives.
+// It should be run while overlay directory is not mounted.
+func (fs *MayakashiFS) GCOverlay() (removed int, freed int64, err error) {
+	if fs.OverlayDir == "" {
+		return 0, 0, fmt.Errorf("overlay directory is not set")
+	}
+	err = filepath.WalkDir(fs.OverlayDir, func(overlayPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if strings.HasSuffix(overlayPath, mayafs.WHITEOUT_SUFFIX) || strings.HasSuffix(overlayPath, mayafs.WRITEBACK_SUFFIX) || strings.HasSuffix(overlayPath, META_SUFFIX) || strings.HasSuffix(overlayPath, COMPRESSED_SUFFIX) {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.OverlayDir, overlayPath)
+		if err != nil {
+			return err
+		}
+		path := "/" + filepath.ToSlash(rel)
+		if p := fs.getOverlayPath(path); p == nil {
+			// under roprefix=, overlay is not used for this path
+			return nil
+		}
+		file, ok := fs.GetFile(path)
+		if !ok {
+			return nil
+		}
+		if whiteoutPath := fs.getOverlayWhiteoutPath(path); whiteoutPath != nil {
+			if _, err := os.Stat(*whiteoutPath); err == nil {
+				return nil
+			}
+		}
+
+		same, err := fs.isSameAsArchive(overlayPath, path, &file)
+		if err != nil {
+			fmt.Println("overlaygc: failed to compare, skipping", path, err)
+			return nil
+		}
+		if !same {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(overlayPath); err != nil {
+			fmt.Println("overlaygc: failed to remove", path, err)
+			return nil
+		}
+		fmt.Println("overlaygc: removed", path)
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// isSameAsArchive compares overlay file with file in archive.
+// .mar files are compared by SHA-256 in index, others are compared by content.
+func (fs *MayakashiFS) isSameAsArchive(overlayPath string, path string, file *mayafs.FileInfo) (bool, error) {
+	f, err := os.Open(overlayPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if st.Size() != file.Size() {
+		return false, nil
+	}
+
+	if file.MarEntry != nil && len(file.MarEntry.Info.OriginalSha256) == sha256.Size {
+		sha := sha256.New()
+		if _, err := io.Copy(sha, f); err != nil {
+			return false, err
+		}
+		return bytes.Equal(sha.Sum(nil), file.MarEntry.Info.OriginalSha256), nil
+	}
+
+	overlayBuf := make([]byte, 1024*1024)
+	archiveBuf := make([]byte, len(overlayBuf))
+	offset := int64(0)
+	for offset < st.Size() {
+		readed, err := fs.ReadFileAt(path, archiveBuf, offset)
+		if err != nil {
+			return false, err
+		}
+		if readed == 0 {
+			return false, fmt.Errorf("unexpected end of file in archive")
+		}
+		if _, err := io.ReadFull(f, overlayBuf[:readed]); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(overlayBuf[:readed], archiveBuf[:readed]) {
+			return false, nil
+		}
+		offset += int64(readed)
+	}
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// With overlayindex=on, names in overlay directory are kept in memory, so lookups of paths which were never written
+// (most of paths in archives) don't stat overlay directory (file, whiteout, compressed file and metadata) every time.
+// It is seeded at mount, and updated before our own writes. It might have paths which were removed, which only costs a stat.
+// With overlayindex=watch, changes made to overlay directory directly (not through the mount) are also followed by fsnotify.
+
+// suffixes of files which are stored next to the file in overlay directory
+var overlaySidecarSuffixes = []string{mayafs.WHITEOUT_SUFFIX, mayafs.WRITEBACK_SUFFIX, META_SUFFIX, COMPRESSED_SUFFIX}
+
+// overlayIndex is a set of paths in mount which might have something in overlay directory, and their parents.
+// nil overlayIndex means everything might be there.
+type overlayIndex struct {
+	mutex sync.RWMutex
+	// normalized paths
+	paths map[string]struct{}
+}
+
+func newOverlayIndex() *overlayIndex {
+	return &overlayIndex{
+		paths: map[string]struct{}{},
+	}
+}
+
+// mayHave reports whether overlay directory might have file, directory, whiteout or metadata for path.
+func (x *overlayIndex) mayHave(path string) bool {
+	if x == nil {
+		return true
+	}
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	_, ok := x.paths[mayafs.NormalizeString(path)]
+	return ok
+}
+
+// touch adds path and its parents, it should be called before something is created for path in overlay directory.
+func (x *overlayIndex) touch(path string) {
+	if x == nil {
+		return
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.add(mayafs.NormalizeString(path))
+}
+
+func (x *overlayIndex) add(lowerPath string) {
+	for {
+		if _, ok := x.paths[lowerPath]; ok {
+			// parents are already added
+			return
+		}
+		x.paths[lowerPath] = struct{}{}
+		if lowerPath == "/" {
+			return
+		}
+		i := strings.LastIndex(lowerPath, "/")
+		lowerPath = lowerPath[:i]
+		if lowerPath == "" {
+			lowerPath = "/"
+		}
+	}
+}
+
+// touchTree adds everything under dir in overlay directory as they are under path in mount (and path itself).
+func (x *overlayIndex) touchTree(path string, dir string) error {
+	if x == nil {
+		return nil
+	}
+	x.touch(path)
+	return filepath.WalkDir(dir, func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return nil
+		}
+		x.touch(strings.TrimSuffix(path, "/") + "/" + trimOverlaySidecarSuffix(filepath.ToSlash(rel)))
+		return nil
+	})
+}
+
+func trimOverlaySidecarSuffix(name string) string {
+	for _, suffix := range overlaySidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return name
+}
+
+func (x *overlayIndex) size() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.paths)
+}
+
+// StartOverlayIndex seeds overlay index (overlayindex=on or watch), and starts watching overlay directory if needed.
+func (fs *MayakashiFS) StartOverlayIndex() error {
+	if fs.OverlayIndexMode == "" || fs.OverlayIndexMode == "off" || fs.OverlayDir == "" {
+		return nil
+	}
+	var watcher *fsnotify.Watcher
+	if fs.OverlayIndexMode == "watch" {
+		// watcher needs the directory, and it is created on first write anyway
+		if err := os.MkdirAll(fs.OverlayDir, 0777); err != nil {
+			return err
+		}
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		// watched before seeding, so files created while seeding are not missed
+		if err := addWatchDirs(w, fs.OverlayDir, true); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to watch overlay directory: %w", err)
+		}
+		watcher = w
+	}
+	index := newOverlayIndex()
+	if err := index.touchTree("/", fs.OverlayDir); err != nil {
+		if watcher != nil {
+			watcher.Close()
+		}
+		return fmt.Errorf("failed to index overlay directory: %w", err)
+	}
+	fmt.Println("overlay index:", index.size(), "paths")
+	fs.OverlayIndex = index
+	if watcher != nil {
+		go fs.watchOverlay(watcher)
+	}
+	return nil
+}
+
+// watchOverlay follows files which are created in overlay directory directly.
+func (fs *MayakashiFS) watchOverlay(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+				// removal leaves path in index, which is harmless
+				continue
+			}
+			rel, err := filepath.Rel(fs.OverlayDir, event.Name)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			path := "/" + trimOverlaySidecarSuffix(filepath.ToSlash(rel))
+			if st, err := os.Stat(event.Name); err == nil && st.IsDir() {
+				if err := addWatchDirs(watcher, event.Name, true); err != nil {
+					fmt.Println("overlay index: failed to watch", event.Name, err)
+				}
+				// directory might be moved in with its contents
+				if err := fs.OverlayIndex.touchTree(path, event.Name); err != nil {
+					fmt.Println("overlay index: failed to index", event.Name, err)
+				}
+			} else {
+				fs.OverlayIndex.touch(path)
+			}
+			fs.NegativeCache.clear()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("overlay index: watch error", err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Sidecar metadata for paths whose attributes can't be stored in overlay directory itself
+// (e.g. timestamps of files which only exists in archives, or permissions/ownership).
+// It is stored as "<path>.__meta__" in overlay directory, like whiteout.
+
+const META_SUFFIX = ".__meta__"
+
+type OverlayMeta struct {
+	Atime *time.Time `json:"atime,omitempty"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+	Mode  *uint32    `json:"mode,omitempty"`
+	Uid   *uint32    `json:"uid,omitempty"`
+	Gid   *uint32    `json:"gid,omitempty"`
+}
+
+// special values of Timespec.Nsec in utimensat(2)
+const (
+	utimeNow  = (1 << 30) - 1
+	utimeOmit = (1 << 30) - 2
+)
+
+func (fs *MayakashiFS) getOverlayMetaPath(path string) *string {
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil {
+		return nil
+	}
+	metaPath := *overlayPath + META_SUFFIX
+	return &metaPath
+}
+
+// loadOverlayMeta returns nil if there is no metadata for path.
+func (fs *MayakashiFS) loadOverlayMeta(path string) *OverlayMeta {
+	metaPath := fs.getOverlayMetaPath(path)
+	if metaPath == nil || !fs.OverlayIndex.mayHave(path) {
+		return nil
+	}
+	data, err := os.ReadFile(*metaPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("failed to read overlay meta", path, err)
+		}
+		return nil
+	}
+	var meta OverlayMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		fmt.Println("failed to parse overlay meta", path, err)
+		return nil
+	}
+	return &meta
+}
+
+func (fs *MayakashiFS) saveOverlayMeta(path string, meta *OverlayMeta) error {
+	metaPath := fs.getOverlayMetaPath(path)
+	if metaPath == nil {
+		return fmt.Errorf("no overlay for %s", path)
+	}
+	fs.OverlayIndex.touch(path)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll((*metaPath)[:strings.LastIndex(*metaPath, "/")], 0777); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*metaPath+mayafs.WRITEBACK_SUFFIX, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(*metaPath+mayafs.WRITEBACK_SUFFIX, *metaPath); err != nil {
+		return err
+	}
+	// stat cached in handlers is now stale
+	lowerPath := mayafs.NormalizeString(path)
+	fs.ArchiveFileHandlers.Range(func(fh uint64, af *ArchiveFileHandler) bool {
+		if mayafs.NormalizeString(af.Path) == lowerPath {
+			fs.ArchiveFileHandlers.Delete(fh)
+		}
+		return true
+	})
+	return nil
+}
+
+func (fs *MayakashiFS) removeOverlayMeta(path string) {
+	metaPath := fs.getOverlayMetaPath(path)
+	if metaPath == nil {
+		return
+	}
+	err := os.Remove(*metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("failed to remove overlay meta", err)
+	}
+}
+
+func (fs *MayakashiFS) renameOverlayMeta(oldPath string, newPath string) {
+	oldMetaPath := fs.getOverlayMetaPath(oldPath)
+	newMetaPath := fs.getOverlayMetaPath(newPath)
+	if oldMetaPath == nil || newMetaPath == nil {
+		return
+	}
+	err := os.Rename(*oldMetaPath, *newMetaPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("failed to rename overlay meta", err)
+	}
+}
+
+// applyTimes overrides timestamps of stat by metadata.
+func (meta *OverlayMeta) applyTimes(stat *fuse.Stat_t) {
+	if meta.Atime != nil {
+		stat.Atim = fuse.NewTimespec(*meta.Atime)
+	}
+	if meta.Mtime != nil {
+		stat.Mtim = fuse.NewTimespec(*meta.Mtime)
+	}
+}
+
+// applyOwnership overrides permission bits and ownership of stat by metadata.
+func (meta *OverlayMeta) applyOwnership(stat *fuse.Stat_t) {
+	if meta.Mode != nil {
+		stat.Mode = stat.Mode&fuse.S_IFMT | *meta.Mode&07777
+	}
+	if meta.Uid != nil {
+		stat.Uid = *meta.Uid
+	}
+	if meta.Gid != nil {
+		stat.Gid = *meta.Gid
+	}
+}
+
+// resolveUtimens converts times passed to Utimens into time.Time.
+// UTIME_OMIT is resolved to current (atime, mtime).
+func resolveUtimens(tmsp []fuse.Timespec, atime time.Time, mtime time.Time) (time.Time, time.Time) {
+	now := time.Now()
+	if tmsp == nil {
+		return now, now
+	}
+	resolve := func(ts fuse.Timespec, current time.Time) time.Time {
+		switch ts.Nsec {
+		case utimeNow:
+			return now
+		case utimeOmit:
+			return current
+		}
+		return ts.Time()
+	}
+	return resolve(tmsp[0], atime), resolve(tmsp[1], mtime)
+}
+
+func (fs *MayakashiFS) Utimens(path string, tmsp []fuse.Timespec) int {
+	defer recoverHandler()
+	if !fs.DisableControlDir && isControlPath(path) {
+		// e.g. `touch` on control files, nothing to do
+		return fs.controlGetattr(path, &fuse.Stat_t{}, ^uint64(0))
+	}
+	if fs.isHiddenPath(path) {
+		return -fuse.ENOENT
+	}
+	if fs.isStubPath(path) {
+		return -fuse.EROFS
+	}
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil {
+		fs.logWarn("tried to utimens on read-only path", path)
+		return -fuse.EROFS
+	}
+	fs.OverlayIndex.touch(path)
+	if errc := fs.ensurePlainOverlay(path); errc != 0 {
+		return errc
+	}
+
+	if us, err := os.Stat(*overlayPath); err == nil {
+		atime, mtime := resolveUtimens(tmsp, us.ModTime(), us.ModTime())
+		if err := os.Chtimes(*overlayPath, atime, mtime); err != nil {
+			fmt.Println("failed to chtimes", path, err)
+			return -fuse.EIO
+		}
+		return 0
+	} else if !os.IsNotExist(err) {
+		fmt.Println("failed to stat overlay", path, err)
+		return -fuse.EIO
+	}
+
+	lowerPath := mayafs.NormalizeString(path)
+	if _, ok := fs.Tree().Directories[lowerPath]; ok {
+		// directory can be copied up without copying contents
+		if err := os.MkdirAll(*overlayPath, 0777); err != nil {
+			return fs.overlayWriteError("mkdir for utimens", path, err)
+		}
+		atime, mtime := resolveUtimens(tmsp, time.Now(), time.Now())
+		if err := os.Chtimes(*overlayPath, atime, mtime); err != nil {
+			fmt.Println("failed to chtimes", path, err)
+			return -fuse.EIO
+		}
+		return 0
+	}
+
+	file, ok := fs.Tree().Files[lowerPath]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if whiteoutPath := fs.getOverlayWhiteoutPath(path); whiteoutPath != nil {
+		if _, err := os.Stat(*whiteoutPath); err == nil {
+			return -fuse.ENOENT
+		}
+	}
+
+	// file only exists in archive, store times in metadata instead of copying whole file
+	meta := fs.loadOverlayMeta(path)
+	if meta == nil {
+		meta = &OverlayMeta{}
+	}
+	currentAtime, currentMtime := file.ModTime(), file.ModTime()
+	if meta.Atime != nil {
+		currentAtime = *meta.Atime
+	}
+	if meta.Mtime != nil {
+		currentMtime = *meta.Mtime
+	}
+	atime, mtime := resolveUtimens(tmsp, currentAtime, currentMtime)
+	meta.Atime = &atime
+	meta.Mtime = &mtime
+	if err := fs.saveOverlayMeta(path, meta); err != nil {
+		return fs.overlayWriteError("save overlay meta", path, err)
+	}
+	return 0
+}
+
+// updateOverlayMeta checks path exists, and saves metadata modified by update.
+func (fs *MayakashiFS) updateOverlayMeta(path string, update func(meta *OverlayMeta)) int {
+	if !fs.DisableControlDir && isControlPath(path) {
+		return -fuse.EPERM
+	}
+	if errc := fs.Getattr(path, &fuse.Stat_t{}, ^uint64(0)); errc != 0 {
+		return errc
+	}
+	if fs.isStubPath(path) || fs.getOverlayPath(path) == nil {
+		return -fuse.EROFS
+	}
+	meta := fs.loadOverlayMeta(path)
+	if meta == nil {
+		meta = &OverlayMeta{}
+	}
+	update(meta)
+	if err := fs.saveOverlayMeta(path, meta); err != nil {
+		return fs.overlayWriteError("save overlay meta", path, err)
+	}
+	return 0
+}
+
+// Chmod and Chown doesn't change overlay files itself (overlay directory might be on filesystem which doesn't support it),
+// just records requested values.
+
+func (fs *MayakashiFS) Chmod(path string, mode uint32) int {
+	defer recoverHandler()
+	return fs.updateOverlayMeta(path, func(meta *OverlayMeta) {
+		mode &= 07777
+		meta.Mode = &mode
+	})
+}
+
+func (fs *MayakashiFS) Chown(path string, uid uint32, gid uint32) int {
+	defer recoverHandler()
+	return fs.updateOverlayMeta(path, func(meta *OverlayMeta) {
+		// -1 means "don't change"
+		if uid != ^uint32(0) {
+			meta.Uid = &uid
+		}
+		if gid != ^uint32(0) {
+			meta.Gid = &gid
+		}
+	})
+}
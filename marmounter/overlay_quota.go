@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// OverlayQuota limits total size of files in overlay directory (overlayquota=), so runaway apps can't fill the disk.
+// Usage is scanned on mount and tracked by writes through the mount.
+// Tracking is not exact (e.g. files replaced by rename, or changed outside of the mount), so it is rescanned periodically.
+type OverlayQuota struct {
+	Limit    int64
+	used     atomic.Int64
+	rejected atomic.Int64
+}
+
+const overlayQuotaRescanInterval = 5 * time.Minute
+
+// Grow reserves n bytes, and returns false if it exceeds the limit. nil OverlayQuota accepts everything.
+func (q *OverlayQuota) Grow(n int64) bool {
+	if q == nil || n <= 0 {
+		return true
+	}
+	for {
+		used := q.used.Load()
+		if used+n > q.Limit {
+			q.rejected.Add(1)
+			return false
+		}
+		if q.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// Shrink releases n bytes.
+func (q *OverlayQuota) Shrink(n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.used.Add(-n)
+}
+
+func (q *OverlayQuota) snapshot() map[string]any {
+	return map[string]any{
+		"limit":    q.Limit,
+		"used":     q.used.Load(),
+		"rejected": q.rejected.Load(),
+	}
+}
+
+// scanOverlayUsage returns total size of regular files in dir.
+func scanOverlayUsage(dir string) int64 {
+	total := int64(0)
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			// ignore errors, files might be removed while scanning
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// StartOverlayQuota scans usage of overlay directory, then keeps rescanning it in background.
+func (fs *MayakashiFS) StartOverlayQuota() {
+	q := fs.OverlayQuota
+	if q == nil || fs.OverlayDir == "" {
+		return
+	}
+	q.used.Store(scanOverlayUsage(fs.OverlayDir))
+	fmt.Println("overlay quota:", q.used.Load(), "/", q.Limit, "bytes used")
+	go func() {
+		for {
+			time.Sleep(overlayQuotaRescanInterval)
+			q.used.Store(scanOverlayUsage(fs.OverlayDir))
+		}
+	}()
+}
+
+// overlayQuotaExceeded logs rejected write and returns ENOSPC.
+func (fs *MayakashiFS) overlayQuotaExceeded(what string, path string, size int64) int {
+	fmt.Println("overlay quota exceeded: rejected to", what, path, size, "bytes", "(limit", fs.OverlayQuota.Limit, "bytes)")
+	return -fuse.ENOSPC
+}
+
+// overlayFileSize returns size of file in overlay directory, or 0 if it doesn't exist.
+func overlayFileSize(path string) int64 {
+	// symbolic links are not followed, they don't use space of their targets
+	if st, err := os.Lstat(path); err == nil && st.Mode().IsRegular() {
+		return st.Size()
+	}
+	return 0
+}
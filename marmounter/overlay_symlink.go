@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Symbolic links (and junctions on Windows) in overlay directory are passed through as symbolic links,
+// instead of being followed. Relative targets are resolved by OS against the mount, absolute ones against the host.
+
+// readOverlaySymlink returns target of overlayPath, or false if it is not a symbolic link (or junction).
+func readOverlaySymlink(overlayPath string) (string, bool) {
+	st, err := os.Lstat(overlayPath)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	target, err := os.Readlink(overlayPath)
+	if err != nil {
+		fmt.Println("failed to readlink", overlayPath, err)
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.ToSlash(target)
+	}
+	return target, true
+}
+
+// getOverlaySymlinkStat fills stat of symbolic link in overlay directory, whose size is length of target.
+func getOverlaySymlinkStat(overlayPath string, st os.FileInfo, stat *fuse.Stat_t) {
+	target, _ := readOverlaySymlink(overlayPath)
+	stat.Mode = fuse.S_IFLNK | 0777
+	stat.Size = int64(len(target))
+	stat.Ctim = fuse.NewTimespec(st.ModTime())
+	stat.Mtim = fuse.NewTimespec(st.ModTime())
+}
+
+// Symlink creates symbolic link in overlay directory.
+// It fails with EPERM where the platform doesn't allow it (e.g. Windows without Developer Mode or the privilege).
+func (fs *MayakashiFS) Symlink(target string, newpath string) int {
+	defer recoverHandler()
+	if !fs.DisableControlDir && isControlPath(newpath) {
+		return -fuse.EACCES
+	}
+	overlayPath := fs.getOverlayPath(newpath)
+	if overlayPath == nil {
+		fmt.Println("tried to create symlink but read-only", newpath)
+		return -fuse.EROFS
+	}
+	if fs.Getattr(newpath, &fuse.Stat_t{}, ^uint64(0)) == 0 {
+		return -fuse.EEXIST
+	}
+	fs.OverlayIndex.touch(newpath)
+	if err := os.MkdirAll((*overlayPath)[:strings.LastIndex(*overlayPath, "/")], 0777); err != nil {
+		return fs.overlayWriteError("mkdir for symlink", newpath, err)
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = filepath.FromSlash(target)
+	}
+	if err := os.Symlink(target, *overlayPath); err != nil {
+		if isDiskFullError(err) {
+			return fs.overlayWriteError("symlink", newpath, err)
+		}
+		fmt.Println("failed to create symlink", newpath, err)
+		return -fuse.EPERM
+	}
+	fs.removeWhiteout(newpath)
+	fs.AuditLog.Record(AuditEntry{Op: "symlink", Path: newpath})
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// Games often read a region of a file in bursts of small reads (e.g. 4-64KiB reads of headers and entries of their own packages).
+// After such reads are seen on a handle, following small reads are served from a larger block which is read at once,
+// so passthrough chunks and stored zip entries take one ReadAt instead of one for every read, and compressed chunks
+// skip cache lookups (and decompression of evicted chunks).
+
+// reads larger than this are not coalesced
+const COALESCE_MAX_READ = 64 << 10
+
+// size of block which is read at once
+const COALESCE_BLOCK_SIZE = 256 << 10
+
+// adjacent small reads before coalescing starts
+const COALESCE_DETECT_READS = 2
+
+// reads which start within this distance after the end of previous read are adjacent
+const COALESCE_GAP = 64 << 10
+
+// readCoalescer is state of read coalescing of archive file handle.
+type readCoalescer struct {
+	mutex sync.Mutex
+	// end of previous read
+	nextOffset int64
+	adjacent   int
+	// block which was read at blockStart of file in tree
+	block      []byte
+	blockStart int64
+	tree       *mayafs.Tree
+}
+
+// readCoalesced reads from block of c, reading new block if reads are coalesced.
+// It returns false if read should be done as usual (it isn't coalesced, or reading block failed).
+func (fs *MayakashiFS) readCoalesced(c *readCoalescer, path string, buff []byte, offset int64) (int, bool) {
+	if !fs.ReadCoalesce || len(buff) > COALESCE_MAX_READ {
+		return 0, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	tree := fs.Tree()
+	if c.tree == tree && offset >= c.blockStart && offset < c.blockStart+int64(len(c.block)) {
+		readed := copy(buff, c.block[offset-c.blockStart:])
+		c.nextOffset = offset + int64(readed)
+		fs.CoalescedReads.Add(1)
+		return readed, true
+	}
+
+	if offset >= c.nextOffset && offset-c.nextOffset <= COALESCE_GAP {
+		c.adjacent++
+	} else {
+		c.adjacent = 0
+	}
+	c.nextOffset = offset + int64(len(buff))
+	if c.adjacent < COALESCE_DETECT_READS {
+		return 0, false
+	}
+
+	if c.block == nil {
+		c.block = mayafs.GetBuffer(COALESCE_BLOCK_SIZE)
+	}
+	block := c.block[:cap(c.block)]
+	filled := 0
+	for filled < len(block) {
+		readed, err := fs.ReadFileAt(path, block[filled:], offset+int64(filled))
+		if err != nil {
+			// read again as usual, which reports the error
+			c.block = c.block[:0]
+			return 0, false
+		}
+		if readed == 0 {
+			break
+		}
+		filled += readed
+	}
+	c.block = block[:filled]
+	c.blockStart = offset
+	c.tree = tree
+	readed := copy(buff, c.block)
+	c.nextOffset = offset + int64(readed)
+	return readed, true
+}
+
+// release returns block to buffer pool, when the handle is released.
+func (c *readCoalescer) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.block != nil {
+		mayafs.PutBuffer(c.block)
+		c.block = nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// AccessRecorder records order and ranges of archived files read in this session,
+// and writes them as commands file which contains preload= rules.
+type AccessRecorder struct {
+	File   string
+	mutex  sync.Mutex
+	order  []string
+	ranges map[string][][2]int64
+	dirty  bool
+}
+
+func NewAccessRecorder(file string) *AccessRecorder {
+	return &AccessRecorder{
+		File:   file,
+		ranges: map[string][][2]int64{},
+	}
+}
+
+func (r *AccessRecorder) Record(path string, offset int64, length int) {
+	if length <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ranges, ok := r.ranges[path]
+	if !ok {
+		r.order = append(r.order, path)
+	}
+	r.ranges[path] = mergeRange(ranges, [2]int64{offset, offset + int64(length)})
+	r.dirty = true
+}
+
+// mergeRange adds [start, end) range to sorted and non-overlapped ranges.
+func mergeRange(ranges [][2]int64, add [2]int64) [][2]int64 {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i][1] >= add[0] })
+	j := i
+	for j < len(ranges) && ranges[j][0] <= add[1] {
+		if ranges[j][0] < add[0] {
+			add[0] = ranges[j][0]
+		}
+		if ranges[j][1] > add[1] {
+			add[1] = ranges[j][1]
+		}
+		j++
+	}
+	merged := append([][2]int64{}, ranges[:i]...)
+	merged = append(merged, add)
+	return append(merged, ranges[j:]...)
+}
+
+// escapeGlob escapes glob meta characters, so path can be used as preload= rule.
+func escapeGlob(path string) string {
+	var sb strings.Builder
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', ']', '{', '}', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// Save writes recorded accesses if there is any change since last save.
+func (r *AccessRecorder) Save() error {
+	r.mutex.Lock()
+	if !r.dirty {
+		r.mutex.Unlock()
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# recorded by marmounter at %s, use this file with commandsfile=\n", time.Now().Format(time.RFC3339))
+	for _, path := range r.order {
+		rangeStrs := []string{}
+		for _, rng := range r.ranges[path] {
+			rangeStrs = append(rangeStrs, fmt.Sprintf("%d-%d", rng[0], rng[1]))
+		}
+		fmt.Fprintf(&sb, "# read %s\n", strings.Join(rangeStrs, ","))
+		fmt.Fprintf(&sb, "preload=%s\n", escapeGlob(path))
+	}
+	r.dirty = false
+	r.mutex.Unlock()
+
+	if err := os.WriteFile(r.File+mayafs.WRITEBACK_SUFFIX, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(r.File+mayafs.WRITEBACK_SUFFIX, r.File)
+}
+
+// StartAutoSave saves recorded accesses periodically, so we don't lose them when marmounter is killed.
+func (r *AccessRecorder) StartAutoSave(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := r.Save(); err != nil {
+				fmt.Println("failed to save access record", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// HTTP server which exposes .mar archives (index and .dat parts) of this filesystem with Range support,
+// so other marmounter instances can mount them by URL (e.g. "http://server:8080/game.mar" with remotetoken=).
+// "<file>.blocks" is sha256 of each block of the file, which clients use to verify blocks from their peers (peer=).
+
+type serveArchive struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+// servedFiles returns local archive files which can be downloaded, keyed by file name.
+// Archives are looked up on each request, so archives which are added later (e.g. by dirwatch) are served too.
+func (fs *MayakashiFS) servedFiles() ([]serveArchive, map[string]string) {
+	archives := []serveArchive{}
+	files := map[string]string{}
+	for _, a := range fs.Archives() {
+		if a.IsDirectory || mayafs.IsRemoteFile(a.File) || !strings.HasSuffix(a.File, ".mar") {
+			continue
+		}
+		name := filepath.Base(a.File)
+		if _, ok := files[name+".idx"]; ok {
+			// same name in different directories, first one wins
+			continue
+		}
+		sa := serveArchive{Name: name, Files: []string{name + ".idx"}}
+		files[name+".idx"] = a.File + ".idx"
+		for _, datPath := range a.DataFiles {
+			datName := filepath.Base(datPath)
+			sa.Files = append(sa.Files, datName)
+			files[datName] = datPath
+		}
+		archives = append(archives, sa)
+	}
+	return archives, files
+}
+
+// servedBlockSums caches "<file>.blocks" by path, since calculating it reads the whole file.
+type servedBlockSums struct {
+	ETag string
+	Data []byte
+}
+
+var servedBlockSumsMutex sync.Mutex
+var servedBlockSumsCache = map[string]servedBlockSums{}
+
+// blockSums returns "<file>.blocks" of f, which is served with etag.
+func blockSums(path string, f *os.File, etag string) ([]byte, error) {
+	servedBlockSumsMutex.Lock()
+	defer servedBlockSumsMutex.Unlock()
+	if cached, ok := servedBlockSumsCache[path]; ok && cached.ETag == etag {
+		return cached.Data, nil
+	}
+	buf := bytes.Buffer{}
+	if err := mayafs.WriteRemoteBlockSums(&buf, f, etag); err != nil {
+		return nil, err
+	}
+	servedBlockSumsCache[path] = servedBlockSums{ETag: etag, Data: buf.Bytes()}
+	return buf.Bytes(), nil
+}
+
+func (fs *MayakashiFS) authorizeServe(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(fs.ServeToken)) == 1
+}
+
+func (fs *MayakashiFS) handleServe(w http.ResponseWriter, r *http.Request) {
+	if !fs.authorizeServe(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mayakashi"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archives, files := fs.servedFiles()
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"archives": archives})
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	name, isBlockSums := strings.CutSuffix(name, ".blocks")
+	path, ok := files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// client discards its cached blocks when this changes (e.g. archive is rebuilt by vacuum)
+	etag := fmt.Sprintf(`"%x-%x"`, st.Size(), st.ModTime().UnixNano())
+	if isBlockSums {
+		data, err := blockSums(path, f, etag)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, st.Name(), st.ModTime(), f)
+}
+
+// ServeArchives serves .mar archives of this filesystem on addr, until it fails.
+func (fs *MayakashiFS) ServeArchives(addr string) error {
+	if fs.ServeToken == "" {
+		return errors.New("servetoken= is required")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", fs.handleServe)
+	archives, _ := fs.servedFiles()
+	for _, a := range archives {
+		fmt.Printf("Serving %s on %s\n", a.Name, addr)
+	}
+	return http.ListenAndServe(addr, mux)
+}
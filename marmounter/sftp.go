@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP (version 3) server, which is backed by MayakashiFS's FUSE handlers so overlay writes also works.
+
+const DEFAULT_SFTP_HOST_KEY = "sftp_host_key"
+const SFTP_MAX_PACKET = 256 * 1024
+const SFTP_READDIR_BATCH = 100
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+const (
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+)
+
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpFlagRead   = 0x1
+	sftpFlagWrite  = 0x2
+	sftpFlagAppend = 0x4
+	sftpFlagCreat  = 0x8
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// SFTPUser is a user which can login to SFTP server by password.
+type SFTPUser struct {
+	Name     string
+	Password string
+}
+
+type sftpDirEntry struct {
+	Name string
+	Stat fuse.Stat_t
+}
+
+type sftpOpenHandle struct {
+	Path    string
+	Fh      uint64
+	IsDir   bool
+	Entries []sftpDirEntry
+}
+
+type sftpSession struct {
+	fs       *MayakashiFS
+	ch       ssh.Channel
+	wMu      sync.Mutex
+	handles  map[string]*sftpOpenHandle
+	hMu      sync.Mutex
+	handleNo uint64
+}
+
+// ParseSFTPUser parses "user:password".
+func ParseSFTPUser(s string) (SFTPUser, error) {
+	up := strings.SplitN(s, ":", 2)
+	if len(up) != 2 || up[0] == "" {
+		return SFTPUser{}, fmt.Errorf("invalid sftpuser (should be user:password): %s", s)
+	}
+	return SFTPUser{Name: up[0], Password: up[1]}, nil
+}
+
+func (fs *MayakashiFS) sftpServerConfig() (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{}
+
+	if len(fs.SFTPUsers) > 0 {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			for _, u := range fs.SFTPUsers {
+				if u.Name == conn.User() && subtle.ConstantTimeCompare([]byte(u.Password), password) == 1 {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("invalid password for %s", conn.User())
+		}
+	}
+
+	if fs.SFTPAuthorizedKeys != "" {
+		data, err := os.ReadFile(fs.SFTPAuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read authorized keys: %w", err)
+		}
+		keys := map[string]struct{}{}
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse authorized keys: %w", err)
+			}
+			keys[string(key.Marshal())] = struct{}{}
+			data = rest
+		}
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := keys[string(key.Marshal())]; ok {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		}
+	}
+
+	if config.PasswordCallback == nil && config.PublicKeyCallback == nil {
+		return nil, fmt.Errorf("sftp requires sftpuser= or sftpauthorizedkeys=")
+	}
+
+	hostKey, err := loadOrCreateSFTPHostKey(fs.SFTPHostKey)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(hostKey)
+
+	return config, nil
+}
+
+func loadOrCreateSFTPHostKey(file string) (ssh.Signer, error) {
+	if file == "" {
+		file = DEFAULT_SFTP_HOST_KEY
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fmt.Println("generating sftp host key", file)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "marmounter")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// ServeSFTP listens on addr and serves fs by SFTP until error.
+func (fs *MayakashiFS) ServeSFTP(addr string) error {
+	config, err := fs.sftpServerConfig()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("SFTP server listening on", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go fs.handleSSHConn(conn, config)
+	}
+}
+
+func (fs *MayakashiFS) handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		fmt.Println("SFTP: handshake failed", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	fmt.Println("SFTP: logged in", sconn.User(), conn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			fmt.Println("SFTP: failed to accept channel", err)
+			continue
+		}
+		go func(ch ssh.Channel, requests <-chan *ssh.Request) {
+			for req := range requests {
+				// payload of subsystem request is string("sftp")
+				ok := req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					session := &sftpSession{
+						fs:      fs,
+						ch:      ch,
+						handles: map[string]*sftpOpenHandle{},
+					}
+					go session.serve()
+				}
+			}
+		}(ch, requests)
+	}
+}
+
+func (s *sftpSession) serve() {
+	defer s.ch.Close()
+	defer s.closeAllHandles()
+	r := bufio.NewReader(s.ch)
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			if err != io.EOF {
+				fmt.Println("SFTP: failed to read packet", err)
+			}
+			return
+		}
+		if length < 1 || length > SFTP_MAX_PACKET {
+			fmt.Println("SFTP: invalid packet length", length)
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			fmt.Println("SFTP: failed to read packet", err)
+			return
+		}
+		s.handle(packet[0], &sftpBuf{b: packet[1:]})
+	}
+}
+
+func (s *sftpSession) closeAllHandles() {
+	s.hMu.Lock()
+	defer s.hMu.Unlock()
+	for _, h := range s.handles {
+		if !h.IsDir {
+			s.fs.Release(h.Path, h.Fh)
+		}
+	}
+	s.handles = nil
+}
+
+// sftpBuf is a big-endian encoder/decoder for SFTP packets.
+type sftpBuf struct {
+	b   []byte
+	err error
+}
+
+func (b *sftpBuf) u32() uint32 {
+	if len(b.b) < 4 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.b)
+	b.b = b.b[4:]
+	return v
+}
+
+func (b *sftpBuf) u64() uint64 {
+	if len(b.b) < 8 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(b.b)
+	b.b = b.b[8:]
+	return v
+}
+
+func (b *sftpBuf) str() string {
+	l := int(b.u32())
+	if len(b.b) < l {
+		b.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(b.b[:l])
+	b.b = b.b[l:]
+	return v
+}
+
+// attrs reads ATTRS and returns size (or -1 if not specified).
+func (b *sftpBuf) attrs() int64 {
+	size := int64(-1)
+	flags := b.u32()
+	if flags&sftpAttrSize != 0 {
+		size = int64(b.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		b.u32()
+		b.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		b.u32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		b.u32()
+		b.u32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		count := b.u32()
+		for i := uint32(0); i < count && b.err == nil; i++ {
+			b.str()
+			b.str()
+		}
+	}
+	return size
+}
+
+func (b *sftpBuf) putU8(v uint8) { b.b = append(b.b, v) }
+func (b *sftpBuf) putU32(v uint32) {
+	b.b = binary.BigEndian.AppendUint32(b.b, v)
+}
+func (b *sftpBuf) putU64(v uint64) {
+	b.b = binary.BigEndian.AppendUint64(b.b, v)
+}
+func (b *sftpBuf) putStr(s string) {
+	b.putU32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+func (b *sftpBuf) putAttrs(stat *fuse.Stat_t) {
+	b.putU32(sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime)
+	b.putU64(uint64(stat.Size))
+	b.putU32(stat.Mode)
+	b.putU32(uint32(stat.Mtim.Sec))
+	b.putU32(uint32(stat.Mtim.Sec))
+}
+
+func (s *sftpSession) send(typ uint8, body []byte) {
+	packet := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(body)))
+	packet[4] = typ
+	packet = append(packet, body...)
+
+	s.wMu.Lock()
+	defer s.wMu.Unlock()
+	if _, err := s.ch.Write(packet); err != nil {
+		fmt.Println("SFTP: failed to write packet", err)
+	}
+}
+
+func (s *sftpSession) sendStatus(id uint32, code uint32, message string) {
+	var b sftpBuf
+	b.putU32(id)
+	b.putU32(code)
+	b.putStr(message)
+	b.putStr("")
+	s.send(sftpStatus, b.b)
+}
+
+// sendErrno sends status from FUSE handler's result.
+func (s *sftpSession) sendErrno(id uint32, errc int) {
+	switch errc {
+	case 0:
+		s.sendStatus(id, sftpStatusOK, "OK")
+	case -fuse.ENOENT:
+		s.sendStatus(id, sftpStatusNoSuchFile, "No such file")
+	case -fuse.EROFS, -fuse.EPERM, -fuse.EACCES:
+		s.sendStatus(id, sftpStatusPermissionDenied, "Permission denied")
+	case -fuse.ENOSYS:
+		s.sendStatus(id, sftpStatusOpUnsupported, "Operation unsupported")
+	default:
+		s.sendStatus(id, sftpStatusFailure, "Failure (errno "+strconv.Itoa(-errc)+")")
+	}
+}
+
+func (s *sftpSession) addHandle(h *sftpOpenHandle) string {
+	s.hMu.Lock()
+	defer s.hMu.Unlock()
+	s.handleNo++
+	name := strconv.FormatUint(s.handleNo, 10)
+	s.handles[name] = h
+	return name
+}
+
+func (s *sftpSession) getHandle(name string) *sftpOpenHandle {
+	s.hMu.Lock()
+	defer s.hMu.Unlock()
+	return s.handles[name]
+}
+
+func (s *sftpSession) removeHandle(name string) *sftpOpenHandle {
+	s.hMu.Lock()
+	defer s.hMu.Unlock()
+	h := s.handles[name]
+	delete(s.handles, name)
+	return h
+}
+
+func sftpCleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func sftpLongName(name string, stat *fuse.Stat_t) string {
+	mode := os.FileMode(stat.Mode & 0777)
+	if stat.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+		mode |= os.ModeDir
+	}
+	mtime := time.Unix(stat.Mtim.Sec, 0)
+	return fmt.Sprintf("%s 1 mayakashi mayakashi %d %s %s", mode.String(), stat.Size, mtime.Format("Jan _2 15:04"), name)
+}
+
+func (s *sftpSession) handle(typ uint8, req *sftpBuf) {
+	defer recoverHandler()
+	if typ == sftpInit {
+		var b sftpBuf
+		b.putU32(3)
+		s.send(sftpVersion, b.b)
+		return
+	}
+
+	id := req.u32()
+	var res sftpBuf
+	res.putU32(id)
+
+	switch typ {
+	case sftpRealpath:
+		p := sftpCleanPath(req.str())
+		res.putU32(1)
+		res.putStr(p)
+		res.putStr(p)
+		res.putU32(0) // empty attrs
+		s.send(sftpName, res.b)
+
+	case sftpStat, sftpLstat:
+		var stat fuse.Stat_t
+		if errc := s.fs.Getattr(sftpCleanPath(req.str()), &stat, ^uint64(0)); errc != 0 {
+			s.sendErrno(id, errc)
+			return
+		}
+		res.putAttrs(&stat)
+		s.send(sftpAttrs, res.b)
+
+	case sftpFstat:
+		h := s.getHandle(req.str())
+		if h == nil {
+			s.sendStatus(id, sftpStatusFailure, "invalid handle")
+			return
+		}
+		var stat fuse.Stat_t
+		if errc := s.fs.Getattr(h.Path, &stat, h.Fh); errc != 0 {
+			s.sendErrno(id, errc)
+			return
+		}
+		res.putAttrs(&stat)
+		s.send(sftpAttrs, res.b)
+
+	case sftpOpen:
+		p := sftpCleanPath(req.str())
+		pflags := req.u32()
+		req.attrs()
+		if req.err != nil {
+			s.sendStatus(id, sftpStatusBadMessage, "bad message")
+			return
+		}
+		flags := fuse.O_RDONLY
+		if pflags&sftpFlagWrite != 0 {
+			if pflags&sftpFlagRead != 0 {
+				flags = fuse.O_RDWR
+			} else {
+				flags = fuse.O_WRONLY
+			}
+		}
+		if pflags&sftpFlagAppend != 0 {
+			flags |= fuse.O_APPEND
+		}
+		if pflags&sftpFlagTrunc != 0 {
+			flags |= fuse.O_TRUNC
+		}
+		var stat fuse.Stat_t
+		exists := s.fs.Getattr(p, &stat, ^uint64(0)) == 0
+		if exists && pflags&sftpFlagCreat != 0 && pflags&sftpFlagExcl != 0 {
+			s.sendStatus(id, sftpStatusFailure, "file already exists")
+			return
+		}
+		var errc int
+		var fh uint64
+		if !exists && pflags&sftpFlagCreat != 0 {
+			errc, fh = s.fs.Create(p, flags, 0644)
+		} else {
+			errc, fh = s.fs.Open(p, flags)
+			if errc == 0 && flags&fuse.O_TRUNC != 0 {
+				errc = s.fs.Truncate(p, 0, fh)
+			}
+		}
+		if errc != 0 {
+			s.sendErrno(id, errc)
+			return
+		}
+		res.putStr(s.addHandle(&sftpOpenHandle{Path: p, Fh: fh}))
+		s.send(sftpHandle, res.b)
+
+	case sftpOpendir:
+		p := sftpCleanPath(req.str())
+		h := &sftpOpenHandle{Path: p, IsDir: true}
+		errc := s.fs.Readdir(p, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			if stat != nil {
+				h.Entries = append(h.Entries, sftpDirEntry{Name: name, Stat: *stat})
+			}
+			return true
+		}, 0, 0)
+		if errc != 0 {
+			s.sendErrno(id, errc)
+			return
+		}
+		res.putStr(s.addHandle(h))
+		s.send(sftpHandle, res.b)
+
+	case sftpReaddir:
+		h := s.getHandle(req.str())
+		if h == nil || !h.IsDir {
+			s.sendStatus(id, sftpStatusFailure, "invalid handle")
+			return
+		}
+		if len(h.Entries) == 0 {
+			s.sendStatus(id, sftpStatusEOF, "EOF")
+			return
+		}
+		entries := h.Entries
+		if len(entries) > SFTP_READDIR_BATCH {
+			entries = entries[:SFTP_READDIR_BATCH]
+		}
+		h.Entries = h.Entries[len(entries):]
+		res.putU32(uint32(len(entries)))
+		for _, e := range entries {
+			res.putStr(e.Name)
+			res.putStr(sftpLongName(e.Name, &e.Stat))
+			res.putAttrs(&e.Stat)
+		}
+		s.send(sftpName, res.b)
+
+	case sftpRead:
+		h := s.getHandle(req.str())
+		offset := req.u64()
+		length := req.u32()
+		if h == nil || h.IsDir {
+			s.sendStatus(id, sftpStatusFailure, "invalid handle")
+			return
+		}
+		if length > SFTP_MAX_PACKET-64 {
+			length = SFTP_MAX_PACKET - 64
+		}
+		buf := make([]byte, length)
+		readed := s.fs.Read(h.Path, buf, int64(offset), h.Fh)
+		if readed < 0 {
+			s.sendErrno(id, readed)
+			return
+		}
+		if readed == 0 {
+			s.sendStatus(id, sftpStatusEOF, "EOF")
+			return
+		}
+		res.putStr(string(buf[:readed]))
+		s.send(sftpData, res.b)
+
+	case sftpWrite:
+		h := s.getHandle(req.str())
+		offset := req.u64()
+		data := req.str()
+		if h == nil || h.IsDir {
+			s.sendStatus(id, sftpStatusFailure, "invalid handle")
+			return
+		}
+		written := s.fs.Write(h.Path, []byte(data), int64(offset), h.Fh)
+		if written < 0 {
+			s.sendErrno(id, written)
+			return
+		}
+		s.sendErrno(id, 0)
+
+	case sftpClose:
+		h := s.removeHandle(req.str())
+		if h == nil {
+			s.sendStatus(id, sftpStatusFailure, "invalid handle")
+			return
+		}
+		if !h.IsDir {
+			s.fs.Release(h.Path, h.Fh)
+		}
+		s.sendErrno(id, 0)
+
+	case sftpSetstat, sftpFsetstat:
+		var p string
+		fh := ^uint64(0)
+		if typ == sftpSetstat {
+			p = sftpCleanPath(req.str())
+		} else {
+			h := s.getHandle(req.str())
+			if h == nil {
+				s.sendStatus(id, sftpStatusFailure, "invalid handle")
+				return
+			}
+			p = h.Path
+			fh = h.Fh
+		}
+		// only size is supported, others are silently ignored
+		if size := req.attrs(); size >= 0 {
+			s.sendErrno(id, s.fs.Truncate(p, size, fh))
+			return
+		}
+		s.sendErrno(id, 0)
+
+	case sftpRemove:
+		s.sendErrno(id, s.fs.Unlink(sftpCleanPath(req.str())))
+
+	case sftpMkdir:
+		s.sendErrno(id, s.fs.Mkdir(sftpCleanPath(req.str()), 0777))
+
+	case sftpRmdir:
+		s.sendErrno(id, s.fs.Rmdir(sftpCleanPath(req.str())))
+
+	case sftpRename:
+		oldPath := sftpCleanPath(req.str())
+		newPath := sftpCleanPath(req.str())
+		s.sendErrno(id, s.fs.Rename(oldPath, newPath))
+
+	default:
+		s.sendStatus(id, sftpStatusOpUnsupported, "Operation unsupported")
+	}
+}
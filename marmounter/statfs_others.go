@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func getVolumeStat(dir string) (*volumeStat, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return nil, err
+	}
+	return &volumeStat{
+		BlockSize: uint64(st.Bsize),
+		Blocks:    uint64(st.Blocks),
+		Bfree:     uint64(st.Bfree),
+		Bavail:    uint64(st.Bavail),
+		Files:     uint64(st.Files),
+		Ffree:     uint64(st.Ffree),
+	}, nil
+}
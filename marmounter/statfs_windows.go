@@ -0,0 +1,22 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+func getVolumeStat(dir string) (*volumeStat, error) {
+	dirPtr, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return nil, err
+	}
+	var freeAvailable, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dirPtr, &freeAvailable, &total, &totalFree); err != nil {
+		return nil, err
+	}
+	// Windows doesn't tell block size here, WinFsp only uses bytes (blocks * frsize) anyway
+	const blockSize = 4096
+	return &volumeStat{
+		BlockSize: blockSize,
+		Blocks:    total / blockSize,
+		Bfree:     totalFree / blockSize,
+		Bavail:    freeAvailable / blockSize,
+	}, nil
+}
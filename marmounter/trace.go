@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// tracingFS logs every FUSE operation of MayakashiFS with arguments, result and latency (trace / trace=<glob>),
+// as "trace <JSON>" lines in stdout.
+// Operations which aren't implemented by MayakashiFS (e.g. Rmdir) go to fuse.FileSystemBase without logging.
+type tracingFS struct {
+	*MayakashiFS
+}
+
+type traceEntry struct {
+	Op        string         `json:"op"`
+	Path      string         `json:"path"`
+	Args      map[string]any `json:"args,omitempty"`
+	Result    int            `json:"result"`
+	LatencyUs int64          `json:"latency_us"`
+}
+
+// shouldTrace reports whether operation on path should be logged.
+func (fs *tracingFS) shouldTrace(paths ...string) bool {
+	if len(fs.TraceGlobs) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		if matchAnyGlob(fs.TraceGlobs, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// trace logs operation which started at start. Negative result is an error code.
+func (fs *tracingFS) trace(op string, path string, start time.Time, result int, args map[string]any) {
+	latency := time.Since(start)
+	line, err := json.Marshal(traceEntry{
+		Op:        op,
+		Path:      path,
+		Args:      args,
+		Result:    result,
+		LatencyUs: latency.Microseconds(),
+	})
+	if err != nil {
+		fmt.Println("failed to encode trace", op, path, err)
+		return
+	}
+	fmt.Println("trace", string(line))
+}
+
+func (fs *tracingFS) Destroy() {
+	start := time.Now()
+	fs.MayakashiFS.Destroy()
+	fs.trace("destroy", "", start, 0, nil)
+}
+
+func (fs *tracingFS) Statfs(path string, stat *fuse.Statfs_t) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Statfs(path, stat)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Statfs(path, stat)
+	fs.trace("statfs", path, start, errc, nil)
+	return errc
+}
+
+func (fs *tracingFS) Mkdir(path string, mode uint32) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Mkdir(path, mode)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Mkdir(path, mode)
+	fs.trace("mkdir", path, start, errc, map[string]any{"mode": mode})
+	return errc
+}
+
+func (fs *tracingFS) Unlink(path string) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Unlink(path)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Unlink(path)
+	fs.trace("unlink", path, start, errc, nil)
+	return errc
+}
+
+func (fs *tracingFS) Rename(oldpath string, newpath string) int {
+	if !fs.shouldTrace(oldpath, newpath) {
+		return fs.MayakashiFS.Rename(oldpath, newpath)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Rename(oldpath, newpath)
+	fs.trace("rename", oldpath, start, errc, map[string]any{"newpath": newpath})
+	return errc
+}
+
+func (fs *tracingFS) Chmod(path string, mode uint32) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Chmod(path, mode)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Chmod(path, mode)
+	fs.trace("chmod", path, start, errc, map[string]any{"mode": mode})
+	return errc
+}
+
+func (fs *tracingFS) Chown(path string, uid uint32, gid uint32) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Chown(path, uid, gid)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Chown(path, uid, gid)
+	fs.trace("chown", path, start, errc, map[string]any{"uid": uid, "gid": gid})
+	return errc
+}
+
+func (fs *tracingFS) Utimens(path string, tmsp []fuse.Timespec) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Utimens(path, tmsp)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Utimens(path, tmsp)
+	times := []string{}
+	for _, t := range tmsp {
+		times = append(times, t.Time().Format(time.RFC3339Nano))
+	}
+	fs.trace("utimens", path, start, errc, map[string]any{"times": times})
+	return errc
+}
+
+func (fs *tracingFS) Access(path string, mask uint32) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Access(path, mask)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Access(path, mask)
+	fs.trace("access", path, start, errc, map[string]any{"mask": mask})
+	return errc
+}
+
+func (fs *tracingFS) Create(path string, flags int, mode uint32) (int, uint64) {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Create(path, flags, mode)
+	}
+	start := time.Now()
+	errc, fh := fs.MayakashiFS.Create(path, flags, mode)
+	fs.trace("create", path, start, errc, map[string]any{"flags": flags, "mode": mode, "fh": fh})
+	return errc, fh
+}
+
+func (fs *tracingFS) CreateEx(path string, mode uint32, fi *fuse.FileInfo_t) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.CreateEx(path, mode, fi)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.CreateEx(path, mode, fi)
+	fs.trace("create", path, start, errc, map[string]any{"flags": fi.Flags, "mode": mode, "fh": fi.Fh})
+	return errc
+}
+
+func (fs *tracingFS) Open(path string, flags int) (int, uint64) {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Open(path, flags)
+	}
+	start := time.Now()
+	errc, fh := fs.MayakashiFS.Open(path, flags)
+	fs.trace("open", path, start, errc, map[string]any{"flags": flags, "fh": fh})
+	return errc, fh
+}
+
+func (fs *tracingFS) OpenEx(path string, fi *fuse.FileInfo_t) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.OpenEx(path, fi)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.OpenEx(path, fi)
+	fs.trace("open", path, start, errc, map[string]any{"flags": fi.Flags, "fh": fi.Fh})
+	return errc
+}
+
+func (fs *tracingFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Getattr(path, stat, fh)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Getattr(path, stat, fh)
+	args := map[string]any{"fh": fh}
+	if errc == 0 {
+		args["mode"] = stat.Mode
+		args["size"] = stat.Size
+	}
+	fs.trace("getattr", path, start, errc, args)
+	return errc
+}
+
+func (fs *tracingFS) Readlink(path string) (int, string) {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Readlink(path)
+	}
+	start := time.Now()
+	errc, target := fs.MayakashiFS.Readlink(path)
+	fs.trace("readlink", path, start, errc, map[string]any{"target": target})
+	return errc, target
+}
+
+func (fs *tracingFS) Symlink(target string, newpath string) int {
+	if !fs.shouldTrace(newpath) {
+		return fs.MayakashiFS.Symlink(target, newpath)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Symlink(target, newpath)
+	fs.trace("symlink", newpath, start, errc, map[string]any{"target": target})
+	return errc
+}
+
+func (fs *tracingFS) Truncate(path string, size int64, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Truncate(path, size, fh)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Truncate(path, size, fh)
+	fs.trace("truncate", path, start, errc, map[string]any{"size": size, "fh": fh})
+	return errc
+}
+
+func (fs *tracingFS) Read(path string, buff []byte, ofst int64, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Read(path, buff, ofst, fh)
+	}
+	start := time.Now()
+	n := fs.MayakashiFS.Read(path, buff, ofst, fh)
+	fs.trace("read", path, start, n, map[string]any{"offset": ofst, "length": len(buff), "fh": fh})
+	return n
+}
+
+func (fs *tracingFS) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Write(path, buff, ofst, fh)
+	}
+	start := time.Now()
+	n := fs.MayakashiFS.Write(path, buff, ofst, fh)
+	fs.trace("write", path, start, n, map[string]any{"offset": ofst, "length": len(buff), "fh": fh})
+	return n
+}
+
+func (fs *tracingFS) Release(path string, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Release(path, fh)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Release(path, fh)
+	fs.trace("release", path, start, errc, map[string]any{"fh": fh})
+	return errc
+}
+
+func (fs *tracingFS) Opendir(path string) (int, uint64) {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Opendir(path)
+	}
+	start := time.Now()
+	errc, fh := fs.MayakashiFS.Opendir(path)
+	fs.trace("opendir", path, start, errc, map[string]any{"fh": fh})
+	return errc, fh
+}
+
+func (fs *tracingFS) Readdir(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64,
+	fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Readdir(path, fill, ofst, fh)
+	}
+	start := time.Now()
+	entries := 0
+	errc := fs.MayakashiFS.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		entries++
+		return fill(name, stat, ofst)
+	}, ofst, fh)
+	fs.trace("readdir", path, start, errc, map[string]any{"offset": ofst, "fh": fh, "entries": entries})
+	return errc
+}
+
+func (fs *tracingFS) Releasedir(path string, fh uint64) int {
+	if !fs.shouldTrace(path) {
+		return fs.MayakashiFS.Releasedir(path, fh)
+	}
+	start := time.Now()
+	errc := fs.MayakashiFS.Releasedir(path, fh)
+	fs.trace("releasedir", path, start, errc, map[string]any{"fh": fh})
+	return errc
+}
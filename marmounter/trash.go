@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trash (trashdir=) keeps overlay files removed by Unlink as "<trashdir>/<time>/<path>" instead of removing them,
+// so they can be restored by undelete=<path> command until they expire.
+
+const trashTimeFormat = "20060102-150405.000000000"
+
+const trashCleanupInterval = 1 * time.Hour
+
+// moveToTrash moves file in overlay directory to new trash entry.
+// It returns error same as os.Remove, so callers can handle os.IsNotExist as before.
+func (fs *MayakashiFS) moveToTrash(overlayFile string) error {
+	rel, err := filepath.Rel(fs.OverlayDir, overlayFile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(overlayFile); err != nil {
+		return err
+	}
+	trashPath := filepath.Join(fs.TrashDir, time.Now().Format(trashTimeFormat), rel)
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0777); err != nil {
+		fmt.Println("failed to create trash directory, removing without trash", overlayFile, err)
+		return os.Remove(overlayFile)
+	}
+	if err := os.Rename(overlayFile, trashPath); err != nil {
+		// e.g. trash directory is on another volume
+		fmt.Println("failed to move to trash, removing without trash", overlayFile, err)
+		return os.Remove(overlayFile)
+	}
+	fs.logInfo("moved to trash", overlayFile, trashPath)
+	return nil
+}
+
+// removeOverlayFile removes file in overlay directory, or moves it to trash if enabled.
+func (fs *MayakashiFS) removeOverlayFile(overlayFile string) error {
+	if fs.TrashDir == "" {
+		return os.Remove(overlayFile)
+	}
+	return fs.moveToTrash(overlayFile)
+}
+
+// trashEntries returns names of trash entries (which are times), older first.
+func (fs *MayakashiFS) trashEntries() ([]string, error) {
+	entries, err := os.ReadDir(fs.TrashDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if _, err := time.ParseInLocation(trashTimeFormat, e.Name(), time.Local); err == nil && e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// cleanupTrash removes trash entries older than retention.
+func (fs *MayakashiFS) cleanupTrash() {
+	names, err := fs.trashEntries()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("failed to list trash", err)
+		}
+		return
+	}
+	for _, name := range names {
+		removedAt, _ := time.ParseInLocation(trashTimeFormat, name, time.Local)
+		if time.Since(removedAt) < fs.TrashRetention {
+			// sorted, rest of them are newer
+			break
+		}
+		fmt.Println("trash: removing expired", name)
+		if err := os.RemoveAll(filepath.Join(fs.TrashDir, name)); err != nil {
+			fmt.Println("failed to remove expired trash", name, err)
+		}
+	}
+}
+
+// StartTrash removes expired trash entries, and keeps removing them in background.
+func (fs *MayakashiFS) StartTrash() {
+	if fs.TrashDir == "" || fs.TrashRetention <= 0 {
+		return
+	}
+	fs.cleanupTrash()
+	go func() {
+		for {
+			time.Sleep(trashCleanupInterval)
+			fs.cleanupTrash()
+		}
+	}()
+}
+
+// ListTrash prints files in trash with time they were removed.
+func (fs *MayakashiFS) ListTrash() error {
+	names, err := fs.trashEntries()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		root := filepath.Join(fs.TrashDir, name)
+		err := filepath.WalkDir(root, func(file string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t/%s\n", name, strings.TrimSuffix(filepath.ToSlash(rel), COMPRESSED_SUFFIX))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Undelete restores the most recently removed version of path from trash.
+func (fs *MayakashiFS) Undelete(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	overlayPath := fs.getOverlayPath(path)
+	if overlayPath == nil {
+		return fmt.Errorf("path is not in overlay: %s", path)
+	}
+	names, err := fs.trashEntries()
+	if err != nil {
+		return err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		trashPath := filepath.Join(fs.TrashDir, names[i], filepath.FromSlash(path))
+		// compressed overlay file is trashed as is
+		for _, suffix := range []string{"", COMPRESSED_SUFFIX} {
+			if _, err := os.Lstat(trashPath + suffix); err != nil {
+				continue
+			}
+			if _, err := os.Lstat(*overlayPath + suffix); err == nil {
+				return fmt.Errorf("file already exists in overlay: %s", path)
+			}
+			if err := os.MkdirAll(filepath.Dir(*overlayPath), 0777); err != nil {
+				return err
+			}
+			if err := os.Rename(trashPath+suffix, *overlayPath+suffix); err != nil {
+				return err
+			}
+			fs.removeWhiteout(path)
+			fmt.Println("undelete: restored", path, "removed at", names[i])
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in trash", os.ErrNotExist, path)
+}
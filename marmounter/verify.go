@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rinsuki/mayakashi/mayafs"
+)
+
+// VerifyStatus is progress of background verification (verify=on).
+type VerifyStatus struct {
+	mutex     sync.Mutex
+	Total     int
+	Checked   int
+	Skipped   int
+	Corrupted []string
+	Done      bool
+}
+
+func (s *VerifyStatus) snapshot() map[string]any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return map[string]any{
+		"total":     s.Total,
+		"checked":   s.Checked,
+		"skipped":   s.Skipped,
+		"corrupted": append([]string{}, s.Corrupted...),
+		"done":      s.Done,
+	}
+}
+
+// StartVerify verifies all files in .mar archives in background, only while apps are not reading .dat files.
+func (fs *MayakashiFS) StartVerify() {
+	if fs.Verify == nil {
+		return
+	}
+	go func() {
+		type target struct {
+			Path string
+			File mayafs.FileInfo
+		}
+		// deduplicated files share same body, so we only need to check it once
+		seen := map[string]struct{}{}
+		targets := []target{}
+		for path, file := range fs.Tree().Files {
+			if file.MarEntry == nil {
+				continue
+			}
+			key := fmt.Sprintf("%s#%d", file.DatPath(), file.MarEntry.BodyOffset)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			targets = append(targets, target{Path: path, File: file})
+		}
+		// read .dat files sequentially
+		sort.Slice(targets, func(i, j int) bool {
+			a, b := targets[i].File, targets[j].File
+			if a.DatPath() != b.DatPath() {
+				return a.DatPath() < b.DatPath()
+			}
+			return a.MarEntry.BodyOffset < b.MarEntry.BodyOffset
+		})
+
+		status := fs.Verify
+		status.mutex.Lock()
+		status.Total = len(targets)
+		status.mutex.Unlock()
+		fmt.Println("verify: start", len(targets), "files")
+
+		for _, t := range targets {
+			err := fs.VerifyMarFile(&t.File, func(size int) {
+				fs.waitForIdle("verify " + t.Path)
+			})
+			status.mutex.Lock()
+			if errors.Is(err, mayafs.ErrNoChecksum) {
+				status.Skipped++
+			} else {
+				status.Checked++
+				if err != nil {
+					fmt.Println("verify: CORRUPTED", t.Path, t.File.DatPath(), err)
+					status.Corrupted = append(status.Corrupted, t.Path)
+				}
+			}
+			status.mutex.Unlock()
+		}
+
+		status.mutex.Lock()
+		status.Done = true
+		fmt.Println("verify: finished, checked", status.Checked, "files, skipped", status.Skipped, "files,", len(status.Corrupted), "corrupted")
+		status.mutex.Unlock()
+	}()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// With dropzoneid, writes to Zone.Identifier (which browsers and Explorer attach to downloaded files,
+// and WSL or Samba store as plain files named "<file>:Zone.Identifier") are accepted and discarded,
+// so installers which copy downloaded files into the mount don't fail and overlay directory isn't littered with them.
+// NOTE: this is not named streams support, WinFsp's FUSE layer still rejects real stream opens before reaching here.
+
+const ZONE_IDENTIFIER_SUFFIX = ":zone.identifier"
+
+func isZoneIdentifierPath(path string) bool {
+	path = strings.TrimSuffix(strings.ToLower(path), ":$data")
+	return strings.HasSuffix(path, ZONE_IDENTIFIER_SUFFIX)
+}
+
+// shouldDropZoneIdentifier reports whether path is sink of dropzoneid.
+func (fs *MayakashiFS) shouldDropZoneIdentifier(path string) bool {
+	return fs.DropZoneIdentifier && isZoneIdentifierPath(path)
+}
+
+// openZoneIdentifierSink returns handle which discards writes, the path never appears in the mount.
+func (fs *MayakashiFS) openZoneIdentifierSink(path string) (int, uint64) {
+	oc := fs.OverlayCount.Add(1)
+	fs.ZoneIdentifierHandlers.Store(oc, struct{}{})
+	// println("dropping zone identifier", path)
+	return 0, oc
+}
+
+func (fs *MayakashiFS) isZoneIdentifierSink(fh uint64) bool {
+	_, ok := fs.ZoneIdentifierHandlers.Load(fh)
+	return ok
+}
+
+// getZoneIdentifierSinkStat answers Getattr of opened sink as empty file.
+func getZoneIdentifierSinkStat(stat *fuse.Stat_t) {
+	*stat = fuse.Stat_t{Mode: fuse.S_IFREG | 0666}
+}
@@ -0,0 +1,80 @@
+package mayafs
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// AdaptiveCacheSize resizes chunk cache following available memory of the system (cachesize=auto):
+// it grows into half of memory which is available beyond Reserve, and shrinks when available memory is less than Reserve.
+// Ristretto evicts entries over new size when next entry is added, and whole cache is dropped if available memory is
+// less than half of Reserve, since nothing might be added while apps are using most of memory.
+type AdaptiveCacheSize struct {
+	Cache *ristretto.Cache
+	Min   int64
+	Max   int64
+	// memory which should be left for apps and OS
+	Reserve int64
+	// times which cache was dropped because of memory pressure
+	drops atomic.Uint64
+}
+
+// default bounds of cachesize=auto
+const DEFAULT_ADAPTIVE_CACHE_MIN = 256 << 20
+const DEFAULT_ADAPTIVE_CACHE_MAX = 16 << 30
+const DEFAULT_ADAPTIVE_CACHE_RESERVE = 1 << 30
+
+// Start checks available memory every interval in background.
+// It returns error if available memory can't be read on this platform.
+func (a *AdaptiveCacheSize) Start(interval time.Duration) error {
+	if _, err := availableMemory(); err != nil {
+		return err
+	}
+	a.adjust()
+	go func() {
+		for {
+			time.Sleep(interval)
+			a.adjust()
+		}
+	}()
+	return nil
+}
+
+func (a *AdaptiveCacheSize) adjust() {
+	available, err := availableMemory()
+	if err != nil {
+		fmt.Println("adaptive cache: failed to get available memory", err)
+		return
+	}
+	var used int64
+	if m := a.Cache.Metrics; m != nil {
+		used = int64(m.CostAdded()) - int64(m.CostEvicted())
+	}
+	target := used + (available-a.Reserve)/2
+	if available < a.Reserve {
+		target = used - (a.Reserve - available)
+	}
+	if target < a.Min {
+		target = a.Min
+	}
+	if target > a.Max {
+		target = a.Max
+	}
+	a.Cache.UpdateMaxCost(target)
+	if available < a.Reserve/2 && used > target {
+		fmt.Println("adaptive cache: dropping cache because of memory pressure, available", available)
+		a.Cache.Clear()
+		a.drops.Add(1)
+		// return freed chunks to OS now, GC might not run soon
+		debug.FreeOSMemory()
+	}
+}
+
+// Drops returns times which cache was dropped because of memory pressure.
+func (a *AdaptiveCacheSize) Drops() uint64 {
+	return a.drops.Load()
+}
@@ -0,0 +1,45 @@
+package mayafs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Alias makes a file also appear at another path (e.g. localized exe names, renamed DLLs), without duplicating data.
+// It is resolved against merged tree (after bind mounts) on every tree update, so it always points the file which wins
+// in current tree, including archives loaded later.
+type Alias struct {
+	Path   string
+	Target string
+}
+
+// ParseAlias parses "<path>:<existing path>" (e.g. "/Game/game_ja.exe:/Game/game.exe").
+func ParseAlias(s string) (Alias, error) {
+	pt := strings.SplitN(s, ":", 2)
+	if len(pt) != 2 || pt[0] == "" || pt[1] == "" {
+		return Alias{}, fmt.Errorf("invalid alias (should be <path>:<existing path>): %s", s)
+	}
+	a := Alias{Path: normalizeMountPath(pt[0]), Target: normalizeMountPath(pt[1])}
+	if a.Path == "/" || NormalizeString(a.Path) == NormalizeString(a.Target) {
+		return Alias{}, fmt.Errorf("invalid alias: %s", s)
+	}
+	return a, nil
+}
+
+// applyAliases puts aliased files into the tree, existing files at alias path are overridden.
+func (fs *FS) applyAliases(b *treeBuilder) {
+	for _, a := range fs.Aliases {
+		file, ok := b.tree.Files[NormalizeString(a.Target)]
+		if !ok {
+			if _, isDir := b.tree.Directories[NormalizeString(a.Target)]; isDir {
+				fmt.Println("Warning: target of alias is a directory (use bindmount= instead):", a.Target)
+			} else {
+				fmt.Println("Warning: target of alias is not found:", a.Target)
+			}
+			continue
+		}
+		lowerPath := NormalizeString(a.Path)
+		b.tree.Files[lowerPath] = file
+		b.getDirInfo(a.Path[:strings.LastIndex(a.Path, "/")]).Files[lowerPath] = a.Path
+	}
+}
@@ -0,0 +1,220 @@
+package mayafs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// PendingArchive is an archive which is specified by arguments, but not loaded yet.
+type PendingArchive struct {
+	File        string
+	Options     ArchiveReadOptions
+	IsDirectory bool
+}
+
+// LoadedArchive is a parsed archive listing which is not merged into FS yet.
+type LoadedArchive struct {
+	File        string
+	Options     ArchiveReadOptions
+	IsDirectory bool
+	ZipEntries  []*ZipEntry
+	MarEntries  []*pb.FileEntry
+	LocalFiles  []*LocalFile
+	ZstEntries  []*ZstEntry
+	// directories which are recorded explicitly (e.g. with metadata, or empty ones)
+	Dirs []ArchiveDir
+	// files which contents are read from (e.g. .dat files of .mar), empty for directories
+	DataFiles []string
+	// archive-level metadata of .mar, nil if not recorded
+	Metadata *pb.ArchiveMetadata
+}
+
+// ArchiveDir is a directory entry in archive. Modified is zero if archive doesn't record it.
+type ArchiveDir struct {
+	Name     string
+	Modified time.Time
+}
+
+// ArchiveSummary is an archive which is merged into FS.
+type ArchiveSummary struct {
+	File        string
+	Priority    int
+	IsDirectory bool
+	FileCount   int
+	DataFiles   []string
+	Metadata    *pb.ArchiveMetadata
+}
+
+func (fs *FS) readArchive(a PendingArchive) (*LoadedArchive, error) {
+	la, err := fs.readArchiveListing(a)
+	if err != nil {
+		return nil, err
+	}
+	// e.g. .idx is there but .dat is not, it fails on first read otherwise
+	for _, file := range la.DataFiles {
+		if _, err := fs.DataFileSize(file); err != nil {
+			return nil, err
+		}
+	}
+	return la, nil
+}
+
+func (fs *FS) readArchiveListing(a PendingArchive) (*LoadedArchive, error) {
+	if a.IsDirectory {
+		return fs.readDirectory(a.File, a.Options)
+	}
+
+	if IsRemoteFile(a.File) && !strings.HasSuffix(a.File, ".mar") {
+		return nil, errRemoteOnlyMar
+	}
+
+	if strings.HasSuffix(a.File, ".zip") {
+		return fs.readZipFile(a.File, a.Options)
+	}
+
+	if strings.HasSuffix(a.File, ".mar") {
+		return fs.readMARFile(a.File, a.Options)
+	}
+
+	if strings.HasSuffix(a.File, ".zst") {
+		return fs.readZstFile(a.File, a.Options)
+	}
+
+	return nil, fmt.Errorf("unknown file type (filename suffix): %s", a.File)
+}
+
+func (fs *FS) applyArchive(b *treeBuilder, la *LoadedArchive) int {
+	for _, d := range la.Dirs {
+		// with trailing slash, so rewrite= rules for directory names (e.g. "/v1/") apply to directories themselves too
+		origPath := la.Options.GetFilePath(strings.TrimSuffix(d.Name, "/") + "/")
+		if origPath == "" {
+			continue
+		}
+		dir := b.getDirInfo(strings.TrimSuffix(origPath, "/"))
+		if !d.Modified.IsZero() {
+			dir.Modified = d.Modified
+		}
+	}
+
+	if la.IsDirectory {
+		return fs.applyDirectory(b, la)
+	}
+
+	if la.ZipEntries != nil {
+		return fs.applyZipFile(b, la)
+	}
+
+	if la.ZstEntries != nil {
+		return fs.applyZstFile(b, la)
+	}
+
+	return fs.applyMARFile(b, la)
+}
+
+// LoadPendingArchives parses all pending archives concurrently (up to fs.LoadJobs at once),
+// then merges them into the tree in the order of priority, and the order they were specified.
+// New tree is published at once after all archives are merged, so readers never see partially merged tree.
+func (fs *FS) LoadPendingArchives() error {
+	pendings := fs.PendingArchives
+	fs.PendingArchives = nil
+	if len(pendings) == 0 {
+		if fs.tree.Load() == nil && len(fs.LooseFiles) > 0 {
+			// mount which only has loose files
+			fs.updateTree(func(b *treeBuilder) {})
+		}
+		return nil
+	}
+
+	jobs := fs.LoadJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	start := time.Now()
+	results := make([]*LoadedArchive, len(pendings))
+	errs := make([]error, len(pendings))
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	var progressLock sync.Mutex
+	done := 0
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				archiveStart := time.Now()
+				results[index], errs[index] = fs.readArchive(pendings[index])
+				skipped := errors.Is(errs[index], os.ErrNotExist) && (pendings[index].Options.Optional || fs.SkipMissingArchives)
+
+				progressLock.Lock()
+				done++
+				if skipped {
+					fmt.Printf("[%d/%d] Warning: skipped missing archive %s: %v\n", done, len(pendings), pendings[index].File, errs[index])
+					errs[index] = nil
+				} else if errs[index] != nil {
+					fmt.Printf("[%d/%d] Failed to read %s: %v\n", done, len(pendings), pendings[index].File, errs[index])
+				} else {
+					fmt.Printf("[%d/%d] Read %s (%s)\n", done, len(pendings), pendings[index].File, time.Since(archiveStart).Round(time.Millisecond))
+				}
+				progressLock.Unlock()
+			}
+		}()
+	}
+
+	for i := range pendings {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", pendings[i].File, err)
+		}
+	}
+
+	loaded := results[:0]
+	for _, la := range results {
+		// nil if skipped
+		if la != nil {
+			loaded = append(loaded, la)
+		}
+	}
+	results = loaded
+
+	// merge in deterministic order, since later archives (and whiteouts) overrides earlier ones
+	// archives which have higher priority are applied later, regardless of argument order
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Options.Priority < results[j].Options.Priority
+	})
+	fs.updateTree(func(b *treeBuilder) {
+		for _, la := range results {
+			fileCount := fs.applyArchive(b, la)
+			fmt.Printf("Loaded %d files from %s\n", fileCount, la.File)
+			if la.Metadata != nil {
+				fmt.Printf("  %s\n", FormatArchiveMetadata(la.Metadata))
+			}
+			b.tree.Archives = append(b.tree.Archives, ArchiveSummary{
+				File:        la.File,
+				Priority:    la.Options.Priority,
+				IsDirectory: la.IsDirectory,
+				FileCount:   fileCount,
+				DataFiles:   la.DataFiles,
+				Metadata:    la.Metadata,
+			})
+		}
+	})
+
+	fmt.Printf("Loaded %d archives in %s\n", len(results), time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
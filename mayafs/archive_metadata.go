@@ -0,0 +1,49 @@
+package mayafs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// FormatArchiveMetadata formats archive-level metadata of .mar for logs,
+// e.g. `name="Foo" version="1.2" source_build="12345" created_by="mayakashi 0.1.0" created_time=2024-01-01T00:00:00Z`.
+func FormatArchiveMetadata(m *pb.ArchiveMetadata) string {
+	var parts []string
+	for _, f := range archiveMetadataFields(m) {
+		parts = append(parts, fmt.Sprintf("%s=%q", f[0], f[1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ArchiveMetadataMap returns archive-level metadata of .mar for JSON (stats), fields which are not recorded are omitted.
+func ArchiveMetadataMap(m *pb.ArchiveMetadata) map[string]any {
+	result := map[string]any{}
+	for _, f := range archiveMetadataFields(m) {
+		result[f[0]] = f[1]
+	}
+	return result
+}
+
+// returns recorded (non-empty) fields as (key, value) pairs
+func archiveMetadataFields(m *pb.ArchiveMetadata) [][2]string {
+	fields := [][2]string{
+		{"name", m.GetName()},
+		{"version", m.GetVersion()},
+		{"description", m.GetDescription()},
+		{"source_build", m.GetSourceBuild()},
+		{"created_by", m.GetCreatedBy()},
+	}
+	if m.GetCreatedTime() != nil {
+		fields = append(fields, [2]string{"created_time", m.GetCreatedTime().AsTime().Format(time.RFC3339)})
+	}
+	result := fields[:0]
+	for _, f := range fields {
+		if f[1] != "" {
+			result = append(result, f)
+		}
+	}
+	return result
+}
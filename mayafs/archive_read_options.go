@@ -1,7 +1,8 @@
-package main
+package mayafs
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/bmatcuk/doublestar"
@@ -13,7 +14,38 @@ type ArchiveReadOptions struct {
 	StripPrefix      string
 	AdditionalPrefix string
 	IncludedGlobs    []string
-	zipLocale        string
+	// applied in order after StripPrefix and before AdditionalPrefix
+	Rewrites []RewriteRule
+	Priority int
+	// limits reads from this archive (in addition to FS.ReadLimiter), nil if unlimited
+	ReadLimiter *RateLimiter
+	// skip (with warning) instead of failing if the archive is missing
+	Optional  bool
+	zipLocale string
+}
+
+// RewriteRule replaces matches of Pattern in path with Replacement (which can refer to groups as $1).
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRewriteRule parses sed-like "<d><pattern><d><replacement><d>" (<d> is any character, e.g. "|v[0-9.]+/||")
+// at the start of s, and returns the rest of s after it.
+func ParseRewriteRule(s string) (RewriteRule, string, error) {
+	if s == "" {
+		return RewriteRule{}, "", fmt.Errorf("invalid rewrite (should be like |<pattern>|<replacement>|): %s", s)
+	}
+	delimiter := s[:1]
+	parts := strings.SplitN(s[1:], delimiter, 3)
+	if len(parts) != 3 {
+		return RewriteRule{}, "", fmt.Errorf("invalid rewrite (should be like %s<pattern>%s<replacement>%s): %s", delimiter, delimiter, delimiter, s)
+	}
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return RewriteRule{}, "", fmt.Errorf("invalid rewrite pattern: %w", err)
+	}
+	return RewriteRule{Pattern: pattern, Replacement: parts[1]}, parts[2], nil
 }
 
 func (o *ArchiveReadOptions) SetZipLocale(locale string) error {
@@ -83,6 +115,13 @@ func (o *ArchiveReadOptions) GetFilePath(path string) string {
 		}
 	}
 
+	for _, r := range o.Rewrites {
+		path = r.Pattern.ReplaceAllString(path, r.Replacement)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+
 	if o.AdditionalPrefix != "" {
 		path = o.AdditionalPrefix + path
 	}
@@ -0,0 +1,73 @@
+package mayafs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BindMount makes a subtree of merged tree also appear at another path, without loading archives twice
+// (e.g. for games which look into multiple historical locations).
+// Bound files share FileInfo with source, so they are read from the same archive.
+type BindMount struct {
+	Source string
+	Target string
+}
+
+func normalizeMountPath(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	for len(p) > 1 && strings.HasSuffix(p, "/") {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// isSubPath reports whether path is dir itself or under dir (both are normalized).
+func isSubPath(path string, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// ParseBindMount parses "<source>:<target>" (e.g. "/Game/Data/StreamingAssets:/Game/StreamingAssets").
+func ParseBindMount(s string) (BindMount, error) {
+	st := strings.SplitN(s, ":", 2)
+	if len(st) != 2 || st[0] == "" || st[1] == "" {
+		return BindMount{}, fmt.Errorf("invalid bindmount (should be <source>:<target>): %s", s)
+	}
+	bm := BindMount{Source: normalizeMountPath(st[0]), Target: normalizeMountPath(st[1])}
+	source, target := NormalizeString(bm.Source), NormalizeString(bm.Target)
+	if isSubPath(target, source) || isSubPath(source, target) {
+		return BindMount{}, fmt.Errorf("invalid bindmount (source and target must not contain each other): %s", s)
+	}
+	return bm, nil
+}
+
+// applyBindMounts copies bound subtrees into the tree. It runs on every tree update, so archives loaded later
+// (e.g. dirwatch) are reflected too, but files which are removed from source later (by whiteout) stay at target.
+func (fs *FS) applyBindMounts(b *treeBuilder) {
+	for _, bm := range fs.BindMounts {
+		if _, ok := b.tree.Directories[NormalizeString(bm.Source)]; !ok {
+			fmt.Println("Warning: source of bindmount is not found:", bm.Source)
+			continue
+		}
+		b.bindDir(bm.Source, bm.Target)
+	}
+}
+
+// bindDir copies files and directories under source into target, files at target are overridden.
+func (b *treeBuilder) bindDir(source string, target string) {
+	dir := b.tree.Directories[NormalizeString(source)]
+	targetDir := b.getDirInfo(target)
+	if !dir.Modified.IsZero() {
+		targetDir.Modified = dir.Modified
+	}
+	for lowerPath, origPath := range dir.Files {
+		targetPath := target + origPath[strings.LastIndex(origPath, "/"):]
+		b.tree.Files[NormalizeString(targetPath)] = b.tree.Files[lowerPath]
+		targetDir.Files[NormalizeString(targetPath)] = targetPath
+	}
+	for _, origPath := range dir.Directories {
+		b.bindDir(origPath, target+origPath[strings.LastIndex(origPath, "/"):])
+	}
+}
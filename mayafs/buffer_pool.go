@@ -0,0 +1,94 @@
+package mayafs
+
+import (
+	"compress/flate"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Temporary buffers (compressed chunks, copy buffers) and decompressors are reused, instead of allocating them for every read,
+// which makes GC busy under heavy IO. Decompressed data isn't pooled since it is kept in chunk cache.
+
+// buffers are pooled in power of two size classes from 4KiB to 16MiB, larger ones are allocated every time
+const minPooledBufferShift = 12
+const pooledBufferClasses = 13
+const minPooledBufferSize = 1 << minPooledBufferShift
+const maxPooledBufferSize = minPooledBufferSize << (pooledBufferClasses - 1)
+
+var bufferPools [pooledBufferClasses]sync.Pool
+
+func bufferClass(size int) int {
+	if size <= minPooledBufferSize {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minPooledBufferShift
+}
+
+// GetBuffer returns buffer of size from pool. Contents are undefined.
+// It should be returned by PutBuffer when it is no longer used (including by other goroutines).
+func GetBuffer(size int) []byte {
+	if size > maxPooledBufferSize {
+		return make([]byte, size)
+	}
+	class := bufferClass(size)
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, minPooledBufferSize<<class)
+}
+
+// PutBuffer returns buffer which was taken by GetBuffer to pool.
+func PutBuffer(b []byte) {
+	if cap(b) > maxPooledBufferSize || cap(b) < minPooledBufferSize {
+		return
+	}
+	class := bufferClass(cap(b))
+	if minPooledBufferSize<<class != cap(b) {
+		// not from GetBuffer
+		return
+	}
+	b = b[:cap(b)]
+	bufferPools[class].Put(&b)
+}
+
+var sharedZstdDecoder *zstd.Decoder
+var sharedZstdDecoderOnce sync.Once
+
+// getZstdDecoder returns zstd decoder for DecodeAll, which can be used concurrently.
+func getZstdDecoder() *zstd.Decoder {
+	sharedZstdDecoderOnce.Do(func() {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			panic(err)
+		}
+		sharedZstdDecoder = decoder
+	})
+	return sharedZstdDecoder
+}
+
+var flateReaders sync.Pool
+
+// pooledFlateReader returns reader to pool when it is closed.
+type pooledFlateReader struct {
+	io.ReadCloser
+}
+
+func (r *pooledFlateReader) Close() error {
+	err := r.ReadCloser.Close()
+	flateReaders.Put(r.ReadCloser)
+	r.ReadCloser = nil
+	return err
+}
+
+// newFlateReader is flate.NewReader which reuses state of closed readers.
+func newFlateReader(r io.Reader) io.ReadCloser {
+	if fr, ok := flateReaders.Get().(io.ReadCloser); ok {
+		if err := fr.(flate.Resetter).Reset(r, nil); err == nil {
+			return &pooledFlateReader{fr}
+		}
+	}
+	return &pooledFlateReader{flate.NewReader(r)}
+}
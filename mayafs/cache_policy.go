@@ -0,0 +1,135 @@
+package mayafs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// CachePolicy controls which decompressed data is added to chunk cache, its cost and how long it is kept.
+type CachePolicy struct {
+	// CACHE_COST_SIZE (default, decompressed bytes, so cachesize= is bytes) or CACHE_COST_COUNT (1 for every entry, so cachesize= is number of entries)
+	Cost string
+	// entries of zip files (whole entries and blocks of large entries) expire after this, 0 to keep until evicted
+	ZipTTL time.Duration
+	// chunks and frames of .mar and .zst expire after this, 0 to keep until evicted
+	MarTTL time.Duration
+	// after a file is read sequentially from its beginning for this size, data decompressed by following sequential reads
+	// of the file is not cached, since one-shot scans (e.g. hash checks by launchers) only evict useful entries. 0 to disable
+	ScanNoCacheSize int64
+}
+
+const CACHE_COST_SIZE = "size"
+const CACHE_COST_COUNT = "count"
+
+type cacheKind int
+
+const (
+	cacheKindZip cacheKind = iota
+	cacheKindMar
+)
+
+// NewChunkCache returns chunk cache which can have maxCost.
+// With ignoreInternalCost, ristretto's overhead of each entry is not added to cost, so maxCost is spent only by data.
+func NewChunkCache(maxCost int64, ignoreInternalCost bool) *ristretto.Cache {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		MaxCost:            maxCost,
+		NumCounters:        1024 * 1024 * 10, // 10MiB * 3
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: ignoreInternalCost,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
+
+// ReplaceSharedChunkCache replaces shared chunk cache with new one which has same maximum cost, for options which ristretto can't change later.
+// Entries of previous cache are dropped. Filesystems which use previous cache should be updated to returned one.
+func ReplaceSharedChunkCache(ignoreInternalCost bool) *ristretto.Cache {
+	previous := GetSharedChunkCache()
+	sharedChunkCache = NewChunkCache(previous.MaxCost(), ignoreInternalCost)
+	previous.Close()
+	return sharedChunkCache
+}
+
+// setChunkCache adds decompressed data to chunk cache following CachePolicy.
+// path is the file which the data was read for, or empty if it isn't read by a file (e.g. preload), which is always cached.
+// Data of pinned files goes to pinned store instead, while PinBudget allows.
+func (fs *FS) setChunkCache(path string, kind cacheKind, key string, value *ChunkCache) {
+	if path != "" && fs.isPinnedPath(path) && fs.pin(key, value) {
+		return
+	}
+	if path != "" && fs.scans.scanning(path, fs.CachePolicy.ScanNoCacheSize) {
+		fs.scans.skipped.Add(1)
+		return
+	}
+	cost := int64(len(value.Data))
+	if fs.CachePolicy.Cost == CACHE_COST_COUNT {
+		cost = 1
+	}
+	ttl := fs.CachePolicy.MarTTL
+	if kind == cacheKindZip {
+		ttl = fs.CachePolicy.ZipTTL
+	}
+	fs.ChunkCache.SetWithTTL(key, value, cost, ttl)
+}
+
+// ScanSkippedCaches returns number of decompressed data which were not cached because they were read by sequential scans.
+func (fs *FS) ScanSkippedCaches() uint64 {
+	return fs.scans.skipped.Load()
+}
+
+// tracking more files than this only wastes memory, it is cleared when it is full
+const maxSequentialScans = 1024
+
+// sequentialScans tracks files which are read sequentially from their beginnings.
+type sequentialScans struct {
+	mutex sync.Mutex
+	// path => offset which continues the scan
+	next    map[string]int64
+	skipped atomic.Uint64
+}
+
+func newSequentialScans() *sequentialScans {
+	return &sequentialScans{
+		next: map[string]int64{},
+	}
+}
+
+// observe records that readed bytes of path were read from offset.
+func (s *sequentialScans) observe(path string, offset int64, readed int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset == 0 {
+		if len(s.next) >= maxSequentialScans {
+			s.next = map[string]int64{}
+		}
+		s.next[path] = int64(readed)
+		return
+	}
+	next, ok := s.next[path]
+	if !ok {
+		return
+	}
+	if next == offset {
+		s.next[path] = next + int64(readed)
+	} else {
+		// random access, it isn't a scan
+		delete(s.next, path)
+	}
+}
+
+// scanning reports whether path has been read sequentially from its beginning for threshold (if not 0).
+func (s *sequentialScans) scanning(path string, threshold int64) bool {
+	if threshold <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	next, ok := s.next[path]
+	return ok && next >= threshold
+}
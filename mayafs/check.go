@@ -0,0 +1,115 @@
+package mayafs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// ArchiveCheckResult is result of CheckPendingArchives for one archive. Problems is empty if it looks fine.
+type ArchiveCheckResult struct {
+	File     string
+	Skipped  bool
+	Problems []string
+}
+
+// CheckPendingArchives checks structure of pending archives without loading them, to catch truncated downloads early:
+// .mar index can be parsed, every .dat part exists and covers all chunks in the index,
+// zip central directory can be parsed and covers all entries, and seek table of .zst can be parsed.
+// It doesn't decompress or hash file contents (see verify= in marmounter for that).
+func (fs *FS) CheckPendingArchives() []ArchiveCheckResult {
+	results := []ArchiveCheckResult{}
+	for _, a := range fs.PendingArchives {
+		result := ArchiveCheckResult{File: a.File}
+		problems, err := fs.checkArchive(a)
+		if errors.Is(err, os.ErrNotExist) && (a.Options.Optional || fs.SkipMissingArchives) {
+			result.Skipped = true
+		} else if err != nil {
+			result.Problems = append(result.Problems, err.Error())
+		}
+		result.Problems = append(result.Problems, problems...)
+		results = append(results, result)
+	}
+	return results
+}
+
+func (fs *FS) checkArchive(a PendingArchive) ([]string, error) {
+	if a.IsDirectory {
+		_, err := os.Stat(a.File)
+		return nil, err
+	}
+	if strings.HasSuffix(a.File, ".zip") {
+		return checkZipFile(a.File)
+	}
+	la, err := fs.readArchiveListing(a)
+	if err != nil {
+		return nil, err
+	}
+	if la.MarEntries == nil {
+		// .zst is checked by parsing its seek table
+		return nil, nil
+	}
+	return fs.checkMARDataFiles(a.File, la.MarEntries)
+}
+
+// checkMARDataFiles checks whether every .dat part is large enough for chunks which refer to it.
+func (fs *FS) checkMARDataFiles(file string, entries []*pb.FileEntry) ([]string, error) {
+	// end of the last chunk in each .dat part
+	ends := map[string]uint64{}
+	for _, entry := range entries {
+		if entry.Info == nil {
+			continue
+		}
+		end := entry.BodyOffset + entry.BodySize
+		for i, chunk := range entry.Info.Chunks {
+			if chunkEnd := entry.ChunkDatOffsets[i] + uint64(chunk.CompressedLength); chunkEnd > end {
+				end = chunkEnd
+			}
+		}
+		datPath := (&FileInfo{MarEntry: entry, ArchiveFile: file}).DatPath()
+		if end > ends[datPath] {
+			ends[datPath] = end
+		}
+	}
+	datPaths := make([]string, 0, len(ends))
+	for datPath := range ends {
+		datPaths = append(datPaths, datPath)
+	}
+	sort.Strings(datPaths)
+
+	problems := []string{}
+	for _, datPath := range datPaths {
+		size, err := fs.DataFileSize(datPath)
+		if err != nil {
+			return problems, err
+		}
+		if uint64(size) < ends[datPath] {
+			problems = append(problems, fmt.Sprintf("%s is truncated: %d bytes, but index refers up to %d bytes", datPath, size, ends[datPath]))
+		}
+	}
+	return problems, nil
+}
+
+// checkZipFile checks whether central directory can be parsed, and every entry is in the file.
+func checkZipFile(file string) ([]string, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	// don't use index cache, it skips parsing central directory
+	entries, err := ReadZipEntries(file, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse central directory: %w", err)
+	}
+	problems := []string{}
+	for _, e := range entries {
+		if end := e.DataOffset + int64(e.CompressedSize64); end > st.Size() {
+			problems = append(problems, fmt.Sprintf("%s is out of file: ends at %d bytes, but file is %d bytes", e.Name, end, st.Size()))
+		}
+	}
+	return problems, nil
+}
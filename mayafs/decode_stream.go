@@ -0,0 +1,278 @@
+package mayafs
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// Large compressed data (deflated zip entries larger than zipStreamThreshold, and zstd chunks of .mar larger than
+// FS.MaxCachedChunkSize) is not decompressed as a whole. Instead, decompressors are kept open between reads with
+// their position and last decompressed window, so sequential reads continue from where previous read ended
+// instead of decompressing from the beginning, and memory used by a read is bounded by the window.
+// Every decompressed window of zip entries is cached as a block (like chunks of MAR), so cache cost and eviction work per block.
+// Reads of uncached blocks before position of every stream (deflate and zstd can't seek) start a new stream from the beginning.
+
+// entries larger than this are read by decodeStream
+const zipStreamThreshold = 8 << 20
+
+// size of decompressed window kept by each stream, which is also size of cached blocks
+const decodeStreamWindow = 1 << 20
+
+// compressed data is read from archive in this size, instead of small reads by decompressors
+const decodeStreamReadSize = 256 << 10
+
+// streams which are kept open (in all entries), least recently used one is closed after this
+const maxDecodeStreams = 16
+
+// decodeStream is decompressor of zip entry or .mar chunk which is kept open between reads.
+type decodeStream struct {
+	// locked while stream is used by a read
+	busy chan struct{}
+	key  string
+	// decompressed size
+	size int64
+	// CRC32 of decompressed data, 0 if unknown
+	expectedCRC uint32
+	// opens decompressor of compressed data in pool
+	open func(pool io.ReaderAt) (io.ReadCloser, error)
+	// for error messages
+	name   string
+	reader io.ReadCloser
+	// decompressed bytes before pos were read from reader
+	pos int64
+	// last decompressed bytes, which are at winStart of decompressed data
+	window   []byte
+	winStart int64
+	// CRC32 of decompressed bytes before pos, checked at end of data
+	crc      uint32
+	lastUsed time.Time
+}
+
+func zipEntryCacheKey(file *FileInfo) string {
+	return fmt.Sprintf("%s#%d+%d", file.ArchiveFile, file.ZipEntry.DataOffset, file.ZipEntry.CompressedSize64)
+}
+
+func zipBlockCacheKey(file *FileInfo, block int64) string {
+	return fmt.Sprintf("%s@%d", zipEntryCacheKey(file), block)
+}
+
+func (s *decodeStream) tryLock() bool {
+	select {
+	case s.busy <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *decodeStream) unlock() {
+	<-s.busy
+}
+
+func (s *decodeStream) covers(offset int64) bool {
+	return s.winStart <= offset && offset < s.winStart+int64(len(s.window))
+}
+
+// acquireDecodeStream returns locked stream of key which can serve offset without restarting: one whose window covers offset,
+// or nearest one before offset. Otherwise it returns new stream from the beginning, which is made by newStream.
+func (fs *FS) acquireDecodeStream(key string, offset int64, newStream func() *decodeStream) *decodeStream {
+	fs.decodeStreamsMutex.Lock()
+	defer fs.decodeStreamsMutex.Unlock()
+	var best *decodeStream
+	for _, s := range fs.decodeStreams {
+		if s.key != key || !s.tryLock() {
+			continue
+		}
+		if s.covers(offset) || (s.pos <= offset && (best == nil || (!best.covers(offset) && s.pos > best.pos))) {
+			if best != nil {
+				best.unlock()
+			}
+			best = s
+			continue
+		}
+		s.unlock()
+	}
+	if best != nil {
+		best.lastUsed = time.Now()
+		return best
+	}
+
+	if len(fs.decodeStreams) >= maxDecodeStreams {
+		fs.evictDecodeStream()
+	}
+	s := newStream()
+	s.busy = make(chan struct{}, 1)
+	s.key = key
+	s.lastUsed = time.Now()
+	s.tryLock()
+	fs.decodeStreams = append(fs.decodeStreams, s)
+	return s
+}
+
+// evictDecodeStream closes least recently used stream which is not used now. decodeStreamsMutex must be held.
+func (fs *FS) evictDecodeStream() {
+	oldest := -1
+	for i, s := range fs.decodeStreams {
+		if oldest < 0 || s.lastUsed.Before(fs.decodeStreams[oldest].lastUsed) {
+			if s.tryLock() {
+				if oldest >= 0 {
+					fs.decodeStreams[oldest].unlock()
+				}
+				oldest = i
+			}
+		}
+	}
+	if oldest < 0 {
+		// all streams are busy, there will be more streams than the limit for a while
+		return
+	}
+	s := fs.decodeStreams[oldest]
+	fs.decodeStreams = append(fs.decodeStreams[:oldest], fs.decodeStreams[oldest+1:]...)
+	s.close()
+	s.unlock()
+}
+
+// discardDecodeStream removes broken stream, which must be locked by caller.
+func (fs *FS) discardDecodeStream(s *decodeStream) {
+	fs.decodeStreamsMutex.Lock()
+	for i, other := range fs.decodeStreams {
+		if other == s {
+			fs.decodeStreams = append(fs.decodeStreams[:i], fs.decodeStreams[i+1:]...)
+			break
+		}
+	}
+	fs.decodeStreamsMutex.Unlock()
+	s.close()
+}
+
+func (s *decodeStream) close() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.window = nil
+}
+
+// next decompresses next window.
+func (s *decodeStream) next(pool io.ReaderAt) error {
+	if s.reader == nil {
+		reader, err := s.open(pool)
+		if err != nil {
+			return err
+		}
+		s.reader = reader
+	}
+	if s.pos >= s.size {
+		return io.ErrUnexpectedEOF
+	}
+	n := s.size - s.pos
+	if n > decodeStreamWindow {
+		n = decodeStreamWindow
+	}
+	// not reused, previous window might be in cache
+	window := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, window); err != nil {
+		return err
+	}
+	s.crc = crc32.Update(s.crc, crc32.IEEETable, window)
+	s.window = window
+	s.winStart = s.pos
+	s.pos += n
+	if s.pos == s.size && s.expectedCRC != 0 && s.crc != s.expectedCRC {
+		return fmt.Errorf("checksum mismatch on %s", s.name)
+	}
+	return nil
+}
+
+// readFromDecodeStream decompresses until offset, and copies from there to end of the window.
+// onWindow is called with every decompressed window, if not nil.
+func (fs *FS) readFromDecodeStream(s *decodeStream, pool io.ReaderAt, buff []byte, offset int64, onWindow func(s *decodeStream)) (int, error) {
+	for !s.covers(offset) {
+		if err := s.next(pool); err != nil {
+			fs.discardDecodeStream(s)
+			return 0, err
+		}
+		if onWindow != nil {
+			onWindow(s)
+		}
+	}
+	return copy(buff, s.window[offset-s.winStart:]), nil
+}
+
+// readFromZipStream reads deflated zip entry (which is larger than zipStreamThreshold) without decompressing whole entry.
+func (fs *FS) readFromZipStream(path string, buff []byte, offset int64, file *FileInfo) (int, error) {
+	cache, ok := fs.getChunkCache(zipBlockCacheKey(file, offset/decodeStreamWindow))
+	if ok {
+		block := cache.Data
+		return copy(buff, block[offset%decodeStreamWindow:]), nil
+	}
+
+	entry := file.ZipEntry
+	s := fs.acquireDecodeStream(zipEntryCacheKey(file), offset, func() *decodeStream {
+		return &decodeStream{
+			size:        entry.Size(),
+			expectedCRC: entry.CRC32,
+			open: func(pool io.ReaderAt) (io.ReadCloser, error) {
+				return newFlateReader(bufio.NewReaderSize(entry.OpenRaw(pool), decodeStreamReadSize)), nil
+			},
+			name: fmt.Sprintf("zip entry: %s in %s", entry.Name, file.ArchiveFile),
+		}
+	})
+	defer s.unlock()
+	readed, err := fs.readFromDecodeStream(s, fs.ArchiveReader(file.ArchiveFile), buff, offset, func(s *decodeStream) {
+		fs.setChunkCache(path, cacheKindZip, zipBlockCacheKey(file, s.winStart/decodeStreamWindow), &ChunkCache{
+			Data: s.window,
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read zip data: %w", err)
+	}
+	return readed, nil
+}
+
+// zstdReadCloser closes zstd decoder, whose Close doesn't return error.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// shouldStreamMarChunk reports whether chunk is too large to be decompressed (and cached) as a whole.
+// Only zstd can be decompressed partially, lz4 blocks are always decompressed as a whole.
+func (fs *FS) shouldStreamMarChunk(chunk *pb.ChunkInfo) bool {
+	return fs.MaxCachedChunkSize > 0 && int64(chunk.OriginalLength) > fs.MaxCachedChunkSize && chunk.CompressedMethod == pb.CompressedMethod_ZSTANDARD
+}
+
+// readFromMarStream reads zstd chunk (which is larger than FS.MaxCachedChunkSize) without decompressing (nor caching) whole chunk.
+// offset is in the chunk.
+func (fs *FS) readFromMarStream(buff []byte, offset int64, marFileName string, datStart int64, chunkNo int, chunk *pb.ChunkInfo) (int, error) {
+	s := fs.acquireDecodeStream(marChunkCacheKey(marFileName, datStart, chunkNo), offset, func() *decodeStream {
+		return &decodeStream{
+			size: int64(chunk.OriginalLength),
+			open: func(pool io.ReaderAt) (io.ReadCloser, error) {
+				raw := io.NewSectionReader(pool, datStart, int64(chunk.CompressedLength))
+				decoder, err := zstd.NewReader(bufio.NewReaderSize(raw, decodeStreamReadSize), zstd.WithDecoderConcurrency(1))
+				if err != nil {
+					return nil, err
+				}
+				return zstdReadCloser{decoder}, nil
+			},
+			name: fmt.Sprintf("chunk %d in %s", chunkNo, marFileName),
+		}
+	})
+	defer s.unlock()
+	readed, err := fs.readFromDecodeStream(s, fs.ArchiveReader(marFileName), buff, offset, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode: %w", err)
+	}
+	return readed, nil
+}
@@ -0,0 +1,118 @@
+package mayafs
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// DEFAULT_SCAN_GLOB is archives which are found by dirscan= without glob.
+const DEFAULT_SCAN_GLOB = "*.{mar,zip}"
+
+// SplitScanPattern splits dirscan= pattern (e.g. "patches/**/*.mar") into directory and glob.
+// Glob starts from the first path component which contains glob characters, and it is DEFAULT_SCAN_GLOB if there is none.
+func SplitScanPattern(pattern string) (dir string, glob string) {
+	components := strings.Split(filepath.ToSlash(pattern), "/")
+	for i, c := range components {
+		if strings.ContainsAny(c, "*?[{") {
+			dir = filepath.FromSlash(strings.Join(components[:i], "/"))
+			if i == 0 {
+				dir = "."
+			} else if dir == "" {
+				dir = "/"
+			}
+			return dir, strings.Join(components[i:], "/")
+		}
+	}
+	return pattern, DEFAULT_SCAN_GLOB
+}
+
+// ScanArchives returns archives (.mar, .zip and .zst) in dir whose slash-separated relative path matches glob,
+// sorted by the path (case insensitive), so later ones (e.g. patch_002.mar) override earlier ones.
+// .mar archives are found by their .mar.idx files.
+func ScanArchives(dir string, glob string) ([]string, error) {
+	// glob without "/" only matches files directly under dir
+	recursive := strings.Contains(glob, "/")
+	glob = NormalizeString(glob)
+	names := []string{}
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasSuffix(name, ".mar.idx") {
+			name = strings.TrimSuffix(name, ".idx")
+		} else if !strings.HasSuffix(name, ".zip") && !strings.HasSuffix(name, ".zst") {
+			return nil
+		}
+		if matched, err := doublestar.Match(glob, NormalizeString(name)); err != nil {
+			return fmt.Errorf("invalid glob %s: %w", glob, err)
+		} else if matched {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// case insensitive like paths in the mount, but still deterministic
+	sort.Slice(names, func(i, j int) bool {
+		a, b := NormalizeString(names[i]), NormalizeString(names[j])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	archives := make([]string, 0, len(names))
+	for _, name := range names {
+		archives = append(archives, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	return archives, nil
+}
+
+// ScanDir is a directory which is scanned by dirscan=, so it can be watched for new archives later.
+type ScanDir struct {
+	Dir     string
+	Glob    string
+	Options ArchiveReadOptions
+}
+
+// AddScannedArchives registers archives found by ScanArchives with same options, to be loaded by LoadPendingArchives.
+func (fs *FS) AddScannedArchives(pattern string, options ArchiveReadOptions) error {
+	dir, glob := SplitScanPattern(pattern)
+	if stat, err := os.Stat(dir); err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	fs.ScanDirs = append(fs.ScanDirs, ScanDir{Dir: dir, Glob: glob, Options: options})
+	archives, err := ScanArchives(dir, glob)
+	if err != nil {
+		return err
+	}
+	if len(archives) == 0 {
+		fmt.Println("dirscan: no archives found in", dir, "matching", glob)
+	}
+	for _, archive := range archives {
+		fmt.Println("dirscan: found", archive)
+		if err := fs.AddArchive(archive, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
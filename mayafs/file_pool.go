@@ -0,0 +1,378 @@
+package mayafs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// default maximum number of idle handles of one file, see SetFilePoolLimit
+const FILE_POOL_LIMIT = 8
+
+var filePoolLimit = FILE_POOL_LIMIT
+
+// reads are treated as sequential after this many reads which start where previous one ended
+const sequentialReadThreshold = 3
+
+// while reads are sequential, OS is asked to read this much ahead of them
+const sequentialReadAhead = 8 << 20
+
+// idleFile is handle in pool, with time when it was returned.
+type idleFile struct {
+	f     *os.File
+	since time.Time
+}
+
+type FilePool struct {
+	// sorted by since, oldest first
+	filePools          []idleFile
+	currentlyUsedFiles int
+	lock               sync.Mutex
+	filePath           string
+	// number of times handles were discarded because they became stale
+	reopens int
+	// number of idle handles closed by reaper
+	reaped int
+	// for detecting sequential reads, guarded by lock
+	nextOffset      int64
+	sequentialReads int
+	// OS was asked to read ahead until this offset
+	advisedUntil int64
+	// opened with sequential hint, shared by reads while they are sequential
+	sequentialFile *os.File
+	// opened without OS cache, shared by all reads if EnableUnbufferedIO was called
+	unbuffered unbufferedHandle
+}
+
+// unbufferedHandle reads file without OS cache, see unbuffered_windows.go
+type unbufferedHandle interface {
+	io.ReaderAt
+	Close() error
+}
+
+// set by EnableUnbufferedIO
+var unbufferedIO bool
+
+var filePools map[string]*FilePool = map[string]*FilePool{}
+var filePoolRWLock sync.RWMutex
+
+func GetFilePoolFromPath(path string) *FilePool {
+	filePoolRWLock.RLock()
+	fp, ok := filePools[path]
+	filePoolRWLock.RUnlock()
+	if ok {
+		return fp
+	}
+	filePoolRWLock.Lock()
+	fp, ok = filePools[path]
+	if !ok {
+		fp = NewFilePool(path)
+		filePools[path] = fp
+	}
+	filePoolRWLock.Unlock()
+	return fp
+}
+
+// SetFilePoolLimit sets maximum number of idle handles kept for one file (default FILE_POOL_LIMIT).
+// Handles which are returned beyond this are closed. It must be called before files are read.
+func SetFilePoolLimit(limit int) {
+	filePoolLimit = limit
+}
+
+func NewFilePool(path string) *FilePool {
+	pools := []idleFile{}
+	now := time.Now()
+	for i := 0; i < (filePoolLimit+1)/2; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		pools = append(pools, idleFile{f: f, since: now})
+	}
+
+	return &FilePool{
+		lock:      sync.Mutex{},
+		filePath:  path,
+		filePools: pools,
+	}
+}
+
+func (fp *FilePool) GetOne() (*os.File, error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+
+	var f *os.File
+	if len(fp.filePools) < 1 {
+		fmt.Println("creating new os.File for ", fp.filePath, "count", fp.currentlyUsedFiles)
+		var err error
+		f, err = os.Open(fp.filePath)
+		if err != nil {
+			fmt.Println("error opening file for pool, path:", fp.filePath)
+			return nil, err
+		}
+	} else {
+		// fmt.Println("reusing os.File for ", fp.filePath)
+		// most recently returned one, so ones which are not needed stay idle and get reaped
+		f = fp.filePools[len(fp.filePools)-1].f
+		fp.filePools = fp.filePools[:len(fp.filePools)-1]
+	}
+
+	fp.currentlyUsedFiles++
+	return f, nil
+}
+
+func (fp *FilePool) ReturnOne(f *os.File) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+
+	fp.currentlyUsedFiles--
+	if len(fp.filePools) >= filePoolLimit {
+		f.Close()
+		return
+	}
+	fp.filePools = append(fp.filePools, idleFile{f: f, since: time.Now()})
+}
+
+// reapIdle closes handles which have been idle since before deadline.
+func (fp *FilePool) reapIdle(deadline time.Time) {
+	fp.lock.Lock()
+	n := sort.Search(len(fp.filePools), func(i int) bool { return !fp.filePools[i].since.Before(deadline) })
+	reaped := append([]idleFile(nil), fp.filePools[:n]...)
+	fp.filePools = append(fp.filePools[:0], fp.filePools[n:]...)
+	fp.reaped += n
+	fp.lock.Unlock()
+
+	for _, idle := range reaped {
+		idle.f.Close()
+	}
+}
+
+// discardStale closes stale handle which was taken by GetOne, and idle ones since they were opened in the same (dropped) session.
+func (fp *FilePool) discardStale(f *os.File) {
+	fp.lock.Lock()
+	idle := fp.filePools
+	fp.filePools = nil
+	fp.currentlyUsedFiles--
+	fp.reopens++
+	fp.lock.Unlock()
+
+	f.Close()
+	for _, i := range idle {
+		i.f.Close()
+	}
+}
+
+// sequentialHandle records read of length at off, and returns handle opened with sequential hint if reads are sequential
+// (asking OS to read ahead of them), or nil otherwise.
+func (fp *FilePool) sequentialHandle(off int64, length int64) *os.File {
+	fp.lock.Lock()
+	if off == fp.nextOffset {
+		fp.sequentialReads++
+	} else {
+		fp.sequentialReads = 0
+		fp.advisedUntil = 0
+	}
+	fp.nextOffset = off + length
+	if fp.sequentialReads < sequentialReadThreshold {
+		fp.lock.Unlock()
+		return nil
+	}
+	if fp.sequentialFile == nil {
+		f, err := openSequentialFile(fp.filePath)
+		if err != nil {
+			fp.sequentialReads = 0
+			fp.lock.Unlock()
+			fmt.Println("failed to open file for sequential read", fp.filePath, err)
+			return nil
+		}
+		fp.sequentialFile = f
+	}
+	f := fp.sequentialFile
+	adviseFrom, adviseUntil := fp.advisedUntil, off+length+sequentialReadAhead
+	if adviseFrom < off+length {
+		adviseFrom = off + length
+	}
+	// not asked for every read, but when half of the window is consumed
+	if adviseUntil-fp.advisedUntil < sequentialReadAhead/2 {
+		adviseUntil = adviseFrom
+	} else {
+		fp.advisedUntil = adviseUntil
+	}
+	fp.lock.Unlock()
+	if adviseUntil > adviseFrom {
+		adviseWillNeed(f, adviseFrom, adviseUntil-adviseFrom)
+	}
+	return f
+}
+
+// AdviseSequential tells that file will be read sequentially from offset (e.g. preload),
+// so reads from there use sequential handle without waiting for detection.
+func (fp *FilePool) AdviseSequential(offset int64) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	if fp.nextOffset != offset {
+		fp.nextOffset = offset
+		fp.advisedUntil = 0
+	}
+	fp.sequentialReads = sequentialReadThreshold
+}
+
+func (fp *FilePool) discardSequential(f *os.File) {
+	fp.lock.Lock()
+	if fp.sequentialFile == f {
+		fp.sequentialFile = nil
+		fp.sequentialReads = 0
+		fp.reopens++
+	}
+	fp.lock.Unlock()
+	f.Close()
+}
+
+// unbufferedHandle returns handle which is opened without OS cache, opening it at first read.
+func (fp *FilePool) unbufferedHandle() (unbufferedHandle, error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	if fp.unbuffered == nil {
+		h, err := openUnbufferedHandle(fp.filePath)
+		if err != nil {
+			return nil, err
+		}
+		fp.unbuffered = h
+	}
+	return fp.unbuffered, nil
+}
+
+func (fp *FilePool) discardUnbuffered(h unbufferedHandle) {
+	fp.lock.Lock()
+	if fp.unbuffered == h {
+		fp.unbuffered = nil
+		fp.reopens++
+	}
+	fp.lock.Unlock()
+	h.Close()
+}
+
+// readUnbuffered reads without OS cache, since compressed data is not read again while its decompressed data is in chunk cache.
+// Sequential reads are not hinted, read ahead of OS needs its cache.
+func (fp *FilePool) readUnbuffered(b []byte, off int64) (int, error) {
+	h, err := fp.unbufferedHandle()
+	if err != nil {
+		return 0, err
+	}
+	n, err := h.ReadAt(b, off)
+	if err == nil || err == io.EOF || !isStaleHandleError(err) {
+		return n, err
+	}
+	fmt.Println("stale file handle, reopening", fp.filePath, err)
+	fp.discardUnbuffered(h)
+	h, reopenErr := fp.unbufferedHandle()
+	if reopenErr != nil {
+		return 0, fmt.Errorf("%w (reopen also failed: %v)", err, reopenErr)
+	}
+	return h.ReadAt(b, off)
+}
+
+func (fp *FilePool) ReadAt(b []byte, off int64) (n int, err error) {
+	if unbufferedIO {
+		return fp.readUnbuffered(b, off)
+	}
+	if f := fp.sequentialHandle(off, int64(len(b))); f != nil {
+		n, err = fileReadAt(f, b, off)
+		if err == nil || err == io.EOF || !isStaleHandleError(err) {
+			return n, err
+		}
+		fmt.Println("stale file handle, reopening", fp.filePath, err)
+		fp.discardSequential(f)
+		// read again with pooled handles below, they are reopened if they are stale too
+	}
+
+	f, err := fp.GetOne()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = fileReadAt(f, b, off)
+	if err == nil || err == io.EOF || !isStaleHandleError(err) {
+		fp.ReturnOne(f)
+		return n, err
+	}
+
+	// e.g. SMB/NFS session was dropped, reopening the file transparently recovers
+	fmt.Println("stale file handle, reopening", fp.filePath, err)
+	fp.discardStale(f)
+	f, reopenErr := fp.GetOne()
+	if reopenErr != nil {
+		return 0, fmt.Errorf("%w (reopen also failed: %v)", err, reopenErr)
+	}
+	defer fp.ReturnOne(f)
+	return fileReadAt(f, b, off)
+}
+
+// FilePoolStats is number of os.File opened for one file.
+type FilePoolStats struct {
+	Path    string
+	Idle    int
+	InUse   int
+	Reopens int
+	Reaped  int
+}
+
+// FilePoolSnapshot returns stats of every file pool, sorted by path.
+func FilePoolSnapshot() []FilePoolStats {
+	pools := allFilePools()
+	stats := make([]FilePoolStats, 0, len(pools))
+	for _, fp := range pools {
+		fp.lock.Lock()
+		stats = append(stats, FilePoolStats{
+			Path:    fp.filePath,
+			Idle:    len(fp.filePools),
+			InUse:   fp.currentlyUsedFiles,
+			Reopens: fp.reopens,
+			Reaped:  fp.reaped,
+		})
+		fp.lock.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Path < stats[j].Path })
+	return stats
+}
+
+func allFilePools() []*FilePool {
+	filePoolRWLock.RLock()
+	defer filePoolRWLock.RUnlock()
+	pools := make([]*FilePool, 0, len(filePools))
+	for _, fp := range filePools {
+		pools = append(pools, fp)
+	}
+	return pools
+}
+
+// StartFilePoolKeepalive reads a byte from every opened file periodically, so sessions of network shares are not dropped while apps are idle
+// (and stale handles are reopened before apps need them).
+func StartFilePoolKeepalive(interval time.Duration) {
+	go func() {
+		buf := make([]byte, 1)
+		for range time.Tick(interval) {
+			for _, fp := range allFilePools() {
+				if _, err := fp.ReadAt(buf, 0); err != nil && err != io.EOF {
+					fmt.Println("keepalive read failed", fp.filePath, err)
+				}
+			}
+		}
+	}()
+}
+
+// StartFilePoolReaper closes handles which have been idle for timeout periodically, so archives which are not read don't keep descriptors.
+// Handles are opened again when the file is read. Handles for sequential and unbuffered reads are kept.
+func StartFilePoolReaper(timeout time.Duration) {
+	go func() {
+		for range time.Tick(timeout / 2) {
+			deadline := time.Now().Add(-timeout)
+			for _, fp := range allFilePools() {
+				fp.reapIdle(deadline)
+			}
+		}
+	}()
+}
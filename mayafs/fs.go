@@ -0,0 +1,780 @@
+// Package mayafs provides merged, read-only view of .mar and .zip archives (and seekable .zst files).
+//
+// Archives are registered by AddArchive (or ParseArchiveSpec, which accepts same syntax as marmounter),
+// then merged by LoadPendingArchives. Later archives override earlier ones, and .mar whiteout entries
+// remove files from earlier archives.
+//
+//	fs := mayafs.New()
+//	if err := fs.ParseArchiveSpec("addprefix=data:game.mar"); err != nil {
+//		panic(err)
+//	}
+//	if err := fs.LoadPendingArchives(); err != nil {
+//		panic(err)
+//	}
+//	http.Handle("/", http.FileServer(http.FS(fs.IOFS())))
+//
+// Paths are slash-separated and starts with "/", and lookups are case-insensitive (see NormalizeString).
+// FS does not depend on FUSE, marmounter is just one of its users.
+package mayafs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/klauspost/compress/zstd"
+	pb "github.com/rinsuki/mayakashi/proto"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/proto"
+)
+
+const INDEX_MAGIC = "MARI"
+
+// INDEX_CHECKSUM_MAGIC is followed by sha256 of compressed index, at the end of .mar.idx (older .mar.idx doesn't have it).
+const INDEX_CHECKSUM_MAGIC = "SHA2"
+const WHITEOUT_SUFFIX = ".__whiteout__"
+const WRITEBACK_SUFFIX = ".__writeback__"
+
+// when same path exists in archives which have same priority, file from later archive wins by default
+const CONFLICT_LAST_WINS = "last"
+const CONFLICT_FIRST_WINS = "first"
+
+// default of FS.MaxCachedChunkSize
+const DEFAULT_MAX_CACHED_CHUNK_SIZE = 64 << 20
+
+// FileInfo is a file entry in merged tree, which is either from .mar (MarEntry), .zip (ZipEntry), .zst (ZstEntry) or plain directory (LocalFile).
+type FileInfo struct {
+	MarEntry    *pb.FileEntry
+	ZipEntry    *ZipEntry
+	ZstEntry    *ZstEntry
+	LocalFile   *LocalFile
+	ArchiveFile string
+	Priority    int
+}
+
+// DirInfo holds children of directory, keyed by normalized path and valued by original path.
+// It is a part of Tree, so it must not be modified after the tree is published.
+type DirInfo struct {
+	Files       map[string]string
+	Directories map[string]string
+	// zero if no archive records it
+	Modified time.Time
+}
+
+type ChunkCache struct {
+	ChunkNo int
+	Data    []byte
+}
+
+// Tree is a snapshot of merged files and directories, keyed by normalized path.
+// Published tree is never modified, so it can be read from any goroutines without locks.
+type Tree struct {
+	Directories map[string]*DirInfo
+	Files       map[string]FileInfo
+	// archives which are merged into this tree, in the order they were applied
+	Archives []ArchiveSummary
+}
+
+// FS is a merged tree of archives.
+type FS struct {
+	tree                 atomic.Pointer[Tree]
+	treeMutex            sync.Mutex
+	ChunkCache           *ristretto.Cache
+	SlowReadLog          *os.File
+	LastDatRead          time.Time
+	DisableZipIndexCache bool
+	PendingArchives      []PendingArchive
+	LoadJobs             int
+	ConflictPolicy       string
+	// print every conflicting file, not only number of them per archive pair
+	LogConflictFiles bool
+	HotChunks        *HotChunkTracker
+	IOStats          *IOStatsTracker
+	// copies of frequently read compressed chunks on fast storage, nil if disabled
+	HotStore *HotStore
+	// limits reads from all archives, nil if unlimited
+	ReadLimiter *RateLimiter
+	// ArchiveReadOptions.ReadLimiter keyed by path of archive (or .dat) file
+	archiveReadLimiters sync.Map
+	// failed reads from archives (e.g. USB disk hiccup, SMB blip) are retried this many times,
+	// waiting ReadRetryBackoff before first retry and doubling it for each retry
+	ReadRetries      int
+	ReadRetryBackoff time.Duration
+	// where blocks of remote (URL) archives are cached, "" to not persist them
+	RemoteCacheDir string
+	// sent as bearer token to servers of remote archives, e.g. serve= of other marmounter
+	RemoteToken string
+	// other mounters on LAN which might have blocks of remote archives, nil if disabled
+	Peers            *PeerCache
+	remoteFiles      map[string]*RemoteFile
+	remoteFilesMutex sync.Mutex
+	// reads from archives which take longer than this fail (without retries) and mark the archive degraded, 0 to wait forever
+	ReadTimeout time.Duration
+	// directories which are scanned by AddScannedArchives
+	ScanDirs []ScanDir
+	// skip (with warning) instead of failing if archives are missing, same as ArchiveReadOptions.Optional for all archives
+	SkipMissingArchives bool
+	// directories which have fast copy of some archive files, see mirrorPath
+	MirrorDirs []string
+	// file => file to read (which is file itself if not mirrored)
+	mirrors sync.Map
+	// decompressors of large zip entries and .mar chunks which are kept open between reads, see decodeStream
+	decodeStreams      []*decodeStream
+	decodeStreamsMutex sync.Mutex
+	// zstd chunks of .mar larger than this are decompressed partially (up to requested range) without caching, 0 to disable
+	MaxCachedChunkSize int64
+	CachePolicy        CachePolicy
+	scans              *sequentialScans
+	// files whose decompressed data is pinned (never evicted), see pin.go
+	PinGlobs  []string
+	PinBudget int64
+	pinned    pinnedStore
+	// applied in order after every tree update, loose files first, then bind mounts and aliases
+	LooseFiles []LooseFile
+	BindMounts []BindMount
+	Aliases    []Alias
+}
+
+func NormalizeString(s string) string {
+	s = strings.ToLower(s)
+	s = norm.NFC.String(s)
+
+	return s
+}
+
+var sharedChunkCache *ristretto.Cache
+var sharedChunkCacheOnce sync.Once
+
+// GetSharedChunkCache returns chunk cache which is shared with every filesystems in this process.
+func GetSharedChunkCache() *ristretto.Cache {
+	sharedChunkCacheOnce.Do(func() {
+		sharedChunkCache = NewChunkCache(4*1024*1024*1024, false) // 4GiB
+	})
+	return sharedChunkCache
+}
+
+// New returns empty FS which uses shared chunk cache.
+func New() *FS {
+	return &FS{
+		ChunkCache:         GetSharedChunkCache(),
+		LoadJobs:           runtime.NumCPU(),
+		ConflictPolicy:     CONFLICT_LAST_WINS,
+		IOStats:            NewIOStatsTracker(),
+		ReadRetries:        3,
+		ReadRetryBackoff:   100 * time.Millisecond,
+		RemoteCacheDir:     DefaultRemoteCacheDir(),
+		MaxCachedChunkSize: DEFAULT_MAX_CACHED_CHUNK_SIZE,
+		scans:              newSequentialScans(),
+		PinBudget:          DEFAULT_PIN_BUDGET,
+	}
+}
+
+var emptyTree = &Tree{
+	Directories: map[string]*DirInfo{},
+	Files:       map[string]FileInfo{},
+}
+
+// Tree returns current snapshot of merged tree. Returned tree must not be modified.
+// Take it once and use it for related lookups (e.g. readdir), so they see consistent state even if archives are (re)loaded.
+func (fs *FS) Tree() *Tree {
+	if tree := fs.tree.Load(); tree != nil {
+		return tree
+	}
+	return emptyTree
+}
+
+// Archives returns archives which are merged into current tree.
+func (fs *FS) Archives() []ArchiveSummary {
+	return fs.Tree().Archives
+}
+
+// treeBuilder makes new tree from current one with copy-on-write, so readers of current tree are not affected.
+type treeBuilder struct {
+	tree *Tree
+	// directories which are already copied by this builder
+	ownedDirs map[string]struct{}
+	// number of conflicting files, printed when the tree is published
+	conflicts map[treeConflict]int
+}
+
+// treeConflict is pair of archives which have same files.
+type treeConflict struct {
+	Winner string
+	Loser  string
+	// Loser is ignored because it is loaded after Winner, instead of being overridden by it
+	Ignored bool
+}
+
+func (t *Tree) edit() *treeBuilder {
+	nt := &Tree{
+		Directories: make(map[string]*DirInfo, len(t.Directories)),
+		Files:       make(map[string]FileInfo, len(t.Files)),
+		// appending never writes into backing array of published tree
+		Archives: t.Archives[:len(t.Archives):len(t.Archives)],
+	}
+	for k, v := range t.Directories {
+		nt.Directories[k] = v
+	}
+	for k, v := range t.Files {
+		nt.Files[k] = v
+	}
+	return &treeBuilder{
+		tree:      nt,
+		ownedDirs: map[string]struct{}{},
+		conflicts: map[treeConflict]int{},
+	}
+}
+
+// updateTree applies update to a copy of current tree, and publishes it.
+// Updates are serialized, readers keep seeing previous tree until update finishes.
+func (fs *FS) updateTree(update func(b *treeBuilder)) {
+	fs.treeMutex.Lock()
+	defer fs.treeMutex.Unlock()
+	b := fs.Tree().edit()
+	update(b)
+	fs.applyLooseFiles(b)
+	fs.applyBindMounts(b)
+	fs.applyAliases(b)
+	fs.tree.Store(b.tree)
+	b.printConflicts()
+}
+
+// printConflicts prints number of conflicting files per archive pair.
+func (b *treeBuilder) printConflicts() {
+	conflicts := make([]treeConflict, 0, len(b.conflicts))
+	for c := range b.conflicts {
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Winner != conflicts[j].Winner {
+			return conflicts[i].Winner < conflicts[j].Winner
+		}
+		return conflicts[i].Loser < conflicts[j].Loser
+	})
+	for _, c := range conflicts {
+		if c.Ignored {
+			fmt.Println("conflict:", b.conflicts[c], "files from", c.Loser, "are ignored, keeping", c.Winner)
+		} else {
+			fmt.Println("conflict:", b.conflicts[c], "files from", c.Loser, "are overridden by", c.Winner)
+		}
+	}
+}
+
+// AddArchive registers archive (.zip, .mar or seekable .zst) to be loaded by LoadPendingArchives.
+// .mar can be URL (http:// or https://), see RemoteFile.
+func (fs *FS) AddArchive(file string, options ArchiveReadOptions) error {
+	if !strings.HasSuffix(file, ".zip") && !strings.HasSuffix(file, ".mar") && !strings.HasSuffix(file, ".zst") {
+		return fmt.Errorf("unknown file type (filename suffix): %s", file)
+	}
+
+	fs.PendingArchives = append(fs.PendingArchives, PendingArchive{
+		File:    file,
+		Options: options,
+	})
+
+	return nil
+}
+
+// ParseArchiveSpec parses archive path with optional prefixes (e.g. "addprefix=foo:onlyglob=*.png:file.zip"),
+// and registers it by AddArchive (or AddDirectory for "dir=<path>").
+func (fs *FS) ParseArchiveSpec(file string) error {
+	var options ArchiveReadOptions
+
+	for {
+		shouldBreak := true
+
+		if strings.HasPrefix(file, "addprefix=") {
+			af := strings.SplitN(file, ":", 2)
+			ap := af[0]
+			file = af[1]
+			ap = strings.SplitN(ap, "=", 2)[1]
+			if len(ap) > 0 && !strings.HasPrefix(ap, "/") {
+				ap = "/" + ap
+			}
+			for strings.HasSuffix(ap, "/") {
+				ap = ap[:len(ap)-1]
+			}
+			if options.AdditionalPrefix != "" {
+				return fmt.Errorf("additional prefix already set (%s)", options.AdditionalPrefix)
+			}
+			options.AdditionalPrefix = ap
+			shouldBreak = false
+		}
+
+		if strings.HasPrefix(file, "stripprefix=") {
+			sf := strings.SplitN(file, ":", 2)
+			file = sf[1]
+			sf = strings.SplitN(sf[0], "=", 2)
+			sp := sf[1]
+			if len(sp) > 0 && !strings.HasPrefix(sp, "/") {
+				sp = "/" + sp
+			}
+			if options.StripPrefix != "" {
+				return fmt.Errorf("strip prefix already set (%s)", options.StripPrefix)
+			}
+			options.StripPrefix = sp
+			shouldBreak = false
+		}
+
+		for strings.HasPrefix(file, "rewrite=") {
+			rule, rest, err := ParseRewriteRule(file[len("rewrite="):])
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(rest, ":") {
+				return fmt.Errorf("invalid rewrite (should be followed by \":\"): %s", file)
+			}
+			file = rest[1:]
+			options.Rewrites = append(options.Rewrites, rule)
+			shouldBreak = false
+		}
+
+		for strings.HasPrefix(file, "onlyglob=") {
+			oa := strings.SplitN(file, ":", 2)
+			file = oa[1]
+			options.IncludedGlobs = append(options.IncludedGlobs, oa[0][len("onlyglob="):])
+			shouldBreak = false
+		}
+
+		if strings.HasPrefix(file, "priority=") {
+			pf := strings.SplitN(file, ":", 2)
+			file = pf[1]
+			priority, err := strconv.Atoi(pf[0][len("priority="):])
+			if err != nil {
+				return fmt.Errorf("invalid priority: %s", pf[0])
+			}
+			options.Priority = priority
+			shouldBreak = false
+		}
+
+		if strings.HasPrefix(file, "maxread=") {
+			mf := strings.SplitN(file, ":", 2)
+			file = mf[1]
+			limit, err := ParseByteRate(mf[0][len("maxread="):])
+			if err != nil {
+				return fmt.Errorf("invalid maxread: %w", err)
+			}
+			options.ReadLimiter = NewRateLimiter(limit)
+			shouldBreak = false
+		}
+
+		if strings.HasPrefix(file, "optional=") {
+			// marker, rest is the archive (with prefixes)
+			file = file[len("optional="):]
+			options.Optional = true
+			shouldBreak = false
+		}
+
+		if strings.HasPrefix(file, "ziplocale=") {
+			zf := strings.SplitN(file, ":", 2)
+			file = zf[1]
+			zf = strings.SplitN(zf[0], "=", 2)
+			locale := zf[1]
+			if err := options.SetZipLocale(locale); err != nil {
+				return err
+			}
+			shouldBreak = false
+		}
+
+		if shouldBreak {
+			break
+		}
+	}
+
+	if strings.HasPrefix(file, "dir=") || strings.HasPrefix(file, "dirscan=") {
+		var err error
+		if strings.HasPrefix(file, "dir=") {
+			err = fs.AddDirectory(file[len("dir="):], options)
+		} else {
+			err = fs.AddScannedArchives(file[len("dirscan="):], options)
+		}
+		if errors.Is(err, os.ErrNotExist) && (options.Optional || fs.SkipMissingArchives) {
+			fmt.Println("Warning: skipped missing directory", file, err)
+			return nil
+		}
+		return err
+	}
+
+	return fs.AddArchive(file, options)
+}
+
+// GetFile returns file entry of path in archives.
+func (fs *FS) GetFile(path string) (FileInfo, bool) {
+	file, ok := fs.Tree().Files[NormalizeString(path)]
+	return file, ok
+}
+
+// GetDir returns directory of path in archives, or nil if not exists.
+func (fs *FS) GetDir(path string) *DirInfo {
+	return fs.Tree().Directories[NormalizeString(path)]
+}
+
+func (fs *FS) readZipFile(file string, o ArchiveReadOptions) (*LoadedArchive, error) {
+	fs.setArchiveReadLimiter(file, o.ReadLimiter)
+	entries, err := ReadZipEntries(file, !fs.DisableZipIndexCache)
+	if err != nil {
+		return nil, err
+	}
+
+	zipEntries := make([]*ZipEntry, 0, len(entries))
+	for i := range entries {
+		f := &entries[i]
+		if f.NonUTF8 {
+			f.Name = o.ConvertZipFileName(f.Name)
+		}
+		zipEntries = append(zipEntries, f)
+	}
+
+	return &LoadedArchive{
+		File:       file,
+		Options:    o,
+		ZipEntries: zipEntries,
+		DataFiles:  []string{file},
+	}, nil
+}
+
+func (fs *FS) applyZipFile(b *treeBuilder, la *LoadedArchive) int {
+	file := la.File
+	o := la.Options
+
+	var fileCount int
+
+	for _, f := range la.ZipEntries {
+		origPath := o.GetFilePath(f.Name)
+		if origPath == "" {
+			continue
+		}
+
+		shouldTreatAsDir := f.IsDir
+
+		if strings.HasSuffix(origPath, "/") {
+			if !shouldTreatAsDir {
+				if f.Size() != 0 {
+					fmt.Println("invalid file size for invalid directory", origPath)
+					continue
+				}
+				origPath = origPath[:len(origPath)-1]
+				shouldTreatAsDir = true
+			}
+		}
+
+		// fmt.Println("dir", origPath, f.FileInfo().IsDir())
+		if shouldTreatAsDir {
+			// just create directory
+			dirInfo := b.getDirInfo(strings.TrimSuffix(origPath, "/"))
+			if f.IsDir && !f.Modified.IsZero() {
+				dirInfo.Modified = f.Modified
+			}
+		} else if fs.putFile(b, origPath, FileInfo{
+			MarEntry:    nil,
+			ZipEntry:    f,
+			ArchiveFile: file,
+			Priority:    o.Priority,
+		}) {
+			fileCount += 1
+		}
+	}
+
+	return fileCount
+}
+
+// verifyIndexChecksum verifies checksum which follows compressed index, if it exists.
+func verifyIndexChecksum(r io.Reader, compressed []byte) error {
+	trailer, err := io.ReadAll(io.LimitReader(r, int64(len(INDEX_CHECKSUM_MAGIC)+sha256.Size+1)))
+	if err != nil {
+		return err
+	}
+	if len(trailer) == 0 {
+		// written by older version
+		return nil
+	}
+	if len(trailer) != len(INDEX_CHECKSUM_MAGIC)+sha256.Size || string(trailer[:len(INDEX_CHECKSUM_MAGIC)]) != INDEX_CHECKSUM_MAGIC {
+		return errors.New("index has unknown trailer")
+	}
+	sum := sha256.Sum256(compressed)
+	if !bytes.Equal(trailer[len(INDEX_CHECKSUM_MAGIC):], sum[:]) {
+		return errors.New("index is corrupted (checksum mismatch)")
+	}
+	return nil
+}
+
+func (fs *FS) readMARFile(file string, o ArchiveReadOptions) (*LoadedArchive, error) {
+
+	f, err := fs.openDataFile(file + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// read magic
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, err
+	}
+
+	if string(magic) != INDEX_MAGIC {
+		return nil, fmt.Errorf("invalid magic: %s", file)
+	}
+
+	// read compressed length
+	var compressedLength uint32
+	if err = binary.Read(f, binary.BigEndian, &compressedLength); err != nil {
+		return nil, err
+	}
+
+	// read decompressed length
+	var decompressedLength uint32
+	if err = binary.Read(f, binary.BigEndian, &decompressedLength); err != nil {
+		return nil, err
+	}
+
+	// read data
+	data := make([]byte, compressedLength)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("index is truncated (%d bytes are expected): %s.idx: %w", compressedLength, file, err)
+	}
+	if err := verifyIndexChecksum(f, data); err != nil {
+		return nil, fmt.Errorf("%w: %s.idx", err, file)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	data, err = decoder.DecodeAll(data, make([]byte, 0, int(decompressedLength)))
+	if err != nil {
+		return nil, fmt.Errorf("index is corrupted (failed to decompress): %s.idx: %w", file, err)
+	}
+
+	var indexFile pb.FileIndexFile
+	if err := proto.Unmarshal(data, &indexFile); err != nil {
+		return nil, fmt.Errorf("index is corrupted (failed to parse): %s.idx: %w", file, err)
+	}
+	datFiles := map[uint32]struct{}{}
+	datPaths := []string{}
+	for _, entry := range indexFile.Entries {
+		ensureChunkOffsets(entry)
+		if _, ok := datFiles[entry.FileIndex]; !ok {
+			datFiles[entry.FileIndex] = struct{}{}
+			datPath := (&FileInfo{MarEntry: entry, ArchiveFile: file}).DatPath()
+			datPaths = append(datPaths, datPath)
+			fs.setArchiveReadLimiter(datPath, o.ReadLimiter)
+		}
+	}
+	sort.Strings(datPaths)
+
+	dirs := make([]ArchiveDir, 0, len(indexFile.Directories))
+	for _, d := range indexFile.Directories {
+		dir := ArchiveDir{Name: d.Path}
+		if d.ModifiedTime != nil {
+			dir.Modified = d.ModifiedTime.AsTime()
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return &LoadedArchive{
+		File:       file,
+		Options:    o,
+		MarEntries: indexFile.Entries,
+		Dirs:       dirs,
+		DataFiles:  datPaths,
+		Metadata:   indexFile.Metadata,
+	}, nil
+}
+
+func (fs *FS) applyMARFile(b *treeBuilder, la *LoadedArchive) int {
+	file := la.File
+	o := la.Options
+
+	fileCount := 0
+
+	ourFiles := map[string]struct{}{}
+	for _, entry := range la.MarEntries {
+		origPath := o.GetFilePath(entry.Info.Path)
+		if origPath == "" {
+			continue
+		}
+
+		lowerPath := NormalizeString(origPath)
+		dir := origPath[:strings.LastIndex(origPath, "/")]
+
+		if strings.HasSuffix(lowerPath, WHITEOUT_SUFFIX) {
+			lowerPath = lowerPath[:len(lowerPath)-len(WHITEOUT_SUFFIX)]
+			if _, ok := ourFiles[lowerPath]; ok {
+				fmt.Println("whiteout but including ", origPath)
+				continue
+			}
+			origPath = origPath[:len(origPath)-len(WHITEOUT_SUFFIX)]
+			if existing, ok := b.tree.Files[lowerPath]; ok && existing.Priority > o.Priority {
+				// same as regular entries, archive with lower priority (e.g. added by dirwatch) can't remove it
+				fmt.Println("whiteout:", origPath, "from", file, "is ignored, keeping", existing.ArchiveFile, "which has higher priority")
+				continue
+			}
+			println("whiteout", origPath)
+			delete(b.tree.Files, lowerPath)
+			delete(b.getDirInfo(dir).Files, NormalizeString(origPath))
+			continue
+		}
+		ourFiles[lowerPath] = struct{}{}
+
+		if fs.putFile(b, origPath, FileInfo{
+			MarEntry:    entry,
+			ArchiveFile: file,
+			Priority:    o.Priority,
+		}) {
+			fileCount += 1
+		}
+	}
+
+	return fileCount
+}
+
+// putFile adds file to the tree, or resolves conflict with existing one by priority and ConflictPolicy.
+// Archives are applied in ascending order of priority, but archives added to live tree (e.g. dirwatch) might have lower priority.
+func (fs *FS) putFile(b *treeBuilder, origPath string, fi FileInfo) bool {
+	lowerPath := NormalizeString(origPath)
+	if existing, ok := b.tree.Files[lowerPath]; ok {
+		if existing.Priority > fi.Priority {
+			if fs.LogConflictFiles {
+				fmt.Println("conflict:", origPath, "from", fi.ArchiveFile, "is ignored, keeping", existing.ArchiveFile, "which has higher priority")
+			}
+			b.conflicts[treeConflict{Winner: existing.ArchiveFile, Loser: fi.ArchiveFile, Ignored: true}]++
+			return false
+		}
+		if existing.Priority == fi.Priority && fs.ConflictPolicy == CONFLICT_FIRST_WINS {
+			if fs.LogConflictFiles {
+				fmt.Println("conflict:", origPath, "from", fi.ArchiveFile, "is ignored, keeping", existing.ArchiveFile)
+			}
+			b.conflicts[treeConflict{Winner: existing.ArchiveFile, Loser: fi.ArchiveFile, Ignored: true}]++
+			return false
+		}
+		if fs.LogConflictFiles {
+			fmt.Println("conflict:", origPath, "from", existing.ArchiveFile, "is overridden by", fi.ArchiveFile)
+		}
+		b.conflicts[treeConflict{Winner: fi.ArchiveFile, Loser: existing.ArchiveFile}]++
+	}
+
+	b.tree.Files[lowerPath] = fi
+	dir := origPath[:strings.LastIndex(origPath, "/")]
+	b.getDirInfo(dir).Files[lowerPath] = origPath
+	return true
+}
+
+// getDirInfo returns directory which can be modified by this builder, creating it (and its parents) if not exists.
+func (b *treeBuilder) getDirInfo(dirPath string) *DirInfo {
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	lowerDirPath := NormalizeString(dirPath)
+	dirInfo, ok := b.tree.Directories[lowerDirPath]
+	if ok {
+		if _, owned := b.ownedDirs[lowerDirPath]; !owned {
+			// shared with published tree, copy before modifying
+			copied := &DirInfo{
+				Files:       make(map[string]string, len(dirInfo.Files)),
+				Directories: make(map[string]string, len(dirInfo.Directories)),
+				Modified:    dirInfo.Modified,
+			}
+			for k, v := range dirInfo.Files {
+				copied.Files[k] = v
+			}
+			for k, v := range dirInfo.Directories {
+				copied.Directories[k] = v
+			}
+			dirInfo = copied
+			b.tree.Directories[lowerDirPath] = dirInfo
+			b.ownedDirs[lowerDirPath] = struct{}{}
+		}
+		return dirInfo
+	}
+
+	dirInfo = &DirInfo{
+		Files:       map[string]string{},
+		Directories: map[string]string{},
+	}
+	b.tree.Directories[lowerDirPath] = dirInfo
+	b.ownedDirs[lowerDirPath] = struct{}{}
+	upDir := dirPath[:strings.LastIndex(dirPath, "/")]
+	if upDir == "" {
+		upDir = "/"
+	}
+	if upDir != dirPath {
+		b.getDirInfo(upDir).Directories[NormalizeString(dirPath)] = dirPath
+	}
+	return dirInfo
+}
+
+// Size returns uncompressed size of the file.
+func (fi *FileInfo) Size() int64 {
+	if fi.MarEntry != nil {
+		chunks := fi.MarEntry.Info.Chunks
+		if len(chunks) == 0 {
+			return 0
+		}
+		return int64(fi.MarEntry.ChunkOriginalOffsets[len(chunks)-1]) + int64(chunks[len(chunks)-1].OriginalLength)
+	}
+	if fi.LocalFile != nil {
+		return fi.LocalFile.Size
+	}
+	if fi.ZstEntry != nil {
+		return fi.ZstEntry.Size
+	}
+	return fi.ZipEntry.Size()
+}
+
+// ModTime returns modified time which is recorded in archive.
+func (fi *FileInfo) ModTime() time.Time {
+	if fi.MarEntry != nil {
+		return fi.MarEntry.Info.ModifiedTime.AsTime()
+	}
+	if fi.LocalFile != nil {
+		return fi.LocalFile.Modified
+	}
+	if fi.ZstEntry != nil {
+		return fi.ZstEntry.Modified
+	}
+	return fi.ZipEntry.Modified
+}
+
+// SymlinkTarget returns target if the file is a symbolic link (recorded by `create --metadata`), otherwise empty.
+func (fi *FileInfo) SymlinkTarget() string {
+	if fi.MarEntry != nil {
+		return fi.MarEntry.SymlinkTarget
+	}
+	return ""
+}
+
+func (fi *FileInfo) GetFilename() string {
+	var path string
+	if fi.MarEntry != nil {
+		path = fi.MarEntry.Info.Path
+	} else if fi.LocalFile != nil {
+		path = fi.LocalFile.Name
+	} else if fi.ZstEntry != nil {
+		path = fi.ZstEntry.Name
+	} else {
+		path = FixPathSplitter(fi.ZipEntry.Name)
+	}
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// DatPath returns path of .dat file which contains body of this file (only for .mar).
+func (fi *FileInfo) DatPath() string {
+	if fi.MarEntry.FileIndex == 0 {
+		return fi.ArchiveFile + ".dat"
+	}
+	return fmt.Sprintf("%s.%d.dat", fi.ArchiveFile, fi.MarEntry.FileIndex)
+}
@@ -0,0 +1,135 @@
+package mayafs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HotChunkTracker counts accesses to decompressed chunks, so hot chunks can be re-warmed after restart.
+// nil HotChunkTracker does nothing.
+type HotChunkTracker struct {
+	mutex  sync.Mutex
+	counts map[HotChunk]uint32
+}
+
+// HotChunk is a chunk of file in merged tree.
+type HotChunk struct {
+	Path    string
+	ChunkNo int
+}
+
+// HotChunkCount is HotChunk with its access count.
+type HotChunkCount struct {
+	HotChunk
+	Count uint32
+}
+
+// tracking too many chunks only wastes memory
+const maxTrackedHotChunks = 1024 * 1024
+
+func NewHotChunkTracker() *HotChunkTracker {
+	return &HotChunkTracker{
+		counts: map[HotChunk]uint32{},
+	}
+}
+
+func (t *HotChunkTracker) Touch(path string, chunkNo int) {
+	if t == nil {
+		return
+	}
+	key := HotChunk{Path: NormalizeString(path), ChunkNo: chunkNo}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if count, ok := t.counts[key]; ok {
+		t.counts[key] = count + 1
+	} else if len(t.counts) < maxTrackedHotChunks {
+		t.counts[key] = 1
+	}
+}
+
+// Seed restores counts loaded by LoadHotChunks.
+// Counts are halved, so chunks which were hot long ago will be cold eventually.
+func (t *HotChunkTracker) Seed(chunks []HotChunkCount) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, c := range chunks {
+		if len(t.counts) >= maxTrackedHotChunks {
+			break
+		}
+		count := c.Count / 2
+		if count == 0 {
+			count = 1
+		}
+		t.counts[c.HotChunk] += count
+	}
+}
+
+// Top returns at most n chunks, most accessed first.
+func (t *HotChunkTracker) Top(n int) []HotChunkCount {
+	t.mutex.Lock()
+	result := make([]HotChunkCount, 0, len(t.counts))
+	for key, count := range t.counts {
+		result = append(result, HotChunkCount{HotChunk: key, Count: count})
+	}
+	t.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		if result[i].Path != result[j].Path {
+			return result[i].Path < result[j].Path
+		}
+		return result[i].ChunkNo < result[j].ChunkNo
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Save writes at most n hottest chunks to file as "<count>\t<chunk number>\t<path>" lines.
+func (t *HotChunkTracker) Save(file string, n int) error {
+	var sb strings.Builder
+	for _, c := range t.Top(n) {
+		fmt.Fprintf(&sb, "%d\t%d\t%s\n", c.Count, c.ChunkNo, c.Path)
+	}
+	if err := os.WriteFile(file+WRITEBACK_SUFFIX, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+WRITEBACK_SUFFIX, file)
+}
+
+// LoadHotChunks reads file written by HotChunkTracker.Save.
+func LoadHotChunks(file string) ([]HotChunkCount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := []HotChunkCount{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cols := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(cols) != 3 {
+			continue
+		}
+		count, err := strconv.ParseUint(cols[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		chunkNo, err := strconv.Atoi(cols[1])
+		if err != nil {
+			continue
+		}
+		result = append(result, HotChunkCount{
+			HotChunk: HotChunk{Path: cols[2], ChunkNo: chunkNo},
+			Count:    uint32(count),
+		})
+	}
+	return result, scanner.Err()
+}
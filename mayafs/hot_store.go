@@ -0,0 +1,412 @@
+package mayafs
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// HotStore is a bounded file on fast storage (e.g. SSD) which holds copies of compressed chunks of archives on slow storage (e.g. HDD).
+// It sits between chunk cache (RAM) and archives: chunks are promoted into it after they are read from archive
+// hotStorePromoteReads times (i.e. chunk cache couldn't keep them), and it is used as a ring buffer. When it is full,
+// oldest chunks are demoted (dropped), except ones which were hit since they were stored, which are moved to head instead
+// with their hit count reset, so only chunks which keep being read stay in it.
+// Index of stored chunks is saved next to the file (<file>.idx), so chunks survive restarts.
+// nil HotStore does nothing.
+type HotStore struct {
+	path     string
+	file     *os.File
+	capacity int64
+
+	mutex   sync.Mutex
+	entries map[hotStoreKey]*hotStoreEntry
+	// stored chunks in write order, oldest first
+	queue []*hotStoreEntry
+	// where next chunk is written
+	head int64
+	// reads from archive of chunks which are not stored
+	counts map[hotStoreKey]uint32
+	// archive file => its size and mtime, chunks are dropped on startup if archive is changed
+	stamps map[string]string
+	// index is changed since last save
+	dirty bool
+
+	promotions chan hotStorePromotion
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	promoted  atomic.Uint64
+	demoted   atomic.Uint64
+	requeued  atomic.Uint64
+	corrupted atomic.Uint64
+}
+
+// HotStoreStats is state of HotStore.
+type HotStoreStats struct {
+	Capacity  int64
+	Used      int64
+	Chunks    int
+	Hits      uint64
+	Misses    uint64
+	Promoted  uint64
+	Demoted   uint64
+	Requeued  uint64
+	Corrupted uint64
+}
+
+type hotStoreKey struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+type hotStoreEntry struct {
+	key hotStoreKey
+	pos int64
+	crc uint32
+	// hits since it was stored (or moved to head)
+	hits uint32
+	// dropped from entries (e.g. checksum mismatch), but still in queue
+	dead bool
+}
+
+type hotStorePromotion struct {
+	key  hotStoreKey
+	data []byte
+}
+
+// chunks are promoted after they are read from archive this many times
+const hotStorePromoteReads = 2
+
+// chunks larger than capacity / this are not stored, since they would push out too many chunks
+const hotStoreMaxChunkRatio = 16
+
+const hotStoreIndexSuffix = ".idx"
+
+// OpenHotStore opens (or creates) store file which holds at most capacity bytes of chunks.
+func OpenHotStore(path string, capacity int64) (*HotStore, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid hot store size: %d", capacity)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &HotStore{
+		path:       path,
+		file:       f,
+		capacity:   capacity,
+		entries:    map[hotStoreKey]*hotStoreEntry{},
+		counts:     map[hotStoreKey]uint32{},
+		stamps:     map[string]string{},
+		promotions: make(chan hotStorePromotion, 64),
+	}
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Warning: failed to load hot store index, starting with empty store:", err)
+	}
+	// size was shrunk since last time, chunks after capacity were dropped by load
+	if st, err := f.Stat(); err == nil && st.Size() > capacity {
+		f.Truncate(capacity)
+	}
+	go s.writeLoop()
+	return s, nil
+}
+
+func fileStamp(file string) (string, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", st.Size(), st.ModTime().UnixNano()), nil
+}
+
+// ReadAt fills buff with chunk at offset of file, and returns false if it is not stored.
+func (s *HotStore) ReadAt(file string, buff []byte, offset int64) bool {
+	if s == nil {
+		return false
+	}
+	key := hotStoreKey{File: file, Offset: offset, Length: int64(len(buff))}
+	s.mutex.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		e.hits++
+	}
+	s.mutex.Unlock()
+	if !ok {
+		s.misses.Add(1)
+		return false
+	}
+	if _, err := s.file.ReadAt(buff, e.pos); err != nil || crc32.ChecksumIEEE(buff) != e.crc {
+		// store file is broken (or index is older than the file after crash), archive is read instead
+		s.corrupted.Add(1)
+		s.misses.Add(1)
+		s.mutex.Lock()
+		if s.entries[key] == e {
+			delete(s.entries, key)
+			e.dead = true
+			s.dirty = true
+		}
+		s.mutex.Unlock()
+		return false
+	}
+	s.hits.Add(1)
+	return true
+}
+
+// Promote counts a read of chunk from archive, and copies it into store in background when it is read enough times.
+// data must not be modified after this.
+func (s *HotStore) Promote(file string, data []byte, offset int64) {
+	if s == nil || int64(len(data)) > s.capacity/hotStoreMaxChunkRatio {
+		return
+	}
+	key := hotStoreKey{File: file, Offset: offset, Length: int64(len(data))}
+	s.mutex.Lock()
+	if _, ok := s.entries[key]; ok {
+		s.mutex.Unlock()
+		return
+	}
+	count := s.counts[key] + 1
+	if count < hotStorePromoteReads {
+		if len(s.counts) < maxTrackedHotChunks {
+			s.counts[key] = count
+		}
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.counts, key)
+	s.mutex.Unlock()
+	select {
+	// data is copied, since it might be returned to buffer pool by caller
+	case s.promotions <- hotStorePromotion{key: key, data: append([]byte(nil), data...)}:
+	default:
+		// writer can't keep up, chunk will be promoted when it is read again
+	}
+}
+
+func (s *HotStore) writeLoop() {
+	for p := range s.promotions {
+		if err := s.store(p.key, p.data); err != nil {
+			fmt.Println("failed to write to hot store:", err)
+		}
+	}
+}
+
+// store writes chunk at head, demoting (or moving to head) chunks which are overwritten.
+// Only writeLoop writes to the file, so data of chunks which are moved can be read before they are overwritten.
+func (s *HotStore) store(key hotStoreKey, data []byte) error {
+	pending := []hotStorePromotion{{key: key, data: data}}
+	promoted := true
+	for len(pending) > 0 {
+		p := pending[0]
+		pending = pending[1:]
+		length := int64(len(p.data))
+
+		s.mutex.Lock()
+		if _, ok := s.entries[p.key]; ok {
+			s.mutex.Unlock()
+			promoted = false
+			continue
+		}
+		if _, ok := s.stamps[p.key.File]; !ok {
+			// empty if archive can't be stat-ed, such chunks are kept on startup
+			s.stamps[p.key.File], _ = fileStamp(p.key.File)
+		}
+		var evicted []*hotStoreEntry
+		if s.head+length > s.capacity {
+			// rest of the file is too small, wrap around
+			evicted = s.evict(s.capacity, evicted)
+			s.head = 0
+		}
+		evicted = s.evict(s.head+length, evicted)
+		pos := s.head
+		s.head += length
+		s.mutex.Unlock()
+
+		for _, e := range evicted {
+			if e.dead {
+				continue
+			}
+			if e.hits == 0 {
+				s.demoted.Add(1)
+				continue
+			}
+			moved := make([]byte, e.key.Length)
+			if _, err := s.file.ReadAt(moved, e.pos); err != nil || crc32.ChecksumIEEE(moved) != e.crc {
+				s.corrupted.Add(1)
+				continue
+			}
+			s.requeued.Add(1)
+			pending = append(pending, hotStorePromotion{key: e.key, data: moved})
+		}
+
+		if _, err := s.file.WriteAt(p.data, pos); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		e := &hotStoreEntry{key: p.key, pos: pos, crc: crc32.ChecksumIEEE(p.data)}
+		s.entries[p.key] = e
+		s.queue = append(s.queue, e)
+		s.dirty = true
+		s.mutex.Unlock()
+		if promoted {
+			s.promoted.Add(1)
+			promoted = false
+		}
+	}
+	return nil
+}
+
+// evict removes chunks which are in [head, end) from index, and returns them appended to evicted.
+// Chunks in queue before head are ones written in current round, so they are not touched.
+func (s *HotStore) evict(end int64, evicted []*hotStoreEntry) []*hotStoreEntry {
+	for len(s.queue) > 0 && s.queue[0].pos >= s.head && s.queue[0].pos < end {
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		if !e.dead {
+			delete(s.entries, e.key)
+		}
+		evicted = append(evicted, e)
+		s.dirty = true
+	}
+	return evicted
+}
+
+// Save writes index of stored chunks, if it is changed.
+// It is line based: "head\t<pos>", "file\t<stamp>\t<path>", and "chunk\t<pos>\t<crc>\t<offset>\t<length>\t<path>" in write order.
+func (s *HotStore) Save() error {
+	if s == nil {
+		return nil
+	}
+	var sb strings.Builder
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	fmt.Fprintf(&sb, "head\t%d\n", s.head)
+	for file, stamp := range s.stamps {
+		fmt.Fprintf(&sb, "file\t%s\t%s\n", stamp, file)
+	}
+	for _, e := range s.queue {
+		if !e.dead {
+			fmt.Fprintf(&sb, "chunk\t%d\t%d\t%d\t%d\t%s\n", e.pos, e.crc, e.key.Offset, e.key.Length, e.key.File)
+		}
+	}
+	s.dirty = false
+	s.mutex.Unlock()
+
+	// store file is synced first, so index never points chunks which are not written yet
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	index := s.path + hotStoreIndexSuffix
+	if err := os.WriteFile(index+WRITEBACK_SUFFIX, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(index+WRITEBACK_SUFFIX, index)
+}
+
+func (s *HotStore) load() error {
+	f, err := os.Open(s.path + hotStoreIndexSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// archive file => whether its chunks are still valid
+	valid := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), "\t")
+		switch {
+		case cols[0] == "head" && len(cols) == 2:
+			head, err := strconv.ParseInt(cols[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid head: %s", cols[1])
+			}
+			if head > s.capacity {
+				head = s.capacity
+			}
+			s.head = head
+		case cols[0] == "file" && len(cols) >= 3:
+			file := strings.Join(cols[2:], "\t")
+			stamp, err := fileStamp(file)
+			// archive which is offline now (e.g. NAS) is when the store helps most, so its chunks are kept
+			valid[file] = err != nil || stamp == cols[1]
+			if valid[file] {
+				s.stamps[file] = cols[1]
+			} else {
+				fmt.Println("hot store: dropping chunks of changed archive", file)
+			}
+		case cols[0] == "chunk" && len(cols) >= 6:
+			pos, err1 := strconv.ParseInt(cols[1], 10, 64)
+			crc, err2 := strconv.ParseUint(cols[2], 10, 32)
+			offset, err3 := strconv.ParseInt(cols[3], 10, 64)
+			length, err4 := strconv.ParseInt(cols[4], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+				continue
+			}
+			key := hotStoreKey{File: strings.Join(cols[5:], "\t"), Offset: offset, Length: length}
+			if !valid[key.File] || pos+length > s.capacity {
+				continue
+			}
+			e := &hotStoreEntry{key: key, pos: pos, crc: uint32(crc)}
+			s.entries[key] = e
+			s.queue = append(s.queue, e)
+		}
+	}
+	return scanner.Err()
+}
+
+// Close saves index and closes store file.
+func (s *HotStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	if err := s.Save(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+// Snapshot returns usage and counters of the store.
+func (s *HotStore) Snapshot() HotStoreStats {
+	s.mutex.Lock()
+	used := int64(0)
+	for key := range s.entries {
+		used += key.Length
+	}
+	chunks := len(s.entries)
+	s.mutex.Unlock()
+	return HotStoreStats{
+		Capacity:  s.capacity,
+		Used:      used,
+		Chunks:    chunks,
+		Hits:      s.hits.Load(),
+		Misses:    s.misses.Load(),
+		Promoted:  s.promoted.Load(),
+		Demoted:   s.demoted.Load(),
+		Requeued:  s.requeued.Load(),
+		Corrupted: s.corrupted.Load(),
+	}
+}
+
+// readCompressedChunk reads compressed bytes of chunk (or seekable frame) at datStart of marFileName into buff,
+// from hot store if it is there. Remote and mirrored archives don't use hot store, since they are already on fast storage.
+func (fs *FS) readCompressedChunk(marFileName string, buff []byte, datStart int64) error {
+	useStore := fs.HotStore != nil && !IsRemoteFile(marFileName) && fs.mirrorPath(marFileName) == marFileName
+	if useStore && fs.HotStore.ReadAt(marFileName, buff, datStart) {
+		return nil
+	}
+	if _, err := fs.ArchiveReader(marFileName).ReadAt(buff, datStart); err != nil {
+		return err
+	}
+	if useStore {
+		fs.HotStore.Promote(marFileName, buff, datStart)
+	}
+	return nil
+}
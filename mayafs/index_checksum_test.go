@@ -0,0 +1,88 @@
+package mayafs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+func writeChecksumTestMar(t *testing.T, o testMarOptions) string {
+	return writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "a.txt", Chunks: []testChunk{{Method: pb.CompressedMethod_PASSTHROUGH, Data: []byte("Hello")}}},
+	}, o)
+}
+
+func loadTestMarError(marPath string) error {
+	fs := New()
+	if err := fs.AddArchive(marPath, ArchiveReadOptions{}); err != nil {
+		return err
+	}
+	return fs.LoadPendingArchives()
+}
+
+func TestIndexChecksum(t *testing.T) {
+	fs := loadTestMar(t, writeChecksumTestMar(t, testMarOptions{}))
+	if _, ok := fs.GetFile("/a.txt"); !ok {
+		t.Fatal("file not found")
+	}
+}
+
+func TestIndexWithoutChecksum(t *testing.T) {
+	// written by older packer
+	fs := loadTestMar(t, writeChecksumTestMar(t, testMarOptions{NoChecksum: true}))
+	if _, ok := fs.GetFile("/a.txt"); !ok {
+		t.Fatal("file not found")
+	}
+}
+
+func TestIndexChecksumMismatch(t *testing.T) {
+	marPath := writeChecksumTestMar(t, testMarOptions{})
+	idx, err := os.ReadFile(marPath + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a bit of the checksum itself
+	idx[len(idx)-1] ^= 1
+	if err := os.WriteFile(marPath+".idx", idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = loadTestMarError(marPath)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestIndexChecksumDetectsCorruptedIndex(t *testing.T) {
+	marPath := writeChecksumTestMar(t, testMarOptions{})
+	idx, err := os.ReadFile(marPath + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a bit of compressed index, right after magic and lengths
+	idx[len(INDEX_MAGIC)+8] ^= 1
+	if err := os.WriteFile(marPath+".idx", idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = loadTestMarError(marPath)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestIndexUnknownTrailer(t *testing.T) {
+	for _, trailer := range []string{"XXXX", "SHA2short", strings.Repeat("x", 100)} {
+		marPath := writeChecksumTestMar(t, testMarOptions{NoChecksum: true})
+		f, err := os.OpenFile(marPath+".idx", os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(trailer)
+		f.Close()
+		err = loadTestMarError(marPath)
+		if err == nil || !strings.Contains(err.Error(), "unknown trailer") {
+			t.Fatalf("trailer %q: expected unknown trailer error, got %v", trailer, err)
+		}
+	}
+}
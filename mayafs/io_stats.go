@@ -0,0 +1,287 @@
+package mayafs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IOStatsTracker records reads from each archive file (.dat, zip, .zst), to spot a slow or dying disk among many sources.
+// nil IOStatsTracker does nothing.
+type IOStatsTracker struct {
+	mutex    sync.Mutex
+	archives map[string]*ArchiveIOStats
+	warnedAt map[string]time.Time
+}
+
+// ArchiveIOStats is accumulated reads of one archive file.
+type ArchiveIOStats struct {
+	File  string
+	Reads uint64
+	Bytes uint64
+	// reads which failed even after retries
+	Errors uint64
+	// failed attempts which were retried
+	Retries uint64
+	// reads which exceeded FS.ReadTimeout, archive is degraded if it's not zero
+	Timeouts     uint64
+	TotalLatency time.Duration
+}
+
+// Degraded reports whether reads from the archive have ever timed out (e.g. dying disk, stuck network mount).
+func (s *ArchiveIOStats) Degraded() bool {
+	return s.Timeouts != 0
+}
+
+func (s *ArchiveIOStats) AverageLatency() time.Duration {
+	if s.Reads == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Reads)
+}
+
+const (
+	// check whether archive is an outlier on every N reads of it, since it walks all archives
+	slowArchiveCheckInterval = 64
+	// archives with fewer reads are not compared, average of few reads is noisy
+	slowArchiveMinReads = 32
+	// archive is slow if its average latency is above both of them
+	slowArchiveRatio      = 4
+	slowArchiveMinLatency = 20 * time.Millisecond
+	slowArchiveWarnEvery  = 10 * time.Minute
+	// backoff of read retries doesn't grow beyond this
+	maxReadRetryBackoff = 5 * time.Second
+)
+
+func NewIOStatsTracker() *IOStatsTracker {
+	return &IOStatsTracker{
+		archives: map[string]*ArchiveIOStats{},
+		warnedAt: map[string]time.Time{},
+	}
+}
+
+// Record adds one read of archive file.
+func (t *IOStatsTracker) Record(file string, n int, latency time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.archives[file]
+	if !ok {
+		s = &ArchiveIOStats{File: file}
+		t.archives[file] = s
+	}
+	s.Reads++
+	s.Bytes += uint64(n)
+	s.TotalLatency += latency
+	if err != nil && err != io.EOF {
+		s.Errors++
+	}
+	if s.Reads%slowArchiveCheckInterval == 0 {
+		t.checkSlowArchive(s)
+	}
+}
+
+// RecordRetry counts failed attempt of read which will be retried.
+func (t *IOStatsTracker) RecordRetry(file string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.archives[file]
+	if !ok {
+		s = &ArchiveIOStats{File: file}
+		t.archives[file] = s
+	}
+	s.Retries++
+}
+
+// RecordTimeout counts read which exceeded deadline, and marks the archive degraded.
+func (t *IOStatsTracker) RecordTimeout(file string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.archives[file]
+	if !ok {
+		s = &ArchiveIOStats{File: file}
+		t.archives[file] = s
+	}
+	s.Timeouts++
+}
+
+// checkSlowArchive warns if average latency of s is far above median of other archives.
+func (t *IOStatsTracker) checkSlowArchive(s *ArchiveIOStats) {
+	latency := s.AverageLatency()
+	if latency < slowArchiveMinLatency {
+		return
+	}
+	others := []time.Duration{}
+	for file, o := range t.archives {
+		if file == s.File || o.Reads < slowArchiveMinReads {
+			continue
+		}
+		others = append(others, o.AverageLatency())
+	}
+	// can't tell which one is slow with only two archives
+	if len(others) < 2 {
+		return
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+	median := others[len(others)/2]
+	if latency < median*slowArchiveRatio {
+		return
+	}
+	if time.Since(t.warnedAt[s.File]) < slowArchiveWarnEvery {
+		return
+	}
+	t.warnedAt[s.File] = time.Now()
+	fmt.Printf("warning: reads from %s are slow (average %v, median of other archives %v, %d errors), its disk might be dying\n", s.File, latency, median, s.Errors)
+}
+
+// Snapshot returns copy of stats of every archive which was read, sorted by file.
+func (t *IOStatsTracker) Snapshot() []ArchiveIOStats {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := make([]ArchiveIOStats, 0, len(t.archives))
+	for _, s := range t.archives {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].File < stats[j].File })
+	return stats
+}
+
+// ErrReadTimeout is returned (wrapped) when read from archive doesn't complete within FS.ReadTimeout.
+var ErrReadTimeout = errors.New("read from archive timed out")
+
+// archiveReaderAt is io.ReaderAt of archive file which records stats of each read, paces reads by rate limiters,
+// and retries failed reads.
+type archiveReaderAt struct {
+	stats        *IOStatsTracker
+	limiters     []*RateLimiter
+	file         string
+	source       io.ReaderAt
+	retries      int
+	retryBackoff time.Duration
+	timeout      time.Duration
+}
+
+// readWithTimeout reads from pool, giving up after r.timeout.
+func (r *archiveReaderAt) readWithTimeout(buff []byte, offset int64) (int, error) {
+	if r.timeout <= 0 {
+		return r.source.ReadAt(buff, offset)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	// hung read might complete after we gave up, so it reads into its own buffer instead of caller's one
+	own := make([]byte, len(buff))
+	done := make(chan result, 1)
+	go func() {
+		n, err := r.source.ReadAt(own, offset)
+		done <- result{n, err}
+	}()
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		copy(buff, own[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		return 0, fmt.Errorf("%w: %s at %d (%v)", ErrReadTimeout, r.file, offset, r.timeout)
+	}
+}
+
+func (r *archiveReaderAt) ReadAt(buff []byte, offset int64) (int, error) {
+	// waiting for limiters is not a latency of the disk
+	for _, l := range r.limiters {
+		l.Wait(len(buff))
+	}
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		n, err := r.readWithTimeout(buff, offset)
+		// retrying hung disk only piles up stuck reads
+		if errors.Is(err, ErrReadTimeout) {
+			r.stats.RecordTimeout(r.file)
+			r.stats.Record(r.file, n, time.Since(start), err)
+			fmt.Printf("warning: %v, marking %s as degraded\n", err, r.file)
+			return n, err
+		}
+		// EOF is not an I/O error (e.g. reading tail of file), retrying doesn't change it
+		if err == nil || err == io.EOF || attempt >= r.retries {
+			if err != nil && err != io.EOF && attempt > 0 {
+				fmt.Printf("read from %s at %d failed after %d retries: %v\n", r.file, offset, attempt, err)
+			}
+			r.stats.Record(r.file, n, time.Since(start), err)
+			return n, err
+		}
+		r.stats.RecordRetry(r.file)
+		fmt.Printf("read from %s at %d failed, retrying in %v (%d/%d): %v\n", r.file, offset, backoff, attempt+1, r.retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReadRetryBackoff {
+			backoff = maxReadRetryBackoff
+		}
+	}
+}
+
+// ArchiveReader returns reader of archive file, which records I/O stats and respects read limits.
+// It should be used instead of FilePool to read archives.
+func (fs *FS) ArchiveReader(file string) io.ReaderAt {
+	limiters := []*RateLimiter{fs.ReadLimiter}
+	// stats are recorded as the primary file, but maxread= of the primary (e.g. NAS) doesn't limit mirror
+	source := fs.mirrorPath(file)
+	if l, ok := fs.archiveReadLimiters.Load(file); ok && source == file {
+		limiters = append(limiters, l.(*RateLimiter))
+	}
+	var reader io.ReaderAt
+	if IsRemoteFile(source) {
+		r, err := fs.remoteFile(source)
+		if err != nil {
+			reader = errReaderAt{err}
+		} else {
+			reader = r
+		}
+	} else {
+		reader = GetFilePoolFromPath(source)
+	}
+	return &archiveReaderAt{
+		stats:        fs.IOStats,
+		limiters:     limiters,
+		file:         file,
+		source:       reader,
+		retries:      fs.ReadRetries,
+		retryBackoff: fs.ReadRetryBackoff,
+		timeout:      fs.ReadTimeout,
+	}
+}
+
+// setArchiveReadLimiter sets per-archive limiter of archive (or .dat) file, nil removes it.
+func (fs *FS) setArchiveReadLimiter(file string, limiter *RateLimiter) {
+	if limiter == nil {
+		fs.archiveReadLimiters.Delete(file)
+		return
+	}
+	fs.archiveReadLimiters.Store(file, limiter)
+}
+
+// AdviseSequential tells that archive (or .dat) file will be read sequentially from offset (e.g. preload),
+// so OS reads ahead of our reads. Remote files are not affected.
+func (fs *FS) AdviseSequential(file string, offset int64) {
+	source := fs.mirrorPath(file)
+	if IsRemoteFile(source) {
+		return
+	}
+	GetFilePoolFromPath(source).AdviseSequential(offset)
+}
@@ -0,0 +1,389 @@
+package mayafs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// With io_uring, reads of FilePool are submitted to a ring which is shared by all files, instead of calling pread for each read.
+// Reads which are requested while previous batch is being submitted are submitted together by one io_uring_enter,
+// so many FUSE threads reading concurrently cost fewer syscalls. Completions are reaped by another goroutine.
+
+// kernel ABI, see include/uapi/linux/io_uring.h
+const (
+	ioringOpRead          = 22
+	ioringEnterGetEvents  = 1 << 0
+	ioringOffSqRing       = 0
+	ioringOffCqRing       = 0x8000000
+	ioringOffSqes         = 0x10000000
+	ioUringSqeSize        = 64
+	ioUringCqeSize        = 16
+	ioUringDefaultEntries = 256
+)
+
+type ioSqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type ioCqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	Cqes        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type ioUringParams struct {
+	SqEntries    uint32
+	CqEntries    uint32
+	Flags        uint32
+	SqThreadCPU  uint32
+	SqThreadIdle uint32
+	Features     uint32
+	WqFd         uint32
+	Resv         [3]uint32
+	SqOff        ioSqringOffsets
+	CqOff        ioCqringOffsets
+}
+
+type ioUringSqe struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	RwFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	Pad2        uint64
+}
+
+type ioUringCqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+type ioUringRequest struct {
+	fd   int32
+	buff []byte
+	off  int64
+	// result of read (bytes or negative errno)
+	done chan int32
+}
+
+type ioUring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqTail    *uint32
+	sqMask    uint32
+	sqArray   []uint32
+	sqes      []ioUringSqe
+	sqEntries uint32
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      []ioUringCqe
+
+	requests chan *ioUringRequest
+	// limits reads in flight to size of completion queue, so completions never overflow
+	slots chan struct{}
+
+	pendingMutex sync.Mutex
+	pending      map[uint64]*ioUringRequest
+	nextID       uint64
+
+	// io_uring_enter failed, entries which were not consumed are left in submission queue, so it can't be used anymore
+	failed  atomic.Bool
+	reads   atomic.Uint64
+	batches atomic.Uint64
+}
+
+// IOUringStats is number of reads done by io_uring and number of io_uring_enter calls which submitted them.
+type IOUringStats struct {
+	Reads   uint64
+	Batches uint64
+}
+
+var sharedIOUring *ioUring
+
+// EnableIOUring makes FilePool read through io_uring with entries of submission queue (0 for default).
+// It returns error if io_uring is not available (e.g. old kernel, or disabled by sysctl or seccomp), then reads are done as before.
+func EnableIOUring(entries uint32) error {
+	if entries == 0 {
+		entries = ioUringDefaultEntries
+	}
+	u, err := newIOUring(entries)
+	if err != nil {
+		return err
+	}
+	sharedIOUring = u
+	go u.submitLoop()
+	go u.reapLoop()
+	return nil
+}
+
+// IOUringSnapshot returns stats of io_uring, or false if it isn't enabled.
+func IOUringSnapshot() (IOUringStats, bool) {
+	u := sharedIOUring
+	if u == nil {
+		return IOUringStats{}, false
+	}
+	return IOUringStats{Reads: u.reads.Load(), Batches: u.batches.Load()}, true
+}
+
+func newIOUring(entries uint32) (*ioUring, error) {
+	var params ioUringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	u := &ioUring{
+		fd:        int(fd),
+		sqEntries: params.SqEntries,
+		pending:   map[uint64]*ioUringRequest{},
+	}
+	var err error
+	u.sqRing, err = unix.Mmap(u.fd, ioringOffSqRing, int(params.SqOff.Array+params.SqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		u.close()
+		return nil, fmt.Errorf("failed to map submission queue: %w", err)
+	}
+	u.cqRing, err = unix.Mmap(u.fd, ioringOffCqRing, int(params.CqOff.Cqes+params.CqEntries*ioUringCqeSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		u.close()
+		return nil, fmt.Errorf("failed to map completion queue: %w", err)
+	}
+	u.sqeMem, err = unix.Mmap(u.fd, ioringOffSqes, int(params.SqEntries*ioUringSqeSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		u.close()
+		return nil, fmt.Errorf("failed to map submission entries: %w", err)
+	}
+
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[params.SqOff.Tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[params.SqOff.RingMask]))
+	u.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[params.SqOff.Array])), params.SqEntries)
+	u.sqes = unsafe.Slice((*ioUringSqe)(unsafe.Pointer(&u.sqeMem[0])), params.SqEntries)
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[params.CqOff.Head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[params.CqOff.Tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[params.CqOff.RingMask]))
+	u.cqes = unsafe.Slice((*ioUringCqe)(unsafe.Pointer(&u.cqRing[params.CqOff.Cqes])), params.CqEntries)
+
+	u.requests = make(chan *ioUringRequest, params.SqEntries)
+	u.slots = make(chan struct{}, params.CqEntries)
+	return u, nil
+}
+
+func (u *ioUring) close() {
+	for _, m := range [][]byte{u.sqRing, u.cqRing, u.sqeMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	unix.Close(u.fd)
+}
+
+func (u *ioUring) enter(toSubmit uint32, minComplete uint32, flags uint32) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+// submitLoop submits requests, with ones which are queued while previous batch was submitted.
+func (u *ioUring) submitLoop() {
+	batch := make([]*ioUringRequest, 0, u.sqEntries)
+	for req := range u.requests {
+		batch = append(batch[:0], req)
+	drain:
+		for uint32(len(batch)) < u.sqEntries {
+			select {
+			case req := <-u.requests:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		if u.failed.Load() {
+			for _, req := range batch {
+				req.done <- -int32(unix.ECANCELED)
+			}
+			continue
+		}
+
+		tail := atomic.LoadUint32(u.sqTail)
+		u.pendingMutex.Lock()
+		for _, req := range batch {
+			u.nextID++
+			u.pending[u.nextID] = req
+			index := tail & u.sqMask
+			u.sqes[index] = ioUringSqe{
+				Opcode:   ioringOpRead,
+				Fd:       req.fd,
+				Off:      uint64(req.off),
+				Addr:     uint64(uintptr(unsafe.Pointer(&req.buff[0]))),
+				Len:      uint32(len(req.buff)),
+				UserData: u.nextID,
+			}
+			u.sqArray[index] = index
+			tail++
+		}
+		u.pendingMutex.Unlock()
+		atomic.StoreUint32(u.sqTail, tail)
+
+		// without SQPOLL, kernel consumes all entries in io_uring_enter, unless it fails
+		for submitted := 0; submitted < len(batch); {
+			n, err := u.enter(uint32(len(batch)-submitted), 0, 0)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EBUSY {
+					runtime.Gosched()
+					continue
+				}
+				// entries which were not consumed are canceled, they are read without io_uring
+				fmt.Println("io_uring_enter failed, falling back to normal reads", err)
+				u.failed.Store(true)
+				u.pendingMutex.Lock()
+				for id := u.nextID - uint64(len(batch)-submitted) + 1; id <= u.nextID; id++ {
+					if req, ok := u.pending[id]; ok {
+						delete(u.pending, id)
+						req.done <- -int32(unix.ECANCELED)
+					}
+				}
+				u.pendingMutex.Unlock()
+				break
+			}
+			submitted += n
+		}
+		u.batches.Add(1)
+	}
+}
+
+// reapLoop delivers completions to waiting reads.
+// Reads which are already submitted can't be canceled safely (kernel might write into their buffers later),
+// so waiting is retried with backoff if it fails.
+func (u *ioUring) reapLoop() {
+	backoff := time.Duration(0)
+	for {
+		head := atomic.LoadUint32(u.cqHead)
+		tail := atomic.LoadUint32(u.cqTail)
+		if head == tail {
+			if _, err := u.enter(0, 1, ioringEnterGetEvents); err != nil {
+				if backoff == 0 {
+					fmt.Println("io_uring_enter (wait) failed, retrying", err)
+					backoff = time.Millisecond
+				} else if backoff < time.Second {
+					backoff *= 2
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			backoff = 0
+			continue
+		}
+		u.pendingMutex.Lock()
+		for ; head != tail; head++ {
+			cqe := u.cqes[head&u.cqMask]
+			if req, ok := u.pending[cqe.UserData]; ok {
+				delete(u.pending, cqe.UserData)
+				req.done <- cqe.Res
+			}
+		}
+		u.pendingMutex.Unlock()
+		atomic.StoreUint32(u.cqHead, head)
+	}
+}
+
+// pread reads once, like pread(2), and returns bytes read or negative errno.
+func (u *ioUring) pread(fd int32, buff []byte, off int64) int32 {
+	u.slots <- struct{}{}
+	defer func() { <-u.slots }()
+	req := &ioUringRequest{fd: fd, buff: buff, off: off, done: make(chan int32, 1)}
+	u.requests <- req
+	res := <-req.done
+	// buffer must be alive until kernel wrote to it
+	runtime.KeepAlive(buff)
+	return res
+}
+
+// readAt is f.ReadAt through io_uring.
+func (u *ioUring) readAt(f *os.File, b []byte, off int64) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return f.ReadAt(b, off)
+	}
+	n := 0
+	var res int32
+	// f might be shared and closed by other goroutine (e.g. stale sequential handle is discarded),
+	// Control holds reference of f, so fd is not closed (and reused by other open) until reads of it complete
+	err = rc.Control(func(fd uintptr) {
+		for n < len(b) {
+			res = u.pread(int32(fd), b[n:], off+int64(n))
+			if res == -int32(unix.EINTR) || res == -int32(unix.EAGAIN) {
+				continue
+			}
+			if res <= 0 {
+				return
+			}
+			n += int(res)
+			u.reads.Add(1)
+		}
+	})
+	if err != nil {
+		// e.g. f is already closed
+		return n, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+	}
+	if res == -int32(unix.ECANCELED) && u.failed.Load() {
+		readed, err := f.ReadAt(b[n:], off+int64(n))
+		return n + readed, err
+	}
+	if res < 0 {
+		return n, &os.PathError{Op: "read", Path: f.Name(), Err: syscall.Errno(-res)}
+	}
+	if res == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileReadAt reads from f with io_uring if it is enabled.
+func fileReadAt(f *os.File, b []byte, off int64) (int, error) {
+	if sharedIOUring == nil || sharedIOUring.failed.Load() || len(b) == 0 {
+		return f.ReadAt(b, off)
+	}
+	return sharedIOUring.readAt(f, b, off)
+}
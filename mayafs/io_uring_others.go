@@ -0,0 +1,28 @@
+//go:build !linux
+
+package mayafs
+
+import (
+	"fmt"
+	"os"
+)
+
+// IOUringStats is number of reads done by io_uring and number of io_uring_enter calls which submitted them.
+type IOUringStats struct {
+	Reads   uint64
+	Batches uint64
+}
+
+// EnableIOUring returns error, io_uring is only available on Linux.
+func EnableIOUring(entries uint32) error {
+	return fmt.Errorf("io_uring is only available on Linux")
+}
+
+// IOUringSnapshot returns false, io_uring is only available on Linux.
+func IOUringSnapshot() (IOUringStats, bool) {
+	return IOUringStats{}, false
+}
+
+func fileReadAt(f *os.File, b []byte, off int64) (int, error) {
+	return f.ReadAt(b, off)
+}
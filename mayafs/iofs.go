@@ -0,0 +1,190 @@
+package mayafs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IOFS returns read-only io/fs.FS view of this FS, so it can be used with standard library (e.g. http.FS, fs.WalkDir).
+func (fs *FS) IOFS() iofs.FS {
+	return &ioFS{fs: fs}
+}
+
+type ioFS struct {
+	fs *FS
+}
+
+type ioFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *ioFileInfo) Name() string       { return fi.name }
+func (fi *ioFileInfo) Size() int64        { return fi.size }
+func (fi *ioFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *ioFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *ioFileInfo) Sys() any           { return nil }
+func (fi *ioFileInfo) Mode() iofs.FileMode {
+	if fi.isDir {
+		return iofs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (f *ioFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+	path := "/" + name
+	if name == "." {
+		path = "/"
+	}
+
+	if file, ok := f.fs.GetFile(path); ok {
+		return &ioFile{
+			fs:   f.fs,
+			path: path,
+			info: &ioFileInfo{
+				name:    path[strings.LastIndex(path, "/")+1:],
+				size:    file.Size(),
+				modTime: file.ModTime(),
+			},
+		}, nil
+	}
+
+	dir := f.fs.GetDir(path)
+	if dir == nil && path != "/" {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+	}
+	return &ioDir{
+		fs:  f.fs,
+		dir: dir,
+		info: &ioFileInfo{
+			name:    path[strings.LastIndex(path, "/")+1:],
+			isDir:   true,
+			modTime: dirModTime(dir),
+		},
+	}, nil
+}
+
+func dirModTime(dir *DirInfo) time.Time {
+	if dir == nil {
+		return time.Time{}
+	}
+	return dir.Modified
+}
+
+type ioFile struct {
+	fs     *FS
+	path   string
+	info   *ioFileInfo
+	offset int64
+}
+
+func (f *ioFile) Stat() (iofs.FileInfo, error) { return f.info, nil }
+func (f *ioFile) Close() error                 { return nil }
+
+func (f *ioFile) ReadAt(b []byte, off int64) (int, error) {
+	readed := 0
+	for readed < len(b) {
+		n, err := f.fs.ReadFileAt(f.path, b[readed:], off+int64(readed))
+		if err != nil {
+			return readed, err
+		}
+		if n == 0 {
+			return readed, io.EOF
+		}
+		readed += n
+	}
+	return readed, nil
+}
+
+func (f *ioFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+type ioDir struct {
+	fs      *FS
+	dir     *DirInfo
+	info    *ioFileInfo
+	entries []iofs.DirEntry
+	read    bool
+}
+
+func (d *ioDir) Stat() (iofs.FileInfo, error) { return d.info, nil }
+func (d *ioDir) Close() error                 { return nil }
+func (d *ioDir) Read(b []byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *ioDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !d.read {
+		d.read = true
+		if d.dir != nil {
+			for _, dir := range d.dir.Directories {
+				d.entries = append(d.entries, iofs.FileInfoToDirEntry(&ioFileInfo{
+					name:    dir[strings.LastIndex(dir, "/")+1:],
+					isDir:   true,
+					modTime: dirModTime(d.fs.GetDir(dir)),
+				}))
+			}
+			for _, path := range d.dir.Files {
+				file, ok := d.fs.GetFile(path)
+				if !ok {
+					continue
+				}
+				d.entries = append(d.entries, iofs.FileInfoToDirEntry(&ioFileInfo{
+					name:    path[strings.LastIndex(path, "/")+1:],
+					size:    file.Size(),
+					modTime: file.ModTime(),
+				}))
+			}
+		}
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,128 @@
+package mayafs
+
+import (
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LocalFile is a file in plain directory which is registered by AddDirectory.
+type LocalFile struct {
+	// Name is a slash-separated path relative to the directory
+	Name     string
+	Path     string
+	Size     int64
+	Modified time.Time
+}
+
+// ReadAt reads the file on disk. Like ReadFileAt, it returns 0 on end of file.
+func (f *LocalFile) ReadAt(buff []byte, offset int64) (int, error) {
+	fp, err := os.Open(f.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer fp.Close()
+
+	readed, err := fp.ReadAt(buff, offset)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read local file: %w", err)
+	}
+	return readed, nil
+}
+
+// AddDirectory registers plain directory as a read-only layer, to be loaded by LoadPendingArchives.
+// Files in the directory are listed at load time, so files added after that will not be visible.
+func (fs *FS) AddDirectory(dir string, options ArchiveReadOptions) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+
+	fs.PendingArchives = append(fs.PendingArchives, PendingArchive{
+		File:        dir,
+		Options:     options,
+		IsDirectory: true,
+	})
+
+	return nil
+}
+
+func (fs *FS) readDirectory(dir string, o ArchiveReadOptions) (*LoadedArchive, error) {
+	la := &LoadedArchive{
+		File:        dir,
+		Options:     o,
+		IsDirectory: true,
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			la.Dirs = append(la.Dirs, ArchiveDir{Name: rel, Modified: info.ModTime()})
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			// symlinks and special files are not supported
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		la.LocalFiles = append(la.LocalFiles, &LocalFile{
+			Name:     rel,
+			Path:     path,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return la, nil
+}
+
+func (fs *FS) applyDirectory(b *treeBuilder, la *LoadedArchive) int {
+	o := la.Options
+
+	fileCount := 0
+	for _, f := range la.LocalFiles {
+		origPath := o.GetFilePath(f.Name)
+		if origPath == "" {
+			continue
+		}
+
+		if fs.putFile(b, origPath, FileInfo{
+			LocalFile:   f,
+			ArchiveFile: la.File,
+			Priority:    o.Priority,
+		}) {
+			fileCount += 1
+		}
+	}
+
+	return fileCount
+}
@@ -0,0 +1,68 @@
+package mayafs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LooseFile maps one local file over a path in the mount (e.g. a fixed DLL), without overlay copy-up or one-file archive.
+// It overrides files in archives regardless of their priority.
+type LooseFile struct {
+	File   string
+	Target string
+}
+
+// ParseLooseFile parses "<local file>:<path>" (e.g. "/mods/fix.dll:/Game/fix.dll").
+// Local file can contain ":" (e.g. "C:\mods\fix.dll:/Game/fix.dll"), since path is after the last ":".
+func ParseLooseFile(s string) (LooseFile, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return LooseFile{}, fmt.Errorf("invalid loosefile (should be <local file>:<path>): %s", s)
+	}
+	lf := LooseFile{File: s[:i], Target: normalizeMountPath(s[i+1:])}
+	if lf.Target == "/" {
+		return LooseFile{}, fmt.Errorf("invalid loosefile: %s", s)
+	}
+	return lf, nil
+}
+
+// AddLooseFile registers loose file, which is applied on every tree update (before bind mounts and aliases).
+func (fs *FS) AddLooseFile(lf LooseFile) error {
+	st, err := os.Stat(lf.File)
+	if err != nil {
+		if os.IsNotExist(err) && fs.SkipMissingArchives {
+			fmt.Println("Warning: skipped missing loose file", lf.File, err)
+			return nil
+		}
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("loose file is a directory (use dir= instead): %s", lf.File)
+	}
+	fs.LooseFiles = append(fs.LooseFiles, lf)
+	return nil
+}
+
+// applyLooseFiles puts loose files into the tree. They are stat-ed on each update, so changed size is reflected
+// when archives are loaded later (e.g. dirwatch).
+func (fs *FS) applyLooseFiles(b *treeBuilder) {
+	for _, lf := range fs.LooseFiles {
+		st, err := os.Stat(lf.File)
+		if err != nil {
+			fmt.Println("Warning: failed to stat loose file:", err)
+			continue
+		}
+		lowerPath := NormalizeString(lf.Target)
+		b.tree.Files[lowerPath] = FileInfo{
+			LocalFile: &LocalFile{
+				Name:     lf.Target[1:],
+				Path:     lf.File,
+				Size:     st.Size(),
+				Modified: st.ModTime(),
+			},
+			ArchiveFile: lf.File,
+		}
+		b.getDirInfo(lf.Target[:strings.LastIndex(lf.Target, "/")]).Files[lowerPath] = lf.Target
+	}
+}
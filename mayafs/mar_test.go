@@ -0,0 +1,300 @@
+package mayafs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	pb "github.com/rinsuki/mayakashi/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// testChunk is chunk of file in .mar written by writeTestMar.
+type testChunk struct {
+	Method pb.CompressedMethod
+	Data   []byte
+	// written in zstd seekable format if not 0 (only for ZSTANDARD)
+	FrameSize uint32
+}
+
+type testMarFile struct {
+	Path   string
+	Chunks []testChunk
+}
+
+type testMarOptions struct {
+	// v1 index doesn't have chunk offset tables
+	V1 bool
+	// don't write SHA2 trailer after compressed index, like older packer
+	NoChecksum bool
+}
+
+// writeTestMar writes .mar.idx and .mar.dat of files into dir like packer does, and returns path of .mar.
+func writeTestMar(t *testing.T, dir string, files []testMarFile, o testMarOptions) string {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var dat bytes.Buffer
+	index := &pb.FileIndexFile{}
+	if !o.V1 {
+		index.Version = 2
+	}
+	for _, f := range files {
+		entry := &pb.FileEntry{
+			Info:       &pb.FileInfo{Path: f.Path},
+			BodyOffset: uint64(dat.Len()),
+		}
+		for _, c := range f.Chunks {
+			var compressed []byte
+			switch c.Method {
+			case pb.CompressedMethod_PASSTHROUGH:
+				compressed = c.Data
+			case pb.CompressedMethod_ZSTANDARD:
+				if c.FrameSize != 0 {
+					var buf bytes.Buffer
+					if _, err := WriteZstSeekable(&buf, bytes.NewReader(c.Data), int(c.FrameSize)); err != nil {
+						t.Fatal(err)
+					}
+					compressed = buf.Bytes()
+				} else {
+					compressed = encoder.EncodeAll(c.Data, nil)
+				}
+			case pb.CompressedMethod_ZERO:
+				// no payload
+			default:
+				t.Fatalf("unsupported method in test: %v", c.Method)
+			}
+			dat.Write(compressed)
+			entry.Info.Chunks = append(entry.Info.Chunks, &pb.ChunkInfo{
+				CompressedLength:  uint32(len(compressed)),
+				OriginalLength:    uint32(len(c.Data)),
+				CompressedMethod:  c.Method,
+				SeekableFrameSize: c.FrameSize,
+			})
+		}
+		entry.BodySize = uint64(dat.Len()) - entry.BodyOffset
+		if !o.V1 {
+			ensureChunkOffsets(entry)
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+
+	marPath := filepath.Join(dir, "test.mar")
+	if err := os.WriteFile(marPath+".dat", dat.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestIndex(t, marPath, index, o)
+	return marPath
+}
+
+// writeTestIndex writes index as .mar.idx of marPath.
+func writeTestIndex(t *testing.T, marPath string, index *pb.FileIndexFile, o testMarOptions) {
+	t.Helper()
+	raw, err := proto.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	compressed := encoder.EncodeAll(raw, nil)
+
+	var idx bytes.Buffer
+	idx.WriteString(INDEX_MAGIC)
+	binary.Write(&idx, binary.BigEndian, uint32(len(compressed)))
+	binary.Write(&idx, binary.BigEndian, uint32(len(raw)))
+	idx.Write(compressed)
+	if !o.NoChecksum {
+		sum := sha256.Sum256(compressed)
+		idx.WriteString(INDEX_CHECKSUM_MAGIC)
+		idx.Write(sum[:])
+	}
+	if err := os.WriteFile(marPath+".idx", idx.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTestMar(t *testing.T, marPath string) *FS {
+	t.Helper()
+	fs := New()
+	if err := fs.AddArchive(marPath, ArchiveReadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.LoadPendingArchives(); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// readAll reads whole file with reads of readSize, so reads cross chunk (and frame) boundaries unless readSize divides them.
+func readAll(t *testing.T, fs *FS, path string, offset int64, readSize int) []byte {
+	t.Helper()
+	var result []byte
+	buf := make([]byte, readSize)
+	for {
+		filled := 0
+		for filled < len(buf) {
+			readed, err := fs.ReadFileAt(path, buf[filled:], offset+int64(filled))
+			if err != nil {
+				t.Fatalf("ReadFileAt(%s, %d): %v", path, offset+int64(filled), err)
+			}
+			if readed == 0 {
+				break
+			}
+			filled += readed
+		}
+		result = append(result, buf[:filled]...)
+		offset += int64(filled)
+		if filled < len(buf) {
+			return result
+		}
+	}
+}
+
+func testPattern(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7) ^ seed
+	}
+	return data
+}
+
+func concatChunks(chunks []testChunk) []byte {
+	var data []byte
+	for _, c := range chunks {
+		data = append(data, c.Data...)
+	}
+	return data
+}
+
+func TestEnsureChunkOffsetsFillsV1(t *testing.T) {
+	entry := &pb.FileEntry{
+		BodyOffset: 100,
+		Info: &pb.FileInfo{Chunks: []*pb.ChunkInfo{
+			{CompressedLength: 10, OriginalLength: 40},
+			{CompressedLength: 0, OriginalLength: 30, CompressedMethod: pb.CompressedMethod_ZERO},
+			{CompressedLength: 20, OriginalLength: 20},
+		}},
+	}
+	ensureChunkOffsets(entry)
+	wantOriginal := []uint64{0, 40, 70}
+	wantDat := []uint64{100, 110, 110}
+	for i := range wantOriginal {
+		if entry.ChunkOriginalOffsets[i] != wantOriginal[i] || entry.ChunkDatOffsets[i] != wantDat[i] {
+			t.Fatalf("chunk %d: got (%d, %d), want (%d, %d)", i, entry.ChunkOriginalOffsets[i], entry.ChunkDatOffsets[i], wantOriginal[i], wantDat[i])
+		}
+	}
+}
+
+func TestEnsureChunkOffsetsKeepsV2(t *testing.T) {
+	// v2 tables can point anywhere (e.g. deduplicated chunks), they must not be recomputed
+	entry := &pb.FileEntry{
+		BodyOffset: 100,
+		Info: &pb.FileInfo{Chunks: []*pb.ChunkInfo{
+			{CompressedLength: 10, OriginalLength: 40},
+			{CompressedLength: 10, OriginalLength: 40},
+		}},
+		ChunkOriginalOffsets: []uint64{0, 40},
+		ChunkDatOffsets:      []uint64{100, 100},
+	}
+	ensureChunkOffsets(entry)
+	if entry.ChunkDatOffsets[1] != 100 {
+		t.Fatalf("v2 table was overwritten: %v", entry.ChunkDatOffsets)
+	}
+}
+
+func TestFindChunk(t *testing.T) {
+	entry := &pb.FileEntry{
+		Info: &pb.FileInfo{Chunks: []*pb.ChunkInfo{
+			{OriginalLength: 40},
+			{OriginalLength: 30},
+			{OriginalLength: 20},
+		}},
+	}
+	ensureChunkOffsets(entry)
+	cases := []struct {
+		offset int64
+		want   int
+	}{
+		{-1, -1},
+		{0, 0},
+		{39, 0},
+		{40, 1},
+		{69, 1},
+		{70, 2},
+		{89, 2},
+		{90, -1},
+		{1000, -1},
+	}
+	for _, c := range cases {
+		if got := findChunk(entry, c.offset); got != c.want {
+			t.Errorf("findChunk(%d) = %d, want %d", c.offset, got, c.want)
+		}
+	}
+}
+
+func TestReadMarV1AndV2(t *testing.T) {
+	chunks := []testChunk{
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(4096, 1)},
+		{Method: pb.CompressedMethod_PASSTHROUGH, Data: testPattern(3000, 2)},
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(5000, 3)},
+		{Method: pb.CompressedMethod_PASSTHROUGH, Data: testPattern(17, 4)},
+	}
+	files := []testMarFile{
+		{Path: "first.bin", Chunks: chunks[:2]},
+		{Path: "dir/second.bin", Chunks: chunks},
+	}
+	for _, v1 := range []bool{true, false} {
+		fs := loadTestMar(t, writeTestMar(t, t.TempDir(), files, testMarOptions{V1: v1}))
+		for _, f := range files {
+			want := concatChunks(f.Chunks)
+			for _, readSize := range []int{1000, 4096, len(want) + 1} {
+				if got := readAll(t, fs, "/"+f.Path, 0, readSize); !bytes.Equal(got, want) {
+					t.Fatalf("v1=%v %s (read size %d): content mismatch", v1, f.Path, readSize)
+				}
+			}
+			// read which starts in the middle of a chunk
+			if got := readAll(t, fs, "/"+f.Path, 4000, 1500); !bytes.Equal(got, want[4000:]) {
+				t.Fatalf("v1=%v %s: content mismatch from middle of chunk", v1, f.Path)
+			}
+		}
+	}
+}
+
+func TestReadMarV2SharedChunk(t *testing.T) {
+	// second chunk points to same data as first one, which v1 index can't express
+	data := testPattern(2048, 5)
+	marPath := writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "a.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZSTANDARD, Data: data}}},
+	}, testMarOptions{})
+	fs := loadTestMar(t, marPath)
+	chunk := fs.Tree().Files[NormalizeString("/a.bin")].MarEntry.Info.Chunks[0]
+	writeTestIndex(t, marPath, &pb.FileIndexFile{
+		Version: 2,
+		Entries: []*pb.FileEntry{{
+			Info: &pb.FileInfo{
+				Path:   "a.bin",
+				Chunks: []*pb.ChunkInfo{chunk, chunk},
+			},
+			BodySize:             uint64(chunk.CompressedLength),
+			ChunkOriginalOffsets: []uint64{0, uint64(len(data))},
+			ChunkDatOffsets:      []uint64{0, 0},
+		}},
+	}, testMarOptions{})
+
+	fs = loadTestMar(t, marPath)
+	want := append(append([]byte{}, data...), data...)
+	if got := readAll(t, fs, "/a.bin", 0, 1000); !bytes.Equal(got, want) {
+		t.Fatal("content mismatch")
+	}
+}
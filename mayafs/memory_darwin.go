@@ -0,0 +1,22 @@
+package mayafs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// availableMemory returns free and speculative (which can be reclaimed immediately) memory.
+func availableMemory() (int64, error) {
+	pageSize, err := unix.SysctlUint32("hw.pagesize")
+	if err != nil {
+		return 0, err
+	}
+	free, err := unix.SysctlUint32("vm.page_free_count")
+	if err != nil {
+		return 0, err
+	}
+	speculative, err := unix.SysctlUint32("vm.page_speculative_count")
+	if err != nil {
+		return 0, err
+	}
+	return (int64(free) + int64(speculative)) * int64(pageSize), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package mayafs
+
+import "fmt"
+
+func availableMemory() (int64, error) {
+	return 0, fmt.Errorf("available memory is not supported on this platform")
+}
@@ -0,0 +1,32 @@
+package mayafs
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx is MEMORYSTATUSEX, which isn't in x/sys/windows.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// availableMemory returns available physical memory (ullAvailPhys of GlobalMemoryStatusEx).
+func availableMemory() (int64, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+	if r, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); r == 0 {
+		return 0, err
+	}
+	return int64(status.AvailPhys), nil
+}
@@ -0,0 +1,75 @@
+package mayafs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Mirror directories hold partial fast copy (e.g. on SSD) of archive files. When a .dat part, zip or .zst exists in one of them
+// with the same name and the same size as the primary file, it is read from the mirror instead.
+// Decision is made on first read of each file and kept, so files copied into mirror while mounted are used after remount.
+
+// mirrorPath returns file in mirror directories which can be read instead of file, or file itself.
+func (fs *FS) mirrorPath(file string) string {
+	if len(fs.MirrorDirs) == 0 {
+		return file
+	}
+	if m, ok := fs.mirrors.Load(file); ok {
+		return m.(string)
+	}
+	m := fs.findMirror(file)
+	if m != file {
+		fmt.Println("reading", file, "from mirror", m)
+	}
+	fs.mirrors.Store(file, m)
+	return m
+}
+
+func (fs *FS) findMirror(file string) string {
+	name := filepath.Base(file)
+	if IsRemoteFile(file) {
+		name = path.Base(file)
+	}
+	var expected int64 = -1
+	for _, dir := range fs.MirrorDirs {
+		st, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || st.IsDir() {
+			continue
+		}
+		if expected < 0 {
+			size, err := fs.DataFileSize(file)
+			if err != nil {
+				// size can't be verified (e.g. NAS is offline), so mirror is not trusted
+				return file
+			}
+			expected = size
+		}
+		if st.Size() == expected {
+			return filepath.Join(dir, name)
+		}
+		fmt.Println("Warning: ignoring", filepath.Join(dir, name), "in mirror directory, since its size is different from", file)
+	}
+	return file
+}
+
+// MirroredFile is an archive file which is read from mirror directory.
+type MirroredFile struct {
+	File   string
+	Mirror string
+}
+
+// MirrorSnapshot returns files which are read from mirror directories, sorted by file.
+func (fs *FS) MirrorSnapshot() []MirroredFile {
+	mirrored := []MirroredFile{}
+	fs.mirrors.Range(func(k, v any) bool {
+		if k.(string) != v.(string) {
+			mirrored = append(mirrored, MirroredFile{File: k.(string), Mirror: v.(string)})
+		}
+		return true
+	})
+	sort.Slice(mirrored, func(i, j int) bool { return mirrored[i].File < mirrored[j].File })
+	return mirrored
+}
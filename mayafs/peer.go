@@ -0,0 +1,251 @@
+package mayafs
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// Mounters on the same LAN find each other by mDNS, and blocks of remote archives are fetched from peers
+// which have them in their cache before downloading from the origin server.
+// Peers only serve blocks which are on their disk (never download for others), and only for the same version of the file.
+// Blocks from peers are verified by sha256 which the origin publishes (see remoteBlockSums) before they are used and cached,
+// so a host which answers mDNS can't inject its own content.
+
+const PEER_SERVICE = "_mayakashi-peer._tcp"
+
+// peers are looked up again with this interval, peers which don't answer are forgotten
+const peerBrowseInterval = 30 * time.Second
+
+// peer which doesn't answer in this duration is skipped, origin is used instead
+const peerFetchTimeout = 5 * time.Second
+
+// PeerCache serves cached blocks of remote archives to peers, and fetches blocks from peers.
+type PeerCache struct {
+	// announced by mDNS, to ignore itself in lookup results
+	instance string
+	cacheDir string
+	token    string
+	client   *http.Client
+	listener net.Listener
+
+	mutex sync.Mutex
+	peers []string
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	served atomic.Uint64
+}
+
+// PeerCacheStats is state of PeerCache.
+type PeerCacheStats struct {
+	Peers  []string
+	Hits   uint64
+	Misses uint64
+	Served uint64
+}
+
+// StartPeerCache listens on addr, announces it by mDNS, and starts looking up peers.
+// Peers must have the same token. Blocks in cacheDir are served by Serve.
+func StartPeerCache(addr string, token string, cacheDir string) (*PeerCache, error) {
+	if cacheDir == "" {
+		return nil, errors.New("peer cache requires remotecache= directory")
+	}
+	if token == "" {
+		return nil, errors.New("peer cache requires peertoken=")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	p := &PeerCache{
+		instance: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		cacheDir: cacheDir,
+		token:    token,
+		client:   &http.Client{Timeout: peerFetchTimeout},
+		listener: listener,
+	}
+
+	service, err := mdns.NewMDNSService(p.instance, PEER_SERVICE, "", "", listener.Addr().(*net.TCPAddr).Port, localIPs(), nil)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if _, err := mdns.NewServer(&mdns.Config{Zone: service}); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to announce by mDNS: %w", err)
+	}
+
+	fmt.Println("Peer cache is listening on", listener.Addr())
+
+	// first lookup is done before returning, so archives which are loaded right after this can use peers
+	p.browse()
+	go func() {
+		for range time.Tick(peerBrowseInterval) {
+			p.browse()
+		}
+	}()
+	return p, nil
+}
+
+// Serve serves cached blocks to peers, until it fails.
+func (p *PeerCache) Serve() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocks/", p.handleBlock)
+	return http.Serve(p.listener, mux)
+}
+
+// localIPs returns addresses which are announced to peers,
+// since hostname might not be resolvable (e.g. hosts file doesn't have it).
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+func (p *PeerCache) browse() {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	found := map[string]struct{}{}
+	done := make(chan struct{})
+	go func() {
+		for e := range entries {
+			if strings.HasPrefix(e.Name, p.instance+".") {
+				continue
+			}
+			ip := e.AddrV4
+			if ip == nil {
+				ip = e.AddrV6
+			}
+			if ip == nil {
+				continue
+			}
+			found[net.JoinHostPort(ip.String(), strconv.Itoa(e.Port))] = struct{}{}
+		}
+		close(done)
+	}()
+	params := mdns.DefaultParams(PEER_SERVICE)
+	params.Entries = entries
+	params.Timeout = 2 * time.Second
+	err := mdns.Query(params)
+	close(entries)
+	<-done
+	if err != nil {
+		fmt.Println("failed to look up peers:", err)
+		return
+	}
+
+	peers := make([]string, 0, len(found))
+	for peer := range found {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	p.mutex.Lock()
+	if strings.Join(peers, ",") != strings.Join(p.peers, ",") {
+		fmt.Println("peers:", peers)
+	}
+	p.peers = peers
+	p.mutex.Unlock()
+}
+
+// handleBlock serves "/blocks/<key>/<start>+<length>?v=<version>" from cache directory.
+func (p *PeerCache) handleBlock(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/blocks/"), "/")
+	if len(parts) != 2 || !isRemoteCacheKey(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	start, length, ok := parseBlockName(parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	dir := filepath.Join(p.cacheDir, parts[0])
+	meta, err := readRemoteMeta(filepath.Join(dir, "meta.json"))
+	if err != nil || meta.version() != r.URL.Query().Get("v") {
+		// not cached, or cached for other version of the file
+		http.NotFound(w, r)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(dir, blockName(start, length)))
+	if err != nil || int64(len(data)) != length {
+		http.NotFound(w, r)
+		return
+	}
+	p.served.Add(1)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// fetch returns block from one of peers, or nil if no peer has it.
+// Blocks which don't pass verify are discarded, and next peer is asked.
+func (p *PeerCache) fetch(key string, version string, start int64, length int64, verify func([]byte) bool) []byte {
+	p.mutex.Lock()
+	peers := p.peers
+	p.mutex.Unlock()
+	for _, peer := range peers {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/blocks/%s/%s?v=%s", peer, key, blockName(start, length), version), nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		res, err := p.client.Do(req)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(res.Body, length+1))
+		res.Body.Close()
+		if err != nil || res.StatusCode != http.StatusOK || int64(len(data)) != length {
+			continue
+		}
+		if !verify(data) {
+			fmt.Printf("discarding block %s of %s from peer %s, its checksum doesn't match\n", blockName(start, length), key, peer)
+			continue
+		}
+		p.hits.Add(1)
+		return data
+	}
+	if len(peers) > 0 {
+		p.misses.Add(1)
+	}
+	return nil
+}
+
+// Snapshot returns current peers and counters.
+func (p *PeerCache) Snapshot() PeerCacheStats {
+	p.mutex.Lock()
+	peers := p.peers
+	p.mutex.Unlock()
+	return PeerCacheStats{
+		Peers:  peers,
+		Hits:   p.hits.Load(),
+		Misses: p.misses.Load(),
+		Served: p.served.Load(),
+	}
+}
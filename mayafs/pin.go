@@ -0,0 +1,109 @@
+package mayafs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// Decompressed data of files which match FS.PinGlobs is kept in pinned store instead of chunk cache, so it is never evicted
+// (e.g. shader caches and UI atlases which cause stutters when they miss cache). Pinned store is checked before chunk cache.
+// Data which doesn't fit in FS.PinBudget goes to chunk cache as usual, and data which isn't cached
+// (stored zip entries, passthrough chunks and oversized chunks, see FS.MaxCachedChunkSize) is never pinned.
+
+// default of FS.PinBudget
+const DEFAULT_PIN_BUDGET = 512 << 20
+
+// pinnedStore is decompressed data which is never evicted.
+type pinnedStore struct {
+	// cache key => *ChunkCache
+	entries sync.Map
+	bytes   atomic.Int64
+}
+
+// PinStats is a snapshot of pinned store.
+type PinStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// isPinnedPath reports whether path matches one of PinGlobs.
+func (fs *FS) isPinnedPath(path string) bool {
+	for _, glob := range fs.PinGlobs {
+		matched, err := doublestar.Match(NormalizeString(glob), NormalizeString(path))
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getChunkCache returns decompressed data from pinned store or chunk cache.
+func (fs *FS) getChunkCache(key string) (*ChunkCache, bool) {
+	if value, ok := fs.pinned.entries.Load(key); ok {
+		return value.(*ChunkCache), true
+	}
+	value, ok := fs.ChunkCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*ChunkCache), true
+}
+
+// pin adds value to pinned store, and reports false if it exceeds PinBudget.
+func (fs *FS) pin(key string, value *ChunkCache) bool {
+	size := int64(len(value.Data))
+	if fs.pinned.bytes.Add(size) > fs.PinBudget {
+		fs.pinned.bytes.Add(-size)
+		return false
+	}
+	if _, loaded := fs.pinned.entries.LoadOrStore(key, value); loaded {
+		fs.pinned.bytes.Add(-size)
+	}
+	return true
+}
+
+// LoadPinnedFiles reads files which match PinGlobs (in current tree) into pinned store, until PinBudget is used.
+// It returns number of files which were read.
+func (fs *FS) LoadPinnedFiles() (int, error) {
+	if len(fs.PinGlobs) == 0 {
+		return 0, nil
+	}
+	buff := make([]byte, 1<<20)
+	files := 0
+	for path, file := range fs.Tree().Files {
+		if fs.pinned.bytes.Load() >= fs.PinBudget {
+			break
+		}
+		if file.LocalFile != nil || !fs.isPinnedPath(path) {
+			continue
+		}
+		for offset := int64(0); ; {
+			readed, err := fs.ReadFileAt(path, buff, offset)
+			if err != nil {
+				return files, fmt.Errorf("failed to pin %s: %w", path, err)
+			}
+			if readed == 0 {
+				break
+			}
+			offset += int64(readed)
+		}
+		files++
+	}
+	return files, nil
+}
+
+// PinStats returns snapshot of pinned store.
+func (fs *FS) PinStats() PinStats {
+	entries := 0
+	fs.pinned.entries.Range(func(_, _ any) bool {
+		entries++
+		return true
+	})
+	return PinStats{
+		Entries: entries,
+		Bytes:   fs.pinned.bytes.Load(),
+	}
+}
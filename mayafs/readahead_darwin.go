@@ -0,0 +1,31 @@
+package mayafs
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSequentialFile opens file with readahead enabled, for reads which are detected as sequential.
+func openSequentialFile(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// hint only, failure doesn't matter
+	unix.FcntlInt(f.Fd(), unix.F_RDAHEAD, 1)
+	return f, nil
+}
+
+// adviseWillNeed asks OS to read range of file into page cache in background (F_RDADVISE, macOS doesn't have posix_fadvise).
+func adviseWillNeed(f *os.File, offset int64, length int64) {
+	if length > math.MaxInt32 {
+		length = math.MaxInt32
+	}
+	ra := unix.Radvisory_t{Offset: offset, Count: int32(length)}
+	unix.FcntlInt(f.Fd(), unix.F_RDADVISE, int(uintptr(unsafe.Pointer(&ra))))
+	runtime.KeepAlive(&ra)
+}
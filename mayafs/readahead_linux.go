@@ -0,0 +1,23 @@
+package mayafs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSequentialFile opens file with larger readahead window, for reads which are detected as sequential.
+func openSequentialFile(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// hint only, failure doesn't matter
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+	return f, nil
+}
+
+// adviseWillNeed asks OS to read range of file into page cache in background.
+func adviseWillNeed(f *os.File, offset int64, length int64) {
+	unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_WILLNEED)
+}
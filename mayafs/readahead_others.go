@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package mayafs
+
+import "os"
+
+func openSequentialFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func adviseWillNeed(f *os.File, offset int64, length int64) {
+}
@@ -0,0 +1,28 @@
+package mayafs
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// openSequentialFile opens file with FILE_FLAG_SEQUENTIAL_SCAN, so cache manager reads ahead aggressively,
+// for reads which are detected as sequential.
+func openSequentialFile(path string) (*os.File, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	// same sharing mode as os.Open
+	h, err := windows.CreateFile(name, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil,
+		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL|windows.FILE_FLAG_SEQUENTIAL_SCAN, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// adviseWillNeed does nothing, Windows doesn't have a hint for range of opened file,
+// and read ahead of FILE_FLAG_SEQUENTIAL_SCAN handle covers it.
+func adviseWillNeed(f *os.File, offset int64, length int64) {
+}
@@ -0,0 +1,308 @@
+package mayafs
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// ReadFileAt reads file in archives from offset.
+// It may read less than len(buff) (e.g. only until end of chunk), and returns 0 on end of file.
+// If path is not found, it returns error which wraps os.ErrNotExist.
+func (fs *FS) ReadFileAt(path string, buff []byte, offset int64) (int, error) {
+	file, ok := fs.GetFile(path)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", os.ErrNotExist, path)
+	}
+
+	readed, err := fs.readFile(path, buff, offset, &file)
+	if err == nil && fs.CachePolicy.ScanNoCacheSize > 0 {
+		fs.scans.observe(path, offset, readed)
+	}
+	return readed, err
+}
+
+func (fs *FS) readFile(path string, buff []byte, offset int64, file *FileInfo) (int, error) {
+	if file.ZipEntry != nil {
+		return fs.readFromZipEntry(path, buff, offset, file)
+	} else if file.MarEntry != nil {
+		return fs.readFromMarEntry(path, buff, offset, file)
+	} else if file.ZstEntry != nil {
+		return fs.readFromZstEntry(path, buff, offset, file)
+	} else if file.LocalFile != nil {
+		return file.LocalFile.ReadAt(buff, offset)
+	}
+
+	return 0, fmt.Errorf("there is no known file entry: %s", path)
+}
+
+func (fs *FS) readFromZipEntry(path string, buff []byte, offset int64, file *FileInfo) (int, error) {
+	entry := file.ZipEntry
+	if offset >= entry.Size() {
+		return 0, nil
+	}
+	pool := fs.ArchiveReader(file.ArchiveFile)
+	// If entry is not compressed, we can read without decompressing, which reduces resource usage.
+	if entry.Method == zip.Store {
+		readed, err := entry.OpenRaw(pool).ReadAt(buff, offset)
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read zip (direct): %w", err)
+		}
+		return readed, nil
+	}
+
+	// large entries are decompressed only up to the requested range, instead of decompressing (and caching) whole entry
+	if entry.Size() > zipStreamThreshold {
+		return fs.readFromZipStream(path, buff, offset, file)
+	}
+
+	// check cache to avoid decompressing
+	cacheKey := zipEntryCacheKey(file)
+	cache, ok := fs.getChunkCache(cacheKey)
+	if ok {
+		decoded := cache.Data
+		readed := copy(buff, decoded[offset:])
+		return readed, nil
+	}
+
+	reader, err := entry.Open(pool)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open zip entry: %w", err)
+	}
+	defer reader.Close()
+
+	dst := make([]byte, entry.UncompressedSize64)
+	_, err = io.ReadFull(reader, dst)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read zip data: %w", err)
+	}
+	if entry.CRC32 != 0 && crc32.ChecksumIEEE(dst) != entry.CRC32 {
+		return 0, fmt.Errorf("checksum mismatch on zip entry: %s", path)
+	}
+
+	fs.setChunkCache(path, cacheKindZip, cacheKey, &ChunkCache{
+		Data: dst,
+	})
+
+	readed := copy(buff, dst[offset:])
+
+	return readed, nil
+}
+
+func (fs *FS) readFromMarEntry(path string, buff []byte, offset int64, file *FileInfo) (int, error) {
+	entry := file.MarEntry
+	chunkNo := findChunk(entry, offset)
+	if chunkNo < 0 {
+		// fmt.Println("chunk not found", path, offset)
+		return 0, nil
+	}
+	targetChunk := entry.Info.Chunks[chunkNo]
+	chunkStart := int64(entry.ChunkOriginalOffsets[chunkNo])
+	datStart := int64(entry.ChunkDatOffsets[chunkNo])
+
+	if targetChunk.CompressedMethod == pb.CompressedMethod_ZERO {
+		// nothing to read nor cache
+		if offset < chunkStart {
+			return 0, fmt.Errorf("offset < chunkStart: %s %d %d", path, offset, chunkStart)
+		}
+		remainsLength := int(targetChunk.OriginalLength) - int(offset-chunkStart)
+		if len(buff) > remainsLength {
+			buff = buff[:remainsLength]
+		}
+		for i := range buff {
+			buff[i] = 0
+		}
+		return len(buff), nil
+	}
+
+	marFileName := file.DatPath()
+
+	pool := fs.ArchiveReader(marFileName)
+
+	if targetChunk.CompressedMethod != pb.CompressedMethod_PASSTHROUGH {
+		// println("zstd")
+		cacheKey := marChunkCacheKey(marFileName, datStart, chunkNo)
+		fs.HotChunks.Touch(path, chunkNo)
+		cachedData, ok := fs.getChunkCache(cacheKey)
+		var decoded []byte
+		if ok {
+			// println("cache hit")
+			decoded = cachedData.Data
+		} else if targetChunk.SeekableFrameSize != 0 && targetChunk.CompressedMethod == pb.CompressedMethod_ZSTANDARD {
+			if offset < chunkStart {
+				return 0, fmt.Errorf("offset < chunkStart: %s %d %d", path, offset, chunkStart)
+			}
+			frame, frameStart, err := fs.readSeekableFrame(path, marFileName, datStart, chunkNo, targetChunk, offset-chunkStart)
+			if err != nil {
+				return 0, err
+			}
+			// only until end of frame, caller will read next frame if needed
+			return copy(buff, frame[offset-chunkStart-frameStart:]), nil
+		} else if fs.shouldStreamMarChunk(targetChunk) {
+			if offset < chunkStart {
+				return 0, fmt.Errorf("offset < chunkStart: %s %d %d", path, offset, chunkStart)
+			}
+			fs.LastDatRead = time.Now()
+			// only until end of window, caller will read next window if needed
+			return fs.readFromMarStream(buff, offset-chunkStart, marFileName, datStart, chunkNo, targetChunk)
+		} else {
+			compressedBytes := GetBuffer(int(targetChunk.CompressedLength))
+			defer PutBuffer(compressedBytes)
+			start := time.Now()
+			fs.LastDatRead = start
+			if err := fs.readCompressedChunk(marFileName, compressedBytes, datStart); err != nil {
+				return 0, fmt.Errorf("failed to ReadAt compressed data: %w", err)
+			}
+			used := time.Since(start)
+			if used.Milliseconds() > 40 && fs.SlowReadLog != nil {
+				fs.SlowReadLog.Write([]byte(path + "\n"))
+			}
+
+			var err error
+			decoded, err = DecodeChunk(targetChunk, compressedBytes)
+			if err != nil {
+				return 0, err
+			}
+
+			fs.setChunkCache(path, cacheKindMar, cacheKey, &ChunkCache{
+				ChunkNo: chunkNo,
+				Data:    decoded,
+			})
+		}
+
+		if offset < chunkStart {
+			return 0, fmt.Errorf("offset < chunkStart: %s %d %d", path, offset, chunkStart)
+		}
+
+		decoded = decoded[offset-chunkStart:]
+
+		readed := copy(buff, decoded)
+
+		// println("ok")
+
+		return readed, nil
+	}
+	// passthrough
+	// println("passthrough", path)
+	remainsLength := int(targetChunk.OriginalLength) - int(offset-chunkStart)
+	if len(buff) > remainsLength {
+		// fmt.Println("!!!OVERLOAD!!!", len(buff), remainsLength)
+		buff = buff[:remainsLength]
+	}
+	readed, err := pool.ReadAt(buff, datStart+(offset-chunkStart))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from passthrough: %w", err)
+	}
+	return readed, nil
+}
+
+// ensureChunkOffsets fills chunk offset tables, for v1 index which doesn't have them.
+func ensureChunkOffsets(entry *pb.FileEntry) {
+	if entry.Info == nil {
+		return
+	}
+	chunks := entry.Info.Chunks
+	if len(entry.ChunkOriginalOffsets) == len(chunks) && len(entry.ChunkDatOffsets) == len(chunks) {
+		return
+	}
+	entry.ChunkOriginalOffsets = make([]uint64, len(chunks))
+	entry.ChunkDatOffsets = make([]uint64, len(chunks))
+	originalOffset := uint64(0)
+	datOffset := entry.BodyOffset
+	for i, chunk := range chunks {
+		entry.ChunkOriginalOffsets[i] = originalOffset
+		entry.ChunkDatOffsets[i] = datOffset
+		originalOffset += uint64(chunk.OriginalLength)
+		datOffset += uint64(chunk.CompressedLength)
+	}
+}
+
+// findChunk returns index of chunk which contains offset, or -1 if offset is out of file.
+func findChunk(entry *pb.FileEntry, offset int64) int {
+	offsets := entry.ChunkOriginalOffsets
+	i := sort.Search(len(offsets), func(i int) bool { return int64(offsets[i]) > offset }) - 1
+	if i < 0 {
+		return -1
+	}
+	if offset >= int64(offsets[i])+int64(entry.Info.Chunks[i].OriginalLength) {
+		return -1
+	}
+	return i
+}
+
+func marChunkCacheKey(marFileName string, datStart int64, chunkNo int) string {
+	return fmt.Sprintf("%s#%d#%d", marFileName, datStart, chunkNo)
+}
+
+// CacheMarChunk reads and decompresses chunk of .mar file into chunk cache, so later reads can skip decompression.
+// It returns size of decompressed data, or 0 if chunk is not compressed (including ZERO) or already cached.
+func (fs *FS) CacheMarChunk(file *FileInfo, chunkNo int) (int, error) {
+	entry := file.MarEntry
+	if entry == nil {
+		return 0, fmt.Errorf("not a mar entry")
+	}
+	if chunkNo < 0 || chunkNo >= len(entry.Info.Chunks) {
+		return 0, fmt.Errorf("invalid chunk number: %d", chunkNo)
+	}
+	datStart := int64(entry.ChunkDatOffsets[chunkNo])
+	targetChunk := entry.Info.Chunks[chunkNo]
+	if targetChunk.CompressedMethod == pb.CompressedMethod_PASSTHROUGH || targetChunk.CompressedMethod == pb.CompressedMethod_ZERO {
+		return 0, nil
+	}
+	if targetChunk.SeekableFrameSize == 0 && fs.shouldStreamMarChunk(targetChunk) {
+		// too large to be cached
+		return 0, nil
+	}
+
+	marFileName := file.DatPath()
+	cacheKey := marChunkCacheKey(marFileName, datStart, chunkNo)
+	if _, ok := fs.getChunkCache(cacheKey); ok {
+		return 0, nil
+	}
+	compressedBytes := GetBuffer(int(targetChunk.CompressedLength))
+	defer PutBuffer(compressedBytes)
+	if err := fs.readCompressedChunk(marFileName, compressedBytes, datStart); err != nil {
+		return 0, fmt.Errorf("failed to ReadAt compressed data: %w", err)
+	}
+	decoded, err := DecodeChunk(targetChunk, compressedBytes)
+	if err != nil {
+		return 0, err
+	}
+	fs.setChunkCache("", cacheKindMar, cacheKey, &ChunkCache{
+		ChunkNo: chunkNo,
+		Data:    decoded,
+	})
+	return len(decoded), nil
+}
+
+// DecodeChunk decompresses compressed chunk of .mar.
+func DecodeChunk(targetChunk *pb.ChunkInfo, compressedBytes []byte) ([]byte, error) {
+	if targetChunk.CompressedMethod == pb.CompressedMethod_ZSTANDARD {
+		decoded, err := getZstdDecoder().DecodeAll(compressedBytes, make([]byte, 0, int(targetChunk.OriginalLength)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode: %w", err)
+		}
+		return decoded, nil
+	} else if targetChunk.CompressedMethod == pb.CompressedMethod_LZ4 {
+		decoded := make([]byte, targetChunk.OriginalLength)
+		decoded_size, err := lz4.UncompressBlock(compressedBytes, decoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to uncompress lz4 block: %w", err)
+		}
+		if uint32(decoded_size) != targetChunk.OriginalLength {
+			return nil, fmt.Errorf("invalid decoded size: %d != %d", decoded_size, targetChunk.OriginalLength)
+		}
+		return decoded, nil
+	} else if targetChunk.CompressedMethod == pb.CompressedMethod_ZERO {
+		return make([]byte, targetChunk.OriginalLength), nil
+	}
+
+	return nil, fmt.Errorf("unknown compression method: %v", targetChunk.CompressedMethod)
+}
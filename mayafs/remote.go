@@ -0,0 +1,531 @@
+package mayafs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// .mar can be mounted from HTTP(S) URL (e.g. "https://example.com/game.mar"), its .idx and .dat files are read by Range requests.
+// Downloaded ranges are persisted into RemoteCacheDir as blocks, so content which was read once doesn't need network anymore
+// (and archive can be mounted offline if all needed blocks are cached).
+
+// REMOTE_BLOCK_SIZE is unit of downloading and caching remote files.
+const REMOTE_BLOCK_SIZE = 1024 * 1024
+
+// IsRemoteFile reports whether file is URL of remote archive.
+func IsRemoteFile(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// DefaultRemoteCacheDir returns directory where blocks of remote archives are cached, in user's cache directory.
+func DefaultRemoteCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mayakashi", "remote")
+}
+
+// remoteMeta identifies version of remote file, cached blocks are discarded when it changes.
+type remoteMeta struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// version is compared with peers, so blocks of other version of the file are not shared.
+func (m *remoteMeta) version() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s\n%s", m.URL, m.Size, m.ETag, m.LastModified)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ifRange returns validator for If-Range header, "" if server gives nothing usable (weak ETag can't be used).
+func (m *remoteMeta) ifRange() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+func readRemoteMeta(path string) (*remoteMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta remoteMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%s is corrupted: %w", path, err)
+	}
+	return &meta, nil
+}
+
+// remoteBlockSums is sha256 of each block of remote file, which origin publishes as "<url>.blocks" (e.g. serve= does).
+// Blocks fetched from peers are verified with it, since version of the file is not secret.
+type remoteBlockSums struct {
+	// same as ETag of the file, so sums of other version are not used
+	ETag      string   `json:"etag"`
+	Size      int64    `json:"size"`
+	BlockSize int64    `json:"block_size"`
+	SHA256    []string `json:"sha256"`
+}
+
+// newRemoteBlockSums calculates sums of content of r, which has etag.
+func newRemoteBlockSums(r io.Reader, etag string) (*remoteBlockSums, error) {
+	sums := &remoteBlockSums{ETag: etag, BlockSize: REMOTE_BLOCK_SIZE, SHA256: []string{}}
+	buf := make([]byte, REMOTE_BLOCK_SIZE)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			sums.SHA256 = append(sums.SHA256, hex.EncodeToString(sum[:]))
+			sums.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteRemoteBlockSums writes "<url>.blocks" of content of r, which is served with etag.
+func WriteRemoteBlockSums(w io.Writer, r io.Reader, etag string) error {
+	sums, err := newRemoteBlockSums(r, etag)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(sums)
+}
+
+// remoteCacheKey is name of cache directory of url.
+func remoteCacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:16])
+}
+
+func isRemoteCacheKey(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// e.g. "1048576+1048576"
+func blockName(start int64, length int64) string {
+	return strconv.FormatInt(start, 10) + "+" + strconv.FormatInt(length, 10)
+}
+
+func parseBlockName(name string) (int64, int64, bool) {
+	sl := strings.SplitN(name, "+", 2)
+	if len(sl) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(sl[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseInt(sl[1], 10, 64)
+	if err != nil || length <= 0 || length > REMOTE_BLOCK_SIZE {
+		return 0, 0, false
+	}
+	return start, length, true
+}
+
+// RemoteFile is io.ReaderAt of remote file, which caches downloaded blocks on disk.
+type RemoteFile struct {
+	URL    string
+	Size   int64
+	client *http.Client
+	// sent as bearer token if not empty (e.g. for serve= of other marmounter)
+	token string
+	// "" if blocks are not persisted
+	dir string
+	// name of cache directory, which is also used to ask peers
+	key     string
+	version string
+	// sent as If-Range, so blocks of other version of the file are never mixed into cache
+	ifRange string
+	// nil if peers are not used
+	peers *PeerCache
+	// sha256 of each block (nil if origin doesn't publish them), blocks from peers are not used if nil
+	sums [][sha256.Size]byte
+
+	mutex    sync.Mutex
+	inflight map[int64]*remoteFetch
+
+	fetches      atomic.Uint64
+	fetchedBytes atomic.Uint64
+	cacheHits    atomic.Uint64
+	peerHits     atomic.Uint64
+}
+
+type remoteFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (r *RemoteFile) newRequest(method string, header map[string]string) (*http.Request, error) {
+	req, err := http.NewRequest(method, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return req, nil
+}
+
+// openRemoteFile gets size and version of url, and prepares its cache directory.
+// If server is unreachable, last known version in cache directory is used, so cached content stays readable offline.
+func openRemoteFile(url string, cacheDir string, token string, client *http.Client, peers *PeerCache) (*RemoteFile, error) {
+	r := &RemoteFile{
+		URL:      url,
+		client:   client,
+		token:    token,
+		key:      remoteCacheKey(url),
+		peers:    peers,
+		inflight: map[int64]*remoteFetch{},
+	}
+	if cacheDir != "" {
+		r.dir = filepath.Join(cacheDir, r.key)
+	}
+	metaPath := filepath.Join(r.dir, "meta.json")
+
+	meta, err := r.head()
+	if err != nil {
+		if r.dir == "" {
+			return nil, err
+		}
+		if _, statErr := os.Stat(metaPath); statErr != nil {
+			return nil, err
+		}
+		cached, readErr := readRemoteMeta(metaPath)
+		if readErr != nil {
+			return nil, readErr
+		}
+		fmt.Println("Warning: using cached", url, "since server is unreachable:", err)
+		r.Size = cached.Size
+		r.version = cached.version()
+		r.ifRange = cached.ifRange()
+		return r, nil
+	}
+	r.Size = meta.Size
+	r.version = meta.version()
+	r.ifRange = meta.ifRange()
+	if r.sums, err = r.blockSums(meta); err != nil && r.peers != nil {
+		fmt.Println("blocks of", url, "are not fetched from peers:", err)
+	}
+	if r.dir == "" {
+		return r, nil
+	}
+
+	if data, err := os.ReadFile(metaPath); err == nil {
+		var cached remoteMeta
+		if json.Unmarshal(data, &cached) == nil && cached == *meta {
+			return r, nil
+		}
+		fmt.Println("remote file is changed, discarding cached blocks:", url)
+		if err := os.RemoveAll(r.dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(metaPath, data, 0644); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RemoteFile) head() (*remoteMeta, error) {
+	req, err := r.newRequest(http.MethodHead, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, r.URL)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%s requires authentication (remotetoken= is missing or wrong)", r.URL)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of %s: %s", r.URL, res.Status)
+	}
+	if res.ContentLength < 0 {
+		return nil, fmt.Errorf("server doesn't report size of %s", r.URL)
+	}
+	return &remoteMeta{
+		URL:          r.URL,
+		Size:         res.ContentLength,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// blockSums downloads sums of blocks which origin publishes, to verify downloaded blocks (and blocks from peers).
+func (r *RemoteFile) blockSums(meta *remoteMeta) ([][sha256.Size]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, r.URL+".blocks", nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origin doesn't publish sums of blocks (%s)", res.Status)
+	}
+	var published remoteBlockSums
+	if err := json.NewDecoder(res.Body).Decode(&published); err != nil {
+		return nil, fmt.Errorf("sums of blocks are corrupted: %w", err)
+	}
+	blocks := (meta.Size + REMOTE_BLOCK_SIZE - 1) / REMOTE_BLOCK_SIZE
+	if published.ETag != meta.ETag || published.Size != meta.Size || published.BlockSize != REMOTE_BLOCK_SIZE || int64(len(published.SHA256)) != blocks {
+		return nil, errors.New("sums of blocks are for other version of the file")
+	}
+	sums := make([][sha256.Size]byte, blocks)
+	for i, s := range published.SHA256 {
+		if n, err := hex.Decode(sums[i][:], []byte(s)); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("sums of blocks are corrupted: %q", s)
+		}
+	}
+	return sums, nil
+}
+
+// verifyBlock reports whether data is content of block which starts at start, by sums from origin.
+func (r *RemoteFile) verifyBlock(start int64, data []byte) bool {
+	return sha256.Sum256(data) == r.sums[start/REMOTE_BLOCK_SIZE]
+}
+
+func (r *RemoteFile) blockPath(start int64, length int64) string {
+	return filepath.Join(r.dir, blockName(start, length))
+}
+
+// block returns block which starts at start, from cache or server.
+func (r *RemoteFile) block(start int64) ([]byte, error) {
+	length := r.Size - start
+	if length > REMOTE_BLOCK_SIZE {
+		length = REMOTE_BLOCK_SIZE
+	}
+	if r.dir != "" {
+		if data, err := os.ReadFile(r.blockPath(start, length)); err == nil && int64(len(data)) == length {
+			r.cacheHits.Add(1)
+			return data, nil
+		}
+	}
+
+	// same block might be requested by multiple readers at once (e.g. preload and app)
+	r.mutex.Lock()
+	if f, ok := r.inflight[start]; ok {
+		r.mutex.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &remoteFetch{done: make(chan struct{})}
+	r.inflight[start] = f
+	r.mutex.Unlock()
+
+	f.data, f.err = r.fetch(start, length)
+	r.mutex.Lock()
+	delete(r.inflight, start)
+	r.mutex.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+func (r *RemoteFile) fetch(start int64, length int64) ([]byte, error) {
+	if r.peers != nil && r.sums != nil {
+		verify := func(data []byte) bool { return r.verifyBlock(start, data) }
+		if data := r.peers.fetch(r.key, r.version, start, length, verify); data != nil {
+			r.peerHits.Add(1)
+			r.store(start, length, data)
+			return data, nil
+		}
+	}
+
+	header := map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", start, start+length-1),
+	}
+	if r.ifRange != "" {
+		// server sends whole file (200) instead of range if the file was changed (e.g. rebuilt) since it was opened
+		header["If-Range"] = r.ifRange
+	}
+	req, err := r.newRequest(http.MethodGet, header)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK && r.ifRange != "" {
+		return nil, fmt.Errorf("%s is changed on server since it was mounted, remount to use new version", r.URL)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status of %s (server must support Range requests): %s", r.URL, res.Status)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(res.Body, data); err != nil {
+		return nil, fmt.Errorf("failed to download %s (%d+%d): %w", r.URL, start, length, err)
+	}
+	if r.sums != nil && !r.verifyBlock(start, data) {
+		// never cached, so it doesn't stay after remount
+		return nil, fmt.Errorf("downloaded block of %s (%d+%d) doesn't match its sum, the file might be changed on server", r.URL, start, length)
+	}
+	r.fetches.Add(1)
+	r.fetchedBytes.Add(uint64(length))
+	r.store(start, length, data)
+	return data, nil
+}
+
+// store persists downloaded block into cache directory.
+func (r *RemoteFile) store(start int64, length int64, data []byte) {
+	if r.dir == "" {
+		return
+	}
+	path := r.blockPath(start, length)
+	// other readers (and peers) never see partially written block
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		fmt.Println("failed to cache block of", r.URL, err)
+	} else if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Println("failed to cache block of", r.URL, err)
+	}
+}
+
+func (r *RemoteFile) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= r.Size {
+			return n, io.EOF
+		}
+		start := pos / REMOTE_BLOCK_SIZE * REMOTE_BLOCK_SIZE
+		data, err := r.block(start)
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], data[pos-start:])
+	}
+	return n, nil
+}
+
+// RemoteFileStats is downloads of one remote file.
+type RemoteFileStats struct {
+	URL          string
+	Size         int64
+	Fetches      uint64
+	FetchedBytes uint64
+	CacheHits    uint64
+	PeerHits     uint64
+}
+
+// remoteFile returns opened remote file of url, opening it on first call.
+func (fs *FS) remoteFile(url string) (*RemoteFile, error) {
+	fs.remoteFilesMutex.Lock()
+	defer fs.remoteFilesMutex.Unlock()
+	if r, ok := fs.remoteFiles[url]; ok {
+		return r, nil
+	}
+	r, err := openRemoteFile(url, fs.RemoteCacheDir, fs.RemoteToken, &http.Client{Timeout: 5 * time.Minute}, fs.Peers)
+	if err != nil {
+		return nil, err
+	}
+	if fs.remoteFiles == nil {
+		fs.remoteFiles = map[string]*RemoteFile{}
+	}
+	fs.remoteFiles[url] = r
+	return r, nil
+}
+
+// RemoteSnapshot returns stats of every remote file, sorted by URL.
+func (fs *FS) RemoteSnapshot() []RemoteFileStats {
+	fs.remoteFilesMutex.Lock()
+	defer fs.remoteFilesMutex.Unlock()
+	stats := make([]RemoteFileStats, 0, len(fs.remoteFiles))
+	for _, r := range fs.remoteFiles {
+		stats = append(stats, RemoteFileStats{
+			URL:          r.URL,
+			Size:         r.Size,
+			Fetches:      r.fetches.Load(),
+			FetchedBytes: r.fetchedBytes.Load(),
+			CacheHits:    r.cacheHits.Load(),
+			PeerHits:     r.peerHits.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].URL < stats[j].URL })
+	return stats
+}
+
+// openDataFile opens file of archive (e.g. .idx) for sequential read, which might be remote.
+func (fs *FS) openDataFile(file string) (io.ReadCloser, error) {
+	if !IsRemoteFile(file) {
+		return os.Open(file)
+	}
+	r, err := fs.remoteFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.NewSectionReader(r, 0, r.Size)), nil
+}
+
+// DataFileSize returns size of file of archive (e.g. .dat), which might be remote.
+func (fs *FS) DataFileSize(file string) (int64, error) {
+	if !IsRemoteFile(file) {
+		st, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		return st.Size(), nil
+	}
+	r, err := fs.remoteFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return r.Size, nil
+}
+
+// errReaderAt is io.ReaderAt which always fails, e.g. remote file which can't be opened.
+type errReaderAt struct {
+	err error
+}
+
+func (r errReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return 0, r.err
+}
+
+var errRemoteOnlyMar = errors.New("only .mar can be mounted from URL")
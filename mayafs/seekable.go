@@ -0,0 +1,143 @@
+package mayafs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// Chunks written with --seekable-frame-size are zstd seekable format
+// (https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md),
+// so we can decompress only frames which contains requested range instead of whole chunk.
+
+const (
+	zstdSkippableFrameMagic = 0x184D2A5E
+	zstdSeekableMagic       = 0x8F92EAB1
+	// skippable frame header (magic + size) and seek table footer (number of frames + descriptor + magic)
+	seekTableHeaderSize = 8
+	seekTableFooterSize = 9
+)
+
+// seekTable holds compressed offset (from start of chunk) and size of each frame.
+type seekTable struct {
+	CompressedOffsets []int64
+	CompressedSizes   []uint32
+}
+
+func seekableFrameCount(chunk *pb.ChunkInfo) int {
+	frameSize := chunk.SeekableFrameSize
+	return int((chunk.OriginalLength + frameSize - 1) / frameSize)
+}
+
+func parseSeekTable(chunk *pb.ChunkInfo, data []byte) (*seekTable, error) {
+	frames := seekableFrameCount(chunk)
+	if len(data) != seekTableHeaderSize+frames*8+seekTableFooterSize {
+		return nil, fmt.Errorf("invalid seek table size: %d", len(data))
+	}
+	if binary.LittleEndian.Uint32(data[0:4]) != zstdSkippableFrameMagic {
+		return nil, fmt.Errorf("invalid seek table: skippable frame magic not found")
+	}
+	footer := data[len(data)-seekTableFooterSize:]
+	if binary.LittleEndian.Uint32(footer[5:9]) != zstdSeekableMagic {
+		return nil, fmt.Errorf("invalid seek table: seekable magic not found")
+	}
+	if int(binary.LittleEndian.Uint32(footer[0:4])) != frames {
+		return nil, fmt.Errorf("invalid seek table: number of frames mismatch")
+	}
+	if footer[4]&0x80 != 0 {
+		// packer never writes checksums, and it changes size of entries
+		return nil, fmt.Errorf("invalid seek table: checksum flag is not supported")
+	}
+
+	table := &seekTable{
+		CompressedOffsets: make([]int64, frames),
+		CompressedSizes:   make([]uint32, frames),
+	}
+	offset := int64(0)
+	for i := 0; i < frames; i++ {
+		entry := data[seekTableHeaderSize+i*8:]
+		table.CompressedOffsets[i] = offset
+		table.CompressedSizes[i] = binary.LittleEndian.Uint32(entry[0:4])
+		if i != frames-1 && binary.LittleEndian.Uint32(entry[4:8]) != chunk.SeekableFrameSize {
+			return nil, fmt.Errorf("invalid seek table: frame %d has unexpected size", i)
+		}
+		offset += int64(table.CompressedSizes[i])
+	}
+	if offset+int64(len(data)) != int64(chunk.CompressedLength) {
+		return nil, fmt.Errorf("invalid seek table: compressed size mismatch")
+	}
+	return table, nil
+}
+
+// readSeekTable reads seek table at the end of chunk. Raw table is cached in chunk cache, since it is small but requires extra read.
+func (fs *FS) readSeekTable(marFileName string, datStart int64, chunkNo int, chunk *pb.ChunkInfo) (*seekTable, error) {
+	cacheKey := marChunkCacheKey(marFileName, datStart, chunkNo) + "#seektable"
+	if cached, ok := fs.getChunkCache(cacheKey); ok {
+		return parseSeekTable(chunk, cached.Data)
+	}
+	tableSize := seekTableHeaderSize + seekableFrameCount(chunk)*8 + seekTableFooterSize
+	if tableSize > int(chunk.CompressedLength) {
+		return nil, fmt.Errorf("invalid seekable chunk: too small for seek table")
+	}
+	data := make([]byte, tableSize)
+	if _, err := fs.ArchiveReader(marFileName).ReadAt(data, datStart+int64(chunk.CompressedLength)-int64(tableSize)); err != nil {
+		return nil, fmt.Errorf("failed to ReadAt seek table: %w", err)
+	}
+	table, err := parseSeekTable(chunk, data)
+	if err != nil {
+		return nil, err
+	}
+	fs.setChunkCache("", cacheKindMar, cacheKey, &ChunkCache{
+		ChunkNo: chunkNo,
+		Data:    data,
+	})
+	return table, nil
+}
+
+// readSeekableFrame returns decompressed frame which contains inChunkOffset, and offset of the frame in chunk.
+func (fs *FS) readSeekableFrame(path string, marFileName string, datStart int64, chunkNo int, chunk *pb.ChunkInfo, inChunkOffset int64) ([]byte, int64, error) {
+	frameNo := int(inChunkOffset / int64(chunk.SeekableFrameSize))
+	frameStart := int64(frameNo) * int64(chunk.SeekableFrameSize)
+	cacheKey := fmt.Sprintf("%s#f%d", marChunkCacheKey(marFileName, datStart, chunkNo), frameNo)
+	if cached, ok := fs.getChunkCache(cacheKey); ok {
+		return cached.Data, frameStart, nil
+	}
+
+	table, err := fs.readSeekTable(marFileName, datStart, chunkNo, chunk)
+	if err != nil {
+		return nil, 0, err
+	}
+	compressedBytes := GetBuffer(int(table.CompressedSizes[frameNo]))
+	defer PutBuffer(compressedBytes)
+	start := time.Now()
+	fs.LastDatRead = start
+	if err := fs.readCompressedChunk(marFileName, compressedBytes, datStart+table.CompressedOffsets[frameNo]); err != nil {
+		return nil, 0, fmt.Errorf("failed to ReadAt compressed frame: %w", err)
+	}
+	if time.Since(start).Milliseconds() > 40 && fs.SlowReadLog != nil {
+		fs.SlowReadLog.Write([]byte(path + "\n"))
+	}
+
+	frameLength := int64(chunk.OriginalLength) - frameStart
+	if frameLength > int64(chunk.SeekableFrameSize) {
+		frameLength = int64(chunk.SeekableFrameSize)
+	}
+	decoded, err := DecodeChunk(&pb.ChunkInfo{
+		CompressedLength: table.CompressedSizes[frameNo],
+		OriginalLength:   uint32(frameLength),
+		CompressedMethod: pb.CompressedMethod_ZSTANDARD,
+	}, compressedBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(decoded)) != frameLength {
+		return nil, 0, fmt.Errorf("invalid decoded frame size: %d != %d", len(decoded), frameLength)
+	}
+	fs.setChunkCache(path, cacheKindMar, cacheKey, &ChunkCache{
+		ChunkNo: chunkNo,
+		Data:    decoded,
+	})
+	return decoded, frameStart, nil
+}
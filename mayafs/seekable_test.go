@@ -0,0 +1,93 @@
+package mayafs
+
+import (
+	"bytes"
+	"testing"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+func TestReadSeekableChunks(t *testing.T) {
+	chunks := []testChunk{
+		// last frame is shorter than frame size
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(10000, 1), FrameSize: 4096},
+		{Method: pb.CompressedMethod_PASSTHROUGH, Data: testPattern(3000, 2)},
+		// single frame
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(2000, 3), FrameSize: 4096},
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(8192, 4), FrameSize: 1024},
+	}
+	want := concatChunks(chunks)
+	for _, v1 := range []bool{true, false} {
+		fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{{Path: "seekable.bin", Chunks: chunks}}, testMarOptions{V1: v1}))
+		for _, readSize := range []int{1, 1000, 4096, 5000, len(want)} {
+			if got := readAll(t, fs, "/seekable.bin", 0, readSize); !bytes.Equal(got, want) {
+				t.Fatalf("v1=%v read size %d: content mismatch", v1, readSize)
+			}
+		}
+		// reads which start in the middle of frames, without reading earlier frames first
+		for _, offset := range []int64{4095, 4097, 9999, 13500, 15000, 20000} {
+			fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{{Path: "seekable.bin", Chunks: chunks}}, testMarOptions{V1: v1}))
+			if got := readAll(t, fs, "/seekable.bin", offset, 3000); !bytes.Equal(got, want[offset:]) {
+				t.Fatalf("v1=%v: content mismatch from %d", v1, offset)
+			}
+		}
+	}
+}
+
+func TestReadSeekableFrameStopsAtFrameEnd(t *testing.T) {
+	data := testPattern(10000, 5)
+	fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "seekable.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZSTANDARD, Data: data, FrameSize: 4096}}},
+	}, testMarOptions{}))
+	buf := make([]byte, 8192)
+	readed, err := fs.ReadFileAt("/seekable.bin", buf, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only until end of first frame, caller reads next frame
+	if readed != 96 || !bytes.Equal(buf[:readed], data[4000:4096]) {
+		t.Fatalf("readed = %d, want 96 bytes of first frame", readed)
+	}
+}
+
+func TestCacheSeekableChunk(t *testing.T) {
+	data := testPattern(10000, 6)
+	fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "seekable.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZSTANDARD, Data: data, FrameSize: 4096}}},
+	}, testMarOptions{}))
+	file, _ := fs.GetFile("/seekable.bin")
+	// seekable chunk is valid zstd stream of concatenated frames (and skippable seek table), so whole chunk can be decoded at once
+	if _, err := fs.CacheMarChunk(&file, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/seekable.bin", 0, 3000); !bytes.Equal(got, data) {
+		t.Fatal("content mismatch after caching whole chunk")
+	}
+}
+
+func TestParseSeekTableRejectsBrokenTable(t *testing.T) {
+	data := testPattern(10000, 7)
+	fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "seekable.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZSTANDARD, Data: data, FrameSize: 4096}}},
+	}, testMarOptions{}))
+	file, _ := fs.GetFile("/seekable.bin")
+	chunk := file.MarEntry.Info.Chunks[0]
+	table := make([]byte, seekTableHeaderSize+seekableFrameCount(chunk)*8+seekTableFooterSize)
+	if _, err := fs.ArchiveReader(file.DatPath()).ReadAt(table, int64(chunk.CompressedLength)-int64(len(table))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSeekTable(chunk, table); err != nil {
+		t.Fatalf("valid table is rejected: %v", err)
+	}
+	broken := append([]byte{}, table...)
+	// compressed size of first frame
+	broken[seekTableHeaderSize]++
+	if _, err := parseSeekTable(chunk, broken); err == nil {
+		t.Fatal("table with wrong compressed size is accepted")
+	}
+	broken = append([]byte{}, table...)
+	broken[len(broken)-1] ^= 0xff
+	if _, err := parseSeekTable(chunk, broken); err == nil {
+		t.Fatal("table without seekable magic is accepted")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package mayafs
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// isStaleHandleError reports whether err means the file handle is no longer usable (e.g. NFS server restarted, SMB session dropped),
+// but opening the file again might work.
+func isStaleHandleError(err error) bool {
+	return errors.Is(err, unix.ESTALE) || errors.Is(err, unix.ENOTCONN) || errors.Is(err, unix.ECONNRESET) || errors.Is(err, unix.EBADF) || errors.Is(err, unix.EIO)
+}
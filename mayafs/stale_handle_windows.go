@@ -0,0 +1,14 @@
+package mayafs
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isStaleHandleError reports whether err means the file handle is no longer usable (e.g. SMB session dropped),
+// but opening the file again might work.
+func isStaleHandleError(err error) bool {
+	return errors.Is(err, windows.ERROR_NETNAME_DELETED) || errors.Is(err, windows.ERROR_UNEXP_NET_ERR) || errors.Is(err, windows.ERROR_BAD_NETPATH) ||
+		errors.Is(err, windows.ERROR_DEV_NOT_EXIST) || errors.Is(err, windows.ERROR_INVALID_HANDLE) || errors.Is(err, windows.ERROR_VC_DISCONNECTED)
+}
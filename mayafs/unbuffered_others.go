@@ -0,0 +1,14 @@
+//go:build !windows
+
+package mayafs
+
+import "fmt"
+
+// EnableUnbufferedIO returns error, unbuffered IO is only available on Windows.
+func EnableUnbufferedIO() error {
+	return fmt.Errorf("unbuffered IO is only available on Windows")
+}
+
+func openUnbufferedHandle(path string) (unbufferedHandle, error) {
+	return nil, fmt.Errorf("unbuffered IO is only available on Windows")
+}
@@ -0,0 +1,134 @@
+package mayafs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// With unbuffered IO, .dat (and zip) files are opened with FILE_FLAG_NO_BUFFERING, so compressed data is not kept in
+// OS file cache in addition to chunk cache of decompressed data. Such handles only accept reads whose offset, length and
+// buffer address are aligned to sector size, so reads are widened to aligned ones into an aligned buffer and copied.
+// Handles are also opened with FILE_FLAG_OVERLAPPED, so reads carry their offset and many threads can read one handle at once.
+
+// multiple of sector size of all common disks (512 and 4Kn)
+const unbufferedAlignment = 4096
+
+// EnableUnbufferedIO makes FilePool read with FILE_FLAG_NO_BUFFERING handles.
+// It must be called before files are read.
+func EnableUnbufferedIO() error {
+	unbufferedIO = true
+	return nil
+}
+
+type unbufferedFile struct {
+	path string
+	// read lock is held while reading, so handle isn't closed (and reused by another file) under reads
+	mutex  sync.RWMutex
+	handle windows.Handle
+}
+
+// events for waiting overlapped reads, they are reused since creating them costs a syscall
+var unbufferedEvents sync.Pool
+
+func openUnbufferedHandle(path string) (unbufferedHandle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	// same sharing mode as os.Open
+	h, err := windows.CreateFile(name, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil,
+		windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL|windows.FILE_FLAG_NO_BUFFERING|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &unbufferedFile{path: path, handle: h}, nil
+}
+
+func (f *unbufferedFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.handle == windows.InvalidHandle {
+		return nil
+	}
+	err := windows.CloseHandle(f.handle)
+	f.handle = windows.InvalidHandle
+	return err
+}
+
+func (f *unbufferedFile) ReadAt(b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	start := off &^ (unbufferedAlignment - 1)
+	end := (off + int64(len(b)) + unbufferedAlignment - 1) &^ (unbufferedAlignment - 1)
+	raw := GetBuffer(int(end-start) + unbufferedAlignment)
+	defer PutBuffer(raw)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&raw[0])) & (unbufferedAlignment - 1)); rem != 0 {
+		shift = unbufferedAlignment - rem
+	}
+	aligned := raw[shift : shift+int(end-start)]
+
+	readed, err := f.readAligned(aligned, start)
+	if err != nil {
+		return 0, err
+	}
+	if readed <= int(off-start) {
+		return 0, io.EOF
+	}
+	n := copy(b, aligned[off-start:readed])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAligned reads into b until it is filled or end of file is reached.
+func (f *unbufferedFile) readAligned(b []byte, off int64) (int, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.handle == windows.InvalidHandle {
+		return 0, &os.PathError{Op: "read", Path: f.path, Err: os.ErrClosed}
+	}
+	event, ok := unbufferedEvents.Get().(windows.Handle)
+	if !ok {
+		var err error
+		// manual reset, ReadFile resets it when the read is started
+		event, err = windows.CreateEvent(nil, 1, 0, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer unbufferedEvents.Put(event)
+
+	total := 0
+	for total < len(b) {
+		pos := off + int64(total)
+		overlapped := windows.Overlapped{
+			Offset:     uint32(pos),
+			OffsetHigh: uint32(pos >> 32),
+			HEvent:     event,
+		}
+		var done uint32
+		err := windows.ReadFile(f.handle, b[total:], &done, &overlapped)
+		if err == windows.ERROR_IO_PENDING {
+			err = windows.GetOverlappedResult(f.handle, &overlapped, &done, true)
+		}
+		if err == windows.ERROR_HANDLE_EOF || (err == nil && done == 0) {
+			break
+		}
+		if err != nil {
+			return total, &os.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		total += int(done)
+		if done%unbufferedAlignment != 0 {
+			// only the last sector of file can be partial
+			break
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,68 @@
+package mayafs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseByteSize parses size like "1048576", "512K", "100M" or "2GiB" (binary units).
+func ParseByteSize(s string) (int64, error) {
+	orig := s
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", orig)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// ParseByteRate parses bytes per second like "50MiB/s" (same as ParseByteSize, "/s" is optional).
+func ParseByteRate(s string) (int64, error) {
+	return ParseByteSize(strings.TrimSuffix(s, "/s"))
+}
+
+// RateLimiter paces operations to BytesPerSec. nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	BytesPerSec int64
+	mutex       sync.Mutex
+	next        time.Time
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{BytesPerSec: bytesPerSec}
+}
+
+// Wait blocks until n bytes can be transferred.
+func (r *RateLimiter) Wait(n int) {
+	if r == nil || r.BytesPerSec <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(int64(n) * int64(time.Second) / r.BytesPerSec))
+	r.mutex.Unlock()
+	time.Sleep(wait)
+}
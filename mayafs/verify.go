@@ -0,0 +1,54 @@
+package mayafs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var ErrNoChecksum = errors.New("no checksum to verify")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// VerifyMarFile checks compressed body of file in .mar with chunks_sha256 (or chunks_crc32 if sha256 is missing),
+// so it doesn't need to decompress chunks.
+// beforeRead is called before reading each chunk (e.g. to wait until apps are idle), and can be nil.
+func (fs *FS) VerifyMarFile(file *FileInfo, beforeRead func(size int)) error {
+	entry := file.MarEntry
+	if entry == nil {
+		return fmt.Errorf("not a mar entry")
+	}
+	info := entry.Info
+	if len(info.ChunksSha256) == 0 && info.ChunksCrc32 == 0 {
+		return ErrNoChecksum
+	}
+
+	pool := fs.ArchiveReader(file.DatPath())
+	sha := sha256.New()
+	crc := crc32.NewIEEE()
+	offset := int64(entry.BodyOffset)
+	for _, chunk := range info.Chunks {
+		if beforeRead != nil {
+			beforeRead(int(chunk.CompressedLength))
+		}
+		buf := make([]byte, chunk.CompressedLength)
+		if _, err := pool.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+		sha.Write(buf)
+		crc.Write(buf)
+		offset += int64(chunk.CompressedLength)
+	}
+
+	if len(info.ChunksSha256) != 0 {
+		if !bytes.Equal(sha.Sum(nil), info.ChunksSha256) {
+			return fmt.Errorf("%w (sha256): %s", ErrChecksumMismatch, info.Path)
+		}
+		return nil
+	}
+	if crc.Sum32() != info.ChunksCrc32 {
+		return fmt.Errorf("%w (crc32): %s", ErrChecksumMismatch, info.Path)
+	}
+	return nil
+}
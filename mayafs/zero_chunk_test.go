@@ -0,0 +1,70 @@
+package mayafs
+
+import (
+	"bytes"
+	"testing"
+
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+func TestReadZeroChunks(t *testing.T) {
+	chunks := []testChunk{
+		{Method: pb.CompressedMethod_ZSTANDARD, Data: testPattern(4096, 1)},
+		{Method: pb.CompressedMethod_ZERO, Data: make([]byte, 4096)},
+		{Method: pb.CompressedMethod_ZERO, Data: make([]byte, 1000)},
+		{Method: pb.CompressedMethod_PASSTHROUGH, Data: testPattern(3000, 2)},
+		{Method: pb.CompressedMethod_ZERO, Data: make([]byte, 123)},
+	}
+	want := concatChunks(chunks)
+	for _, v1 := range []bool{true, false} {
+		fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+			{Path: "sparse.bin", Chunks: chunks},
+			// ZERO chunks have no payload, so next file starts right after last chunk which has one
+			{Path: "after.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_PASSTHROUGH, Data: testPattern(100, 3)}}},
+		}, testMarOptions{V1: v1}))
+		for _, readSize := range []int{1, 777, 4096, len(want)} {
+			if got := readAll(t, fs, "/sparse.bin", 0, readSize); !bytes.Equal(got, want) {
+				t.Fatalf("v1=%v read size %d: content mismatch", v1, readSize)
+			}
+		}
+		// starts in ZERO chunk and ends in passthrough chunk
+		if got := readAll(t, fs, "/sparse.bin", 5000, 2500); !bytes.Equal(got, want[5000:]) {
+			t.Fatalf("v1=%v: content mismatch from middle of ZERO chunk", v1)
+		}
+		if got := readAll(t, fs, "/after.bin", 0, 4096); !bytes.Equal(got, testPattern(100, 3)) {
+			t.Fatalf("v1=%v: file after ZERO chunks is broken", v1)
+		}
+	}
+}
+
+func TestReadZeroChunkOverwritesBuffer(t *testing.T) {
+	fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "zero.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZERO, Data: make([]byte, 100)}}},
+	}, testMarOptions{}))
+	buf := bytes.Repeat([]byte{0xff}, 200)
+	readed, err := fs.ReadFileAt("/zero.bin", buf, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readed != 90 {
+		t.Fatalf("readed = %d, want 90", readed)
+	}
+	if !bytes.Equal(buf[:90], make([]byte, 90)) || buf[90] != 0xff {
+		t.Fatal("buffer is not zero filled only for the chunk")
+	}
+}
+
+func TestCacheZeroChunk(t *testing.T) {
+	fs := loadTestMar(t, writeTestMar(t, t.TempDir(), []testMarFile{
+		{Path: "zero.bin", Chunks: []testChunk{{Method: pb.CompressedMethod_ZERO, Data: make([]byte, 100)}}},
+	}, testMarOptions{}))
+	file, _ := fs.GetFile("/zero.bin")
+	cached, err := fs.CacheMarChunk(&file, 0)
+	if err != nil || cached != 0 {
+		t.Fatalf("ZERO chunk shouldn't be cached: %d %v", cached, err)
+	}
+	decoded, err := DecodeChunk(file.MarEntry.Info.Chunks[0], nil)
+	if err != nil || !bytes.Equal(decoded, make([]byte, 100)) {
+		t.Fatalf("DecodeChunk of ZERO chunk: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package mayafs
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const ZIP_INDEX_CACHE_SUFFIX = ".mayakashi-idx"
+const ZIP_INDEX_CACHE_VERSION = 1
+
+// ZipEntry is a minimal representation of zip.File, which can be saved to sidecar index cache.
+type ZipEntry struct {
+	Name               string
+	NonUTF8            bool
+	IsDir              bool
+	Method             uint16
+	CRC32              uint32
+	CompressedSize64   uint64
+	UncompressedSize64 uint64
+	DataOffset         int64
+	Modified           time.Time
+}
+
+type zipIndexCache struct {
+	Version  int
+	ZipSize  int64
+	ZipMtime time.Time
+	Entries  []ZipEntry
+}
+
+func (e *ZipEntry) Size() int64 {
+	return int64(e.UncompressedSize64)
+}
+
+// OpenRaw returns a reader for (maybe compressed) body of entry.
+func (e *ZipEntry) OpenRaw(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, e.DataOffset, int64(e.CompressedSize64))
+}
+
+// Open returns a reader for decompressed body of entry.
+func (e *ZipEntry) Open(r io.ReaderAt) (io.ReadCloser, error) {
+	switch e.Method {
+	case zip.Store:
+		return io.NopCloser(e.OpenRaw(r)), nil
+	case zip.Deflate:
+		return newFlateReader(e.OpenRaw(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression method: %d", e.Method)
+}
+
+func zipIndexCachePath(file string) string {
+	return file + ZIP_INDEX_CACHE_SUFFIX
+}
+
+func loadZipIndexCache(file string, stat os.FileInfo) ([]ZipEntry, error) {
+	data, err := os.ReadFile(zipIndexCachePath(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var cache zipIndexCache
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cache); err != nil {
+		return nil, err
+	}
+
+	if cache.Version != ZIP_INDEX_CACHE_VERSION {
+		return nil, fmt.Errorf("version mismatch (cache: %d, expected: %d)", cache.Version, ZIP_INDEX_CACHE_VERSION)
+	}
+
+	if cache.ZipSize != stat.Size() || !cache.ZipMtime.Equal(stat.ModTime()) {
+		return nil, fmt.Errorf("zip file was modified")
+	}
+
+	return cache.Entries, nil
+}
+
+func saveZipIndexCache(file string, stat os.FileInfo, entries []ZipEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(zipIndexCache{
+		Version:  ZIP_INDEX_CACHE_VERSION,
+		ZipSize:  stat.Size(),
+		ZipMtime: stat.ModTime(),
+		Entries:  entries,
+	}); err != nil {
+		return err
+	}
+
+	// write to temporary file first, to avoid leaving broken cache
+	tmpPath := zipIndexCachePath(file) + WRITEBACK_SUFFIX
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, zipIndexCachePath(file)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func parseZipEntries(file string) ([]ZipEntry, error) {
+	zf, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zf.Close()
+
+	entries := make([]ZipEntry, 0, len(zf.File))
+	for _, f := range zf.File {
+		dataOffset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ZipEntry{
+			Name:               f.Name,
+			NonUTF8:            f.NonUTF8,
+			IsDir:              f.FileInfo().IsDir(),
+			Method:             f.Method,
+			CRC32:              f.CRC32,
+			CompressedSize64:   f.CompressedSize64,
+			UncompressedSize64: f.UncompressedSize64,
+			DataOffset:         dataOffset,
+			Modified:           f.FileInfo().ModTime(),
+		})
+	}
+
+	return entries, nil
+}
+
+// ReadZipEntries returns entries of zip file.
+// If useCache is true, it tries to use the sidecar index cache (and creates it if missing or outdated).
+func ReadZipEntries(file string, useCache bool) ([]ZipEntry, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if useCache {
+		entries, err := loadZipIndexCache(file, stat)
+		if err == nil {
+			return entries, nil
+		}
+		if !os.IsNotExist(err) {
+			fmt.Println("ignoring zip index cache", file, err)
+		}
+	}
+
+	entries, err := parseZipEntries(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if useCache {
+		if err := saveZipIndexCache(file, stat, entries); err != nil {
+			fmt.Println("failed to save zip index cache", file, err)
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,341 @@
+package mayafs
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	pb "github.com/rinsuki/mayakashi/proto"
+)
+
+// .zst files in zstd seekable format can be registered as sources directly.
+// "*.tar.zst" is treated as tar archive, and others are treated as single file (e.g. "foo.bin.zst" is mounted as "/foo.bin").
+// Reads only decompress frames which contains requested range, like seekable chunks in .mar.
+
+// ZstArchive is a seek table of .zst file.
+type ZstArchive struct {
+	File string
+	// if nil, File is read through FilePool (which keeps files opened, so it must not be used for files which might be replaced)
+	Reader io.ReaderAt
+	// prefix of chunk cache keys, which contains size and modified time since the file might be rewritten (e.g. overlay files)
+	cacheKey string
+	// offsets of each frame, and end of frames as last element
+	CompressedOffsets   []int64
+	DecompressedOffsets []int64
+}
+
+// ZstEntry is a file in .zst, either member of tar or whole decompressed content.
+type ZstEntry struct {
+	Archive *ZstArchive
+	Name    string
+	// offset in decompressed content
+	Offset   int64
+	Size     int64
+	Modified time.Time
+}
+
+func (a *ZstArchive) frameCount() int {
+	return len(a.DecompressedOffsets) - 1
+}
+
+// Size returns size of whole decompressed content.
+func (a *ZstArchive) Size() int64 {
+	return a.DecompressedOffsets[a.frameCount()]
+}
+
+// OpenZstArchive reads seek table of .zst file in zstd seekable format.
+func OpenZstArchive(file string) (*ZstArchive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, seekTableFooterSize)
+	if stat.Size() < int64(len(footer)) {
+		return nil, fmt.Errorf("too small for zstd seekable format: %s", file)
+	}
+	if _, err := f.ReadAt(footer, stat.Size()-int64(len(footer))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:9]) != zstdSeekableMagic {
+		return nil, fmt.Errorf("not a zstd seekable format (seek table not found): %s", file)
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	descriptor := footer[4]
+	if descriptor&0x7c != 0 {
+		return nil, fmt.Errorf("invalid seek table descriptor: %#x", descriptor)
+	}
+	entrySize := int64(8)
+	if descriptor&0x80 != 0 {
+		// each entry has checksum of decompressed frame, we don't use it
+		entrySize = 12
+	}
+
+	tableSize := seekTableHeaderSize + frames*entrySize + seekTableFooterSize
+	if tableSize > stat.Size() {
+		return nil, fmt.Errorf("invalid seek table size: %s", file)
+	}
+	table := make([]byte, tableSize)
+	if _, err := f.ReadAt(table, stat.Size()-tableSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:4]) != zstdSkippableFrameMagic || int64(binary.LittleEndian.Uint32(table[4:8])) != tableSize-seekTableHeaderSize {
+		return nil, fmt.Errorf("invalid seek table: skippable frame header mismatch: %s", file)
+	}
+
+	archive := &ZstArchive{
+		File:                file,
+		cacheKey:            fmt.Sprintf("%s#zst#%d#%d", file, stat.Size(), stat.ModTime().UnixNano()),
+		CompressedOffsets:   make([]int64, frames+1),
+		DecompressedOffsets: make([]int64, frames+1),
+	}
+	for i := int64(0); i < frames; i++ {
+		entry := table[seekTableHeaderSize+i*entrySize:]
+		archive.CompressedOffsets[i+1] = archive.CompressedOffsets[i] + int64(binary.LittleEndian.Uint32(entry[0:4]))
+		archive.DecompressedOffsets[i+1] = archive.DecompressedOffsets[i] + int64(binary.LittleEndian.Uint32(entry[4:8]))
+	}
+	if archive.CompressedOffsets[frames] != stat.Size()-tableSize {
+		return nil, fmt.Errorf("invalid seek table: compressed size mismatch: %s", file)
+	}
+	return archive, nil
+}
+
+// readZstFrame returns decompressed frame of .zst, from chunk cache if possible.
+// path is the file which the frame is read for (see setChunkCache).
+func (fs *FS) readZstFrame(path string, archive *ZstArchive, frameNo int) ([]byte, error) {
+	cacheKey := fmt.Sprintf("%s#%d", archive.cacheKey, frameNo)
+	if cached, ok := fs.getChunkCache(cacheKey); ok {
+		return cached.Data, nil
+	}
+
+	compressedBytes := GetBuffer(int(archive.CompressedOffsets[frameNo+1] - archive.CompressedOffsets[frameNo]))
+	defer PutBuffer(compressedBytes)
+	fs.LastDatRead = time.Now()
+	reader := archive.Reader
+	if reader == nil {
+		reader = fs.ArchiveReader(archive.File)
+	}
+	if _, err := reader.ReadAt(compressedBytes, archive.CompressedOffsets[frameNo]); err != nil {
+		return nil, fmt.Errorf("failed to ReadAt compressed frame: %w", err)
+	}
+	frameLength := archive.DecompressedOffsets[frameNo+1] - archive.DecompressedOffsets[frameNo]
+	decoded, err := DecodeChunk(&pb.ChunkInfo{
+		CompressedLength: uint32(len(compressedBytes)),
+		OriginalLength:   uint32(frameLength),
+		CompressedMethod: pb.CompressedMethod_ZSTANDARD,
+	}, compressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) != frameLength {
+		return nil, fmt.Errorf("invalid decoded frame size: %d != %d", len(decoded), frameLength)
+	}
+	fs.setChunkCache(path, cacheKindMar, cacheKey, &ChunkCache{
+		ChunkNo: frameNo,
+		Data:    decoded,
+	})
+	return decoded, nil
+}
+
+// ReadZstAt reads decompressed content of .zst from offset, until end of the frame.
+func (fs *FS) ReadZstAt(archive *ZstArchive, buff []byte, offset int64) (int, error) {
+	return fs.readZstAt("", archive, buff, offset)
+}
+
+func (fs *FS) readZstAt(path string, archive *ZstArchive, buff []byte, offset int64) (int, error) {
+	frames := archive.frameCount()
+	frameNo := sort.Search(frames, func(i int) bool { return archive.DecompressedOffsets[i+1] > offset })
+	if frameNo >= frames {
+		return 0, nil
+	}
+	frame, err := fs.readZstFrame(path, archive, frameNo)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buff, frame[offset-archive.DecompressedOffsets[frameNo]:]), nil
+}
+
+func (fs *FS) readFromZstEntry(path string, buff []byte, offset int64, file *FileInfo) (int, error) {
+	entry := file.ZstEntry
+	if offset >= entry.Size {
+		return 0, nil
+	}
+	if remains := entry.Size - offset; int64(len(buff)) > remains {
+		buff = buff[:remains]
+	}
+	return fs.readZstAt(path, entry.Archive, buff, entry.Offset+offset)
+}
+
+// zstReaderAt is io.ReaderAt of decompressed content, for reading tar headers.
+type zstReaderAt struct {
+	fs      *FS
+	archive *ZstArchive
+}
+
+func (r *zstReaderAt) ReadAt(buff []byte, offset int64) (int, error) {
+	readed := 0
+	for readed < len(buff) {
+		n, err := r.fs.ReadZstAt(r.archive, buff[readed:], offset+int64(readed))
+		if err != nil {
+			return readed, err
+		}
+		if n == 0 {
+			return readed, io.EOF
+		}
+		readed += n
+	}
+	return readed, nil
+}
+
+func (fs *FS) readZstFile(file string, o ArchiveReadOptions) (*LoadedArchive, error) {
+	// set before reading tar headers, since they are also read from the archive
+	fs.setArchiveReadLimiter(file, o.ReadLimiter)
+	archive, err := OpenZstArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(file), ".zst")
+	la := &LoadedArchive{
+		File:       file,
+		Options:    o,
+		ZstEntries: []*ZstEntry{},
+		DataFiles:  []string{file},
+	}
+	if !strings.HasSuffix(name, ".tar") {
+		la.ZstEntries = append(la.ZstEntries, &ZstEntry{
+			Archive:  archive,
+			Name:     name,
+			Size:     archive.Size(),
+			Modified: stat.ModTime(),
+		})
+		return la, nil
+	}
+
+	// SectionReader implements io.Seeker, so tar.Reader skips bodies without decompressing them (except its last byte)
+	sr := io.NewSectionReader(&zstReaderAt{fs: fs, archive: archive}, 0, archive.Size())
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			la.Dirs = append(la.Dirs, ArchiveDir{
+				Name:     strings.TrimPrefix(path.Clean("/"+hdr.Name), "/"),
+				Modified: hdr.ModTime,
+			})
+			continue
+		}
+		// links are not supported
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeGNUSparse || len(hdr.PAXRecords["GNU.sparse.map"]) > 0 || hdr.PAXRecords["GNU.sparse.major"] != "" {
+			fmt.Println("sparse file in tar is not supported, skipping", hdr.Name)
+			continue
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		la.ZstEntries = append(la.ZstEntries, &ZstEntry{
+			Archive:  archive,
+			Name:     strings.TrimPrefix(path.Clean("/"+hdr.Name), "/"),
+			Offset:   offset,
+			Size:     hdr.Size,
+			Modified: hdr.ModTime,
+		})
+	}
+	return la, nil
+}
+
+func (fs *FS) applyZstFile(b *treeBuilder, la *LoadedArchive) int {
+	o := la.Options
+
+	fileCount := 0
+	for _, e := range la.ZstEntries {
+		origPath := o.GetFilePath(e.Name)
+		if origPath == "" {
+			continue
+		}
+
+		if fs.putFile(b, origPath, FileInfo{
+			ZstEntry:    e,
+			ArchiveFile: la.File,
+			Priority:    o.Priority,
+		}) {
+			fileCount += 1
+		}
+	}
+
+	return fileCount
+}
+
+// WriteZstSeekable compresses src into dst in zstd seekable format, with frames of frameSize bytes (except last one).
+// It returns size of written data.
+func WriteZstSeekable(dst io.Writer, src io.Reader, frameSize int) (int64, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer encoder.Close()
+
+	buf := make([]byte, frameSize)
+	compressed := []byte{}
+	entries := []byte{}
+	frames := 0
+	written := int64(0)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			compressed = encoder.EncodeAll(buf[:n], compressed[:0])
+			if _, err := dst.Write(compressed); err != nil {
+				return written, err
+			}
+			written += int64(len(compressed))
+			entries = binary.LittleEndian.AppendUint32(entries, uint32(len(compressed)))
+			entries = binary.LittleEndian.AppendUint32(entries, uint32(n))
+			frames++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	table := make([]byte, 0, seekTableHeaderSize+len(entries)+seekTableFooterSize)
+	table = binary.LittleEndian.AppendUint32(table, zstdSkippableFrameMagic)
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(entries)+seekTableFooterSize))
+	table = append(table, entries...)
+	table = binary.LittleEndian.AppendUint32(table, uint32(frames))
+	// descriptor: no checksums
+	table = append(table, 0)
+	table = binary.LittleEndian.AppendUint32(table, zstdSeekableMagic)
+	if _, err := dst.Write(table); err != nil {
+		return written, err
+	}
+	return written + int64(len(table)), nil
+}
@@ -0,0 +1,88 @@
+use std::{io::Write, path::PathBuf};
+
+use clap::Parser;
+
+use crate::{format::mar, util::normalize_archive_path};
+
+#[derive(Parser)]
+#[command(name = "MAR Cat")]
+pub struct Args {
+    /// .mar or .zip files, later one overrides earlier one (same as marmounter)
+    #[arg(short, long, required = true)]
+    input: Vec<PathBuf>,
+
+    /// Path in archive (case insensitive)
+    path: String,
+}
+
+enum Found {
+    // already written to stdout
+    Written,
+    Whiteout,
+    NotFound,
+}
+
+fn find_in_mar(input: &PathBuf, path: &str) -> Found {
+    let index = mar::read_index(input);
+    let whiteout_path = format!("{}{}", path, mar::WHITEOUT_SUFFIX);
+    let mut whiteouted = false;
+    for entry in &index.entries {
+        let info = entry.info.as_ref().unwrap();
+        let entry_path = normalize_archive_path(&info.path).to_lowercase();
+        if entry_path == path {
+            let mut stdout = std::io::stdout().lock();
+            let matched = mar::MarReader::new(input).write_entry(entry, &mut stdout).unwrap();
+            stdout.flush().unwrap();
+            if !matched {
+                // written data is broken, but it can't be taken back
+                eprintln!("hash mismatch: {}", info.path);
+                std::process::exit(1);
+            }
+            return Found::Written;
+        }
+        if entry_path == whiteout_path {
+            whiteouted = true;
+        }
+    }
+    match whiteouted {
+        true => Found::Whiteout,
+        false => Found::NotFound,
+    }
+}
+
+fn find_in_zip(input: &PathBuf, path: &str) -> Found {
+    let mut archive = zip::ZipArchive::new(std::fs::File::open(input).unwrap()).unwrap();
+    for i in 0..archive.len() {
+        let mut file = archive.by_index(i).unwrap();
+        if file.is_dir() || normalize_archive_path(file.name()).to_lowercase() != path {
+            continue;
+        }
+        let mut stdout = std::io::stdout().lock();
+        // zip crate checks crc32 at the end of the entry
+        std::io::copy(&mut file, &mut stdout).unwrap();
+        stdout.flush().unwrap();
+        return Found::Written;
+    }
+    Found::NotFound
+}
+
+pub fn main(args: Args) {
+    let path = normalize_archive_path(&args.path).to_lowercase();
+
+    // search from the top layer
+    for input in args.input.iter().rev() {
+        let found = match input.extension().and_then(|e| e.to_str()) {
+            Some("mar") => find_in_mar(input, &path),
+            Some("zip") => find_in_zip(input, &path),
+            _ => panic!("unknown file type (filename suffix): {}", input.display()),
+        };
+        match found {
+            Found::Written => return,
+            Found::Whiteout => break,
+            Found::NotFound => continue,
+        }
+    }
+
+    eprintln!("not found: {}", args.path);
+    std::process::exit(1);
+}
@@ -1,9 +1,9 @@
-use std::{collections::{BTreeMap, HashMap, HashSet, VecDeque}, ffi::OsString, io::{Read, Seek, Write}, path::PathBuf, sync::{Arc, Mutex}, thread};
+use std::{collections::{BTreeMap, HashMap, HashSet, VecDeque}, ffi::OsString, io::{Read, Seek, Write}, path::PathBuf, sync::{mpsc, Arc, Condvar, Mutex}, thread};
 
 use prost::Message;
 use clap::Parser;
 
-use crate::{format::index_file, proto::{self, CompressedMethod}};
+use crate::{cmd::parity::{update_parity, ParityArgs}, format::{index_file, mar::DatWriter, tar::{TarEntry, TarEntryKind, TarReader}}, proto::{self, CompressedMethod}, util::{append_to_path, format_duration, format_size, parse_size, split_glob_rule, GlobRules}};
 
 use rayon::prelude::*;
 
@@ -16,53 +16,450 @@ pub struct Args {
     #[arg(short, long)]
     output: PathBuf,
 
-    #[arg(short, long)]
+    /// Number of threads which compress files (default: number of CPUs)
+    #[arg(short, long, default_value_t = std::thread::available_parallelism().map(|n| n.get()).unwrap_or(1))]
     jobs: usize,
 
+    /// Number of threads which read input files
+    #[arg(long, default_value_t = 2)]
+    read_jobs: usize,
+
     #[arg(long)]
     dedup: bool,
+
+    /// Append new/changed files to existing archive (writes new .dat part and updates .idx)
+    #[arg(long)]
+    append: bool,
+
+    /// Write zstd chunks as zstd seekable format with this frame size (in bytes), so readers can decompress only needed frames (0 to disable)
+    #[arg(long, default_value_t = 0)]
+    seekable_frame_size: usize,
+
+    /// Max size of each .dat part (e.g. 4294967295 for FAT32, K/M/G suffixes are accepted), new part is started when it exceeds (0 for unlimited)
+    #[arg(long, value_parser = parse_size, default_value_t = 0)]
+    max_dat_size: u64,
+
+    /// Number of .dat parts to write at same time, bodies are balanced between them (e.g. to place parts on different disks)
+    #[arg(long, default_value_t = 1)]
+    dat_parts: usize,
+
+    #[command(flatten)]
+    compress: CompressArgs,
+
+    #[command(flatten)]
+    archive_metadata: ArchiveMetadataArgs,
+
+    #[command(flatten)]
+    parity: ParityArgs,
+
+    /// Record mode, uid/gid (Unix), file attributes (Windows) and symbolic links (instead of following them) of input files
+    #[arg(long)]
+    metadata: bool,
+
+    /// Record this time (in UNIX seconds) as modified time of all files and directories, for reproducible output (e.g. $SOURCE_DATE_EPOCH)
+    #[arg(long)]
+    mtime: Option<u64>,
+
+    /// Resume interrupted packing from <output>.mar.checkpoint (with same options as interrupted one)
+    #[arg(long)]
+    resume: bool,
+
+    /// Write <output>.mar.checkpoint every this seconds, so interrupted packing can be resumed with --resume (0 to disable)
+    #[arg(long, default_value_t = 60)]
+    checkpoint_interval: u64,
+
+    /// Don't print progress
+    #[arg(short, long, conflicts_with = "progress_json")]
+    quiet: bool,
+
+    /// Print progress as JSON lines (one event per line) to stdout instead of human readable messages, for GUI frontends
+    #[arg(long)]
+    progress_json: bool,
 }
 
 #[derive(Debug)]
-struct FileInfo {
-    path: PathBuf,
-    size: u64,
+pub struct FileInfo {
+    pub path: PathBuf,
+    pub size: u64,
+    // only set when keep_symlinks is true
+    pub symlink_target: Option<String>,
 }
 
 
-fn walk_dir(dir: &PathBuf) -> (Vec<FileInfo>, Vec<PathBuf>) {
+// if keep_symlinks is true, symbolic links are returned as files with symlink_target instead of following them
+pub fn walk_dir(dir: &PathBuf, keep_symlinks: bool) -> (Vec<FileInfo>, Vec<PathBuf>) {
     let mut files = Vec::new();
     let mut directories = Vec::new();
     for entry in dir.read_dir().unwrap() {
         let entry = entry.unwrap();
         let path = entry.path();
-        if path.is_dir() {
-            let (mut f, mut d) = walk_dir(&path);
+        if keep_symlinks && entry.file_type().unwrap().is_symlink() {
+            let target = std::fs::read_link(&path).unwrap().to_str().unwrap().to_string();
+            files.push(FileInfo { path, size: 0, symlink_target: Some(target) });
+        } else if path.is_dir() {
+            let (mut f, mut d) = walk_dir(&path, keep_symlinks);
             directories.push(path);
             directories.append(&mut d);
             files.append(&mut f);
         } else {
-            files.push(FileInfo { path: entry.path(), size: entry.metadata().unwrap().len() });
+            files.push(FileInfo { path: entry.path(), size: entry.metadata().unwrap().len(), symlink_target: None });
         }
     }
     return (files, directories);
 }
 
-const CHUNK_SIZE: usize = 512 * 1024;
+// metadata of input file, which is taken from filesystem or tar header
+#[derive(Clone)]
+struct InputMetadata {
+    modified_time: std::time::SystemTime,
+    mode: Option<u32>,
+    uid: Option<u32>,
+    gid: Option<u32>,
+    windows_attributes: u32,
+}
+
+impl InputMetadata {
+    fn from_fs(metadata: &std::fs::Metadata) -> Self {
+        #[allow(unused_mut)]
+        let mut m = Self {
+            modified_time: metadata.modified().unwrap(),
+            mode: None,
+            uid: None,
+            gid: None,
+            windows_attributes: 0,
+        };
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::MetadataExt;
+            m.mode = Some(metadata.mode() & 0o7777);
+            m.uid = Some(metadata.uid());
+            m.gid = Some(metadata.gid());
+        }
+        #[cfg(windows)]
+        {
+            use std::os::windows::fs::MetadataExt;
+            m.windows_attributes = metadata.file_attributes();
+        }
+        m
+    }
+
+    fn from_tar(entry: &TarEntry) -> Self {
+        Self {
+            modified_time: entry.modified_time,
+            mode: Some(entry.mode & 0o7777),
+            uid: Some(entry.uid),
+            gid: Some(entry.gid),
+            windows_attributes: 0,
+        }
+    }
+}
+
+// record metadata of original file to entry (--metadata)
+fn apply_metadata(entry: &mut proto::FileEntry, metadata: &InputMetadata) {
+    entry.mode = metadata.mode;
+    entry.uid = metadata.uid;
+    entry.gid = metadata.gid;
+    entry.windows_attributes = metadata.windows_attributes;
+}
+
+// chunk size is stored in u32, and file which is smaller than SINGLE_CHUNK_MAX_CHUNKS chunks is stored as single chunk
+const MAX_CHUNK_SIZE: u64 = 256 * 1024 * 1024;
+const SINGLE_CHUNK_MAX_CHUNKS: usize = 16;
+
+fn parse_chunk_size(s: &str) -> Result<u64, String> {
+    let size = parse_size(s)?;
+    if size == 0 || size > MAX_CHUNK_SIZE {
+        return Err(format!("chunk size must be between 1 and {} bytes: {}", MAX_CHUNK_SIZE, s));
+    }
+    Ok(size)
+}
+
+fn parse_chunk_size_rule(s: &str) -> Result<(String, u64), String> {
+    let (glob, size) = split_glob_rule(s)?;
+    Ok((glob, parse_chunk_size(&size)?))
+}
+
+/// Compression method which is forced by --compression-rule
+#[derive(Clone, Copy, Debug)]
+pub enum CompressionRule {
+    // lz4 for small files and first chunk, zstd for others (default)
+    Auto,
+    Passthrough,
+    Lz4,
+    // level (1-22)
+    Zstd(i32),
+}
+
+fn parse_compression_method(s: &str) -> Result<CompressionRule, String> {
+    match s.to_ascii_lowercase().as_str() {
+        "auto" => Ok(CompressionRule::Auto),
+        "passthrough" | "store" => Ok(CompressionRule::Passthrough),
+        "lz4" => Ok(CompressionRule::Lz4),
+        "zstd" => Ok(CompressionRule::Zstd(22)),
+        m => match m.strip_prefix("zstd-").and_then(|l| l.parse::<i32>().ok()) {
+            Some(level) if (1..=22).contains(&level) => Ok(CompressionRule::Zstd(level)),
+            _ => Err(format!("compression method must be auto, passthrough, lz4, zstd or zstd-<1-22>: {}", s)),
+        },
+    }
+}
+
+fn parse_compression_rule(s: &str) -> Result<(String, CompressionRule), String> {
+    let (glob, method) = split_glob_rule(s)?;
+    Ok((glob, parse_compression_method(&method)?))
+}
+
+/// Compression options shared by create and zip2mar
+#[derive(clap::Args)]
+pub struct CompressArgs {
+    /// Size of chunks (K/M/G suffixes are accepted), smaller one makes random access faster but compression ratio worse
+    #[arg(long, value_parser = parse_chunk_size, default_value = "512K")]
+    chunk_size: u64,
+
+    /// Override chunk size for files which match the glob (e.g. "**/*.ogg=128K"), can be specified multiple times (later one wins)
+    #[arg(long = "chunk-size-rule", value_parser = parse_chunk_size_rule)]
+    chunk_size_rules: Vec<(String, u64)>,
+
+    /// Force compression method (auto, passthrough, lz4, zstd or zstd-<level>) for files which match the glob (e.g. "**/*.ogg=passthrough"), can be specified multiple times (later one wins)
+    #[arg(long = "compression-rule", value_parser = parse_compression_rule)]
+    compression_rules: Vec<(String, CompressionRule)>,
+
+    /// Store chunks as is without compressing them, if trial compression of their samples saves less than this percent (0 to disable, only for auto method)
+    #[arg(long, default_value_t = 5, value_parser = clap::value_parser!(u32).range(0..100))]
+    passthrough_threshold: u32,
+}
+
+/// Archive-level metadata (recorded in .mar.idx and shown by marmounter), shared by create and zip2mar
+#[derive(clap::Args)]
+pub struct ArchiveMetadataArgs {
+    /// Name of the archive
+    #[arg(long)]
+    name: Option<String>,
+
+    /// Version string of the archive
+    #[arg(long)]
+    archive_version: Option<String>,
+
+    /// Description of the archive
+    #[arg(long)]
+    description: Option<String>,
+
+    /// Build (version) of the game which files are taken from
+    #[arg(long)]
+    source_build: Option<String>,
+}
+
+impl ArchiveMetadataArgs {
+    /// Returns metadata to record, fields which aren't specified are taken from existing one (on append mode).
+    /// None if neither of them is specified, so archives stay same as before unless asked.
+    pub fn to_proto(&self, existing: Option<proto::ArchiveMetadata>, created_time: std::time::SystemTime) -> Option<proto::ArchiveMetadata> {
+        let specified = self.name.is_some() || self.archive_version.is_some() || self.description.is_some() || self.source_build.is_some();
+        if !specified && existing.is_none() {
+            return None;
+        }
+        let existing = existing.unwrap_or_default();
+        Some(proto::ArchiveMetadata {
+            name: self.name.clone().unwrap_or(existing.name),
+            version: self.archive_version.clone().unwrap_or(existing.version),
+            description: self.description.clone().unwrap_or(existing.description),
+            source_build: self.source_build.clone().unwrap_or(existing.source_build),
+            created_by: format!("mayakashi {}", env!("CARGO_PKG_VERSION")),
+            created_time: Some(prost_types::Timestamp::from(created_time)),
+        })
+    }
+}
+
+/// Options of compress_file for a file
+#[derive(Clone, Copy)]
+pub struct CompressOptions {
+    pub chunk_size: usize,
+    pub seekable_frame_size: usize,
+    pub method: CompressionRule,
+    pub passthrough_threshold: u32,
+}
+
+/// CompressArgs which can be resolved for each file
+pub struct CompressRules {
+    default: CompressOptions,
+    chunk_sizes: GlobRules<u64>,
+    methods: GlobRules<CompressionRule>,
+}
+
+impl CompressRules {
+    pub fn new(args: &CompressArgs, seekable_frame_size: usize) -> Self {
+        Self {
+            default: CompressOptions { chunk_size: args.chunk_size as usize, seekable_frame_size, method: CompressionRule::Auto, passthrough_threshold: args.passthrough_threshold },
+            chunk_sizes: GlobRules::new(&args.chunk_size_rules),
+            methods: GlobRules::new(&args.compression_rules),
+        }
+    }
 
-struct Chunk {
+    pub fn options_for(&self, path: &str) -> CompressOptions {
+        let mut options = self.default;
+        if let Some(&chunk_size) = self.chunk_sizes.get(path) {
+            options.chunk_size = chunk_size as usize;
+        }
+        if let Some(&method) = self.methods.get(path) {
+            options.method = method;
+        }
+        options
+    }
+}
+
+pub struct Chunk {
     start: usize,
     original_size: usize,
     compressed: Vec<u8>,
     compressed_method: CompressedMethod,
     // using_dictionary: bool,
+    seekable_frame_size: usize,
 }
 
 static RAYON_LOCK: Mutex<()> = Mutex::new(());
 
-fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
+const ZSTD_SKIPPABLE_FRAME_MAGIC: u32 = 0x184D2A5E;
+const ZSTD_SEEKABLE_MAGIC: u32 = 0x8F92EAB1;
+
+const ZSTD_DEFAULT_LEVEL: i32 = 22;
+
+// returns compressed data and seekable frame size (0 if it is not seekable)
+fn compress_zstd(src: &[u8], seekable_frame_size: usize, level: i32) -> (Vec<u8>, usize) {
+    if seekable_frame_size == 0 || src.len() <= seekable_frame_size {
+        let mut buf = Vec::<u8>::with_capacity(src.len() * 2);
+        let mut encoder = zstd::Encoder::new(&mut buf, level).unwrap();
+        encoder.write_all(src).unwrap();
+        encoder.finish().unwrap();
+        return (buf, 0);
+    }
+
+    // zstd seekable format (https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md)
+    // seek table is in skippable frame, so readers which doesn't know seekable format can decode whole chunk as usual
+    let mut buf = Vec::<u8>::with_capacity(src.len());
+    let mut frames = Vec::<(u32, u32)>::new();
+    for frame in src.chunks(seekable_frame_size) {
+        let compressed = zstd::encode_all(frame, level).unwrap();
+        frames.push((compressed.len() as u32, frame.len() as u32));
+        buf.extend_from_slice(&compressed);
+    }
+    buf.extend_from_slice(&ZSTD_SKIPPABLE_FRAME_MAGIC.to_le_bytes());
+    buf.extend_from_slice(&((frames.len() * 8 + 9) as u32).to_le_bytes());
+    for (compressed_size, decompressed_size) in &frames {
+        buf.extend_from_slice(&compressed_size.to_le_bytes());
+        buf.extend_from_slice(&decompressed_size.to_le_bytes());
+    }
+    buf.extend_from_slice(&(frames.len() as u32).to_le_bytes());
+    buf.push(0); // descriptor (no checksums)
+    buf.extend_from_slice(&ZSTD_SEEKABLE_MAGIC.to_le_bytes());
+    (buf, seekable_frame_size)
+}
+
+// all-zero region (e.g. preallocated space in game files) is stored as ZERO chunk, which has no payload
+fn zero_chunk(start: usize, src: &[u8]) -> Option<Chunk> {
+    if src.is_empty() || src.iter().any(|&b| b != 0) {
+        return None;
+    }
+    Some(Chunk {
+        start,
+        original_size: src.len(),
+        compressed: Vec::new(),
+        compressed_method: CompressedMethod::Zero,
+        // using_dictionary: false,
+        seekable_frame_size: 0,
+    })
+}
+
+fn passthrough_chunk(start: usize, src: &[u8]) -> Chunk {
+    Chunk {
+        start,
+        original_size: src.len(),
+        compressed: src.to_vec(),
+        compressed_method: CompressedMethod::Passthrough,
+        // using_dictionary: false,
+        seekable_frame_size: 0,
+    }
+}
+
+// size of each sample, and number of samples which are taken from evenly spaced positions
+const TRIAL_SAMPLE_SIZE: usize = 16 * 1024;
+const TRIAL_SAMPLES: usize = 4;
+
+// compresses samples of src with fast zstd, to skip (slow) compression of data which barely shrinks (e.g. already compressed assets)
+fn looks_incompressible(src: &[u8], threshold_percent: u32) -> bool {
+    if threshold_percent == 0 || src.is_empty() {
+        return false;
+    }
+    let sample = match src.len() <= TRIAL_SAMPLE_SIZE * TRIAL_SAMPLES {
+        true => src.to_vec(),
+        false => {
+            let step = (src.len() - TRIAL_SAMPLE_SIZE) / (TRIAL_SAMPLES - 1);
+            let mut sample = Vec::with_capacity(TRIAL_SAMPLE_SIZE * TRIAL_SAMPLES);
+            for i in 0..TRIAL_SAMPLES {
+                sample.extend_from_slice(&src[i * step..i * step + TRIAL_SAMPLE_SIZE]);
+            }
+            sample
+        },
+    };
+    let compressed = zstd::encode_all(&sample[..], 1).unwrap();
+    compressed.len() as u64 * 100 > sample.len() as u64 * (100 - threshold_percent as u64)
+}
+
+// compresses chunk with method which is forced by --compression-rule, or stores as is if it doesn't get smaller
+fn compress_chunk_with(start: usize, src: &[u8], method: CompressionRule, seekable_frame_size: usize) -> Chunk {
+    if let Some(chunk) = zero_chunk(start, src) {
+        return chunk;
+    }
+    let (compressed, compressed_method, seekable_frame_size) = match method {
+        CompressionRule::Lz4 => (lz4::block::compress(src, Some(lz4::block::CompressionMode::HIGHCOMPRESSION(12)), false).unwrap(), CompressedMethod::Lz4, 0),
+        CompressionRule::Zstd(level) => {
+            let (compressed, seekable_frame_size) = compress_zstd(src, seekable_frame_size, level);
+            (compressed, CompressedMethod::Zstandard, seekable_frame_size)
+        },
+        CompressionRule::Passthrough | CompressionRule::Auto => (Vec::new(), CompressedMethod::Passthrough, 0),
+    };
+    if compressed_method == CompressedMethod::Passthrough || compressed.len() >= src.len() {
+        return passthrough_chunk(start, src);
+    }
+    Chunk {
+        start,
+        original_size: src.len(),
+        compressed,
+        compressed_method,
+        // using_dictionary: false,
+        seekable_frame_size,
+    }
+}
+
+pub fn compress_file(input_data: &[u8], options: &CompressOptions) -> Vec<Chunk> {
+    let chunk_size = options.chunk_size;
+    let seekable_frame_size = options.seekable_frame_size;
+    // 単一チャンクになるサイズなら、全体がゼロかだけ見る (大きいファイルはチャンク毎に見る)
+    if input_data.len() <= chunk_size * SINGLE_CHUNK_MAX_CHUNKS {
+        if let Some(chunk) = zero_chunk(0, input_data) {
+            return vec![chunk];
+        }
+    }
+
+    // --compression-rule で指定されている場合はその方式で圧縮する (チャンクの分け方はデフォルトと同じ)
+    if !matches!(options.method, CompressionRule::Auto) {
+        if input_data.len() <= chunk_size * SINGLE_CHUNK_MAX_CHUNKS {
+            return vec![compress_chunk_with(0, input_data, options.method, seekable_frame_size)];
+        }
+        let lock = RAYON_LOCK.lock();
+        let chunks = input_data
+            .chunks(chunk_size)
+            .enumerate()
+            .collect::<Vec<_>>()
+            .par_iter()
+            .map(|(i, src)| compress_chunk_with(i * chunk_size, src, options.method, seekable_frame_size))
+            .collect();
+        drop(lock);
+        return chunks;
+    }
+    // 試し圧縮でほとんど縮まないデータ (圧縮済みのアセットなど) は圧縮せずに素通しする
+    if input_data.len() <= chunk_size * SINGLE_CHUNK_MAX_CHUNKS && looks_incompressible(input_data, options.passthrough_threshold) {
+        return vec![passthrough_chunk(0, input_data)];
+    }
     // 小さいファイルはサクッと読みたさそうなので適当にlz4で圧縮する
-    if input_data.len() <= CHUNK_SIZE {
+    if input_data.len() <= chunk_size {
         let compressed_with_lz4 = lz4::block::compress(input_data, Some(lz4::block::CompressionMode::HIGHCOMPRESSION(12)), false).unwrap();
         if input_data.len() > compressed_with_lz4.len() {
             return vec![Chunk {
@@ -71,19 +468,14 @@ fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
                 compressed: compressed_with_lz4,
                 compressed_method: CompressedMethod::Lz4,
                 // using_dictionary: false,
+                seekable_frame_size: 0,
             }];
         }
     }
-    // 入力サイズが 8MB 以下の時はチャンク毎圧縮をしない (十分に小さいためシーク時の遅さを気にする必要がない…ことにする)
-    if input_data.len() <= 8 * 1024 * 1024 {
+    // 入力サイズがチャンク 16 個分 (デフォルトで 8MB) 以下の時はチャンク毎圧縮をしない (十分に小さいためシーク時の遅さを気にする必要がない…ことにする)
+    if input_data.len() <= chunk_size * SINGLE_CHUNK_MAX_CHUNKS {
         // input_data を Zstandard で圧縮したもの
-        let compressed_with_zstd = {
-            let mut buf = Vec::<u8>::with_capacity(input_data.len() * 2);
-            let mut encoder = zstd::Encoder::new(&mut buf, 22).unwrap();
-            encoder.write_all(&input_data).unwrap();
-            encoder.finish().unwrap();
-            buf
-        };
+        let (compressed_with_zstd, zstd_seekable_frame_size) = compress_zstd(input_data, seekable_frame_size, ZSTD_DEFAULT_LEVEL);
 
         // 圧縮成功したら圧縮したものを返す、そうでなかったらパススルー
         if input_data.len() > compressed_with_zstd.len() {
@@ -93,6 +485,7 @@ fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
                 compressed: compressed_with_zstd,
                 compressed_method: CompressedMethod::Zstandard,
                 // using_dictionary: false,
+                seekable_frame_size: zstd_seekable_frame_size,
             }];
         } else {
             return vec![Chunk {
@@ -101,36 +494,36 @@ fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
                 compressed: input_data.to_vec(),
                 compressed_method: CompressedMethod::Passthrough,
                 // using_dictionary: false,
+                seekable_frame_size: 0,
             }];
         }
     }
 
-    // 入力データを CHUNK_SIZE ずつに分割して圧縮する
+    // 入力データを chunk_size ずつに分割して圧縮する
     let mut chunks = Vec::<Chunk>::new();
     let mut sources = Vec::<(usize, &[u8])>::new();
-    for i in (0..input_data.len()).step_by(CHUNK_SIZE) {
+    for i in (0..input_data.len()).step_by(chunk_size) {
         // 範囲を取得
-        let end = (i + CHUNK_SIZE).min(input_data.len());
+        let end = (i + chunk_size).min(input_data.len());
         let src = &input_data[i..end];
         sources.push((i, src));
     };
 
     let lock = RAYON_LOCK.lock();
 
-    println!("start");
     let chunks = sources
         .par_iter()
         .map(|(i, src)| {
+            if let Some(chunk) = zero_chunk(*i, src) {
+                return chunk;
+            }
+            if looks_incompressible(src, options.passthrough_threshold) {
+                return passthrough_chunk(*i, src);
+            }
             let should_use_lz4 = *i == 0;
-            let compressed = match should_use_lz4 {
-                true => lz4::block::compress(src, Some(lz4::block::CompressionMode::HIGHCOMPRESSION(12)), false).unwrap(),
-                false => {
-                    let mut buf = Vec::<u8>::with_capacity(CHUNK_SIZE * 2);
-                    let mut encoder = zstd::Encoder::new(&mut buf, 22).unwrap();
-                    encoder.write_all(src).unwrap();
-                    encoder.finish().unwrap();
-                    buf
-                }
+            let (compressed, zstd_seekable_frame_size) = match should_use_lz4 {
+                true => (lz4::block::compress(src, Some(lz4::block::CompressionMode::HIGHCOMPRESSION(12)), false).unwrap(), 0),
+                false => compress_zstd(src, seekable_frame_size, ZSTD_DEFAULT_LEVEL),
             };
     
             let is_compressed = compressed.len() < (src.len() / 4 * 3);
@@ -146,6 +539,7 @@ fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
                         false => CompressedMethod::Zstandard
                     },
                     // using_dictionary: false,
+                    seekable_frame_size: zstd_seekable_frame_size,
                 }
             } else {
                 // 圧縮できなかった
@@ -155,224 +549,764 @@ fn compress_file(input_data: &[u8]) -> Vec<Chunk> {
                     compressed: src.to_vec(),
                     compressed_method: CompressedMethod::Passthrough,
                     // using_dictionary: false,
+                    seekable_frame_size: 0,
                 }
             }
         })
         .collect();
 
     drop(lock);
-    println!("end");
     return chunks;
 }
 
+// returns chunk infos and concatenated compressed body
+pub fn concat_chunks(chunks: Vec<Chunk>) -> (Vec<proto::ChunkInfo>, Vec<u8>) {
+    let mut chunk_infos = Vec::<proto::ChunkInfo>::with_capacity(chunks.len());
+    let mut compressed = Vec::new();
+    for mut chunk in chunks {
+        chunk_infos.push(proto::ChunkInfo {
+            compressed_length: chunk.compressed.len() as u32,
+            compressed_method: chunk.compressed_method as i32,
+            original_length: chunk.original_size as u32,
+            seekable_frame_size: chunk.seekable_frame_size as u32,
+        });
+        compressed.append(&mut chunk.compressed);
+    }
+    (chunk_infos, compressed)
+}
+
+// input file which is read by reader threads
+struct ReadFile {
+    seq: usize,
+    relative_path: String,
+    metadata: InputMetadata,
+    content: FileContent,
+}
+
+enum FileContent {
+    // symbolic link (only with --metadata), which doesn't have body
+    Symlink(String),
+    Body { data: Vec<u8>, original_crc32: u32, original_sha256: Vec<u8> },
+}
+
+// what compressor threads pass to the writer for each input file
+enum WriteItem {
+    Symlink(proto::FileEntry),
+    // unchanged file on append mode, which doesn't need body to be written
+    Unchanged(proto::FileEntry),
+    // entry and its compressed body, file_index and body_offset are filled by the writer
+    Body(proto::FileEntry, Vec<u8>),
+    // file which has same content as earlier one (--dedup), it points body of that file after all bodies are written
+    // (only path, modified_time, hashes and metadata of the entry are used)
+    Dedup(proto::FileEntry),
+}
+
+#[derive(Clone, Copy, PartialEq)]
+enum ProgressMode {
+    Human,
+    Quiet,
+    Json,
+}
+
+#[derive(serde::Serialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+enum ProgressEvent<'a> {
+    File {
+        path: &'a str,
+        // "compressed", "unchanged", "dedup" or "symlink"
+        status: &'a str,
+        size: u64,
+        written_size: u64,
+        chunks: usize,
+    },
+    Progress {
+        files_done: usize,
+        // null when reading tar from stdin
+        files_total: Option<usize>,
+        bytes_read: u64,
+        bytes_total: Option<u64>,
+        bytes_written: u64,
+        ratio: f64,
+        elapsed_ms: u64,
+        eta_ms: Option<u64>,
+    },
+    Done {
+        files: usize,
+        bytes_read: u64,
+        bytes_written: u64,
+        ratio: f64,
+        enc_ms: u64,
+        dec_ms: u64,
+    },
+}
+
+// reports progress of files which are written by the writer (so bytes_read counts only finished files)
+struct Progress {
+    mode: ProgressMode,
+    // unknown when reading tar from stdin
+    files_total: Option<usize>,
+    bytes_total: Option<u64>,
+    files_done: usize,
+    bytes_read: u64,
+    bytes_written: u64,
+    started: std::time::Instant,
+    last_report: Option<std::time::Instant>,
+}
+
+impl Progress {
+    fn new(mode: ProgressMode, files_total: Option<usize>, bytes_total: Option<u64>) -> Self {
+        Self {
+            mode,
+            files_total,
+            bytes_total,
+            files_done: 0,
+            bytes_read: 0,
+            bytes_written: 0,
+            started: std::time::Instant::now(),
+            last_report: None,
+        }
+    }
+
+    fn emit(event: &ProgressEvent) {
+        println!("{}", serde_json::to_string(event).unwrap());
+    }
+
+    fn ratio(&self) -> f64 {
+        match self.bytes_read {
+            0 => 1.0,
+            n => self.bytes_written as f64 / n as f64,
+        }
+    }
+
+    fn eta(&self) -> Option<std::time::Duration> {
+        let bytes_total = self.bytes_total?;
+        if self.bytes_read == 0 {
+            return None;
+        }
+        let remaining = bytes_total.saturating_sub(self.bytes_read);
+        Some(self.started.elapsed().mul_f64(remaining as f64 / self.bytes_read as f64))
+    }
+
+    fn file(&mut self, path: &str, item: &WriteItem, size: u64, written_size: u64) {
+        self.files_done += 1;
+        self.bytes_read += size;
+        self.bytes_written += written_size;
+
+        match self.mode {
+            ProgressMode::Quiet => return,
+            ProgressMode::Json => {
+                let (status, chunks) = match item {
+                    WriteItem::Symlink(_) => ("symlink", 0),
+                    WriteItem::Unchanged(_) => ("unchanged", 0),
+                    WriteItem::Body(entry, _) => ("compressed", entry.info.as_ref().unwrap().chunks.len()),
+                    WriteItem::Dedup(_) => ("dedup", 0),
+                };
+                Self::emit(&ProgressEvent::File { path, status, size, written_size, chunks });
+            },
+            ProgressMode::Human => {
+                let prefix = match (self.files_total, self.bytes_total) {
+                    (Some(files_total), Some(0)) => format!("[{:5.1}%]", self.files_done as f64 * 100.0 / files_total as f64),
+                    (_, Some(n)) => format!("[{:5.1}%]", (self.bytes_read as f64 * 100.0 / n as f64).min(100.0)),
+                    _ => format!("[#{}]", self.files_done),
+                };
+                match item {
+                    WriteItem::Symlink(entry) => println!("{} {} -> {} (symlink)", prefix, path, entry.symlink_target),
+                    WriteItem::Unchanged(_) => println!("{} unchanged {}", prefix, path),
+                    WriteItem::Body(entry, _) => println!("{} {} ({} chunks, {} -> {} bytes)", prefix, path, entry.info.as_ref().unwrap().chunks.len(), size, written_size),
+                    WriteItem::Dedup(_) => println!("{} dedup {}", prefix, path),
+                }
+            },
+        }
+
+        // overall progress is reported at most once per second (5 times per second for JSON)
+        let interval = match self.mode {
+            ProgressMode::Json => std::time::Duration::from_millis(200),
+            _ => std::time::Duration::from_secs(1),
+        };
+        if self.last_report.map_or(true, |t| t.elapsed() >= interval) || Some(self.files_done) == self.files_total {
+            self.last_report = Some(std::time::Instant::now());
+            self.report();
+        }
+    }
+
+    fn report(&self) {
+        match self.mode {
+            ProgressMode::Quiet => {},
+            ProgressMode::Json => Self::emit(&ProgressEvent::Progress {
+                files_done: self.files_done,
+                files_total: self.files_total,
+                bytes_read: self.bytes_read,
+                bytes_total: self.bytes_total,
+                bytes_written: self.bytes_written,
+                ratio: self.ratio(),
+                elapsed_ms: self.started.elapsed().as_millis() as u64,
+                eta_ms: self.eta().map(|d| d.as_millis() as u64),
+            }),
+            ProgressMode::Human => println!(
+                "progress: {}/{} files, {} / {} read, {} written ({:.1}%), elapsed {}, ETA {}",
+                self.files_done,
+                self.files_total.map_or("?".to_string(), |n| n.to_string()),
+                format_size(self.bytes_read),
+                self.bytes_total.map_or("?".to_string(), format_size),
+                format_size(self.bytes_written),
+                self.ratio() * 100.0,
+                format_duration(self.started.elapsed()),
+                self.eta().map_or("-".to_string(), format_duration),
+            ),
+        }
+    }
+
+    fn done(&self, enc_ms: u64, dec_ms: u64) {
+        match self.mode {
+            ProgressMode::Quiet => {},
+            ProgressMode::Json => Self::emit(&ProgressEvent::Done {
+                files: self.files_done,
+                bytes_read: self.bytes_read,
+                bytes_written: self.bytes_written,
+                ratio: self.ratio(),
+                enc_ms,
+                dec_ms,
+            }),
+            ProgressMode::Human => println!("{},{}", enc_ms, dec_ms),
+        }
+    }
+}
+
+// limits number of files which are read but not written yet, since whole body of them are kept in memory
+struct Window {
+    written: Mutex<usize>,
+    cond: Condvar,
+    size: usize,
+}
+
+impl Window {
+    // waits until file of seq can be read
+    fn wait_for(&self, seq: usize) {
+        let mut written = self.written.lock().unwrap();
+        while seq >= *written + self.size {
+            written = self.cond.wait(written).unwrap();
+        }
+    }
+
+    fn set_written(&self, written: usize) {
+        *self.written.lock().unwrap() = written;
+        self.cond.notify_all();
+    }
+}
+
+// "/input/a/b.txt" => "a/b.txt" (when input is "/input/")
+fn relative_path(input: &str, path: &std::path::Path) -> String {
+    let relative_path = path.to_str().unwrap();
+    assert!(relative_path.starts_with(input));
+    relative_path[input.len()..].to_string()
+}
+
+// makes entry which shares body with already written file, None if that file isn't written yet
+fn dedup_entry(e: &proto::FileEntry, hash_to_offsets: &HashMap<Vec<u8>, proto::FileEntry>) -> Option<proto::FileEntry> {
+    let info = e.info.as_ref().unwrap();
+    let dedup_target = hash_to_offsets.get(&info.original_sha256)?.clone();
+    assert!(dedup_target.info.as_ref().unwrap().original_sha256 == info.original_sha256);
+    assert!(dedup_target.info.as_ref().unwrap().original_crc32 == info.original_crc32);
+    Some(proto::FileEntry {
+        info: Some(proto::FileInfo {
+            path: info.path.clone(),
+            modified_time: info.modified_time.clone(),
+            ..dedup_target.info.as_ref().unwrap().clone()
+        }),
+        // metadata belongs to each file, not to the body
+        mode: e.mode,
+        uid: e.uid,
+        gid: e.gid,
+        windows_attributes: e.windows_attributes,
+        ..dedup_target
+    })
+}
+
+// records entries which are written so far (in .mar.idx format), so interrupted packing can be resumed with --resume
+fn write_checkpoint(path: &OsString, outdatfile: &DatWriter, entries: &[proto::FileEntry], deduped_file_entries: &[proto::FileEntry], hash_to_offsets: &HashMap<Vec<u8>, proto::FileEntry>) {
+    outdatfile.sync();
+    let mut entries = entries.to_vec();
+    entries.extend(deduped_file_entries.iter().filter_map(|e| dedup_entry(e, hash_to_offsets)));
+
+    let mut tmppath = path.clone();
+    tmppath.push(".tmp");
+    let mut file = std::fs::File::create(&tmppath).unwrap();
+    index_file::write_index_file(proto::FileIndexFile {
+        entries,
+        ..Default::default()
+    }, &mut file);
+    file.sync_data().unwrap();
+    drop(file);
+    std::fs::rename(&tmppath, path).unwrap();
+}
+
+// computes hashes of the body
+fn body_content(data: Vec<u8>) -> FileContent {
+    use sha2::Digest;
+
+    FileContent::Body {
+        original_crc32: crc32fast::hash(&data),
+        original_sha256: sha2::Sha256::digest(&data).to_vec(),
+        data,
+    }
+}
+
+fn read_input_file(seq: usize, input: &str, file: &FileInfo) -> ReadFile {
+    let relative_path = relative_path(input, &file.path);
+
+    if let Some(target) = &file.symlink_target {
+        return ReadFile {
+            seq,
+            relative_path,
+            metadata: InputMetadata::from_fs(&std::fs::symlink_metadata(&file.path).unwrap()),
+            content: FileContent::Symlink(target.clone()),
+        };
+    }
+
+    let mut fp: std::fs::File = std::fs::File::open(&file.path).unwrap();
+    let metadata = fp.metadata().unwrap();
+    let mut data = Vec::<u8>::with_capacity(metadata.len() as usize);
+    fp.read_to_end(&mut data).unwrap();
+
+    ReadFile {
+        seq,
+        relative_path,
+        metadata: InputMetadata::from_fs(&metadata),
+        content: body_content(data),
+    }
+}
 
 pub fn main(args: Args) {
-    let (mut files, directories) = walk_dir(&args.input);
+    // "-" reads tar archive from stdin instead of directory
+    let from_tar = args.input.as_os_str() == "-";
+    assert!(!(from_tar && args.resume), "--resume can't be used with tar input");
+    let (mut files, directories) = match from_tar {
+        true => (Vec::new(), Vec::new()),
+        false => walk_dir(&args.input, args.metadata),
+    };
+    files.retain(|f| f.path.file_name().unwrap() != ".DS_Store");
     files.sort_by_key(|f| f.path.to_str().unwrap().to_string());
     // println!("Files: {:#?}", files);
 
-    let files_count: usize = files.len();
+    let fixed_mtime = args.mtime.map(|t| std::time::UNIX_EPOCH + std::time::Duration::from_secs(t));
+
+    let progress_mode = match (args.quiet, args.progress_json) {
+        (_, true) => ProgressMode::Json,
+        (true, _) => ProgressMode::Quiet,
+        _ => ProgressMode::Human,
+    };
 
-    let workload = Arc::new(Mutex::new(VecDeque::from(files)));
     let outfilestr = args.output.into_os_string();
-    let outdatfile = Arc::new(Mutex::new(std::fs::File::create({
+    let outidxpath = {
         let mut outfile = OsString::from(&outfilestr);
-        outfile.push(".mar.dat");
-        println!("Output: {}", outfile.to_str().unwrap());
+        outfile.push(".mar.idx");
         outfile
-    }).unwrap()));
-    let mut outidxfile = std::fs::File::create({
+    };
+    let checkpoint_path = {
         let mut outfile = OsString::from(&outfilestr);
-        outfile.push(".mar.idx");
+        outfile.push(".mar.checkpoint");
         outfile
-    }).unwrap();
+    };
 
-    // make ${input.jobs} threads
+    // entries which were written before interrupted
+    let checkpoint_entries = match args.resume {
+        true => match std::fs::File::open(&checkpoint_path) {
+            Ok(mut f) => index_file::parse_index_file(&mut f).entries,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                eprintln!("warning: checkpoint is not found, starting from scratch");
+                Vec::new()
+            },
+            Err(e) => panic!("failed to open checkpoint: {}", e),
+        },
+        false => Vec::new(),
+    };
 
-    let enc_start = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_millis();
+    // files which aren't modified since checkpoint don't need to be packed again
+    let mut resumed_entries = Vec::new();
+    {
+        let input = args.input.to_str().unwrap();
+        let checkpoint_entries_by_path = checkpoint_entries.iter().map(|e| (e.info.as_ref().unwrap().path.as_str(), e)).collect::<HashMap<_, _>>();
+        files.retain(|f| {
+            let Some(entry) = checkpoint_entries_by_path.get(relative_path(input, &f.path).as_str()) else {
+                return true;
+            };
+            let metadata = match f.symlink_target {
+                Some(_) => std::fs::symlink_metadata(&f.path),
+                None => std::fs::metadata(&f.path),
+            }.unwrap();
+            if entry.info.as_ref().unwrap().modified_time != Some(prost_types::Timestamp::from(fixed_mtime.unwrap_or(metadata.modified().unwrap()))) {
+                return true;
+            }
+            resumed_entries.push((*entry).clone());
+            false
+        });
+    }
+    if progress_mode == ProgressMode::Human && !checkpoint_entries.is_empty() {
+        println!("resuming: {} files are already packed", resumed_entries.len());
+    }
 
-    let mut threads = Vec::new();
+    // number of files in tar is unknown until it is read to the end
+    let files_count = (!from_tar).then(|| files.len());
+    let mut progress = Progress::new(progress_mode, files_count, (!from_tar).then(|| files.iter().map(|f| f.size).sum()));
 
-    let hash_to_offsets = Arc::new(Mutex::new(HashMap::<Vec<u8>, proto::FileEntry>::new()));
+    // on append mode, new files are written to the next .dat part
+    let (existing_entries, existing_directories, existing_metadata) = match args.append {
+        true => {
+            let index = index_file::parse_index_file(&mut std::fs::File::open(&outidxpath).unwrap());
+            (index.entries, index.directories, index.metadata)
+        },
+        false => (Vec::new(), Vec::new(), None),
+    };
+    let file_index = existing_entries.iter().map(|e| e.file_index + 1).max().unwrap_or(0);
+    let existing_entries_by_path = Arc::new(existing_entries.iter().map(|e| (e.info.as_ref().unwrap().path.clone(), e.clone())).collect::<HashMap<_, _>>());
 
-    struct PartialFileInfo {
-        path: String,
-        modified_time: Option<prost_types::Timestamp>,
-        original_crc32: u32,
-        original_sha256: Vec<u8>,
+    let mut outdatfile = DatWriter::new(&PathBuf::from({
+        let mut outfile = OsString::from(&outfilestr);
+        outfile.push(".mar");
+        outfile
+    }), file_index, args.max_dat_size, args.dat_parts);
+    outdatfile.quiet = progress_mode != ProgressMode::Human;
+    // new part is created on first body, empty bodies point to existing part instead
+    outdatfile.empty_body_index = existing_entries.iter().map(|e| e.file_index).max();
+
+    // continue writing .dat parts from checkpoint, bodies which were written after it are discarded
+    {
+        let mut part_sizes = BTreeMap::<u32, u64>::new();
+        for e in checkpoint_entries.iter().filter(|e| e.file_index >= file_index) {
+            let size = part_sizes.entry(e.file_index).or_insert(0);
+            *size = (*size).max(e.body_offset + e.body_size);
+        }
+        if let Some(&last) = part_sizes.keys().last() {
+            for i in file_index..=last {
+                outdatfile.reopen(i, part_sizes.get(&i).copied().unwrap_or(0));
+            }
+        }
     }
 
-    let mut already_well_known_hashes = Arc::new(Mutex::new(HashSet::<Vec<u8>>::new()));
-    let mut deduped_file_entries = Arc::new(Mutex::new(Vec::<PartialFileInfo>::new()));
+    // pipeline: ${read_jobs} reader threads -> ${jobs} compressor threads -> writer (this thread), which writes bodies in order of files
+
+    let enc_start = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_millis();
+
+    let jobs = args.jobs.max(1);
+    let read_jobs = args.read_jobs.max(1);
+    let window = Arc::new(Window { written: Mutex::new(0), cond: Condvar::new(), size: read_jobs + jobs * 2 });
+    let workload = Arc::new(Mutex::new(files.into_iter().enumerate().collect::<VecDeque<_>>()));
+    let (read_tx, read_rx) = mpsc::sync_channel::<ReadFile>(jobs);
+    let read_rx = Arc::new(Mutex::new(read_rx));
+    // (seq, size of input file, item)
+    let (write_tx, write_rx) = mpsc::channel::<(usize, u64, WriteItem)>();
 
-    for thread_no in 0..args.jobs {
+    let mut threads = Vec::new();
+
+    let file_readers = match from_tar {
+        true => 0,
+        false => read_jobs,
+    };
+    for _ in 0..file_readers {
         let workload = workload.clone();
+        let window = window.clone();
+        let read_tx = read_tx.clone();
         let input = args.input.to_str().unwrap().to_string();
-        let outdatfile = outdatfile.clone();
-        let hash_to_offsets = hash_to_offsets.clone();
-        let already_well_known_hashes = already_well_known_hashes.clone();
-        let deduped_file_entries = deduped_file_entries.clone();
-
         threads.push(thread::spawn(move || {
-            let mut entries = Vec::new();
             loop {
                 let workload = workload.lock().unwrap().pop_front();
-                if let Some(file) = workload {
-                    if file.path.file_name().unwrap() == ".DS_Store" {
+                let Some((seq, file)) = workload else {
+                    break;
+                };
+                window.wait_for(seq);
+                if read_tx.send(read_input_file(seq, &input, &file)).is_err() {
+                    break;
+                }
+            }
+        }));
+    }
+
+    // tar is read sequentially by single thread, which returns number of files and directories in it
+    let tar_thread = from_tar.then(|| {
+        let window = window.clone();
+        let read_tx = read_tx.clone();
+        let keep_symlinks = args.metadata;
+        thread::spawn(move || {
+            let mut seq = 0;
+            let mut directories = Vec::new();
+            for (entry, data) in TarReader::new(std::io::stdin().lock()) {
+                // root directory
+                if entry.path.is_empty() {
+                    continue;
+                }
+                let path = format!("/{}", entry.path);
+                let metadata = InputMetadata::from_tar(&entry);
+                let content = match entry.kind {
+                    TarEntryKind::Directory => {
+                        directories.push(proto::DirectoryEntry {
+                            path,
+                            modified_time: Some(prost_types::Timestamp::from(fixed_mtime.unwrap_or(entry.modified_time))),
+                        });
                         continue;
-                    }
+                    },
+                    TarEntryKind::Symlink(target) if keep_symlinks => FileContent::Symlink(target),
+                    TarEntryKind::Symlink(_) => {
+                        eprintln!("warning: {} is skipped (symbolic links in tar are recorded only with --metadata)", path);
+                        continue;
+                    },
+                    TarEntryKind::File if path.ends_with("/.DS_Store") => continue,
+                    TarEntryKind::File => body_content(data),
+                    _ => {
+                        eprintln!("warning: {} is skipped (unsupported entry type in tar)", path);
+                        continue;
+                    },
+                };
+                window.wait_for(seq);
+                if read_tx.send(ReadFile { seq, relative_path: path, metadata, content }).is_err() {
+                    break;
+                }
+                seq += 1;
+            }
+            (seq, directories)
+        })
+    });
+    drop(read_tx);
 
-                    let mut fp: std::fs::File = std::fs::File::open(&file.path).unwrap();
-                    let metadata = fp.metadata().unwrap();
-                    let (input_data, original_crc32, original_sha256) = {
-                        let mut crc32_hasher = crc32fast::Hasher::new();
-                        let mut sha256_hasher = sha2::Sha256::new();
-                        let mut data = Vec::<u8>::with_capacity(metadata.len() as usize);
-
-                        let mut reader = std::io::BufReader::new(&mut fp);
-                        loop {
-                            let mut buf = [0; 32768];
-                            let n = reader.read(&mut buf).unwrap();
-                            if n == 0 {
-                                break;
-                            }
-                            crc32_hasher.update(&buf[..n]);
-                            sha256_hasher.update(&buf[..n]);
-                            data.extend_from_slice(&buf[..n]);
-                        }
+    let compress_rules = Arc::new(CompressRules::new(&args.compress, args.seekable_frame_size));
+    // SHA-256 => seq of the earliest file which has that content (so far), it owns the body
+    let claimed_hashes = Arc::new(Mutex::new(HashMap::<Vec<u8>, usize>::new()));
+    let mut hash_to_offsets = HashMap::<Vec<u8>, proto::FileEntry>::new();
 
-                        (data, crc32_hasher.finalize(), sha256_hasher.finalize().to_vec())
-                    };
+    // existing bodies also can be used as dedup target
+    if args.dedup {
+        let mut claimed_hashes = claimed_hashes.lock().unwrap();
+        for e in existing_entries.iter().chain(resumed_entries.iter().filter(|e| e.symlink_target.is_empty())) {
+            let hash = e.info.as_ref().unwrap().original_sha256.clone();
+            claimed_hashes.insert(hash.clone(), 0);
+            hash_to_offsets.insert(hash, e.clone());
+        }
+    }
 
-                    let relative_path = file.path.to_str().unwrap();
-                    assert!(relative_path.starts_with(&input));
-                    let relative_path = relative_path[input.len()..].to_string();
+    for _ in 0..jobs {
+        let read_rx = read_rx.clone();
+        let write_tx = write_tx.clone();
+        let claimed_hashes = claimed_hashes.clone();
+        let existing_entries_by_path = existing_entries_by_path.clone();
+        let compress_rules = compress_rules.clone();
 
-                    let modified_time = fp.metadata().unwrap().modified().unwrap();
+        threads.push(thread::spawn(move || {
+            use sha2::Digest;
 
-                    // もしもう圧縮済みの同 SHA-256 ファイルがあればそちらを使う
-                    if args.dedup {
-                        let mut already_well_known_hashes = already_well_known_hashes.lock().unwrap();
-                        if already_well_known_hashes.contains(&original_sha256) {
-                            println!("dedup {}", relative_path);
-                            let mut deduped_file_entries = deduped_file_entries.lock().unwrap();
-                            deduped_file_entries.push(PartialFileInfo {
-                                path: relative_path.clone(),
+            loop {
+                let file = read_rx.lock().unwrap().recv();
+                let Ok(file) = file else {
+                    break;
+                };
+                let ReadFile { seq, relative_path, metadata, content } = file;
+                let modified_time = fixed_mtime.unwrap_or(metadata.modified_time);
+
+                let (input_data, original_crc32, original_sha256) = match content {
+                    FileContent::Symlink(target) => {
+                        let mut entry = proto::FileEntry {
+                            info: Some(proto::FileInfo {
+                                path: relative_path,
+                                chunks_crc32: crc32fast::hash(&[]),
+                                chunks_sha256: sha2::Sha256::digest(b"").to_vec(),
+                                original_crc32: crc32fast::hash(&[]),
+                                original_sha256: sha2::Sha256::digest(b"").to_vec(),
                                 modified_time: Some(prost_types::Timestamp::from(modified_time)),
-                                original_crc32,
-                                original_sha256,
-                            });
-                            continue;
+                                ..Default::default()
+                            }),
+                            symlink_target: target,
+                            ..Default::default()
+                        };
+                        apply_metadata(&mut entry, &metadata);
+                        if write_tx.send((seq, 0, WriteItem::Symlink(entry))).is_err() {
+                            break;
                         }
-                        already_well_known_hashes.insert(original_sha256.clone());
-                    }
-
-                    let chunks = compress_file(&input_data);
+                        continue;
+                    },
+                    FileContent::Body { data, original_crc32, original_sha256 } => (data, original_crc32, original_sha256),
+                };
 
-                    let mut chunk_infos = Vec::<proto::ChunkInfo>::with_capacity(chunks.len());
-                    let mut compressed = Vec::new();
-                    for mut chunk in chunks {
-                        chunk_infos.push(proto::ChunkInfo {
-                            compressed_length: chunk.compressed.len() as u32,
-                            compressed_method: chunk.compressed_method as i32,
-                            original_length: chunk.original_size as u32,
-                        });
-                        compressed.append(&mut chunk.compressed);
+                let item = 'item: {
+                    // 追記モードで中身が変わっていないファイルは既存のエントリをそのまま使う
+                    if let Some(existing) = existing_entries_by_path.get(&relative_path) {
+                        if existing.info.as_ref().unwrap().original_sha256 == original_sha256 {
+                            let mut entry = existing.clone();
+                            if args.metadata {
+                                apply_metadata(&mut entry, &metadata);
+                            }
+                            break 'item WriteItem::Unchanged(entry);
+                        }
                     }
-                    println!("{}: {} ({} chunks, {} -> {} bytes)", thread_no, relative_path, chunk_infos.len(), input_data.len(), compressed.len());
-
-                    use sha2::Digest;
 
-                    let entry = {
-                        let mut hash_to_offsets = hash_to_offsets.lock().unwrap();
-
-                        let file_info = proto::FileInfo {
-                            path: relative_path,
-                            chunks: chunk_infos,
-    
-                            chunks_crc32: crc32fast::hash(&compressed),
-                            chunks_sha256: sha2::Sha256::digest(&compressed).to_vec(),
-    
-                            original_crc32,
-                            original_sha256,
-    
-                            modified_time: Some(prost_types::Timestamp::from(modified_time)),
-                            // dictionary_size: 0,
-                            priority: 0,
-                        };
+                    // もしもう圧縮済みの同 SHA-256 ファイルがあればそちらを使う
+                    // (body is owned by the earliest file, so output doesn't depend on which thread came first)
+                    if args.dedup {
+                        let mut claimed_hashes = claimed_hashes.lock().unwrap();
+                        match claimed_hashes.get(&original_sha256) {
+                            Some(&owner) if owner < seq => {
+                                let mut entry = proto::FileEntry {
+                                    info: Some(proto::FileInfo {
+                                        path: relative_path,
+                                        original_crc32,
+                                        original_sha256,
+                                        modified_time: Some(prost_types::Timestamp::from(modified_time)),
+                                        ..Default::default()
+                                    }),
+                                    ..Default::default()
+                                };
+                                if args.metadata {
+                                    apply_metadata(&mut entry, &metadata);
+                                }
+                                break 'item WriteItem::Dedup(entry);
+                            },
+                            _ => {
+                                claimed_hashes.insert(original_sha256.clone(), seq);
+                            },
+                        }
+                    }
 
-                        let offset = {
-                            let mut outdatfile = outdatfile.lock().unwrap();
-                            let offset = outdatfile.seek(std::io::SeekFrom::End(0)).unwrap();
-                            outdatfile.write_all(&compressed).unwrap();
+                    let (chunk_infos, compressed) = concat_chunks(compress_file(&input_data, &compress_rules.options_for(&relative_path)));
 
-                            offset
-                        };
+                    let file_info = proto::FileInfo {
+                        path: relative_path,
+                        chunks: chunk_infos,
 
-                        let entry = proto::FileEntry {
-                            info: Some(file_info),
-                            file_index: 0,
-                            body_offset: offset,
-                            body_size: compressed.len() as u64,
-                        };
+                        chunks_crc32: crc32fast::hash(&compressed),
+                        chunks_sha256: sha2::Sha256::digest(&compressed).to_vec(),
 
-                        if args.dedup {
-                            hash_to_offsets.insert(entry.info.as_ref().unwrap().original_sha256.clone(), entry.clone());
-                        }
+                        original_crc32,
+                        original_sha256,
 
-                        entry
+                        modified_time: Some(prost_types::Timestamp::from(modified_time)),
+                        // dictionary_size: 0,
+                        priority: 0,
                     };
 
-                    entries.push(entry);
-                } else {
-                    break entries;
+                    let mut entry = proto::FileEntry {
+                        info: Some(file_info),
+                        body_size: compressed.len() as u64,
+                        ..Default::default()
+                    };
+                    if args.metadata {
+                        apply_metadata(&mut entry, &metadata);
+                    }
+                    WriteItem::Body(entry, compressed)
+                };
+                if write_tx.send((seq, input_data.len() as u64, item)).is_err() {
+                    break;
                 }
             }
         }));
     }
+    drop(write_tx);
 
-    let mut entries = Vec::<proto::FileEntry>::with_capacity(files_count);
+    // write bodies in order of files, so .dat doesn't depend on which thread finished first
+    let mut ees = Vec::with_capacity(resumed_entries.len() + files_count.unwrap_or(0));
+    ees.extend(resumed_entries);
+    let mut last_checkpoint = std::time::Instant::now();
+    let mut deduped_file_entries = Vec::<proto::FileEntry>::new();
+    let mut pending = BTreeMap::<usize, (u64, WriteItem)>::new();
+    let mut next_seq = 0;
+    for (seq, size, item) in write_rx {
+        pending.insert(seq, (size, item));
+        while let Some((size, item)) = pending.remove(&next_seq) {
+            // later file which has same content may be compressed before earlier one claims the body, then it's deduped here
+            let item = match item {
+                WriteItem::Body(entry, _) if args.dedup && hash_to_offsets.contains_key(&entry.info.as_ref().unwrap().original_sha256) => WriteItem::Dedup(entry),
+                item => item,
+            };
+            let written_size = match &item {
+                WriteItem::Body(_, compressed) => compressed.len() as u64,
+                _ => 0,
+            };
+            let (WriteItem::Symlink(entry) | WriteItem::Unchanged(entry) | WriteItem::Body(entry, _) | WriteItem::Dedup(entry)) = &item;
+            progress.file(&entry.info.as_ref().unwrap().path, &item, size, written_size);
+            match item {
+                WriteItem::Symlink(entry) | WriteItem::Unchanged(entry) => ees.push(entry),
+                WriteItem::Body(mut entry, compressed) => {
+                    let (file_index, offset) = outdatfile.write(&compressed);
+                    entry.file_index = file_index;
+                    entry.body_offset = offset;
+                    if args.dedup {
+                        hash_to_offsets.insert(entry.info.as_ref().unwrap().original_sha256.clone(), entry.clone());
+                    }
+                    ees.push(entry);
+                },
+                WriteItem::Dedup(e) => deduped_file_entries.push(e),
+            }
+            next_seq += 1;
+            window.set_written(next_seq);
 
-    let mut ees = Vec::with_capacity(files_count);
-    for thread in threads {
-        for e in thread.join().unwrap() {
-            // entries.push(FileEntry {
-            //     path: e.path.to_str().unwrap().to_string(),
-            //     compressed_method: e.compressed_method,
-            //     dictionary_id: None,
-            //     compressed_size: e.compressed_size,
-            //     original_size: e.compressed_size,
-            //     compressed_crc32: e.compressed_crc32,
-            //     original_crc32: e.original_crc32,
-            // });
-            ees.push(e);
+            if args.checkpoint_interval != 0 && last_checkpoint.elapsed().as_secs() >= args.checkpoint_interval {
+                write_checkpoint(&checkpoint_path, &outdatfile, &ees, &deduped_file_entries, &hash_to_offsets);
+                last_checkpoint = std::time::Instant::now();
+            }
         }
     }
+    for thread in threads {
+        thread.join().unwrap();
+    }
+    let (tar_files_count, tar_directories) = tar_thread.map(|t| t.join().unwrap()).unwrap_or_default();
+    assert_eq!(next_seq, files_count.unwrap_or(tar_files_count), "some files were not written");
+    drop(outdatfile);
 
-    let hash_to_offsets = hash_to_offsets.lock().unwrap();
-    for e in deduped_file_entries.lock().unwrap().drain(0..) {
-        let dedup_target = hash_to_offsets.get(&e.original_sha256).unwrap().clone();
-        assert!(dedup_target.info.as_ref().unwrap().original_sha256 == e.original_sha256);
-        assert!(dedup_target.info.as_ref().unwrap().original_crc32 == e.original_crc32);
-        ees.push(proto::FileEntry {
-            info: Some(proto::FileInfo {
-                path: e.path,
-                modified_time: e.modified_time,
-                ..dedup_target.info.as_ref().unwrap().clone()
-            }),
-            ..dedup_target
-        });
+    for e in &deduped_file_entries {
+        ees.push(dedup_entry(e, &hash_to_offsets).unwrap());
     }
 
+    // keep existing files which are not in input directory
+    {
+        let new_paths = ees.iter().map(|e| e.info.as_ref().unwrap().path.clone()).collect::<HashSet<_>>();
+        for e in existing_entries {
+            if !new_paths.contains(&e.info.as_ref().unwrap().path) {
+                ees.push(e);
+            }
+        }
+    }
+
+    // record directories (with metadata), existing ones are kept on append mode
+    let directories = {
+        let input = args.input.to_str().unwrap();
+        let mut dir_entries = BTreeMap::<String, proto::DirectoryEntry>::new();
+        for d in existing_directories.into_iter().chain(tar_directories) {
+            dir_entries.insert(d.path.clone(), d);
+        }
+        for dir in &directories {
+            let relative_path = dir.to_str().unwrap();
+            assert!(relative_path.starts_with(input));
+            let relative_path = relative_path[input.len()..].to_string();
+            let modified_time = fixed_mtime.unwrap_or(std::fs::metadata(dir).unwrap().modified().unwrap());
+            dir_entries.insert(relative_path.clone(), proto::DirectoryEntry {
+                path: relative_path,
+                modified_time: Some(prost_types::Timestamp::from(modified_time)),
+            });
+        }
+        dir_entries.into_values().collect::<Vec<_>>()
+    };
+
     let enc_end = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_millis();
 
     let dec_start = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_millis();
     ees.sort_by(|a, b| a.info.as_ref().unwrap().path.cmp(&b.info.as_ref().unwrap().path));
     let index_file = proto::FileIndexFile {
         entries: ees,
+        directories,
+        metadata: args.archive_metadata.to_proto(existing_metadata, fixed_mtime.unwrap_or_else(std::time::SystemTime::now)),
+        ..Default::default()
     };
-    index_file::write_index_file(index_file, &mut outidxfile);
+    {
+        // write to temporary file first, to avoid breaking existing index on append mode
+        let mut tmpidxpath = outidxpath.clone();
+        tmpidxpath.push(".tmp");
+        let mut outidxfile = std::fs::File::create(&tmpidxpath).unwrap();
+        index_file::write_index_file(index_file, &mut outidxfile);
+        drop(outidxfile);
+        std::fs::rename(&tmpidxpath, &outidxpath).unwrap();
+    }
+    // packing is finished, so checkpoint is no longer needed
+    if std::path::Path::new(&checkpoint_path).exists() {
+        std::fs::remove_file(&checkpoint_path).unwrap();
+    }
+    update_parity(&append_to_path(std::path::Path::new(&outfilestr), ".mar"), &args.parity, progress_mode == ProgressMode::Human);
 
     let dec_end = std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_millis();
-    println!("{},{}", enc_end - enc_start, dec_end - dec_start);
+    progress.done((enc_end - enc_start) as u64, (dec_end - dec_start) as u64);
 }
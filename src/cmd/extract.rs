@@ -0,0 +1,94 @@
+use std::path::{Component, Path, PathBuf};
+
+use clap::Parser;
+
+use crate::{format::mar, proto, util::PathFilter};
+
+#[derive(Parser)]
+#[command(name = "MAR Extractor")]
+pub struct Args {
+    #[arg(short, long)]
+    input: PathBuf,
+
+    /// Output directory
+    #[arg(short, long)]
+    output: PathBuf,
+
+    /// Only extract entries which matches this glob pattern (case insensitive, can be specified multiple times)
+    #[arg(short, long)]
+    glob: Vec<String>,
+}
+
+fn output_path(output: &Path, path: &str) -> PathBuf {
+    let relative = Path::new(path.trim_start_matches(|c| c == '/' || c == '\\'));
+    assert!(relative.components().all(|c| matches!(c, Component::Normal(_))), "invalid path in archive: {}", path);
+    output.join(relative)
+}
+
+#[cfg(unix)]
+fn create_symlink(target: &str, path: &Path) {
+    std::os::unix::fs::symlink(target, path).unwrap();
+}
+
+#[cfg(windows)]
+fn create_symlink(target: &str, path: &Path) {
+    // might require Developer Mode or administrator
+    std::os::windows::fs::symlink_file(target, path).unwrap();
+}
+
+// permission bits recorded by `create --metadata` (ownership is not restored)
+#[cfg(unix)]
+fn restore_mode(entry: &proto::FileEntry, path: &Path) {
+    use std::os::unix::fs::PermissionsExt;
+    if let Some(mode) = entry.mode {
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(mode)).unwrap();
+    }
+}
+
+#[cfg(not(unix))]
+fn restore_mode(_entry: &proto::FileEntry, _path: &Path) {}
+
+pub fn main(args: Args) {
+    let filter = PathFilter::new(&args.glob);
+    let index = mar::read_index(&args.input);
+    let mut reader = mar::MarReader::new(&args.input);
+
+    let mut extracted = 0;
+    let mut failed = 0;
+
+    for entry in &index.entries {
+        let info = entry.info.as_ref().unwrap();
+        if info.path.ends_with(mar::WHITEOUT_SUFFIX) || !filter.is_match(&info.path) {
+            continue;
+        }
+
+        if !entry.symlink_target.is_empty() {
+            let path = output_path(&args.output, &info.path);
+            std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+            create_symlink(&entry.symlink_target, &path);
+            println!("{} -> {}", info.path, entry.symlink_target);
+            extracted += 1;
+            continue;
+        }
+
+        let data = reader.read_entry(entry);
+        if !mar::verify(info, &data) {
+            println!("hash mismatch, skipped: {}", info.path);
+            failed += 1;
+            continue;
+        }
+
+        let path = output_path(&args.output, &info.path);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(&path, &data).unwrap();
+        restore_mode(entry, &path);
+        println!("{}", info.path);
+        extracted += 1;
+    }
+
+    println!("Extracted {} files", extracted);
+    if failed > 0 {
+        println!("{} files are corrupted", failed);
+        std::process::exit(1);
+    }
+}
@@ -0,0 +1,118 @@
+use std::{collections::{BTreeMap, HashSet}, path::PathBuf};
+
+use clap::Parser;
+
+use crate::{format::mar, proto, util::{civil_from_days, format_size}};
+
+#[derive(Parser)]
+#[command(name = "MAR Info")]
+pub struct Args {
+    /// .mar file
+    #[arg(short, long)]
+    input: PathBuf,
+}
+
+// e.g. "2024-01-02 03:04:05 UTC"
+fn format_timestamp(ts: &prost_types::Timestamp) -> String {
+    let (y, m, d) = civil_from_days(ts.seconds.div_euclid(86400));
+    let secs = ts.seconds.rem_euclid(86400);
+    format!("{:04}-{:02}-{:02} {:02}:{:02}:{:02} UTC", y, m, d, secs / 3600, secs / 60 % 60, secs % 60)
+}
+
+fn percent(part: u64, total: u64) -> f64 {
+    match total {
+        0 => 100.0,
+        n => part as f64 * 100.0 / n as f64,
+    }
+}
+
+#[derive(Default)]
+struct MethodStats {
+    chunks: u64,
+    original: u64,
+    compressed: u64,
+}
+
+pub fn main(args: Args) {
+    let index = mar::read_index(&args.input);
+
+    println!("Archive: {}", args.input.display());
+    println!("Index version: {}", index.version);
+
+    if let Some(m) = &index.metadata {
+        println!("Metadata:");
+        for (key, value) in [("name", &m.name), ("version", &m.version), ("description", &m.description), ("source build", &m.source_build), ("created by", &m.created_by)] {
+            if !value.is_empty() {
+                println!("  {}: {}", key, value);
+            }
+        }
+        if let Some(t) = &m.created_time {
+            println!("  created time: {}", format_timestamp(t));
+        }
+    }
+
+    let mut files = 0;
+    let mut symlinks = 0;
+    let mut whiteouts = 0;
+    let mut original_size = 0u64;
+    // bodies can be shared by multiple entries (create --dedup), so they're counted once
+    let mut bodies = HashSet::<(u32, u64)>::new();
+    let mut stored_size = 0u64;
+    let mut referenced_sizes = BTreeMap::<u32, u64>::new();
+    let mut methods = BTreeMap::<i32, MethodStats>::new();
+    // (power of two which is >= original length) => number of chunks
+    let mut chunk_sizes = BTreeMap::<u64, u64>::new();
+
+    for entry in &index.entries {
+        let info = entry.info.as_ref().unwrap();
+        if !entry.symlink_target.is_empty() {
+            symlinks += 1;
+            continue;
+        }
+        if info.path.ends_with(mar::WHITEOUT_SUFFIX) {
+            whiteouts += 1;
+            continue;
+        }
+        files += 1;
+        original_size += mar::original_size(info);
+        if !bodies.insert((entry.file_index, entry.body_offset)) {
+            continue;
+        }
+        stored_size += entry.body_size;
+        *referenced_sizes.entry(entry.file_index).or_insert(0) += entry.body_size;
+        for chunk in &info.chunks {
+            let m = methods.entry(chunk.compressed_method).or_default();
+            m.chunks += 1;
+            m.original += chunk.original_length as u64;
+            m.compressed += chunk.compressed_length as u64;
+            *chunk_sizes.entry((chunk.original_length as u64).next_power_of_two()).or_insert(0) += 1;
+        }
+    }
+
+    println!("Entries: {} files, {} symlinks, {} whiteouts, {} directories", files, symlinks, whiteouts, index.directories.len());
+    println!("Original size: {} ({} bytes)", format_size(original_size), original_size);
+    println!("Stored size: {} ({} bytes, {:.1}% of original)", format_size(stored_size), stored_size, percent(stored_size, original_size));
+    if bodies.len() < files {
+        println!("Deduplicated: {} files share body with other files", files - bodies.len());
+    }
+
+    println!(".dat files:");
+    for (file_index, referenced) in &referenced_sizes {
+        let path = mar::dat_path(&args.input, *file_index);
+        match std::fs::metadata(&path) {
+            Ok(m) => println!("  {}: {} (referenced {}, {:.1}%)", path.display(), format_size(m.len()), format_size(*referenced), percent(*referenced, m.len())),
+            Err(e) => println!("  {}: {} (referenced {})", path.display(), e, format_size(*referenced)),
+        }
+    }
+
+    println!("Compression methods:");
+    for (method, m) in &methods {
+        let name = proto::CompressedMethod::try_from(*method).map_or(format!("UNKNOWN({})", method), |m| m.as_str_name().to_string());
+        println!("  {}: {} chunks, {} -> {} ({:.1}%)", name, m.chunks, format_size(m.original), format_size(m.compressed), percent(m.compressed, m.original));
+    }
+
+    println!("Chunk sizes (original):");
+    for (size, count) in &chunk_sizes {
+        println!("  <= {}: {}", format_size(*size), count);
+    }
+}
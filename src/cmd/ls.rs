@@ -0,0 +1,49 @@
+use std::path::PathBuf;
+
+use clap::Parser;
+
+use crate::{format::mar, util::{to_hex, PathFilter}};
+
+#[derive(Parser)]
+#[command(name = "MAR Lister")]
+pub struct Args {
+    /// .mar or .zip file
+    #[arg(short, long)]
+    input: PathBuf,
+
+    /// Only list entries which matches this glob pattern (case insensitive, can be specified multiple times)
+    #[arg(short, long)]
+    glob: Vec<String>,
+}
+
+fn list_mar(input: &PathBuf, filter: &PathFilter) {
+    let index = mar::read_index(input);
+    for entry in index.entries {
+        let info = entry.info.unwrap();
+        if !filter.is_match(&info.path) {
+            continue;
+        }
+        println!("{}\t{}\t{}\t{}\t{}", info.path, mar::original_size(&info), info.chunks.len(), mar::methods_name(&info), to_hex(&info.original_sha256));
+    }
+}
+
+fn list_zip(input: &PathBuf, filter: &PathFilter) {
+    let mut archive = zip::ZipArchive::new(std::fs::File::open(input).unwrap()).unwrap();
+    for i in 0..archive.len() {
+        let file = archive.by_index(i).unwrap();
+        if file.is_dir() || !filter.is_match(file.name()) {
+            continue;
+        }
+        // zip doesn't have SHA-256, so we show CRC32 instead
+        println!("{}\t{}\t{}\t{}\t{:08x}", file.name(), file.size(), 1, file.compression(), file.crc32());
+    }
+}
+
+pub fn main(args: Args) {
+    let filter = PathFilter::new(&args.glob);
+    match args.input.extension().and_then(|e| e.to_str()) {
+        Some("mar") => list_mar(&args.input, &filter),
+        Some("zip") => list_zip(&args.input, &filter),
+        _ => panic!("unknown file type (filename suffix): {}", args.input.display()),
+    }
+}
@@ -0,0 +1,62 @@
+use std::{io::Write, path::PathBuf};
+
+use clap::Parser;
+
+use crate::{format::mar, util::civil_from_days};
+
+#[derive(Parser)]
+#[command(name = "MAR to ZIP Converter")]
+pub struct Args {
+    #[arg(short, long)]
+    input: PathBuf,
+
+    #[arg(short, long)]
+    output: PathBuf,
+
+    /// Store files without compression (faster, but bigger)
+    #[arg(long)]
+    store: bool,
+}
+
+fn timestamp_to_zip_datetime(ts: &prost_types::Timestamp) -> zip::DateTime {
+    let days = ts.seconds.div_euclid(86400);
+    let secs = ts.seconds.rem_euclid(86400);
+    let (y, m, d) = civil_from_days(days);
+    // zip can't represent before 1980 (or after 2107), so fallback to default (1980-01-01)
+    zip::DateTime::from_date_and_time(y as u16, m as u8, d as u8, (secs / 3600) as u8, (secs / 60 % 60) as u8, (secs % 60) as u8).unwrap_or_default()
+}
+
+pub fn main(args: Args) {
+    let index = mar::read_index(&args.input);
+    let mut reader = mar::MarReader::new(&args.input);
+    let mut writer = zip::ZipWriter::new(std::fs::File::create(&args.output).unwrap());
+
+    let method = match args.store {
+        true => zip::CompressionMethod::Stored,
+        false => zip::CompressionMethod::Deflated,
+    };
+
+    for entry in &index.entries {
+        let info = entry.info.as_ref().unwrap();
+        if info.path.ends_with(mar::WHITEOUT_SUFFIX) {
+            println!("skipping whiteout: {}", info.path);
+            continue;
+        }
+
+        let data = reader.read_entry(entry);
+        assert!(mar::verify(info, &data), "hash mismatch: {}", info.path);
+
+        let mut options = zip::write::FileOptions::default()
+            .compression_method(method)
+            .large_file(data.len() as u64 >= u32::MAX as u64);
+        if let Some(modified_time) = &info.modified_time {
+            options = options.last_modified_time(timestamp_to_zip_datetime(modified_time));
+        }
+
+        writer.start_file(info.path.trim_start_matches('/'), options).unwrap();
+        writer.write_all(&data).unwrap();
+        println!("{}", info.path);
+    }
+
+    writer.finish().unwrap();
+}
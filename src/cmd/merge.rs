@@ -0,0 +1,188 @@
+use std::{collections::{BTreeMap, HashMap, HashSet}, io::Read, path::PathBuf};
+
+use clap::Parser;
+use sha2::Digest;
+
+use crate::{cmd::{create::{compress_file, concat_chunks, ArchiveMetadataArgs, CompressArgs, CompressRules}, zip2mar::zip_datetime_to_timestamp}, format::{index_file, mar::{self, DatWriter}}, proto, util::{append_to_path, normalize_archive_path, parse_size}};
+
+#[derive(Parser)]
+#[command(name = "MAR Merger")]
+pub struct Args {
+    /// .mar or .zip layers, later one overrides earlier one (same as marmounter)
+    #[arg(short, long, required = true)]
+    input: Vec<PathBuf>,
+
+    /// Output path, same as create (.mar.idx and .mar.dat will be appended)
+    #[arg(short, long)]
+    output: PathBuf,
+
+    /// Write zstd chunks as zstd seekable format with this frame size, same as create (only for files from zip)
+    #[arg(long, default_value_t = 0)]
+    seekable_frame_size: usize,
+
+    /// Max size of each .dat part, same as create
+    #[arg(long, value_parser = parse_size, default_value_t = 0)]
+    max_dat_size: u64,
+
+    /// Number of .dat parts to write at same time, same as create
+    #[arg(long, default_value_t = 1)]
+    dat_parts: usize,
+
+    #[command(flatten)]
+    compress: CompressArgs,
+
+    #[command(flatten)]
+    archive_metadata: ArchiveMetadataArgs,
+}
+
+enum Layer {
+    Mar(proto::FileIndexFile),
+    Zip(zip::ZipArchive<std::fs::File>),
+}
+
+// where the file in merged view comes from
+enum Source {
+    Mar { layer: usize, entry: proto::FileEntry },
+    Zip { layer: usize, index: usize },
+}
+
+fn open_layer(input: &PathBuf) -> Layer {
+    match input.extension().and_then(|e| e.to_str()) {
+        Some("mar") => Layer::Mar(mar::read_index(input)),
+        Some("zip") => Layer::Zip(zip::ZipArchive::new(std::fs::File::open(input).unwrap()).unwrap()),
+        _ => panic!("unknown file type (filename suffix): {}", input.display()),
+    }
+}
+
+pub fn main(args: Args) {
+    let mut layers = args.input.iter().map(open_layer).collect::<Vec<_>>();
+
+    // lowercased path => source, applied from the bottom layer like marmounter does
+    let mut files = BTreeMap::<String, Source>::new();
+    let mut directories = BTreeMap::<String, proto::DirectoryEntry>::new();
+    for (layer, (input, opened)) in args.input.iter().zip(layers.iter_mut()).enumerate() {
+        match opened {
+            Layer::Mar(index) => {
+                // whiteouts only hide lower layers, not files of the same layer
+                let ours = index.entries.iter()
+                    .map(|e| normalize_archive_path(&e.info.as_ref().unwrap().path).to_lowercase())
+                    .filter(|p| !p.ends_with(mar::WHITEOUT_SUFFIX))
+                    .collect::<HashSet<_>>();
+                for entry in &index.entries {
+                    let path = normalize_archive_path(&entry.info.as_ref().unwrap().path).to_lowercase();
+                    if let Some(hidden) = path.strip_suffix(mar::WHITEOUT_SUFFIX) {
+                        if !ours.contains(hidden) && files.remove(hidden).is_some() {
+                            println!("whiteout: {} (by {})", hidden, input.display());
+                        }
+                        continue;
+                    }
+                    files.insert(path, Source::Mar { layer, entry: entry.clone() });
+                }
+                for dir in &index.directories {
+                    directories.insert(normalize_archive_path(&dir.path).to_lowercase(), dir.clone());
+                }
+            },
+            Layer::Zip(archive) => {
+                for i in 0..archive.len() {
+                    let file = archive.by_index(i).unwrap();
+                    let path = normalize_archive_path(file.name().trim_end_matches('/'));
+                    if file.is_dir() {
+                        directories.insert(path.to_lowercase(), proto::DirectoryEntry {
+                            path,
+                            modified_time: Some(zip_datetime_to_timestamp(file.last_modified())),
+                        });
+                        continue;
+                    }
+                    files.insert(path.to_lowercase(), Source::Zip { layer, index: i });
+                }
+            },
+        }
+    }
+
+    let mut outdatfile = DatWriter::new(&append_to_path(&args.output, ".mar"), 0, args.max_dat_size, args.dat_parts);
+    let mut outidxfile = std::fs::File::create(append_to_path(&args.output, ".mar.idx")).unwrap();
+
+    let compress_rules = CompressRules::new(&args.compress, args.seekable_frame_size);
+    let mut readers = HashMap::<usize, mar::MarReader>::new();
+    // bodies which are shared in source archive (create --dedup) stay shared
+    // (layer, file_index, body_offset) => (file_index, body_offset)
+    let mut copied = HashMap::<(usize, u32, u64), (u32, u64)>::new();
+    let mut entries = Vec::<proto::FileEntry>::with_capacity(files.len());
+
+    for source in files.into_values() {
+        match source {
+            Source::Mar { layer, mut entry } => {
+                let info = entry.info.as_ref().unwrap();
+                if !entry.symlink_target.is_empty() {
+                    println!("{} (symlink, from {})", info.path, args.input[layer].display());
+                    entries.push(entry);
+                    continue;
+                }
+                let key = (layer, entry.file_index, entry.body_offset);
+                if let Some(&(file_index, offset)) = copied.get(&key) {
+                    println!("{} (dedup, from {})", info.path, args.input[layer].display());
+                    entry.file_index = file_index;
+                    entry.body_offset = offset;
+                    entries.push(entry);
+                    continue;
+                }
+
+                // chunks are copied without recompressing
+                let reader = readers.entry(layer).or_insert_with(|| mar::MarReader::new(&args.input[layer]));
+                let body = reader.read_chunks(&entry).concat();
+                println!("{} ({} chunks, {} bytes, from {})", info.path, info.chunks.len(), body.len(), args.input[layer].display());
+                let (file_index, offset) = outdatfile.write(&body);
+                copied.insert(key, (file_index, offset));
+                entry.file_index = file_index;
+                entry.body_offset = offset;
+                entry.body_size = body.len() as u64;
+                entries.push(entry);
+            },
+            Source::Zip { layer, index } => {
+                let Layer::Zip(archive) = &mut layers[layer] else {
+                    unreachable!();
+                };
+                let mut file = archive.by_index(index).unwrap();
+                let mut input_data = Vec::with_capacity(file.size() as usize);
+                file.read_to_end(&mut input_data).unwrap();
+
+                let path = normalize_archive_path(file.name());
+                let (chunk_infos, compressed) = concat_chunks(compress_file(&input_data, &compress_rules.options_for(&path)));
+                println!("{} ({} chunks, {} -> {} bytes, from {})", path, chunk_infos.len(), input_data.len(), compressed.len(), args.input[layer].display());
+
+                let (file_index, offset) = outdatfile.write(&compressed);
+                entries.push(proto::FileEntry {
+                    info: Some(proto::FileInfo {
+                        path,
+                        chunks: chunk_infos,
+
+                        chunks_crc32: crc32fast::hash(&compressed),
+                        chunks_sha256: sha2::Sha256::digest(&compressed).to_vec(),
+
+                        original_crc32: crc32fast::hash(&input_data),
+                        original_sha256: sha2::Sha256::digest(&input_data).to_vec(),
+
+                        modified_time: Some(zip_datetime_to_timestamp(file.last_modified())),
+                        priority: 0,
+                    }),
+                    file_index,
+                    body_offset: offset,
+                    body_size: compressed.len() as u64,
+                    ..Default::default()
+                });
+            },
+        }
+    }
+
+    entries.sort_by(|a, b| a.info.as_ref().unwrap().path.cmp(&b.info.as_ref().unwrap().path));
+    let mut directories = directories.into_values().collect::<Vec<_>>();
+    directories.sort_by(|a, b| a.path.cmp(&b.path));
+    // fields which aren't specified are taken from the top-most layer which has metadata
+    let existing = layers.iter().rev().find_map(|l| match l {
+        Layer::Mar(index) => index.metadata.clone(),
+        Layer::Zip(_) => None,
+    });
+    let metadata = args.archive_metadata.to_proto(existing, std::time::SystemTime::now());
+    println!("{} files, {} directories", entries.len(), directories.len());
+    index_file::write_index_file(proto::FileIndexFile { entries, directories, metadata, ..Default::default() }, &mut outidxfile);
+}
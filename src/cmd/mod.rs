@@ -1,3 +1,14 @@
 pub mod create;
 pub mod showsum;
-pub mod split;
\ No newline at end of file
+pub mod split;
+pub mod ls;
+pub mod extract;
+pub mod cat;
+pub mod zip2mar;
+pub mod mar2zip;
+pub mod whiteout;
+pub mod info;
+pub mod merge;
+pub mod vacuum;
+pub mod parity;
+pub mod repair;
\ No newline at end of file
@@ -0,0 +1,71 @@
+use std::path::{Path, PathBuf};
+
+use clap::Parser;
+
+use crate::{format::parity, util::{format_size, parse_size}};
+
+#[derive(Parser)]
+#[command(name = "MAR Parity Writer")]
+pub struct Args {
+    /// .mar file
+    #[arg(short, long)]
+    input: PathBuf,
+
+    #[command(flatten)]
+    parity: ParityArgs,
+}
+
+/// Reed-Solomon parity options shared by create, vacuum and parity
+#[derive(clap::Args)]
+pub struct ParityArgs {
+    /// Write Reed-Solomon parity (<file.mar>.par) with <data>:<parity> blocks, e.g. "20:2" can repair any 2 damaged blocks in each 20 blocks (10% larger)
+    #[arg(long, value_parser = parse_parity)]
+    parity: Option<(usize, usize)>,
+
+    /// Size of parity blocks (K/M/G suffixes are accepted), smaller one can repair scattered damage better but makes .par metadata larger
+    #[arg(long, value_parser = parse_parity_block_size, default_value = "1M")]
+    parity_block_size: u64,
+}
+
+// "20:2" => (20, 2)
+fn parse_parity(s: &str) -> Result<(usize, usize), String> {
+    let (data, parity) = s.split_once(':').ok_or_else(|| format!("expected <data>:<parity>: {}", s))?;
+    let data = data.parse::<usize>().map_err(|e| format!("invalid number of data blocks: {}", e))?;
+    let parity = parity.parse::<usize>().map_err(|e| format!("invalid number of parity blocks: {}", e))?;
+    if data == 0 || parity == 0 || data + parity > 256 {
+        return Err(format!("both numbers must be positive, and their sum must be 256 or less: {}", s));
+    }
+    Ok((data, parity))
+}
+
+fn parse_parity_block_size(s: &str) -> Result<u64, String> {
+    match parse_size(s)? {
+        0 => Err("parity block size must be positive".to_string()),
+        size => Ok(size),
+    }
+}
+
+/// Writes parity of (modified) archive if requested, otherwise removes stale one since it no longer matches
+pub fn update_parity(mar: &Path, args: &ParityArgs, verbose: bool) {
+    let path = parity::par_path(mar);
+    match args.parity {
+        Some((data, parity)) => {
+            let size = parity::write_parity(mar, data, parity, args.parity_block_size);
+            if verbose {
+                println!("Parity: {} ({} parity blocks)", path.display(), format_size(size));
+            }
+        },
+        None => if path.exists() {
+            std::fs::remove_file(&path).unwrap();
+            eprintln!("warning: {} is removed since archive is modified, run `mayakashi parity` to write it again", path.display());
+        },
+    }
+}
+
+pub fn main(args: Args) {
+    if args.parity.parity.is_none() {
+        eprintln!("--parity <data>:<parity> is required");
+        std::process::exit(1);
+    }
+    update_parity(&args.input, &args.parity, true);
+}
@@ -0,0 +1,45 @@
+use std::path::PathBuf;
+
+use clap::Parser;
+
+use crate::format::parity;
+
+#[derive(Parser)]
+#[command(name = "MAR Repair")]
+pub struct Args {
+    /// .mar file (<file.mar>.par is used)
+    #[arg(short, long)]
+    input: PathBuf,
+
+    /// Only check damaged blocks, without writing reconstructed ones
+    #[arg(long)]
+    dry_run: bool,
+}
+
+pub fn main(args: Args) {
+    let reports = parity::repair(&args.input, args.dry_run);
+
+    let mut ok = true;
+    for r in &reports {
+        if r.outdated {
+            println!("{}: larger than when parity was written (modified after that?), skipped", r.path.display());
+            ok = false;
+            continue;
+        }
+        if r.damaged == 0 {
+            println!("{}: OK ({} blocks)", r.path.display(), r.blocks);
+            continue;
+        }
+        match args.dry_run {
+            true => println!("{}: {} of {} blocks are damaged, {} can be repaired", r.path.display(), r.damaged, r.blocks, r.repaired),
+            false => println!("{}: {} of {} blocks are damaged, {} repaired, {} unrecoverable", r.path.display(), r.damaged, r.blocks, r.repaired, r.unrecoverable),
+        }
+        if r.unrecoverable != 0 || args.dry_run {
+            ok = false;
+        }
+    }
+
+    if !ok {
+        std::process::exit(1);
+    }
+}
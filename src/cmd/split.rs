@@ -120,6 +120,7 @@ pub fn main(args: Args) {
                         file_index: 0,
                         body_offset: *offset as u64,
                         body_size: in_entry.body_size,
+                        ..Default::default()
                     }
                 }
                 None => {
@@ -142,6 +143,7 @@ pub fn main(args: Args) {
                         file_index: 0,
                         body_offset: current_offset,
                         body_size: written,
+                        ..Default::default()
                     };
 
                     assert_eq!(in_entry.body_size, written);
@@ -154,6 +156,6 @@ pub fn main(args: Args) {
             out_entries.push(out_entry);
         }
 
-        write_index_file(proto::FileIndexFile { entries: out_entries }, &mut idxfile);
+        write_index_file(proto::FileIndexFile { entries: out_entries, ..Default::default() }, &mut idxfile);
     }
 }
\ No newline at end of file
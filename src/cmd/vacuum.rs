@@ -0,0 +1,147 @@
+use std::{collections::{BTreeMap, HashMap}, path::{Path, PathBuf}};
+
+use clap::Parser;
+
+use crate::{cmd::parity::{update_parity, ParityArgs}, format::{index_file, mar::{self, DatWriter}}, util::{append_to_path, format_size, parse_size}};
+
+#[derive(Parser)]
+#[command(name = "MAR Vacuum")]
+pub struct Args {
+    /// .mar file
+    #[arg(short, long)]
+    input: PathBuf,
+
+    /// Output path, same as create (.mar.idx and .mar.dat will be appended), rewrites input in place if omitted
+    #[arg(short, long)]
+    output: Option<PathBuf>,
+
+    /// Max size of each .dat part, same as create
+    #[arg(long, value_parser = parse_size, default_value_t = 0)]
+    max_dat_size: u64,
+
+    /// Number of .dat parts to write at same time, same as create
+    #[arg(long, default_value_t = 1)]
+    dat_parts: usize,
+
+    #[command(flatten)]
+    parity: ParityArgs,
+}
+
+// total size of existing .dat parts, including ones which aren't referenced at all
+fn dat_sizes(mar: &PathBuf, max_index: u32) -> u64 {
+    (0..).take_while(|&i| i <= max_index || mar::dat_path(mar, i).exists())
+        .filter_map(|i| std::fs::metadata(mar::dat_path(mar, i)).ok())
+        .map(|m| m.len())
+        .sum()
+}
+
+// files of the archive (index and existing .dat parts), which are moved to ".bak" while they are replaced in place
+fn archive_files(mar: &PathBuf, max_index: u32) -> Vec<PathBuf> {
+    let mut files = vec![mar::idx_path(mar)];
+    files.extend((0..).take_while(|&i| i <= max_index || mar::dat_path(mar, i).exists())
+        .map(|i| mar::dat_path(mar, i))
+        .filter(|p| p.exists()));
+    files
+}
+
+fn bak_path(path: &Path) -> PathBuf {
+    append_to_path(path, ".bak")
+}
+
+// replaces archive at input with vacuumed one at output.
+// old files are moved to ".bak" first (index first, so the archive can't be read with mismatched index meanwhile),
+// and removed only after the new index is in place, so interruption never leaves old index pointing rewritten parts.
+fn replace_in_place(input: &PathBuf, output: &PathBuf, tmpidxpath: &PathBuf, old_files: &[PathBuf], part_count: u32) {
+    for (i, path) in old_files.iter().enumerate() {
+        if let Err(e) = std::fs::rename(path, bak_path(path)) {
+            // e.g. parts are opened by marmounter on Windows, nothing is replaced yet
+            for path in &old_files[..i] {
+                std::fs::rename(bak_path(path), path).unwrap();
+            }
+            eprintln!("failed to move {} (is it mounted?): {}", path.display(), e);
+            eprintln!("archive is not modified, vacuumed one is left at {}", output.display());
+            std::process::exit(1);
+        }
+    }
+    let result = (0..part_count)
+        .try_for_each(|i| std::fs::rename(mar::dat_path(output, i), mar::dat_path(input, i)))
+        .and_then(|_| std::fs::rename(tmpidxpath, mar::idx_path(input)));
+    if let Err(e) = result {
+        eprintln!("failed to replace archive: {}", e);
+        eprintln!("original files are kept as *.bak, remove {}* and rename *.bak back to restore it", input.display());
+        std::process::exit(1);
+    }
+    for path in old_files {
+        std::fs::remove_file(bak_path(path)).unwrap();
+    }
+}
+
+pub fn main(args: Args) {
+    let mut index = mar::read_index(&args.input);
+    let max_index = index.entries.iter().map(|e| e.file_index).max().unwrap_or(0);
+    let old_size = dat_sizes(&args.input, max_index);
+    let old_files = archive_files(&args.input, max_index);
+    if args.output.is_none() {
+        if let Some(bak) = old_files.iter().map(|p| bak_path(p)).find(|p| p.exists()) {
+            eprintln!("{} exists, previous vacuum might be interrupted; restore or remove *.bak first", bak.display());
+            std::process::exit(1);
+        }
+    }
+
+    // in place mode writes to "<input>.vacuum.*" first, then renames them
+    let output = match &args.output {
+        Some(output) => append_to_path(output, ".mar"),
+        None => append_to_path(&args.input, ".vacuum"),
+    };
+    let mut outdatfile = DatWriter::new(&output, 0, args.max_dat_size, args.dat_parts);
+
+    // bodies are copied in order of original position (which is path order for single create), and shared ones (create --dedup) stay shared
+    // (file_index, body_offset) => indices of entries
+    let mut bodies = BTreeMap::<(u32, u64), Vec<usize>>::new();
+    for (i, entry) in index.entries.iter_mut().enumerate() {
+        if entry.info.as_ref().unwrap().chunks.is_empty() {
+            // symlinks, whiteouts and empty files don't have body
+            entry.file_index = 0;
+            entry.body_offset = 0;
+            entry.body_size = 0;
+            continue;
+        }
+        bodies.entry((entry.file_index, entry.body_offset)).or_default().push(i);
+    }
+
+    let mut reader = mar::MarReader::new(&args.input);
+    let mut new_size = 0u64;
+    let mut part_count = 0;
+    for indices in bodies.values() {
+        let body = reader.read_chunks(&index.entries[indices[0]]).concat();
+        let (file_index, offset) = outdatfile.write(&body);
+        new_size += body.len() as u64;
+        part_count = part_count.max(file_index + 1);
+        for &i in indices {
+            let entry = &mut index.entries[i];
+            entry.file_index = file_index;
+            entry.body_offset = offset;
+            entry.body_size = body.len() as u64;
+        }
+    }
+    // bodies must be on disk before index which points them replaces the old one
+    outdatfile.sync();
+    drop(outdatfile);
+
+    let entry_count = index.entries.len();
+    let body_count = bodies.len();
+    let tmpidxpath = append_to_path(&mar::idx_path(&output), ".tmp");
+    let mut outidxfile = std::fs::File::create(&tmpidxpath).unwrap();
+    index_file::write_index_file(index, &mut outidxfile);
+    drop(outidxfile);
+
+    match &args.output {
+        Some(_) => std::fs::rename(&tmpidxpath, mar::idx_path(&output)).unwrap(),
+        // parts which are no longer needed (all of their bodies are dead, or moved to earlier parts) are removed with other .bak files
+        None => replace_in_place(&args.input, &output, &tmpidxpath, &old_files, part_count),
+    }
+    update_parity(args.output.as_ref().map_or(&args.input, |_| &output), &args.parity, true);
+
+    println!("{} entries, {} bodies", entry_count, body_count);
+    println!(".dat size: {} -> {} ({} reclaimed)", format_size(old_size), format_size(new_size), format_size(old_size.saturating_sub(new_size)));
+}
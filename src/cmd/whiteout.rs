@@ -0,0 +1,99 @@
+use std::{collections::{HashMap, HashSet}, ffi::OsString, io::BufRead, path::PathBuf};
+
+use clap::Parser;
+
+use crate::{cmd::create::walk_dir, format::{index_file, mar}, proto, util::normalize_archive_path};
+
+#[derive(Parser)]
+#[command(name = "MAR Whiteout Maker")]
+pub struct Args {
+    /// Base archive (.mar), whiteouts are only generated for files which exist in this archive
+    #[arg(short, long)]
+    base: PathBuf,
+
+    /// Output path, same as create (.mar.idx and .mar.dat will be appended)
+    #[arg(short, long)]
+    output: PathBuf,
+
+    /// Path to whiteout (can be specified multiple times)
+    #[arg(short, long)]
+    path: Vec<String>,
+
+    /// File which contains paths to whiteout (one path per line)
+    #[arg(short, long)]
+    list: Option<PathBuf>,
+
+    /// Whiteout files which exist in base archive but not in this directory
+    #[arg(short, long)]
+    dir: Option<PathBuf>,
+}
+
+pub fn main(args: Args) {
+    let base = mar::read_index(&args.base);
+    // lower-cased path => path in base archive
+    let base_paths = base.entries.iter()
+        .map(|e| e.info.as_ref().unwrap().path.clone())
+        .filter(|p| !p.ends_with(mar::WHITEOUT_SUFFIX))
+        .map(|p| (normalize_archive_path(&p).to_lowercase(), p))
+        .collect::<HashMap<_, _>>();
+
+    let mut requested = args.path.clone();
+    if let Some(list) = &args.list {
+        for line in std::io::BufReader::new(std::fs::File::open(list).unwrap()).lines() {
+            let line = line.unwrap();
+            if !line.is_empty() {
+                requested.push(line);
+            }
+        }
+    }
+    if let Some(dir) = &args.dir {
+        let (files, _) = walk_dir(dir, false);
+        let prefix = dir.to_str().unwrap();
+        let existing = files.iter()
+            .map(|f| normalize_archive_path(&f.path.to_str().unwrap()[prefix.len()..]).to_lowercase())
+            .collect::<HashSet<_>>();
+        for (lower_path, path) in &base_paths {
+            if !existing.contains(lower_path) {
+                requested.push(path.clone());
+            }
+        }
+    }
+
+    let mut whiteouts = HashSet::new();
+    for path in requested {
+        match base_paths.get(&normalize_archive_path(&path).to_lowercase()) {
+            Some(base_path) => {
+                whiteouts.insert(base_path.clone());
+            }
+            None => println!("not found in base archive, skipped: {}", path),
+        }
+    }
+
+    let mut entries = whiteouts.into_iter().map(|path| proto::FileEntry {
+        info: Some(proto::FileInfo {
+            path: format!("{}{}", path, mar::WHITEOUT_SUFFIX),
+            ..Default::default()
+        }),
+        file_index: 0,
+        body_offset: 0,
+        body_size: 0,
+        ..Default::default()
+    }).collect::<Vec<_>>();
+    entries.sort_by(|a, b| a.info.as_ref().unwrap().path.cmp(&b.info.as_ref().unwrap().path));
+    for e in &entries {
+        println!("whiteout {}", e.info.as_ref().unwrap().path);
+    }
+
+    // whiteout doesn't have body, but create empty .dat to keep archive complete
+    std::fs::File::create({
+        let mut outfile = OsString::from(&args.output);
+        outfile.push(".mar.dat");
+        outfile
+    }).unwrap();
+    let mut outidxfile = std::fs::File::create({
+        let mut outfile = OsString::from(&args.output);
+        outfile.push(".mar.idx");
+        outfile
+    }).unwrap();
+    index_file::write_index_file(proto::FileIndexFile { entries, ..Default::default() }, &mut outidxfile);
+}
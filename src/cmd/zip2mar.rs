@@ -0,0 +1,104 @@
+use std::{ffi::OsString, io::Read, path::PathBuf};
+
+use clap::Parser;
+use sha2::Digest;
+
+use crate::{cmd::create::{compress_file, concat_chunks, ArchiveMetadataArgs, CompressArgs, CompressRules}, format::{index_file, mar::DatWriter}, proto, util::{append_to_path, days_from_civil, normalize_archive_path, parse_size}};
+
+#[derive(Parser)]
+#[command(name = "ZIP to MAR Converter")]
+pub struct Args {
+    #[arg(short, long)]
+    input: PathBuf,
+
+    /// Output path, same as create (.mar.idx and .mar.dat will be appended)
+    #[arg(short, long)]
+    output: PathBuf,
+
+    /// Write zstd chunks as zstd seekable format with this frame size, same as create
+    #[arg(long, default_value_t = 0)]
+    seekable_frame_size: usize,
+
+    /// Max size of each .dat part, same as create
+    #[arg(long, value_parser = parse_size, default_value_t = 0)]
+    max_dat_size: u64,
+
+    /// Number of .dat parts to write at same time, same as create
+    #[arg(long, default_value_t = 1)]
+    dat_parts: usize,
+
+    #[command(flatten)]
+    compress: CompressArgs,
+
+    #[command(flatten)]
+    archive_metadata: ArchiveMetadataArgs,
+}
+
+// zip stores local time without timezone, we treat it as UTC like marmounter does
+pub fn zip_datetime_to_timestamp(dt: zip::DateTime) -> prost_types::Timestamp {
+    let days = days_from_civil(dt.year() as i64, dt.month() as u32, dt.day() as u32);
+    prost_types::Timestamp {
+        seconds: days * 86400 + dt.hour() as i64 * 3600 + dt.minute() as i64 * 60 + dt.second() as i64,
+        nanos: 0,
+    }
+}
+
+pub fn main(args: Args) {
+    let mut archive = zip::ZipArchive::new(std::fs::File::open(&args.input).unwrap()).unwrap();
+
+    let mut outdatfile = DatWriter::new(&append_to_path(&args.output, ".mar"), 0, args.max_dat_size, args.dat_parts);
+    let mut outidxfile = std::fs::File::create({
+        let mut outfile = OsString::from(&args.output);
+        outfile.push(".mar.idx");
+        outfile
+    }).unwrap();
+
+    let compress_rules = CompressRules::new(&args.compress, args.seekable_frame_size);
+    let mut entries = Vec::<proto::FileEntry>::with_capacity(archive.len());
+    let mut directories = Vec::<proto::DirectoryEntry>::new();
+
+    for i in 0..archive.len() {
+        let mut file = archive.by_index(i).unwrap();
+        if file.is_dir() {
+            directories.push(proto::DirectoryEntry {
+                path: normalize_archive_path(file.name().trim_end_matches('/')),
+                modified_time: Some(zip_datetime_to_timestamp(file.last_modified())),
+            });
+            continue;
+        }
+
+        let mut input_data = Vec::with_capacity(file.size() as usize);
+        file.read_to_end(&mut input_data).unwrap();
+
+        let path = normalize_archive_path(file.name());
+        let (chunk_infos, compressed) = concat_chunks(compress_file(&input_data, &compress_rules.options_for(&path)));
+        println!("{} ({} chunks, {} -> {} bytes)", path, chunk_infos.len(), input_data.len(), compressed.len());
+
+        let (file_index, offset) = outdatfile.write(&compressed);
+
+        entries.push(proto::FileEntry {
+            info: Some(proto::FileInfo {
+                path,
+                chunks: chunk_infos,
+
+                chunks_crc32: crc32fast::hash(&compressed),
+                chunks_sha256: sha2::Sha256::digest(&compressed).to_vec(),
+
+                original_crc32: crc32fast::hash(&input_data),
+                original_sha256: sha2::Sha256::digest(&input_data).to_vec(),
+
+                modified_time: Some(zip_datetime_to_timestamp(file.last_modified())),
+                priority: 0,
+            }),
+            file_index,
+            body_offset: offset,
+            body_size: compressed.len() as u64,
+            ..Default::default()
+        });
+    }
+
+    entries.sort_by(|a, b| a.info.as_ref().unwrap().path.cmp(&b.info.as_ref().unwrap().path));
+    directories.sort_by(|a, b| a.path.cmp(&b.path));
+    let metadata = args.archive_metadata.to_proto(None, std::time::SystemTime::now());
+    index_file::write_index_file(proto::FileIndexFile { entries, directories, metadata, ..Default::default() }, &mut outidxfile);
+}
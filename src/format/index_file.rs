@@ -1,16 +1,19 @@
 use std::io::{Read, Write};
 
 use prost::Message;
+use sha2::Digest;
 
 use crate::proto;
 
 const INDEX_MAGIC: &[u8; 4] = b"MARI";
+const INDEX_CHECKSUM_MAGIC: &[u8; 4] = b"SHA2";
 
 pub fn parse_index_file(input: &mut impl Read) -> proto::FileIndexFile {
     // first 4 bytes: INDEX_MAGIC
     // next 4 bytes: compressed length (big-endian)
     // next 4 bytes: raw length (big-endian)
     // (data)
+    // optional (older index doesn't have it): INDEX_CHECKSUM_MAGIC and sha256 of (data)
 
     let mut magic = [0; 4];
     input.read_exact(&mut magic).unwrap();
@@ -25,8 +28,17 @@ pub fn parse_index_file(input: &mut impl Read) -> proto::FileIndexFile {
     let raw_len = u32::from_be_bytes(raw_len);
 
     let mut compressed = Vec::with_capacity(compressed_len as usize);
-    let mut l = input.take(compressed_len as u64);
+    let mut l = input.by_ref().take(compressed_len as u64);
     l.read_to_end(&mut compressed).unwrap();
+    assert_eq!(compressed.len(), compressed_len as usize, "index is truncated");
+
+    let mut trailer = Vec::new();
+    input.read_to_end(&mut trailer).unwrap();
+    if !trailer.is_empty() {
+        assert_eq!(trailer.len(), 4 + 32, "index has unknown trailer");
+        assert_eq!(&trailer[..4], INDEX_CHECKSUM_MAGIC, "index has unknown trailer");
+        assert_eq!(&trailer[4..], sha2::Sha256::digest(&compressed).as_slice(), "index is corrupted (checksum mismatch)");
+    }
 
     let raw = zstd::decode_all(&compressed[..]).unwrap();
     assert_eq!(raw.len(), raw_len as usize);
@@ -34,7 +46,32 @@ pub fn parse_index_file(input: &mut impl Read) -> proto::FileIndexFile {
     return proto::FileIndexFile::decode(&raw[..]).unwrap();
 }
 
-pub fn write_index_file(file: proto::FileIndexFile, output: &mut impl Write) {
+// v2: each entries have chunk offset tables
+pub const INDEX_VERSION: u32 = 2;
+
+// fill chunk_original_offsets and chunk_dat_offsets from chunks
+fn fill_chunk_offsets(entry: &mut proto::FileEntry) {
+    entry.chunk_original_offsets.clear();
+    entry.chunk_dat_offsets.clear();
+    let chunks = match entry.info.as_ref() {
+        Some(info) => &info.chunks,
+        None => return,
+    };
+    let mut original_offset = 0;
+    let mut dat_offset = entry.body_offset;
+    for chunk in chunks {
+        entry.chunk_original_offsets.push(original_offset);
+        entry.chunk_dat_offsets.push(dat_offset);
+        original_offset += chunk.original_length as u64;
+        dat_offset += chunk.compressed_length as u64;
+    }
+}
+
+pub fn write_index_file(mut file: proto::FileIndexFile, output: &mut impl Write) {
+    for entry in &mut file.entries {
+        fill_chunk_offsets(entry);
+    }
+    file.version = INDEX_VERSION;
     let index_file_bytes = file.encode_to_vec();
     let index_file_len = index_file_bytes.len();
     let index_file_bytes = zstd::encode_all(&index_file_bytes[..], 22).unwrap();
@@ -43,4 +80,6 @@ pub fn write_index_file(file: proto::FileIndexFile, output: &mut impl Write) {
     output.write_all(&(index_file_bytes.len() as u32).to_be_bytes()).unwrap();
     output.write_all(&(index_file_len as u32).to_be_bytes()).unwrap();
     output.write_all(&index_file_bytes).unwrap();
+    output.write_all(INDEX_CHECKSUM_MAGIC).unwrap();
+    output.write_all(sha2::Sha256::digest(&index_file_bytes).as_slice()).unwrap();
 }
\ No newline at end of file
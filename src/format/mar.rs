@@ -0,0 +1,256 @@
+use std::{collections::HashMap, fs::File, io::{Read, Seek, SeekFrom, Write}, path::{Path, PathBuf}};
+
+use sha2::Digest;
+
+use crate::{format::index_file, proto::{self, CompressedMethod}, util::append_to_path};
+
+pub const WHITEOUT_SUFFIX: &str = ".__whiteout__";
+
+// "/a/b/c.mar" => "/a/b/c.mar.idx"
+pub fn idx_path(mar: &Path) -> PathBuf {
+    append_to_path(mar, ".idx")
+}
+
+// "/a/b/c.mar", 0 => "/a/b/c.mar.dat"
+// "/a/b/c.mar", 1 => "/a/b/c.mar.1.dat"
+pub fn dat_path(mar: &Path, file_index: u32) -> PathBuf {
+    match file_index {
+        0 => append_to_path(mar, ".dat"),
+        n => append_to_path(mar, &format!(".{}.dat", n)),
+    }
+}
+
+pub fn read_index(mar: &Path) -> proto::FileIndexFile {
+    let mut f = std::fs::File::open(idx_path(mar)).unwrap();
+    index_file::parse_index_file(&mut f)
+}
+
+pub fn original_size(info: &proto::FileInfo) -> u64 {
+    info.chunks.iter().map(|c| c.original_length as u64).sum()
+}
+
+// e.g. "LZ4+ZSTANDARD"
+pub fn methods_name(info: &proto::FileInfo) -> String {
+    let mut methods = Vec::new();
+    for chunk in &info.chunks {
+        let name = chunk.compressed_method().as_str_name();
+        if !methods.contains(&name) {
+            methods.push(name);
+        }
+    }
+    methods.join("+")
+}
+
+pub fn decompress_chunk(chunk: &proto::ChunkInfo, compressed: &[u8]) -> Vec<u8> {
+    let decompressed = match chunk.compressed_method() {
+        CompressedMethod::Passthrough => compressed.to_vec(),
+        CompressedMethod::Zstandard => zstd::decode_all(compressed).unwrap(),
+        CompressedMethod::Lz4 => lz4::block::decompress(compressed, Some(chunk.original_length as i32)).unwrap(),
+        CompressedMethod::Zero => vec![0; chunk.original_length as usize],
+    };
+    assert_eq!(decompressed.len(), chunk.original_length as usize);
+    decompressed
+}
+
+// check decompressed data with original_sha256 (or original_crc32 if sha256 is missing)
+pub fn verify(info: &proto::FileInfo, data: &[u8]) -> bool {
+    if !info.original_sha256.is_empty() {
+        return sha2::Sha256::digest(data).as_slice() == info.original_sha256.as_slice();
+    }
+    crc32fast::hash(data) == info.original_crc32
+}
+
+/// Checks decompressed data which is fed in pieces, same as verify
+pub enum Verifier {
+    Sha256(sha2::Sha256),
+    Crc32(crc32fast::Hasher),
+}
+
+impl Verifier {
+    pub fn new(info: &proto::FileInfo) -> Self {
+        match info.original_sha256.is_empty() {
+            false => Self::Sha256(sha2::Sha256::new()),
+            true => Self::Crc32(crc32fast::Hasher::new()),
+        }
+    }
+
+    pub fn update(&mut self, data: &[u8]) {
+        match self {
+            Self::Sha256(hasher) => hasher.update(data),
+            Self::Crc32(hasher) => hasher.update(data),
+        }
+    }
+
+    pub fn finish(self, info: &proto::FileInfo) -> bool {
+        match self {
+            Self::Sha256(hasher) => hasher.finalize().as_slice() == info.original_sha256.as_slice(),
+            Self::Crc32(hasher) => hasher.finalize() == info.original_crc32,
+        }
+    }
+}
+
+/// Reads file bodies from .dat files of MAR archive
+pub struct MarReader {
+    path: PathBuf,
+    dat_files: HashMap<u32, File>,
+}
+
+impl MarReader {
+    pub fn new(mar: &Path) -> Self {
+        Self {
+            path: mar.to_path_buf(),
+            dat_files: HashMap::new(),
+        }
+    }
+
+    fn dat_file(&mut self, file_index: u32) -> &mut File {
+        let path = &self.path;
+        self.dat_files.entry(file_index).or_insert_with(|| File::open(dat_path(path, file_index)).unwrap())
+    }
+
+    // returns (still compressed) chunks of entry
+    pub fn read_chunks(&mut self, entry: &proto::FileEntry) -> Vec<Vec<u8>> {
+        let info = entry.info.as_ref().unwrap();
+        let dat = self.dat_file(entry.file_index);
+        dat.seek(SeekFrom::Start(entry.body_offset)).unwrap();
+        let mut chunks = Vec::with_capacity(info.chunks.len());
+        for chunk in &info.chunks {
+            let mut buf = vec![0; chunk.compressed_length as usize];
+            dat.read_exact(&mut buf).unwrap();
+            chunks.push(buf);
+        }
+        chunks
+    }
+
+    /// Decompresses entry into w chunk by chunk (so whole file is never in memory), and returns whether it matches its hash.
+    /// Data is already written when it turns out to be broken.
+    pub fn write_entry(&mut self, entry: &proto::FileEntry, w: &mut impl Write) -> std::io::Result<bool> {
+        let info = entry.info.as_ref().unwrap();
+        let mut verifier = Verifier::new(info);
+        let dat = self.dat_file(entry.file_index);
+        dat.seek(SeekFrom::Start(entry.body_offset))?;
+        let mut compressed = Vec::new();
+        for chunk in &info.chunks {
+            compressed.resize(chunk.compressed_length as usize, 0);
+            dat.read_exact(&mut compressed)?;
+            let data = decompress_chunk(chunk, &compressed);
+            verifier.update(&data);
+            w.write_all(&data)?;
+        }
+        Ok(verifier.finish(info))
+    }
+
+    pub fn read_entry(&mut self, entry: &proto::FileEntry) -> Vec<u8> {
+        let info = entry.info.as_ref().unwrap();
+        let mut data = Vec::with_capacity(original_size(info) as usize);
+        for (chunk, compressed) in info.chunks.iter().zip(self.read_chunks(entry)) {
+            data.append(&mut decompress_chunk(chunk, &compressed));
+        }
+        data
+    }
+}
+
+struct DatPart {
+    file_index: u32,
+    file: File,
+    size: u64,
+    full: bool,
+}
+
+/// Writes file bodies into .dat files of MAR archive, splitting them into parts if needed
+/// (body is never split, since FileEntry can point only one .dat file)
+pub struct DatWriter {
+    path: PathBuf,
+    next_index: u32,
+    // 0 means unlimited
+    max_size: u64,
+    // number of parts which are written at same time, body goes to smallest one
+    balance: usize,
+    parts: Vec<DatPart>,
+    // don't print paths of new parts
+    pub quiet: bool,
+    // existing part which empty bodies (empty or all-ZERO files) point to while no part is opened,
+    // so appending only such files doesn't create an empty part
+    pub empty_body_index: Option<u32>,
+}
+
+impl DatWriter {
+    pub fn new(mar: &Path, first_index: u32, max_size: u64, balance: usize) -> Self {
+        Self {
+            path: mar.to_path_buf(),
+            next_index: first_index,
+            max_size,
+            balance: balance.max(1),
+            parts: Vec::new(),
+            quiet: false,
+            empty_body_index: None,
+        }
+    }
+
+    fn open_part(&mut self) -> usize {
+        let path = dat_path(&self.path, self.next_index);
+        if !self.quiet {
+            println!("Output: {}", path.display());
+        }
+        self.parts.push(DatPart {
+            file_index: self.next_index,
+            file: File::create(path).unwrap(),
+            size: 0,
+            full: false,
+        });
+        self.next_index += 1;
+        self.parts.len() - 1
+    }
+
+    /// Reopens existing part (e.g. to resume interrupted packing), bytes after `size` are discarded
+    pub fn reopen(&mut self, file_index: u32, size: u64) {
+        let mut file = std::fs::OpenOptions::new().write(true).open(dat_path(&self.path, file_index)).unwrap();
+        file.set_len(size).unwrap();
+        file.seek(SeekFrom::End(0)).unwrap();
+        self.parts.push(DatPart {
+            file_index,
+            file,
+            size,
+            full: false,
+        });
+        self.next_index = self.next_index.max(file_index + 1);
+    }
+
+    // makes sure written bodies are on disk, before recording entries which point them
+    pub fn sync(&self) {
+        for part in &self.parts {
+            part.file.sync_data().unwrap();
+        }
+    }
+
+    // returns (file_index, body_offset)
+    pub fn write(&mut self, body: &[u8]) -> (u32, u64) {
+        let body_size = body.len() as u64;
+        if body_size == 0 {
+            if let Some(part) = self.parts.first() {
+                return (part.file_index, part.size);
+            }
+            if let Some(file_index) = self.empty_body_index {
+                return (file_index, 0);
+            }
+        }
+        let active = self.parts.iter().filter(|p| !p.full).count();
+        let mut i = match active < self.balance {
+            true => self.open_part(),
+            false => (0..self.parts.len()).filter(|&i| !self.parts[i].full).min_by_key(|&i| self.parts[i].size).unwrap(),
+        };
+        if self.max_size != 0 && self.parts[i].size != 0 && self.parts[i].size + body_size > self.max_size {
+            self.parts[i].full = true;
+            i = self.open_part();
+        }
+        if self.max_size != 0 && body_size > self.max_size {
+            eprintln!("warning: body ({} bytes) is larger than max .dat size, part {} will exceed the limit", body_size, self.parts[i].file_index);
+        }
+
+        let part = &mut self.parts[i];
+        let offset = part.size;
+        part.file.write_all(body).unwrap();
+        part.size += body_size;
+        (part.file_index, offset)
+    }
+}
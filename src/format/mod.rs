@@ -1 +1,4 @@
-pub mod index_file;
\ No newline at end of file
+pub mod index_file;
+pub mod mar;
+pub mod tar;
+pub mod parity;
@@ -0,0 +1,368 @@
+use std::{collections::BTreeSet, fs::File, io::{Read, Seek, SeekFrom, Write}, path::{Path, PathBuf}};
+
+use crate::{format::mar, util::append_to_path};
+
+// Reed-Solomon parity of .mar.idx and .dat parts (<file.mar>.par), to repair bit rot without redownloading whole archive
+//
+// Each file is split into blocks, and each stripe of `data` blocks gets `parity` parity blocks, so any `parity` damaged blocks in the stripe can be reconstructed.
+// Blocks of a stripe are interleaved (stripe s has block s, s + stripes, s + stripes * 2, ...), so burst damage (e.g. bad sectors) is spread across stripes.
+//
+// Layout: parity blocks, metadata, footer (metadata offset: u64, crc32 of metadata: u32, MAGIC), all integers are little endian
+
+const MAGIC: &[u8; 8] = b"MARPAR01";
+const FOOTER_SIZE: u64 = 8 + 4 + 8;
+// file_index for .mar.idx
+const IDX_FILE_INDEX: u32 = u32::MAX;
+
+// "/a/b/c.mar" => "/a/b/c.mar.par"
+pub fn par_path(mar: &Path) -> PathBuf {
+    append_to_path(mar, ".par")
+}
+
+// .mar.idx and .dat parts which are referenced by it
+fn protected_files(mar: &Path) -> Vec<(u32, PathBuf)> {
+    let index = mar::read_index(mar);
+    let dat_indices = index.entries.iter().filter(|e| e.body_size != 0).map(|e| e.file_index).collect::<BTreeSet<_>>();
+    let mut files = vec![(IDX_FILE_INDEX, mar::idx_path(mar))];
+    files.extend(dat_indices.into_iter().map(|i| (i, mar::dat_path(mar, i))));
+    files
+}
+
+// GF(2^8) with polynomial x^8 + x^4 + x^3 + x^2 + 1
+struct Gf {
+    exp: [u8; 512],
+    log: [u8; 256],
+}
+
+const GF: Gf = {
+    let mut exp = [0; 512];
+    let mut log = [0; 256];
+    let mut x: u16 = 1;
+    let mut i = 0;
+    while i < 255 {
+        exp[i] = x as u8;
+        exp[i + 255] = x as u8;
+        log[x as usize] = i as u8;
+        x <<= 1;
+        if x & 0x100 != 0 {
+            x ^= 0x11d;
+        }
+        i += 1;
+    }
+    Gf { exp, log }
+};
+
+fn gf_mul(a: u8, b: u8) -> u8 {
+    match a == 0 || b == 0 {
+        true => 0,
+        false => GF.exp[GF.log[a as usize] as usize + GF.log[b as usize] as usize],
+    }
+}
+
+fn gf_inv(a: u8) -> u8 {
+    GF.exp[255 - GF.log[a as usize] as usize]
+}
+
+// dst ^= src * c
+fn gf_mul_add(dst: &mut [u8], src: &[u8], c: u8) {
+    if c == 0 {
+        return;
+    }
+    let log_c = GF.log[c as usize] as usize;
+    for (d, &s) in dst.iter_mut().zip(src) {
+        if s != 0 {
+            *d ^= GF.exp[GF.log[s as usize] as usize + log_c];
+        }
+    }
+}
+
+// coefficients of Cauchy matrix, any square submatrix of [identity; cauchy] is invertible
+fn coefficient(data: usize, p: usize, j: usize) -> u8 {
+    gf_inv((data + p) as u8 ^ j as u8)
+}
+
+// Gauss-Jordan elimination, matrix is always invertible if rows are taken from [identity; cauchy]
+fn invert(mut m: Vec<Vec<u8>>) -> Vec<Vec<u8>> {
+    let n = m.len();
+    let mut inv = (0..n).map(|i| (0..n).map(|j| (i == j) as u8).collect::<Vec<_>>()).collect::<Vec<_>>();
+    for col in 0..n {
+        let pivot = (col..n).find(|&r| m[r][col] != 0).expect("parity matrix is singular");
+        m.swap(col, pivot);
+        inv.swap(col, pivot);
+        let scale = gf_inv(m[col][col]);
+        for j in 0..n {
+            m[col][j] = gf_mul(m[col][j], scale);
+            inv[col][j] = gf_mul(inv[col][j], scale);
+        }
+        for r in 0..n {
+            let factor = m[r][col];
+            if r == col || factor == 0 {
+                continue;
+            }
+            for j in 0..n {
+                m[r][j] ^= gf_mul(m[col][j], factor);
+                inv[r][j] ^= gf_mul(inv[col][j], factor);
+            }
+        }
+    }
+    inv
+}
+
+/// Parity of a file
+struct FileParity {
+    file_index: u32,
+    size: u64,
+    // offset of first parity block in .par
+    parity_offset: u64,
+    // crc32 of each (zero padded) data block
+    data_crcs: Vec<u32>,
+    // crc32 of each parity block, stripe-major
+    parity_crcs: Vec<u32>,
+}
+
+struct ParityFile {
+    data: usize,
+    parity: usize,
+    block_size: u64,
+    files: Vec<FileParity>,
+}
+
+impl ParityFile {
+    fn stripes(&self, size: u64) -> u64 {
+        size.div_ceil(self.block_size).div_ceil(self.data as u64)
+    }
+
+    fn encode_metadata(&self) -> Vec<u8> {
+        let mut buf = Vec::new();
+        buf.extend((self.data as u32).to_le_bytes());
+        buf.extend((self.parity as u32).to_le_bytes());
+        buf.extend(self.block_size.to_le_bytes());
+        buf.extend((self.files.len() as u32).to_le_bytes());
+        for f in &self.files {
+            buf.extend(f.file_index.to_le_bytes());
+            buf.extend(f.size.to_le_bytes());
+            buf.extend(f.parity_offset.to_le_bytes());
+            // number of crcs can be calculated from size
+            for crc in f.data_crcs.iter().chain(&f.parity_crcs) {
+                buf.extend(crc.to_le_bytes());
+            }
+        }
+        buf
+    }
+
+    fn decode_metadata(buf: &[u8]) -> Self {
+        let mut rest = buf;
+        let mut take = |n: usize| {
+            assert!(rest.len() >= n, "parity file is corrupted (metadata is truncated)");
+            let (head, tail) = rest.split_at(n);
+            rest = tail;
+            head
+        };
+        let mut parity_file = Self {
+            data: u32::from_le_bytes(take(4).try_into().unwrap()) as usize,
+            parity: u32::from_le_bytes(take(4).try_into().unwrap()) as usize,
+            block_size: u64::from_le_bytes(take(8).try_into().unwrap()),
+            files: Vec::new(),
+        };
+        let count = u32::from_le_bytes(take(4).try_into().unwrap());
+        for _ in 0..count {
+            let file_index = u32::from_le_bytes(take(4).try_into().unwrap());
+            let size = u64::from_le_bytes(take(8).try_into().unwrap());
+            let parity_offset = u64::from_le_bytes(take(8).try_into().unwrap());
+            let blocks = size.div_ceil(parity_file.block_size);
+            let parity_blocks = parity_file.stripes(size) * parity_file.parity as u64;
+            let mut crcs = (0..blocks + parity_blocks).map(|_| u32::from_le_bytes(take(4).try_into().unwrap())).collect::<Vec<_>>();
+            let parity_crcs = crcs.split_off(blocks as usize);
+            parity_file.files.push(FileParity { file_index, size, parity_offset, data_crcs: crcs, parity_crcs });
+        }
+        parity_file
+    }
+}
+
+// reads block, zero padded if file is shorter than it
+fn read_block(file: Option<&mut File>, index: u64, block_size: u64) -> Vec<u8> {
+    let mut block = Vec::with_capacity(block_size as usize);
+    if let Some(file) = file {
+        file.seek(SeekFrom::Start(index * block_size)).unwrap();
+        file.take(block_size).read_to_end(&mut block).unwrap();
+    }
+    block.resize(block_size as usize, 0);
+    block
+}
+
+// data block of shard j in stripe s, None if it's out of file (treated as zeros)
+fn data_block_index(s: u64, j: usize, stripes: u64, blocks: u64) -> Option<u64> {
+    let index = s + j as u64 * stripes;
+    (index < blocks).then_some(index)
+}
+
+/// Writes <file.mar>.par for .mar.idx and .dat parts, returns size of parity blocks
+pub fn write_parity(mar: &Path, data: usize, parity: usize, block_size: u64) -> u64 {
+    assert!(data != 0 && parity != 0 && data + parity <= 256, "number of data + parity blocks must be 2..=256");
+    let path = par_path(mar);
+    let tmppath = append_to_path(&path, ".tmp");
+    let mut out = File::create(&tmppath).unwrap();
+    let mut parity_file = ParityFile { data, parity, block_size, files: Vec::new() };
+    let mut offset = 0u64;
+
+    for (file_index, file_path) in protected_files(mar) {
+        let mut file = File::open(&file_path).unwrap_or_else(|e| panic!("failed to open {}: {}", file_path.display(), e));
+        let size = file.metadata().unwrap().len();
+        let blocks = size.div_ceil(block_size);
+        let stripes = parity_file.stripes(size);
+        let mut file_parity = FileParity { file_index, size, parity_offset: offset, data_crcs: vec![0; blocks as usize], parity_crcs: Vec::new() };
+
+        for s in 0..stripes {
+            let mut parity_blocks = vec![vec![0u8; block_size as usize]; parity];
+            for j in 0..data {
+                let Some(index) = data_block_index(s, j, stripes, blocks) else {
+                    continue;
+                };
+                let block = read_block(Some(&mut file), index, block_size);
+                file_parity.data_crcs[index as usize] = crc32fast::hash(&block);
+                for (p, parity_block) in parity_blocks.iter_mut().enumerate() {
+                    gf_mul_add(parity_block, &block, coefficient(data, p, j));
+                }
+            }
+            for parity_block in &parity_blocks {
+                file_parity.parity_crcs.push(crc32fast::hash(parity_block));
+                out.write_all(parity_block).unwrap();
+            }
+            offset += block_size * parity as u64;
+        }
+        parity_file.files.push(file_parity);
+    }
+
+    let metadata = parity_file.encode_metadata();
+    out.write_all(&metadata).unwrap();
+    out.write_all(&offset.to_le_bytes()).unwrap();
+    out.write_all(&crc32fast::hash(&metadata).to_le_bytes()).unwrap();
+    out.write_all(MAGIC).unwrap();
+    out.sync_all().unwrap();
+    drop(out);
+    std::fs::rename(&tmppath, &path).unwrap();
+    offset
+}
+
+/// Result of repair for a file
+pub struct RepairReport {
+    pub path: PathBuf,
+    pub blocks: u64,
+    pub damaged: u64,
+    pub repaired: u64,
+    pub unrecoverable: u64,
+    // file is larger than when parity was written, so it's not checked
+    pub outdated: bool,
+}
+
+fn read_parity_file(par: &mut File) -> ParityFile {
+    let len = par.metadata().unwrap().len();
+    assert!(len >= FOOTER_SIZE, "parity file is corrupted (too short)");
+    let mut footer = [0u8; FOOTER_SIZE as usize];
+    par.seek(SeekFrom::Start(len - FOOTER_SIZE)).unwrap();
+    par.read_exact(&mut footer).unwrap();
+    assert_eq!(&footer[12..], MAGIC, "not a parity file (or footer is corrupted)");
+    let metadata_offset = u64::from_le_bytes(footer[0..8].try_into().unwrap());
+    let metadata_crc = u32::from_le_bytes(footer[8..12].try_into().unwrap());
+    assert!(metadata_offset <= len - FOOTER_SIZE, "parity file is corrupted (invalid metadata offset)");
+
+    let mut metadata = vec![0; (len - FOOTER_SIZE - metadata_offset) as usize];
+    par.seek(SeekFrom::Start(metadata_offset)).unwrap();
+    par.read_exact(&mut metadata).unwrap();
+    assert_eq!(crc32fast::hash(&metadata), metadata_crc, "parity file is corrupted (metadata checksum mismatch)");
+    ParityFile::decode_metadata(&metadata)
+}
+
+/// Checks .mar.idx and .dat parts with <file.mar>.par, and reconstructs damaged blocks (unless dry_run)
+pub fn repair(mar: &Path, dry_run: bool) -> Vec<RepairReport> {
+    let mut par = File::open(par_path(mar)).unwrap_or_else(|e| panic!("failed to open {}: {}", par_path(mar).display(), e));
+    let parity_file = read_parity_file(&mut par);
+    let (data, parity, block_size) = (parity_file.data, parity_file.parity, parity_file.block_size);
+
+    let mut reports = Vec::new();
+    for f in &parity_file.files {
+        let path = match f.file_index {
+            IDX_FILE_INDEX => mar::idx_path(mar),
+            i => mar::dat_path(mar, i),
+        };
+        // missing file is treated as empty one, and recreated
+        let mut file = match dry_run {
+            true => File::open(&path).ok(),
+            false => Some(std::fs::OpenOptions::new().read(true).write(true).create(true).truncate(false).open(&path).unwrap()),
+        };
+        let current_size = file.as_ref().map_or(0, |file| file.metadata().unwrap().len());
+        let blocks = f.data_crcs.len() as u64;
+        let mut report = RepairReport { path, blocks, damaged: 0, repaired: 0, unrecoverable: 0, outdated: current_size > f.size };
+        if report.outdated {
+            reports.push(report);
+            continue;
+        }
+
+        let stripes = parity_file.stripes(f.size);
+        for s in 0..stripes {
+            // (row of coefficient matrix, block) which are intact
+            let mut available = Vec::<(Vec<u8>, Vec<u8>)>::with_capacity(data);
+            // (shard, block index) which need to be reconstructed
+            let mut damaged = Vec::<(usize, u64)>::new();
+            for j in 0..data {
+                let row = (0..data).map(|i| (i == j) as u8).collect::<Vec<_>>();
+                let Some(index) = data_block_index(s, j, stripes, blocks) else {
+                    available.push((row, vec![0; block_size as usize]));
+                    continue;
+                };
+                let block = read_block(file.as_mut(), index, block_size);
+                match crc32fast::hash(&block) == f.data_crcs[index as usize] {
+                    true => available.push((row, block)),
+                    false => damaged.push((j, index)),
+                }
+            }
+            if damaged.is_empty() {
+                continue;
+            }
+            report.damaged += damaged.len() as u64;
+
+            for p in 0..parity {
+                if available.len() >= data {
+                    break;
+                }
+                let block = read_block(Some(&mut par), (f.parity_offset / block_size) + s * parity as u64 + p as u64, block_size);
+                if crc32fast::hash(&block) == f.parity_crcs[(s * parity as u64) as usize + p] {
+                    available.push(((0..data).map(|j| coefficient(data, p, j)).collect(), block));
+                }
+            }
+            if available.len() < data {
+                report.unrecoverable += damaged.len() as u64;
+                continue;
+            }
+
+            let inverse = invert(available.iter().map(|(row, _)| row.clone()).collect());
+            for (j, index) in damaged {
+                let mut block = vec![0u8; block_size as usize];
+                for (c, (_, available_block)) in inverse[j].iter().zip(&available) {
+                    gf_mul_add(&mut block, available_block, *c);
+                }
+                if crc32fast::hash(&block) != f.data_crcs[index as usize] {
+                    report.unrecoverable += 1;
+                    continue;
+                }
+                if !dry_run {
+                    let file = file.as_mut().unwrap();
+                    let len = block_size.min(f.size - index * block_size);
+                    file.seek(SeekFrom::Start(index * block_size)).unwrap();
+                    file.write_all(&block[..len as usize]).unwrap();
+                }
+                report.repaired += 1;
+            }
+        }
+
+        // truncated tail which was all zeros doesn't need reconstruction, but file still needs to be extended
+        if let Some(file) = file.as_mut().filter(|_| !dry_run) {
+            if current_size < f.size {
+                file.set_len(f.size).unwrap();
+            }
+            file.sync_all().unwrap();
+        }
+        reports.push(report);
+    }
+    reports
+}
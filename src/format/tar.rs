@@ -0,0 +1,236 @@
+use std::{io::Read, time::{Duration, SystemTime, UNIX_EPOCH}};
+
+// minimal streaming reader of tar archive (ustar, GNU long names and pax headers), for `create -i -`
+
+const BLOCK_SIZE: usize = 512;
+
+pub enum TarEntryKind {
+    File,
+    Directory,
+    // target
+    Symlink(String),
+    // typeflag of unsupported entries (hard link, device, fifo, ...)
+    Other(u8),
+}
+
+pub struct TarEntry {
+    // relative path without leading "./" or "/" (and trailing "/" of directories)
+    pub path: String,
+    pub kind: TarEntryKind,
+    pub mode: u32,
+    pub uid: u32,
+    pub gid: u32,
+    pub modified_time: SystemTime,
+}
+
+pub struct TarReader<R: Read> {
+    input: R,
+    finished: bool,
+}
+
+// values which are overwritten by pax extended header or GNU long name/link
+#[derive(Default)]
+struct Overrides {
+    path: Option<String>,
+    linkpath: Option<String>,
+    size: Option<u64>,
+    mtime: Option<SystemTime>,
+    uid: Option<u32>,
+    gid: Option<u32>,
+}
+
+impl<R: Read> TarReader<R> {
+    pub fn new(input: R) -> Self {
+        Self { input, finished: false }
+    }
+
+    // returns false on EOF before first byte of the block (some writers omit end-of-archive blocks)
+    fn read_block(&mut self, block: &mut [u8; BLOCK_SIZE]) -> bool {
+        let mut read = 0;
+        while read < BLOCK_SIZE {
+            let n = self.input.read(&mut block[read..]).unwrap();
+            if n == 0 {
+                assert_eq!(read, 0, "tar is truncated");
+                return false;
+            }
+            read += n;
+        }
+        true
+    }
+
+    fn read_body(&mut self, size: u64) -> Vec<u8> {
+        let mut body = Vec::with_capacity(size as usize);
+        self.input.by_ref().take(size).read_to_end(&mut body).unwrap();
+        assert_eq!(body.len() as u64, size, "tar is truncated");
+        // body is padded to block size
+        let padding = (BLOCK_SIZE as u64 - size % BLOCK_SIZE as u64) % BLOCK_SIZE as u64;
+        let mut buf = [0; BLOCK_SIZE];
+        self.input.read_exact(&mut buf[..padding as usize]).unwrap();
+        body
+    }
+}
+
+impl<R: Read> Iterator for TarReader<R> {
+    // entry and its body (empty for entries other than File)
+    type Item = (TarEntry, Vec<u8>);
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let mut overrides = Overrides::default();
+        loop {
+            if self.finished {
+                return None;
+            }
+            let mut header = [0; BLOCK_SIZE];
+            if !self.read_block(&mut header) || header.iter().all(|&b| b == 0) {
+                self.finished = true;
+                return None;
+            }
+            verify_checksum(&header);
+
+            let typeflag = header[156];
+            let size = parse_number(&header[124..136]);
+            match typeflag {
+                // pax extended header (applies to next entry)
+                b'x' => {
+                    let body = self.read_body(size);
+                    parse_pax(&body, &mut overrides);
+                    continue;
+                },
+                // GNU long name/link (applies to next entry)
+                b'L' => {
+                    overrides.path = Some(parse_string(&self.read_body(size)));
+                    continue;
+                },
+                b'K' => {
+                    overrides.linkpath = Some(parse_string(&self.read_body(size)));
+                    continue;
+                },
+                // pax global header
+                b'g' => {
+                    self.read_body(size);
+                    continue;
+                },
+                _ => {},
+            }
+
+            let path = overrides.path.take().unwrap_or_else(|| {
+                let name = parse_string(&header[0..100]);
+                let prefix = match &header[257..262] == b"ustar" {
+                    true => parse_string(&header[345..500]),
+                    false => String::new(),
+                };
+                match prefix.is_empty() {
+                    true => name,
+                    false => format!("{}/{}", prefix, name),
+                }
+            });
+            let linkpath = overrides.linkpath.take().unwrap_or_else(|| parse_string(&header[157..257]));
+
+            let kind = match typeflag {
+                b'0' | 0 | b'7' => TarEntryKind::File,
+                b'5' => TarEntryKind::Directory,
+                b'2' => TarEntryKind::Symlink(linkpath),
+                t => TarEntryKind::Other(t),
+            };
+            // only regular files have body (hard links may have size field, but no body)
+            let size = overrides.size.unwrap_or(size);
+            let body = match kind {
+                TarEntryKind::File => self.read_body(size),
+                _ if typeflag == b'1' => Vec::new(),
+                _ => {
+                    self.read_body(size);
+                    Vec::new()
+                },
+            };
+
+            let entry = TarEntry {
+                path: normalize_path(&path),
+                kind,
+                mode: parse_number(&header[100..108]) as u32,
+                uid: overrides.uid.unwrap_or_else(|| parse_number(&header[108..116]) as u32),
+                gid: overrides.gid.unwrap_or_else(|| parse_number(&header[116..124]) as u32),
+                modified_time: overrides.mtime.unwrap_or_else(|| UNIX_EPOCH + Duration::from_secs(parse_number(&header[136..148]))),
+            };
+            return Some((entry, body));
+        }
+    }
+}
+
+// NUL terminated (or full length) string
+fn parse_string(field: &[u8]) -> String {
+    let end = field.iter().position(|&b| b == 0).unwrap_or(field.len());
+    String::from_utf8_lossy(&field[..end]).to_string()
+}
+
+// octal number (padded with spaces/NULs), or big-endian binary if highest bit of first byte is set (GNU extension for large values)
+fn parse_number(field: &[u8]) -> u64 {
+    if field[0] & 0x80 != 0 {
+        return field[1..].iter().fold((field[0] & 0x7f) as u64, |n, &b| n << 8 | b as u64);
+    }
+    let s = parse_string(field);
+    let s = s.trim_matches(|c| c == ' ' || c == '\0');
+    match s.is_empty() {
+        true => 0,
+        false => u64::from_str_radix(s, 8).unwrap_or_else(|_| panic!("invalid number in tar header: {:?}", s)),
+    }
+}
+
+fn verify_checksum(header: &[u8; BLOCK_SIZE]) {
+    // checksum field itself is treated as spaces
+    let sum = header.iter().enumerate().map(|(i, &b)| match i {
+        148..=155 => b' ' as u64,
+        _ => b as u64,
+    }).sum::<u64>();
+    assert_eq!(sum, parse_number(&header[148..156]), "tar header checksum mismatch");
+}
+
+// "<length> <key>=<value>\n" records
+fn parse_pax(body: &[u8], overrides: &mut Overrides) {
+    let mut rest = body;
+    while !rest.is_empty() {
+        let space = rest.iter().position(|&b| b == b' ').expect("invalid pax header");
+        let len = std::str::from_utf8(&rest[..space]).unwrap().parse::<usize>().expect("invalid pax header");
+        let record = String::from_utf8_lossy(&rest[space + 1..len - 1]).to_string();
+        rest = &rest[len..];
+        let Some((key, value)) = record.split_once('=') else {
+            continue;
+        };
+        match key {
+            "path" => overrides.path = Some(value.to_string()),
+            "linkpath" => overrides.linkpath = Some(value.to_string()),
+            "size" => overrides.size = value.parse().ok(),
+            "uid" => overrides.uid = value.parse().ok(),
+            "gid" => overrides.gid = value.parse().ok(),
+            "mtime" => overrides.mtime = parse_pax_time(value),
+            _ => {},
+        }
+    }
+}
+
+// "1700000000.123456789" => SystemTime
+fn parse_pax_time(s: &str) -> Option<SystemTime> {
+    let (secs, frac) = s.split_once('.').unwrap_or((s, ""));
+    let nanos = match frac.is_empty() {
+        true => 0,
+        false => format!("{:0<9}", &frac[..frac.len().min(9)]).parse::<u32>().ok()?,
+    };
+    match secs.strip_prefix('-') {
+        Some(secs) => UNIX_EPOCH.checked_sub(Duration::new(secs.parse().ok()?, 0))?.checked_add(Duration::new(0, nanos)),
+        None => UNIX_EPOCH.checked_add(Duration::new(secs.parse().ok()?, nanos)),
+    }
+}
+
+// "./a/b/" => "a/b"
+fn normalize_path(path: &str) -> String {
+    let mut path = path;
+    loop {
+        if let Some(p) = path.strip_prefix("./") {
+            path = p;
+        } else if let Some(p) = path.strip_prefix('/') {
+            path = p;
+        } else {
+            break;
+        }
+    }
+    path.trim_end_matches('/').to_string()
+}
@@ -3,6 +3,7 @@ use clap::{Parser, Subcommand};
 mod proto;
 mod cmd;
 mod format;
+mod util;
 
 #[derive(Parser)]
 struct Cli {
@@ -15,6 +16,17 @@ enum SubCommands {
     Create(cmd::create::Args),
     ShowSum(cmd::showsum::Args),
     Split(cmd::split::Args),
+    Ls(cmd::ls::Args),
+    Extract(cmd::extract::Args),
+    Cat(cmd::cat::Args),
+    Zip2mar(cmd::zip2mar::Args),
+    Mar2zip(cmd::mar2zip::Args),
+    Whiteout(cmd::whiteout::Args),
+    Info(cmd::info::Args),
+    Merge(cmd::merge::Args),
+    Vacuum(cmd::vacuum::Args),
+    Parity(cmd::parity::Args),
+    Repair(cmd::repair::Args),
 }
 
 fn main() {
@@ -23,5 +35,16 @@ fn main() {
         SubCommands::Create(args) => cmd::create::main(args),
         SubCommands::ShowSum(args) => cmd::showsum::main(args),
         SubCommands::Split(args) => cmd::split::main(args),
+        SubCommands::Ls(args) => cmd::ls::main(args),
+        SubCommands::Extract(args) => cmd::extract::main(args),
+        SubCommands::Cat(args) => cmd::cat::main(args),
+        SubCommands::Zip2mar(args) => cmd::zip2mar::main(args),
+        SubCommands::Mar2zip(args) => cmd::mar2zip::main(args),
+        SubCommands::Whiteout(args) => cmd::whiteout::main(args),
+        SubCommands::Info(args) => cmd::info::main(args),
+        SubCommands::Merge(args) => cmd::merge::main(args),
+        SubCommands::Vacuum(args) => cmd::vacuum::main(args),
+        SubCommands::Parity(args) => cmd::parity::main(args),
+        SubCommands::Repair(args) => cmd::repair::main(args),
     }
 }
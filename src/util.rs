@@ -0,0 +1,146 @@
+use std::path::{Path, PathBuf};
+
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
+
+// "/a/b/c", "d" => "/a/b/cd"
+pub fn append_to_path(p: &Path, s: &str) -> PathBuf {
+    let mut p = p.to_path_buf().into_os_string();
+    p.push(s);
+    p.into()
+}
+
+pub fn to_hex(bytes: &[u8]) -> String {
+    let mut hex = String::with_capacity(bytes.len() * 2);
+    for byte in bytes {
+        hex.push_str(&format!("{:02x}", byte));
+    }
+    hex
+}
+
+// same as marmounter's FixPathSplitter + leading slash
+pub fn normalize_archive_path(path: &str) -> String {
+    let path = path.replace('\\', "/");
+    match path.starts_with('/') {
+        true => path,
+        false => format!("/{}", path),
+    }
+}
+
+/// Matches archive paths with glob patterns, in case insensitive (like marmounter's onlyglob)
+pub struct PathFilter {
+    globs: Option<GlobSet>,
+}
+
+impl PathFilter {
+    pub fn new(globs: &[String]) -> Self {
+        if globs.is_empty() {
+            return Self { globs: None };
+        }
+        let mut builder = GlobSetBuilder::new();
+        for glob in globs {
+            builder.add(GlobBuilder::new(glob).case_insensitive(true).literal_separator(true).build().unwrap());
+        }
+        Self { globs: Some(builder.build().unwrap()) }
+    }
+
+    pub fn is_match(&self, path: &str) -> bool {
+        match &self.globs {
+            Some(globs) => globs.is_match(normalize_archive_path(path)),
+            None => true,
+        }
+    }
+}
+
+/// Values for archive paths which match glob patterns (case insensitive), later rule wins
+pub struct GlobRules<T> {
+    globs: GlobSet,
+    values: Vec<T>,
+}
+
+impl<T> GlobRules<T> {
+    pub fn new(rules: &[(String, T)]) -> Self where T: Clone {
+        let mut builder = GlobSetBuilder::new();
+        for (glob, _) in rules {
+            builder.add(GlobBuilder::new(glob).case_insensitive(true).literal_separator(true).build().unwrap());
+        }
+        Self { globs: builder.build().unwrap(), values: rules.iter().map(|(_, v)| v.clone()).collect() }
+    }
+
+    pub fn get(&self, path: &str) -> Option<&T> {
+        self.globs.matches(normalize_archive_path(path)).last().map(|&i| &self.values[i])
+    }
+}
+
+// "**/*.ogg=128K" => ("**/*.ogg", "128K")
+pub fn split_glob_rule(s: &str) -> Result<(String, String), String> {
+    match s.rsplit_once('=') {
+        Some((glob, value)) if !glob.is_empty() => Ok((glob.to_string(), value.to_string())),
+        _ => Err(format!("rule must be <glob>=<value>: {}", s)),
+    }
+}
+
+// "4G", "512MiB", "1000" => bytes (binary units, same as marmounter)
+pub fn parse_size(s: &str) -> Result<u64, String> {
+    let upper = s.trim().to_ascii_uppercase();
+    let number = upper.trim_end_matches("IB").trim_end_matches('B');
+    let (number, unit) = match number.chars().last() {
+        Some('K') => (&number[..number.len() - 1], 1u64 << 10),
+        Some('M') => (&number[..number.len() - 1], 1u64 << 20),
+        Some('G') => (&number[..number.len() - 1], 1u64 << 30),
+        Some('T') => (&number[..number.len() - 1], 1u64 << 40),
+        _ => (number, 1),
+    };
+    let n = number.trim().parse::<u64>().map_err(|e| format!("invalid size {}: {}", s, e))?;
+    n.checked_mul(unit).ok_or_else(|| format!("size is too large: {}", s))
+}
+
+// bytes => "1.5GiB" (binary units, same as parse_size)
+pub fn format_size(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KiB", "MiB", "GiB", "TiB"];
+    if bytes < 1024 {
+        return format!("{}B", bytes);
+    }
+    let mut size = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    format!("{:.1}{}", size, UNITS[unit])
+}
+
+// 3723s => "1h02m03s"
+pub fn format_duration(d: std::time::Duration) -> String {
+    let secs = d.as_secs();
+    match (secs / 3600, secs / 60 % 60, secs % 60) {
+        (0, 0, s) => format!("{}s", s),
+        (0, m, s) => format!("{}m{:02}s", m, s),
+        (h, m, s) => format!("{}h{:02}m{:02}s", h, m, s),
+    }
+}
+
+// days since 1970-01-01 in proleptic Gregorian calendar
+// see http://howardhinnant.github.io/date_algorithms.html#days_from_civil
+pub fn days_from_civil(y: i64, m: u32, d: u32) -> i64 {
+    let y = if m <= 2 { y - 1 } else { y };
+    let era = if y >= 0 { y } else { y - 399 } / 400;
+    let yoe = y - era * 400;
+    let m = m as i64;
+    let doy = (153 * (if m > 2 { m - 3 } else { m + 9 }) + 2) / 5 + d as i64 - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    era * 146097 + doe - 719468
+}
+
+// inverse of days_from_civil, returns (year, month, day)
+pub fn civil_from_days(z: i64) -> (i64, u32, u32) {
+    let z = z + 719468;
+    let era = if z >= 0 { z } else { z - 146096 } / 146097;
+    let doe = z - era * 146097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let y = yoe + era * 400;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let d = (doy - (153 * mp + 2) / 5 + 1) as u32;
+    let m = if mp < 10 { mp + 3 } else { mp - 9 } as u32;
+    (if m <= 2 { y + 1 } else { y }, m, d)
+}
@@ -115,6 +115,100 @@ def run_test(mountdir: str, overlaydir: str | None):
 
     print("Test Done!")
 
+def wait_for_mount(mounter: subprocess.Popen, path: str):
+    start_time = time.time()
+    while time.time() - start_time < 60:
+        time.sleep(1)
+        if mounter.poll() is not None:
+            raise Exception("mounter unexpectedly terminated with code " + str(mounter.returncode))
+        if os.path.exists(path):
+            return
+    raise Exception("mounter didn't get ready in time: " + path)
+
+def pattern_bytes(size: int, seed: int) -> bytes:
+    # compressible but not uniform, so chunks are actually compressed
+    return bytes((i * 7 + (i >> 10) * seed) & 0xff for i in range(size))
+
+def run_format_test(tmpdir: str, name: str, create_args: list[str], files: dict[str, bytes]):
+    """Packs files with create_args, and reads them back through the mount with reads which cross chunk (and frame) boundaries."""
+    print("Format Test -", name)
+    srcdir = os.path.join(tmpdir, name + '.src')
+    os.mkdir(srcdir)
+    for filename, content in files.items():
+        with open(os.path.join(srcdir, filename), 'wb') as f:
+            f.write(content)
+    mountdir = os.path.join(tmpdir, name + '.mount')
+    if os.name != 'nt':
+        os.mkdir(mountdir)
+    subprocess.run([
+        "./mayakashi.exe",
+        "create",
+        "-i", srcdir,
+        "-o", os.path.join(tmpdir, name),
+        "-q",
+        *create_args,
+    ]).check_returncode()
+    mounter = subprocess.Popen([
+        "./marmounter.exe",
+        os.path.join(tmpdir, name + ".mar"),
+        "--",
+        mountdir,
+    ])
+    try:
+        wait_for_mount(mounter, os.path.join(mountdir, next(iter(files))))
+        for filename, content in files.items():
+            with open(os.path.join(mountdir, filename), 'rb') as f:
+                assert f.read() == content, filename
+                # odd sizes and offsets so reads start and end in the middle of chunks
+                for offset, size in [(1, 4097), (len(content) // 3, 65537), (len(content) - 5, 100)]:
+                    f.seek(offset)
+                    assert f.read(size) == content[offset:offset + size], (filename, offset, size)
+    finally:
+        mounter.terminate()
+        mounter.wait()
+
+def run_checksum_test(tmpdir: str):
+    """Corrupts SHA2 trailer of .mar.idx, and checks that mounter refuses it instead of mounting broken index."""
+    print("Format Test - checksum")
+    name = "chunks"
+    with open(os.path.join(tmpdir, name + ".mar.idx"), 'r+b') as f:
+        f.seek(-1, os.SEEK_END)
+        last = f.read(1)
+        f.seek(-1, os.SEEK_END)
+        f.write(bytes([last[0] ^ 1]))
+    mountdir = os.path.join(tmpdir, name + '.corrupted.mount')
+    if os.name != 'nt':
+        os.mkdir(mountdir)
+    result = subprocess.run([
+        "./marmounter.exe",
+        os.path.join(tmpdir, name + ".mar"),
+        "--",
+        mountdir,
+    ], capture_output=True, timeout=60)
+    assert result.returncode != 0, "mounter accepted corrupted index"
+    assert b"checksum mismatch" in result.stdout + result.stderr
+
+def run_format_tests(tmpdir: str):
+    print(" --- Format tests ---")
+    # index v2 has offset tables of chunks, which are used to find chunks of files
+    run_format_test(tmpdir, "chunks", ["--chunk-size", "16K"], {
+        "multi.bin": pattern_bytes(200 * 1024 + 123, 3),
+        "small.txt": b"Hello",
+    })
+    # all-zero chunks are stored as ZERO chunks without payload, both in the middle of large file and as whole small file
+    run_format_test(tmpdir, "zero", ["--chunk-size", "16K"], {
+        "sparse.bin": pattern_bytes(100 * 1024 + 1, 5) + bytes(200 * 1024) + pattern_bytes(100 * 1024 + 7, 6),
+        "zero.bin": bytes(10 * 1024),
+        "after.bin": pattern_bytes(50 * 1024, 7),
+    })
+    # zstd chunks are written in seekable format, and reads decompress only frames which contain requested range
+    run_format_test(tmpdir, "seekable", ["--chunk-size", "64K", "--seekable-frame-size", "4096", "--compression-rule", "**=zstd"], {
+        "seekable.bin": pattern_bytes(1024 * 1024 + 4097, 9),
+        "short.bin": pattern_bytes(3000, 10),
+    })
+    # every index has SHA2 trailer, run after tests which read "chunks" archive since it corrupts it
+    run_checksum_test(tmpdir)
+
 def main():
     with tempfile.TemporaryDirectory() as tmpdir:
         srcdir = os.path.join(tmpdir, 'src')
@@ -147,13 +241,7 @@ def main():
         ])
         try:
             # first, we need to wait until mounter is ready
-            start_time = time.time()
-            while time.time() - start_time < 60:
-                time.sleep(1)
-                if mounter.poll() is not None:
-                    raise Exception("mounter unexpectedly terminated with code " + str(mounter.returncode))
-                if os.path.exists(os.path.join(mountdir, 'test.txt')):
-                    break
+            wait_for_mount(mounter, os.path.join(mountdir, 'test.txt'))
             run_test(mountdir, overlaydir)
             print(" --- Run with actual file system ---")
             run_test(srcdir, None)
@@ -165,6 +253,7 @@ def main():
             print("Terminate mounter")
             mounter.terminate()
             mounter.wait()
+        run_format_tests(tmpdir)
 
 if __name__ == "__main__":
     main()